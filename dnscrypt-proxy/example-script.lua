@@ -0,0 +1,46 @@
+------------------------------------------
+--        dnscrypt-proxy scripting       --
+------------------------------------------
+
+-- This script is loaded when the `script_file` property is set in the main
+-- configuration file.
+--
+-- The `query` function is called for every query, and the `response` function
+-- for every response received from an upstream server. Both are optional.
+--
+-- They receive a table with the following fields:
+--   name       the query name, lowercased and without a trailing dot
+--   qtype      the query type, such as "A" or "AAAA"
+--   client_ip  the IP address of the client
+--   proto      "udp" or "tcp"
+--
+-- The `response` function also receives:
+--   rcode      the response code, such as "NOERROR" or "NXDOMAIN"
+--   answers    a list of answer records, in text format
+--
+-- Possible return values are:
+--   nil or "pass"  process the query as usual
+--   "block"        block the query, using the configured blocked query response
+--   "drop"         do not respond at all
+--   a list of IP addresses (query function only) to use as the response
+--
+-- Scripts cannot access files, and must return within 100 ms.
+
+function query(q)
+  if q.name == "router.lan" then
+    return { "192.168.1.1" }
+  end
+  if q.qtype == "ANY" then
+    return "block"
+  end
+  return nil
+end
+
+function response(r)
+  for _, answer in ipairs(r.answers) do
+    if string.find(answer, "0.0.0.0", 1, true) then
+      return "block"
+    end
+  end
+  return nil
+end
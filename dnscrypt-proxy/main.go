@@ -3,60 +3,71 @@ package main
 import (
 	"flag"
 	"fmt"
+	"math/rand"
 	"os"
+	"os/signal"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/facebookgo/pidfile"
 	"github.com/jedisct1/dlog"
+	"github.com/jedisct1/dnscrypt-proxy/proxy"
 	"github.com/kardianos/service"
 )
 
-const (
-	AppVersion            = "2.0.11"
-	DefaultConfigFileName = "dnscrypt-proxy.toml"
-)
-
 type App struct {
 	wg    sync.WaitGroup
 	quit  chan struct{}
-	proxy Proxy
+	proxy proxy.Proxy
 }
 
 func main() {
 	dlog.Init("dnscrypt-proxy", dlog.SeverityNotice, "DAEMON")
+	rand.Seed(time.Now().UnixNano())
 
 	pwd, err := os.Getwd()
 	if err != nil {
 		dlog.Fatal("Unable to find the path to the current directory")
 	}
+	svcFlag := flag.String("service", "", fmt.Sprintf("Control the system service: %q", service.ControlAction))
+	app := &App{}
+	app.proxy = proxy.NewProxy()
+
+	if err := proxy.ConfigLoad(&app.proxy, svcFlag); err != nil {
+		dlog.Fatal(err)
+	}
 	svcConfig := &service.Config{
 		Name:             "dnscrypt-proxy",
 		DisplayName:      "DNSCrypt client proxy",
 		Description:      "Encrypted/authenticated DNS proxy",
 		WorkingDirectory: pwd,
+		Option: service.KeyValue{
+			"RunAtLoad":    true,
+			"ReloadSignal": "HUP",
+		},
 	}
-	svcFlag := flag.String("service", "", fmt.Sprintf("Control the system service: %q", service.ControlAction))
-	app := &App{}
+	svcConfig.Arguments = app.proxy.ServiceArguments()
+	prepareServiceConfig(svcConfig)
 	svc, err := service.New(app, svcConfig)
 	if err != nil {
 		svc = nil
 		dlog.Debug(err)
 	}
-	app.proxy = NewProxy()
-
-	if err := ConfigLoad(&app.proxy, svcFlag); err != nil {
-		dlog.Fatal(err)
-	}
-	dlog.Noticef("dnscrypt-proxy %s", AppVersion)
+	dlog.Noticef("dnscrypt-proxy %s", proxy.AppVersion)
 
 	if len(*svcFlag) != 0 {
 		if svc == nil {
 			dlog.Fatal("Built-in service installation is not supported on this platform")
 		}
+		if !isServiceControlAction(*svcFlag) {
+			dlog.Fatalf("Unsupported service action [%s] -- Valid actions are: %q", *svcFlag, service.ControlAction)
+		}
 		if err := service.Control(svc, *svcFlag); err != nil {
 			dlog.Fatal(err)
 		}
 		if *svcFlag == "install" {
+			configureInstalledService(svcConfig.Name)
 			dlog.Notice("Installed as a service. Use `-service start` to start")
 		} else if *svcFlag == "uninstall" {
 			dlog.Notice("Service uninstalled")
@@ -74,33 +85,59 @@ func main() {
 			dlog.Fatal(err)
 		}
 	} else {
-		app.Start(nil)
+		stopOnSignal(app)
+		if err := app.Start(nil); err != nil {
+			dlog.Fatal(err)
+		}
 	}
 }
 
-func (app *App) Start(service service.Service) error {
-	proxy := &app.proxy
-	if err := InitPluginsGlobals(&proxy.pluginsGlobals, proxy); err != nil {
-		dlog.Fatal(err)
+// stopOnSignal stops the proxy gracefully when it is not managed by a service manager
+func stopOnSignal(app *App) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		app.Stop(nil)
+		os.Exit(0)
+	}()
+}
+
+func isServiceControlAction(action string) bool {
+	for _, controlAction := range service.ControlAction {
+		if action == controlAction {
+			return true
+		}
 	}
-	if proxy.daemonize {
-		Daemonize()
+	return false
+}
+
+// Start returns an error instead of exiting if the proxy cannot be prepared, so that the
+// service manager is told that the service failed to start, and can restart it.
+func (app *App) Start(service service.Service) error {
+	if err := app.proxy.Prepare(); err != nil {
+		return err
 	}
 	app.quit = make(chan struct{})
 	app.wg.Add(1)
 	if service != nil {
 		go func() {
-			app.AppMain(proxy)
+			app.AppMain()
 		}()
 	} else {
-		app.AppMain(proxy)
+		app.AppMain()
 	}
 	return nil
 }
 
-func (app *App) AppMain(proxy *Proxy) {
-	proxy.StartProxy()
-	pidfile.Write()
+func (app *App) AppMain() {
+	defer app.proxy.ReportPanic()
+	// The process keeps the same identifier after privileges have been dropped
+	if !app.proxy.IsChild() {
+		pidfile.Write()
+	}
+	app.proxy.StartProxy()
+	app.proxy.ReloadOnSignal()
 	<-app.quit
 	dlog.Notice("Quit signal received...")
 	app.wg.Done()
@@ -108,6 +145,7 @@ func (app *App) AppMain(proxy *Proxy) {
 }
 
 func (app *App) Stop(service service.Service) error {
+	app.proxy.Stop()
 	if pidFilePath := pidfile.GetPidfilePath(); len(pidFilePath) > 1 {
 		os.Remove(pidFilePath)
 	}
@@ -0,0 +1,9 @@
+// +build !windows
+
+package main
+
+import "github.com/kardianos/service"
+
+func prepareServiceConfig(svcConfig *service.Config) {}
+
+func configureInstalledService(name string) {}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"unsafe"
+
+	"github.com/jedisct1/dlog"
+	"github.com/kardianos/service"
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const (
+	serviceConfigDelayedAutoStartInfo = 3
+	serviceConfigFailureActionsFlag   = 4
+	scActionRestart                   = 1
+	// Failures are forgotten after a day without any
+	serviceFailureResetPeriod = 86400
+)
+
+// Delays before the service is restarted after consecutive failures, in milliseconds.
+// The last delay is used for all the subsequent failures.
+var serviceRestartDelays = []uint32{5000, 30000, 120000}
+
+type serviceDelayedAutoStartInfo struct {
+	delayedAutoStart uint32
+}
+
+type scAction struct {
+	actionType uint32
+	delay      uint32
+}
+
+type serviceFailureActions struct {
+	resetPeriod  uint32
+	rebootMsg    *uint16
+	command      *uint16
+	actionsCount uint32
+	actions      *scAction
+}
+
+type serviceFailureActionsFlag struct {
+	failureActionsOnNonCrashFailures int32
+}
+
+// prepareServiceConfig makes the service start after the network stack
+func prepareServiceConfig(svcConfig *service.Config) {
+	svcConfig.Dependencies = []string{"Tcpip", "Nsi"}
+}
+
+// configureInstalledService sets what the service manager cannot set when creating a service:
+// a delayed automatic start, so that network interfaces are likely to be configured when the
+// proxy starts, and restarts with an increasing delay if it crashes or stops with an error.
+func configureInstalledService(name string) {
+	m, err := mgr.Connect()
+	if err != nil {
+		dlog.Warnf("Unable to connect to the service manager: %v", err)
+		return
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(name)
+	if err != nil {
+		dlog.Warnf("Unable to open the service: %v", err)
+		return
+	}
+	defer s.Close()
+
+	delayedAutoStart := serviceDelayedAutoStartInfo{delayedAutoStart: 1}
+	if err := windows.ChangeServiceConfig2(s.Handle, serviceConfigDelayedAutoStartInfo, (*byte)(unsafe.Pointer(&delayedAutoStart))); err != nil {
+		dlog.Warnf("Unable to enable the delayed start of the service: %v", err)
+	}
+
+	actions := make([]scAction, len(serviceRestartDelays))
+	for i, delay := range serviceRestartDelays {
+		actions[i] = scAction{actionType: scActionRestart, delay: delay}
+	}
+	failureActions := serviceFailureActions{
+		resetPeriod:  serviceFailureResetPeriod,
+		actionsCount: uint32(len(actions)),
+		actions:      &actions[0],
+	}
+	if err := windows.ChangeServiceConfig2(s.Handle, windows.SERVICE_CONFIG_FAILURE_ACTIONS, (*byte)(unsafe.Pointer(&failureActions))); err != nil {
+		dlog.Warnf("Unable to set the recovery actions of the service: %v", err)
+		return
+	}
+	// Also restart the service if it reports an error to the service manager instead of crashing
+	failureActionsFlag := serviceFailureActionsFlag{failureActionsOnNonCrashFailures: 1}
+	if err := windows.ChangeServiceConfig2(s.Handle, serviceConfigFailureActionsFlag, (*byte)(unsafe.Pointer(&failureActionsFlag))); err != nil {
+		dlog.Warnf("Unable to enable the recovery actions on errors: %v", err)
+	}
+}
@@ -0,0 +1,145 @@
+// Package mobile exposes dnscrypt-proxy to Android and iOS applications, such as VPN-based
+// DNS filters, using types that gomobile can bind:
+//
+//	gomobile bind -target=android github.com/jedisct1/dnscrypt-proxy/mobile
+//	gomobile bind -target=ios github.com/jedisct1/dnscrypt-proxy/mobile
+//
+// Applications usually disable the listeners (listen_addresses = []), and call Resolve()
+// with the DNS packets read from their tunnel interface. Relative file names in the
+// configuration are relative to the current directory of the process, so absolute names
+// should be used.
+package mobile
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"github.com/jedisct1/dnscrypt-proxy/proxy"
+)
+
+var dlogInit sync.Once
+
+// QueryEvent describes a query once it has been processed
+type QueryEvent struct {
+	Time     int64 // Unix time, in milliseconds
+	Client   string
+	Name     string
+	Type     string
+	Action   string // forwarded, cached, blocked, synthesized or dropped
+	Server   string
+	Rcode    string
+	Duration int64 // In milliseconds
+}
+
+// QueryListener is implemented by applications to be notified of the processed queries
+type QueryListener interface {
+	OnQuery(event *QueryEvent)
+}
+
+// Proxy is a dnscrypt-proxy instance running in the application process
+type Proxy struct {
+	sync.Mutex
+	proxy       *proxy.Proxy
+	started     bool
+	stopWatcher func()
+}
+
+// NewProxy creates a proxy from a configuration file. Nothing is listened to until Start()
+// is called.
+func NewProxy(configFile string) (*Proxy, error) {
+	dlogInit.Do(func() {
+		dlog.Init("dnscrypt-proxy", dlog.SeverityNotice, "DAEMON")
+	})
+	embedded, err := proxy.NewFromFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	return &Proxy{proxy: embedded}, nil
+}
+
+// Start starts the proxy, and returns once it is ready to answer queries
+func (mobileProxy *Proxy) Start() error {
+	mobileProxy.Lock()
+	defer mobileProxy.Unlock()
+	if mobileProxy.started {
+		return errors.New("The proxy has already been started")
+	}
+	// The proxy is stopped by Stop(), not by the context
+	if err := mobileProxy.proxy.Start(context.Background()); err != nil {
+		return err
+	}
+	mobileProxy.started = true
+	return nil
+}
+
+// Stop stops the proxy; a new proxy has to be created in order to start it again
+func (mobileProxy *Proxy) Stop() {
+	mobileProxy.Lock()
+	defer mobileProxy.Unlock()
+	if mobileProxy.stopWatcher != nil {
+		mobileProxy.stopWatcher()
+		mobileProxy.stopWatcher = nil
+	}
+	mobileProxy.proxy.Stop()
+}
+
+// Reload reads the configuration file again, and applies the settings that don't require a
+// restart
+func (mobileProxy *Proxy) Reload() error {
+	return mobileProxy.proxy.Reload()
+}
+
+// Resolve answers a DNS query; timeout is in milliseconds, 0 meaning no timeout besides the
+// timeout of the upstream servers
+func (mobileProxy *Proxy) Resolve(query []byte, timeout int64) ([]byte, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Millisecond)
+		defer cancel()
+	}
+	return mobileProxy.proxy.Exchange(ctx, query)
+}
+
+// SetQueryListener registers a listener called for every processed query, replacing the
+// previous one; nil removes it. The listener is called from a single goroutine, and events
+// are skipped if it doesn't keep up.
+func (mobileProxy *Proxy) SetQueryListener(listener QueryListener) {
+	mobileProxy.Lock()
+	defer mobileProxy.Unlock()
+	if mobileProxy.stopWatcher != nil {
+		mobileProxy.stopWatcher()
+		mobileProxy.stopWatcher = nil
+	}
+	if listener == nil {
+		return
+	}
+	events, stopWatcher := mobileProxy.proxy.WatchQueries("")
+	done := make(chan struct{})
+	mobileProxy.stopWatcher = func() {
+		stopWatcher()
+		close(done)
+	}
+	go func() {
+		for {
+			select {
+			case event := <-events:
+				listener.OnQuery(&QueryEvent{
+					Time:     event.Time.UnixNano() / int64(time.Millisecond),
+					Client:   event.Client,
+					Name:     event.Name,
+					Type:     event.Type,
+					Action:   event.Action,
+					Server:   event.Server,
+					Rcode:    event.Rcode,
+					Duration: event.Duration,
+				})
+			case <-done:
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,163 @@
+// Package proxy implements dnscrypt-proxy. Besides the dnscrypt-proxy command, it can be used
+// by other programs, such as graphical frontends and management daemons, to run a proxy in
+// the same process:
+//
+//	dlog.Init("myapp", dlog.SeverityNotice, "DAEMON")
+//	config, err := proxy.LoadConfig("dnscrypt-proxy.toml")
+//	...
+//	p, err := proxy.New(config)
+//	...
+//	err = p.Start(ctx)
+//	...
+//	response, err := p.Resolve(ctx, "example.com", dns.TypeA)
+//	...
+//	p.Stop()
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Time to wait for queries to be answered on shutdown, on top of the query timeout
+const ShutdownGracePeriod = 500 * time.Millisecond
+
+// DefaultConfig returns a configuration with the default settings, that can be changed before
+// being given to New()
+func DefaultConfig() *Config {
+	config := newConfig()
+	return &config
+}
+
+// LoadConfig reads a configuration file, and the files it includes
+func LoadConfig(file string) (*Config, error) {
+	config := newConfig()
+	if err := decodeConfigFile(file, &config, 0); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// New creates a proxy for a program embedding dnscrypt-proxy. The sources of the configuration
+// are downloaded if their cached copies are missing or too old, but nothing is listened to
+// until the proxy is started. Relative file names are relative to the current directory.
+// Settings affecting the whole process (user_name, daemonize and sandbox) are not supported,
+// and only one proxy should run at a time, as the cache is shared. Logs are sent to dlog,
+// that has to be initialized by the caller beforehand.
+func New(config *Config) (*Proxy, error) {
+	return newEmbedded(config, "")
+}
+
+// NewFromFile creates a proxy from a configuration file, like New(). The file is remembered,
+// so that the configuration can be applied again with Reload().
+func NewFromFile(file string) (*Proxy, error) {
+	config, err := LoadConfig(file)
+	if err != nil {
+		return nil, err
+	}
+	return newEmbedded(config, file)
+}
+
+func newEmbedded(config *Config, configFile string) (*Proxy, error) {
+	if len(config.UserName) > 0 || config.Daemonize || config.Sandbox {
+		return nil, errors.New("user_name, daemonize and sandbox are not supported by embedded proxies")
+	}
+	proxy := NewProxy()
+	if err := config.load(&proxy, configFile); err != nil {
+		return nil, err
+	}
+	return &proxy, nil
+}
+
+// Start loads the rule files, starts the listeners and looks for usable servers. It returns
+// once the proxy is ready, or can't be started. The proxy is stopped when the context is done.
+func (proxy *Proxy) Start(ctx context.Context) error {
+	if err := InitPluginsGlobals(&proxy.pluginsGlobals, proxy); err != nil {
+		return err
+	}
+	if err := proxy.start(); err != nil {
+		proxy.Shutdown(0)
+		return err
+	}
+	proxy.stopped = make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			proxy.Stop()
+		case <-proxy.stopped:
+		}
+	}()
+	return nil
+}
+
+// Stop closes the listeners, waits for the queries being processed to be answered, and
+// unloads the plugins. Calling it more than once has no effect.
+func (proxy *Proxy) Stop() {
+	if !atomic.CompareAndSwapInt32(&proxy.stopping, 0, 1) {
+		return
+	}
+	proxy.Shutdown(proxy.timeout + ShutdownGracePeriod)
+	if proxy.stopped != nil {
+		close(proxy.stopped)
+	}
+}
+
+// Resolve sends a query through the plugins, the cache and the upstream servers, as if it
+// had been received by a listener from a local client, over TCP. A response is returned even
+// if it is an error such as NXDOMAIN or SERVFAIL.
+func (proxy *Proxy) Resolve(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	msg := dns.Msg{}
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+	query, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	response, err := proxy.Exchange(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	responseMsg := dns.Msg{}
+	if err := responseMsg.Unpack(response); err != nil {
+		return nil, err
+	}
+	return &responseMsg, nil
+}
+
+// Exchange is the same as Resolve(), for a query that has already been packed, such as a
+// packet captured by a VPN interface. The response is returned packed as well.
+func (proxy *Proxy) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	if !proxy.clientsCountInc() {
+		return nil, errors.New("Too many clients")
+	}
+	clientAddr := net.Addr(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	responses := make(chan []byte, 1)
+	go func() {
+		defer proxy.clientsCountDec()
+		responses <- proxy.resolveQuery(proxy.serversInfo.getOne(), "tcp", proxy.mainProto, query, &clientAddr, nil)
+	}()
+	var response []byte
+	select {
+	case response = <-responses:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if response == nil {
+		return nil, errors.New("The query was dropped")
+	}
+	return response, nil
+}
+
+// WatchQueries returns a channel receiving the queries once they have been processed, for
+// names under filter, or for all names if filter is empty. Events are skipped if the channel
+// is not drained fast enough. The returned function stops the delivery of events.
+func (proxy *Proxy) WatchQueries(filter string) (<-chan TailEvent, func()) {
+	events := proxy.queryTail.subscribe(filter)
+	return events, func() {
+		proxy.queryTail.unsubscribe(events)
+	}
+}
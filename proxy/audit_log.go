@@ -0,0 +1,298 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+	lumberjack "gopkg.in/natefinch/lumberjack.v2"
+)
+
+const (
+	AuditLogMaxLineLength = 64 * 1024
+	// Size at which lumberjack rotates files if max_size is not set, in MB
+	auditLogDefaultMaxSize = 100
+)
+
+var auditLogHashField = []byte(`,"hash":"`)
+
+// AuditRecord is a policy decision applied to a query: blocked, allowed by a whitelist,
+// cloaked, rewritten or forwarded to a specific server
+type AuditRecord struct {
+	Time   time.Time `json:"time"`
+	Client string    `json:"client"`
+	Name   string    `json:"name"`
+	Type   string    `json:"type"`
+	Action string    `json:"action"`
+	Plugin string    `json:"plugin"`
+	Rule   string    `json:"rule,omitempty"`
+	Target string    `json:"target,omitempty"`
+	Prev   string    `json:"prev"`
+}
+
+type auditEntry struct {
+	action string
+	plugin string
+	rule   string
+	target string
+}
+
+// AuditLog writes policy decisions as JSON lines, each of them including the hash of the
+// previous one. Removing, inserting or modifying a record breaks the chain, which can be
+// checked with VerifyAuditLog. With a key, hashes are HMACs, so that someone who can write to
+// the log but can't read the key can't rewrite the chain either. Records removed from the end
+// don't break the chain: the hash of the last record is logged on startup and before every
+// rotation, so that it can be compared with the log later.
+type AuditLog struct {
+	sync.Mutex
+	logger   *lumberjack.Logger
+	key      []byte
+	lastHash string
+	size     int64
+	maxSize  int64
+}
+
+func NewAuditLog(config *AuditLogConfig) (*AuditLog, error) {
+	auditLog := AuditLog{
+		logger:  &lumberjack.Logger{LocalTime: true, MaxSize: config.MaxSize, MaxAge: config.MaxAge, MaxBackups: config.MaxBackups, Filename: config.File},
+		maxSize: int64(config.MaxSize) * 1024 * 1024,
+	}
+	if auditLog.maxSize <= 0 {
+		auditLog.maxSize = auditLogDefaultMaxSize * 1024 * 1024
+	}
+	if len(config.KeyFile) > 0 {
+		key, err := loadAuditLogKey(config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		auditLog.key = key
+	}
+	// Appending to a chain that doesn't verify any more would hide what happened to it
+	fp, err := os.Open(config.File)
+	if os.IsNotExist(err) {
+		dlog.Noticef("Starting a new audit log chain in [%s]", config.File)
+		return &auditLog, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	_, lastHash, _, err := verifyAuditChain(fp, auditLog.key, nil)
+	if err != nil {
+		return nil, fmt.Errorf("The audit log [%s] doesn't verify: %v -- Move it away to start a new chain", config.File, err)
+	}
+	if info, err := fp.Stat(); err == nil {
+		auditLog.size = info.Size()
+	}
+	auditLog.lastHash = lastHash
+	auditLog.anchor("startup")
+	return &auditLog, nil
+}
+
+// loadAuditLogKey reads the HMAC key of the audit log, and creates it if it doesn't exist
+func loadAuditLogKey(file string) ([]byte, error) {
+	bin, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		fp, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return nil, err
+		}
+		_, err = fp.Write([]byte(hex.EncodeToString(key) + "\n"))
+		if closeErr := fp.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, err
+		}
+		dlog.Noticef("Audit log key created in [%s]", file)
+		return key, nil
+	} else if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(bin)))
+	if err != nil || len(key) < 16 {
+		return nil, fmt.Errorf("[%s] doesn't contain a valid audit log key", file)
+	}
+	return key, nil
+}
+
+// anchor logs the hash of the last record, so that records removed from the end of the log can
+// be detected by comparing it with the logs of the proxy
+func (auditLog *AuditLog) anchor(event string) {
+	if len(auditLog.lastHash) == 0 {
+		return
+	}
+	dlog.Noticef("Audit log [%s] last record on %s: %s", auditLog.logger.Filename, event, auditLog.lastHash)
+}
+
+// audit records a policy decision, that will be written to the audit log once the query
+// has been answered
+func (pluginsState *PluginsState) audit(action string, plugin string, rule string, target string) {
+	if !pluginsState.auditEnabled {
+		return
+	}
+	pluginsState.auditEntries = append(pluginsState.auditEntries, auditEntry{action: action, plugin: plugin, rule: rule, target: target})
+}
+
+func (auditLog *AuditLog) write(pluginsState *PluginsState) {
+	if len(pluginsState.auditEntries) == 0 {
+		return
+	}
+	now := time.Now()
+	client := pluginsState.ClientIP().String()
+	qType, ok := dns.TypeToString[pluginsState.qType]
+	if !ok {
+		qType = fmt.Sprintf("TYPE%d", pluginsState.qType)
+	}
+	auditLog.Lock()
+	defer auditLog.Unlock()
+	for _, entry := range pluginsState.auditEntries {
+		record := AuditRecord{
+			Time:   now,
+			Client: client,
+			Name:   pluginsState.qName,
+			Type:   qType,
+			Action: entry.action,
+			Plugin: entry.plugin,
+			Rule:   entry.rule,
+			Target: entry.target,
+			Prev:   auditLog.lastHash,
+		}
+		body, err := json.Marshal(record)
+		if err != nil {
+			dlog.Warnf("Unable to encode an audit record: %v", err)
+			return
+		}
+		hash := auditHash(auditLog.key, body)
+		line := make([]byte, 0, len(body)+len(auditLogHashField)+len(hash)+3)
+		line = append(line, body[:len(body)-1]...)
+		line = append(append(line, auditLogHashField...), hash...)
+		line = append(line, '"', '}', '\n')
+		// lumberjack rotates the file before writing a line that would exceed the maximum size
+		if auditLog.size+int64(len(line)) > auditLog.maxSize {
+			auditLog.anchor("rotation")
+			auditLog.size = 0
+		}
+		if _, err := auditLog.logger.Write(line); err != nil {
+			dlog.Warnf("Unable to write to the audit log: %v", err)
+			return
+		}
+		auditLog.size += int64(len(line))
+		auditLog.lastHash = hash
+	}
+}
+
+// auditHash returns the hash of a record, or its HMAC if there is a key
+func auditHash(key []byte, body []byte) string {
+	if len(key) == 0 {
+		sum := sha256.Sum256(body)
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// parseAuditLine returns a record and its hash, after having checked that the hash matches
+func parseAuditLine(line []byte, key []byte) (AuditRecord, string, error) {
+	var record AuditRecord
+	offset := bytes.LastIndex(line, auditLogHashField)
+	if offset < 0 || !bytes.HasSuffix(line, []byte(`"}`)) {
+		return record, "", errors.New("Missing hash")
+	}
+	hash := string(line[offset+len(auditLogHashField) : len(line)-2])
+	body := append(line[:offset:offset], '}')
+	if !hmac.Equal([]byte(auditHash(key, body)), []byte(hash)) {
+		return record, "", errors.New("The record doesn't match its hash")
+	}
+	if err := json.Unmarshal(body, &record); err != nil {
+		return record, "", err
+	}
+	return record, hash, nil
+}
+
+// verifyAuditChain checks the records of an audit log, and returns the hash the first record
+// refers to, the hash of the last record, and the number of records. visit is called with the
+// hash of every record, if it is not nil.
+func verifyAuditChain(reader io.Reader, key []byte, visit func(hash string)) (first string, last string, count int, err error) {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 4096), AuditLogMaxLineLength)
+	for scanner.Scan() {
+		record, hash, err := parseAuditLine(scanner.Bytes(), key)
+		if err != nil {
+			return "", "", count, fmt.Errorf("Invalid record at line %d: %v", 1+count, err)
+		}
+		if count == 0 {
+			first = record.Prev
+		} else if record.Prev != last {
+			return "", "", count, fmt.Errorf("The chain is broken at line %d -- Records may have been removed, inserted or reordered", 1+count)
+		}
+		if visit != nil {
+			visit(hash)
+		}
+		last = hash
+		count++
+	}
+	return first, last, count, scanner.Err()
+}
+
+// VerifyAuditLog checks the hash chain of an audit log file, using the HMAC key in keyFile if
+// it is not empty. Rotated files can be checked separately; the first record of a file is then
+// expected to refer to the last record of the previous one. If head is not empty, it has to be
+// the hash of a record of the file, as logged by the proxy, so that records removed from the
+// end of the file are detected.
+func VerifyAuditLog(file string, keyFile string, head string) error {
+	var key []byte
+	if len(keyFile) > 0 {
+		bin, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return err
+		}
+		if key, err = hex.DecodeString(strings.TrimSpace(string(bin))); err != nil {
+			return fmt.Errorf("[%s] doesn't contain a valid audit log key", keyFile)
+		}
+	}
+	fp, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	headFound := false
+	first, last, count, err := verifyAuditChain(fp, key, func(hash string) {
+		if hash == head {
+			headFound = true
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if len(head) > 0 && !headFound {
+		return fmt.Errorf("No record with the hash [%s] -- Records may have been removed from the end of the log", head)
+	}
+	if count == 0 {
+		fmt.Println("OK - no records")
+		return nil
+	}
+	if len(first) == 0 {
+		first = "-"
+	}
+	fmt.Printf("OK - %d records - previous record: %s - last record: %s\n", count, first, last)
+	return nil
+}
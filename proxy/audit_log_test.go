@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func writeAuditRecords(t *testing.T, auditLog *AuditLog, names ...string) {
+	clientAddr := net.Addr(&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1)})
+	for _, name := range names {
+		pluginsState := PluginsState{clientProto: "tcp", clientAddr: &clientAddr, qName: name, qType: dns.TypeA, auditEnabled: true}
+		pluginsState.audit("block", "block_name", "*."+name, "")
+		auditLog.write(&pluginsState)
+	}
+}
+
+func TestAuditLogChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := AuditLogConfig{File: filepath.Join(dir, "audit.log"), KeyFile: filepath.Join(dir, "audit.key")}
+	auditLog, err := NewAuditLog(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAuditRecords(t, auditLog, "a.example", "b.example", "c.example")
+	head := auditLog.lastHash
+	auditLog.logger.Close()
+
+	// The chain is extended by the next instance
+	if auditLog, err = NewAuditLog(&config); err != nil {
+		t.Fatal(err)
+	}
+	if auditLog.lastHash != head {
+		t.Fatal("The chain should be extended after a restart")
+	}
+	writeAuditRecords(t, auditLog, "d.example")
+	auditLog.logger.Close()
+	if err := VerifyAuditLog(config.File, config.KeyFile, head); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyAuditLog(config.File, "", ""); err == nil {
+		t.Fatal("The records should only verify with the key")
+	}
+
+	content, err := ioutil.ReadFile(config.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.SplitAfter(content, []byte("\n"))
+
+	// A record removed from the middle of the log breaks the chain
+	ioutil.WriteFile(config.File, bytes.Join(append(lines[:1:1], lines[2:]...), nil), 0644)
+	if err := VerifyAuditLog(config.File, config.KeyFile, ""); err == nil {
+		t.Fatal("A removed record should be detected")
+	}
+	if _, err := NewAuditLog(&config); err == nil {
+		t.Fatal("A log that doesn't verify should be refused")
+	}
+
+	// A modified record doesn't match its hash
+	ioutil.WriteFile(config.File, bytes.Replace(content, []byte("b.example"), []byte("x.example"), 1), 0644)
+	if err := VerifyAuditLog(config.File, config.KeyFile, ""); err == nil {
+		t.Fatal("A modified record should be detected")
+	}
+
+	// Records removed from the end are only detected with the hash logged by the proxy
+	ioutil.WriteFile(config.File, bytes.Join(lines[:2], nil), 0644)
+	if err := VerifyAuditLog(config.File, config.KeyFile, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyAuditLog(config.File, config.KeyFile, head); err == nil {
+		t.Fatal("Records removed from the end should be detected")
+	}
+}
@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/miekg/dns"
+)
+
+// Names queried by the benchmark when no query list is given
+var benchPopularNames = []string{
+	"google.com", "youtube.com", "facebook.com", "baidu.com", "wikipedia.org", "amazon.com",
+	"twitter.com", "instagram.com", "yahoo.com", "linkedin.com", "netflix.com", "reddit.com",
+	"microsoft.com", "apple.com", "bing.com", "live.com", "office.com", "github.com",
+	"stackoverflow.com", "twitch.tv", "ebay.com", "cloudflare.com", "wordpress.org", "zoom.us",
+	"dropbox.com", "paypal.com", "adobe.com", "tiktok.com", "whatsapp.com", "spotify.com",
+	"imdb.com", "bbc.co.uk", "cnn.com", "nytimes.com", "mozilla.org", "duckduckgo.com",
+	"yandex.ru", "qq.com", "taobao.com", "aliexpress.com", "booking.com", "pinterest.com",
+	"tumblr.com", "vk.com", "weather.com", "espn.com", "salesforce.com", "apache.org",
+}
+
+type benchQuery struct {
+	name  string
+	qType uint16
+}
+
+// benchConn receives the response that the proxy would send to a client
+type benchConn struct {
+	net.Conn
+	response []byte
+}
+
+func (conn *benchConn) WriteTo(packet []byte, addr net.Addr) (int, error) {
+	conn.response = packet
+	return len(packet), nil
+}
+
+func (conn *benchConn) ReadFrom(packet []byte) (int, net.Addr, error) {
+	return 0, nil, errors.New("Not supported")
+}
+
+type benchResult struct {
+	latency  time.Duration
+	response []byte
+}
+
+// LoadBenchQueries reads a list of queries, with a name and an optional record type per line
+func LoadBenchQueries(file string) ([]benchQuery, error) {
+	bin, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var queries []benchQuery
+	for lineNo, line := range strings.Split(string(bin), "\n") {
+		line = strings.TrimFunc(line, unicode.IsSpace)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		query := benchQuery{name: line, qType: dns.TypeA}
+		if name, qTypeStr, ok := StringTwoFields(line); ok {
+			qType, found := dns.StringToType[strings.ToUpper(qTypeStr)]
+			if !found {
+				return nil, fmt.Errorf("Unsupported record type [%s] at line %d", qTypeStr, 1+lineNo)
+			}
+			query = benchQuery{name: name, qType: qType}
+		}
+		queries = append(queries, query)
+	}
+	if len(queries) == 0 {
+		return nil, fmt.Errorf("No queries found in [%s]", file)
+	}
+	return queries, nil
+}
+
+// Bench sends count queries through the plugins and servers of the configuration, at the given
+// rate, and prints the latency, what the cache did and how the queries were spread among the
+// servers. Queries are taken in order from the list, or at random among popular names if
+// the list is empty.
+func Bench(proxy *Proxy, queries []benchQuery, qps int, count int) error {
+	if qps <= 0 || count <= 0 {
+		return errors.New("The rate and the number of queries must be positive")
+	}
+	if err := InitPluginsGlobals(&proxy.pluginsGlobals, proxy); err != nil {
+		return err
+	}
+	proxy.initServers()
+	if _, err := proxy.serversInfo.refresh(proxy); proxy.serversInfo.liveServers() == 0 {
+		if err == nil {
+			err = errors.New("No live servers available")
+		}
+		return err
+	}
+	serversBefore := make(map[string]ServerHealth)
+	for _, health := range proxy.serversInfo.health() {
+		serversBefore[health.Name] = health
+	}
+	cacheBefore := cachedResponses.stats(proxy)
+	fmt.Printf("Sending %d queries at %d queries/s\n\n", count, qps)
+
+	results := make([]benchResult, count)
+	var wg sync.WaitGroup
+	ticker := time.NewTicker(time.Second / time.Duration(qps))
+	start := time.Now()
+	for i := 0; i < count; i++ {
+		query := benchQuery{name: benchPopularNames[rand.Intn(len(benchPopularNames))], qType: dns.TypeA}
+		if len(queries) > 0 {
+			query = queries[i%len(queries)]
+		}
+		msg := dns.Msg{}
+		msg.SetQuestion(dns.Fqdn(query.name), query.qType)
+		msg.Id = uint16(i)
+		packet, err := msg.Pack()
+		if err != nil {
+			return fmt.Errorf("Invalid name [%s]: %v", query.name, err)
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var clientAddr net.Addr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+			conn := &benchConn{}
+			queryStart := time.Now()
+			proxy.processIncomingQuery(proxy.serversInfo.getOne(), "udp", proxy.mainProto, packet, &clientAddr, conn, nil)
+			results[i] = benchResult{latency: time.Since(queryStart), response: conn.response}
+		}(i)
+		<-ticker.C
+	}
+	ticker.Stop()
+	sent := time.Since(start)
+	wg.Wait()
+
+	var latencies []time.Duration
+	rcodes := make(map[string]int)
+	for _, result := range results {
+		if len(result.response) < MinDNSPacketSize {
+			continue
+		}
+		latencies = append(latencies, result.latency)
+		rcodes[dns.RcodeToString[int(Rcode(result.response))]]++
+	}
+	fmt.Printf("Queries:        %d sent, %d answered\n", count, len(latencies))
+	fmt.Printf("Rate:           %.1f queries/s\n", float64(count)/sent.Seconds())
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		percentile := func(p int) float64 {
+			return float64(latencies[(len(latencies)-1)*p/100].Nanoseconds()) / 1000000
+		}
+		fmt.Printf("Latency:        p50: %.1fms - p90: %.1fms - p99: %.1fms - max: %.1fms\n", percentile(50), percentile(90), percentile(99), percentile(100))
+		var rcodeNames []string
+		for rcode := range rcodes {
+			rcodeNames = append(rcodeNames, rcode)
+		}
+		sort.Strings(rcodeNames)
+		var rcodeCounts []string
+		for _, rcode := range rcodeNames {
+			rcodeCounts = append(rcodeCounts, fmt.Sprintf("%s: %d", rcode, rcodes[rcode]))
+		}
+		fmt.Printf("Response codes: %s\n", strings.Join(rcodeCounts, " - "))
+	}
+	cacheAfter := cachedResponses.stats(proxy)
+	if cacheAfter.Enabled {
+		hits, misses := cacheAfter.Hits-cacheBefore.Hits, cacheAfter.Misses-cacheBefore.Misses
+		hitRatio := 0.0
+		if hits+misses > 0 {
+			hitRatio = 100 * float64(hits) / float64(hits+misses)
+		}
+		fmt.Printf("Cache:          %d hits - %d misses - %.1f%% hit ratio - %d entries\n", hits, misses, hitRatio, cacheAfter.Entries)
+	} else {
+		fmt.Println("Cache:          disabled")
+	}
+	fmt.Println("\nServers:")
+	for _, health := range proxy.serversInfo.health() {
+		before := serversBefore[health.Name]
+		successes, failures, timeouts := health.Successes-before.Successes, health.Errors-before.Errors, health.Timeouts-before.Timeouts
+		if successes+failures == 0 {
+			continue
+		}
+		fmt.Printf("  %-30s %6d queries - %d errors (%d timeouts) - p50: %dms - p90: %dms - p99: %dms\n", health.Name,
+			successes+failures, failures, timeouts, health.LatencyP50, health.LatencyP90, health.LatencyP99)
+	}
+	fmt.Println("")
+	return nil
+}
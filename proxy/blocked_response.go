@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"unicode"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	BlockedResponseTTL = 600
+
+	EDNS0ExtendedError        = 15
+	ExtendedErrorCodeBlocked  = 15
+	ExtendedErrorCodeFiltered = 17
+)
+
+type BlockedResponseType int
+
+const (
+	BlockedResponseRefused BlockedResponseType = iota
+	BlockedResponseNXDomain
+	BlockedResponseEmpty
+	BlockedResponseSinkhole
+)
+
+type BlockedResponse struct {
+	responseType BlockedResponseType
+	ipv4         net.IP
+	ipv6         net.IP
+	ede          bool
+}
+
+func ParseBlockedResponse(str string) (*BlockedResponse, error) {
+	blockedResponse := BlockedResponse{responseType: BlockedResponseRefused}
+	hasType := false
+	for _, part := range strings.Split(strings.ToLower(str), ",") {
+		part = strings.TrimFunc(part, unicode.IsSpace)
+		if len(part) == 0 {
+			continue
+		}
+		if part == "ede" {
+			blockedResponse.ede = true
+			continue
+		}
+		if strings.HasPrefix(part, "a:") || strings.HasPrefix(part, "aaaa:") {
+			if hasType && blockedResponse.responseType != BlockedResponseSinkhole {
+				return nil, fmt.Errorf("Conflicting blocked query responses in [%s]", str)
+			}
+			hasType = true
+			blockedResponse.responseType = BlockedResponseSinkhole
+			idx := strings.Index(part, ":")
+			ip := net.ParseIP(part[idx+1:])
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid sinkhole address in [%s]", str)
+			}
+			if part[:idx] == "a" {
+				if blockedResponse.ipv4 = ip.To4(); blockedResponse.ipv4 == nil {
+					return nil, fmt.Errorf("Invalid IPv4 sinkhole address in [%s]", str)
+				}
+			} else {
+				blockedResponse.ipv6 = ip.To16()
+			}
+			continue
+		}
+		if hasType {
+			return nil, fmt.Errorf("Conflicting blocked query responses in [%s]", str)
+		}
+		hasType = true
+		switch part {
+		case "refused":
+			blockedResponse.responseType = BlockedResponseRefused
+		case "nxdomain":
+			blockedResponse.responseType = BlockedResponseNXDomain
+		case "empty":
+			blockedResponse.responseType = BlockedResponseEmpty
+		default:
+			return nil, fmt.Errorf("Unsupported blocked query response: [%s]", part)
+		}
+	}
+	return &blockedResponse, nil
+}
+
+func (blockedResponse *BlockedResponse) ResponseFromMessage(srcMsg *dns.Msg, infoCode uint16, reason string) (*dns.Msg, error) {
+	hasEdns0 := srcMsg.IsEdns0() != nil
+	dstMsg, err := EmptyResponseFromMessage(srcMsg)
+	if err != nil {
+		return dstMsg, err
+	}
+	switch blockedResponse.responseType {
+	case BlockedResponseRefused:
+		dstMsg.Rcode = dns.RcodeRefused
+	case BlockedResponseNXDomain:
+		dstMsg.Rcode = dns.RcodeNameError
+	case BlockedResponseEmpty:
+		dstMsg.Rcode = dns.RcodeSuccess
+	case BlockedResponseSinkhole:
+		dstMsg.Rcode = dns.RcodeSuccess
+		if len(dstMsg.Question) == 1 {
+			question := dstMsg.Question[0]
+			if question.Qclass == dns.ClassINET && question.Qtype == dns.TypeA && blockedResponse.ipv4 != nil {
+				rr := new(dns.A)
+				rr.Hdr = dns.RR_Header{Name: question.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: BlockedResponseTTL}
+				rr.A = blockedResponse.ipv4
+				dstMsg.Answer = []dns.RR{rr}
+			} else if question.Qclass == dns.ClassINET && question.Qtype == dns.TypeAAAA && blockedResponse.ipv6 != nil {
+				rr := new(dns.AAAA)
+				rr.Hdr = dns.RR_Header{Name: question.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: BlockedResponseTTL}
+				rr.AAAA = blockedResponse.ipv6
+				dstMsg.Answer = []dns.RR{rr}
+			}
+		}
+	}
+	blockedResponse.explain(dstMsg, hasEdns0, infoCode, reason)
+	return dstMsg, nil
+}
+
+// explain adds an Extended DNS Error to a response synthesized for a blocked query, if this
+// is enabled and the client sent an EDNS query
+func (blockedResponse *BlockedResponse) explain(msg *dns.Msg, hasEdns0 bool, infoCode uint16, reason string) {
+	if blockedResponse.ede && hasEdns0 {
+		AddExtendedDNSError(msg, infoCode, reason)
+	}
+}
+
+func AddExtendedDNSError(msg *dns.Msg, infoCode uint16, extraText string) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		msg.SetEdns0(uint16(MaxDNSPacketSize), false)
+		opt = msg.IsEdns0()
+	}
+	data := make([]byte, 2+len(extraText))
+	binary.BigEndian.PutUint16(data[0:2], infoCode)
+	copy(data[2:], extraText)
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: EDNS0ExtendedError, Data: data})
+}
@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+	"unicode"
+)
+
+type BlocklistFormat int
+
+const (
+	BlocklistFormatNative BlocklistFormat = iota
+	BlocklistFormatHosts
+	BlocklistFormatAdBlock
+	BlocklistFormatRPZ
+)
+
+const blocklistFormatDetectionLines = 100
+
+var hostsIgnoredNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+	"0.0.0.0":               true,
+}
+
+// DetectBlocklistFormat guesses the format of a list of rules from its first significant lines
+func DetectBlocklistFormat(in string) BlocklistFormat {
+	votes := make(map[BlocklistFormat]int)
+	lines := 0
+	for _, line := range strings.Split(in, "\n") {
+		line = strings.TrimFunc(line, unicode.IsSpace)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if lines++; lines > blocklistFormatDetectionLines {
+			break
+		}
+		fields := strings.FieldsFunc(line, unicode.IsSpace)
+		switch {
+		case strings.HasPrefix(line, "[Adblock") || strings.HasPrefix(line, "!") || strings.HasPrefix(line, "||") || strings.HasPrefix(line, "@@"):
+			votes[BlocklistFormatAdBlock]++
+		case strings.HasPrefix(line, "$ORIGIN") || strings.HasPrefix(line, "$TTL") || strings.HasPrefix(line, ";") || rpzRecordType(fields) != "":
+			votes[BlocklistFormatRPZ]++
+		case len(fields) >= 2 && net.ParseIP(fields[0]) != nil:
+			votes[BlocklistFormatHosts]++
+		default:
+			votes[BlocklistFormatNative]++
+		}
+	}
+	format, maxVotes := BlocklistFormatNative, votes[BlocklistFormatNative]
+	for _, candidate := range []BlocklistFormat{BlocklistFormatHosts, BlocklistFormatAdBlock, BlocklistFormatRPZ} {
+		if votes[candidate] > maxVotes {
+			format, maxVotes = candidate, votes[candidate]
+		}
+	}
+	return format
+}
+
+// NormalizeBlocklist converts a list of rules in any supported format to the native format
+func NormalizeBlocklist(in string) string {
+	var convert func(line string) []string
+	switch DetectBlocklistFormat(in) {
+	case BlocklistFormatHosts:
+		convert = convertHostsLine
+	case BlocklistFormatAdBlock:
+		convert = convertAdBlockLine
+	case BlocklistFormatRPZ:
+		convert = newRPZConverter()
+	default:
+		return in
+	}
+	var out []string
+	for _, line := range strings.Split(in, "\n") {
+		line = strings.TrimFunc(line, unicode.IsSpace)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		out = append(out, convert(line)...)
+	}
+	return strings.Join(out, "\n")
+}
+
+func convertHostsLine(line string) []string {
+	if idx := strings.Index(line, "#"); idx >= 0 {
+		line = line[:idx]
+	}
+	fields := strings.FieldsFunc(line, unicode.IsSpace)
+	if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+		return nil
+	}
+	var rules []string
+	for _, name := range fields[1:] {
+		name = strings.ToLower(StripTrailingDot(name))
+		if hostsIgnoredNames[name] {
+			continue
+		}
+		rules = append(rules, "="+name)
+	}
+	return rules
+}
+
+// convertAdBlockLine only keeps domain rules (||domain^), that block a domain and its subdomains
+func convertAdBlockLine(line string) []string {
+	if !strings.HasPrefix(line, "||") {
+		return nil
+	}
+	line = line[2:]
+	if idx := strings.Index(line, "$"); idx >= 0 {
+		for _, option := range strings.Split(line[idx+1:], ",") {
+			if option != "important" && option != "all" && option != "document" {
+				return nil
+			}
+		}
+		line = line[:idx]
+	}
+	if !strings.HasSuffix(line, "^") {
+		return nil
+	}
+	name := strings.ToLower(strings.TrimSuffix(line, "^"))
+	if len(name) == 0 || strings.ContainsAny(name, "/:|^") {
+		return nil
+	}
+	return []string{name}
+}
+
+func rpzRecordType(fields []string) string {
+	if len(fields) == 0 || net.ParseIP(fields[0]) != nil {
+		return ""
+	}
+	for i, field := range fields {
+		if i == 0 {
+			continue
+		}
+		switch upper := strings.ToUpper(field); upper {
+		case "CNAME", "SOA", "NS":
+			return upper
+		}
+	}
+	return ""
+}
+
+// newRPZConverter returns a function to convert the records of an RPZ zone.
+// Only the NXDOMAIN (CNAME .) and NODATA (CNAME *.) policies are supported.
+// A wildcard only applies to subdomains; when a name and its wildcard follow each other, as RPZ zones
+// usually list them, they are merged into a single suffix rule.
+func newRPZConverter() func(line string) []string {
+	origin, previous := "", ""
+	return func(line string) []string {
+		if idx := strings.Index(line, ";"); idx >= 0 {
+			line = line[:idx]
+		}
+		fields := strings.FieldsFunc(line, unicode.IsSpace)
+		if len(fields) == 0 {
+			return nil
+		}
+		if strings.EqualFold(fields[0], "$ORIGIN") {
+			if len(fields) > 1 {
+				origin = strings.ToLower(fields[1])
+			}
+			return nil
+		}
+		if rpzRecordType(fields) != "CNAME" {
+			return nil
+		}
+		target := fields[len(fields)-1]
+		if target != "." && target != "*." {
+			return nil
+		}
+		name := strings.ToLower(fields[0])
+		if strings.HasSuffix(name, ".") {
+			if len(origin) == 0 || !strings.HasSuffix(name, "."+origin) {
+				return nil
+			}
+			name = strings.TrimSuffix(name, "."+origin)
+		}
+		rule := "=" + name
+		if strings.HasPrefix(name, "*.") {
+			rule = "?" + name
+			if name[2:] == previous {
+				rule = previous
+			}
+		} else if "*."+name == previous {
+			rule = name
+		}
+		previous = name
+		return []string{rule}
+	}
+}
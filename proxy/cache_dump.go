@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+)
+
+const CacheDumpHeader = "# dnscrypt-proxy cache dump v1"
+
+// export writes the entries that haven't expired yet to a snapshot
+func (cachedResponses *CachedResponses) export(storage Storage, name string) (int, error) {
+	content, exported := cachedResponses.dump()
+	if err := storage.Write(name, []byte(content)); err != nil {
+		return 0, err
+	}
+	return exported, nil
+}
+
+// dump returns the entries that haven't expired yet, one per line: key, expiration (Unix
+// time), protected (0 or 1) and the packed response, encoded in base64
+func (cachedResponses *CachedResponses) dump() (string, int) {
+	var lines []string
+	now := time.Now()
+	for i := range cachedResponses.shards {
+		shard := &cachedResponses.shards[i]
+		shard.Lock()
+		if shard.cache != nil {
+			shard.cache.Walk(func(key [32]byte, value CachedResponse, protected bool) {
+				if now.After(value.expiration) {
+					return
+				}
+				packed, err := value.msg.Pack()
+				if err != nil {
+					return
+				}
+				protectedStr := "0"
+				if protected {
+					protectedStr = "1"
+				}
+				lines = append(lines, fmt.Sprintf("%s %d %s %s", hex.EncodeToString(key[:]), value.expiration.Unix(), protectedStr, base64.StdEncoding.EncodeToString(packed)))
+			})
+		}
+		shard.Unlock()
+	}
+	return CacheDumpHeader + "\n" + strings.Join(lines, "\n") + "\n", len(lines)
+}
+
+// load adds the entries of a snapshot written by export, skipping the ones that have expired since
+func (cachedResponses *CachedResponses) load(proxy *Proxy, name string) (int, error) {
+	bin, err := proxy.storage.Read(name)
+	if err != nil {
+		return 0, err
+	}
+	return cachedResponses.loadDump(proxy, bytes.NewReader(bin), name)
+}
+
+// loadDump adds the entries of a dump, whose name is only used in error messages
+func (cachedResponses *CachedResponses) loadDump(proxy *Proxy, reader io.Reader, name string) (int, error) {
+	settings := proxy.pluginsSettings()
+	pluginsState := PluginsState{cacheSize: settings.cacheSize, cacheMaxBytes: settings.cacheMaxBytes}
+	scanner := bufio.NewScanner(reader)
+	// Responses received over TCP can be up to 64 KB, that is 88 KB once encoded
+	scanner.Buffer(make([]byte, 0, 4096), 128*1024)
+	now := time.Now()
+	loaded := 0
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimFunc(scanner.Text(), unicode.IsSpace)
+		if lineNo == 1 {
+			if line != CacheDumpHeader {
+				return 0, fmt.Errorf("[%s] is not a cache dump", name)
+			}
+			continue
+		}
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, cachedResponse, protected, err := parseCacheDumpLine(line)
+		if err != nil {
+			return loaded, fmt.Errorf("Syntax error for a cache entry at line %d: %v", lineNo, err)
+		}
+		if now.After(cachedResponse.expiration) {
+			continue
+		}
+		shard := cachedResponses.shard(key)
+		shard.Lock()
+		if shard.cache == nil {
+			shard.cache = newCacheShard(&pluginsState)
+		}
+		if evicted := shard.cache.Add(key, cachedResponse, cacheEntrySize(&cachedResponse.msg)); evicted > 0 {
+			atomic.AddUint64(&cachedResponses.evictions, uint64(evicted))
+		}
+		if protected {
+			shard.cache.Get(key)
+		}
+		shard.Unlock()
+		loaded++
+	}
+	return loaded, scanner.Err()
+}
+
+func parseCacheDumpLine(line string) ([32]byte, CachedResponse, bool, error) {
+	var key [32]byte
+	parts := strings.Fields(line)
+	if len(parts) != 4 {
+		return key, CachedResponse{}, false, fmt.Errorf("Expected 4 fields, got %d", len(parts))
+	}
+	keyBin, err := hex.DecodeString(parts[0])
+	if err != nil || len(keyBin) != len(key) {
+		return key, CachedResponse{}, false, fmt.Errorf("Invalid key [%s]", parts[0])
+	}
+	copy(key[:], keyBin)
+	expiration, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return key, CachedResponse{}, false, fmt.Errorf("Invalid expiration [%s]", parts[1])
+	}
+	packed, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return key, CachedResponse{}, false, err
+	}
+	cachedResponse := CachedResponse{expiration: time.Unix(expiration, 0)}
+	if err := cachedResponse.msg.Unpack(packed); err != nil {
+		return key, CachedResponse{}, false, err
+	}
+	return key, cachedResponse, parts[2] == "1", nil
+}
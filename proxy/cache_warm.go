@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"github.com/jedisct1/dlog"
+	clocksmith "github.com/jedisct1/go-clocksmith"
+	"github.com/miekg/dns"
+)
+
+const (
+	// Warm names are not resolved again more often than this
+	CacheWarmMinDelay = 5 * time.Second
+	// Delay before trying again to resolve a warm name, after a failure
+	CacheWarmRetryDelay = 30 * time.Second
+)
+
+type cacheWarmName struct {
+	name  string
+	qType uint16
+	next  time.Time
+}
+
+// loadCacheWarmNames reads the names to keep in the cache, one per line, optionally followed by
+// the record types to resolve; A and AAAA are resolved by default
+func loadCacheWarmNames(file string) ([]cacheWarmName, error) {
+	bin, err := ReadRuleFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var names []cacheWarmName
+	for lineNo, line := range strings.Split(string(bin), "\n") {
+		line = strings.TrimFunc(line, unicode.IsSpace)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		name := strings.ToLower(fields[0])
+		if _, ok := dns.IsDomainName(name); !ok {
+			return nil, fmt.Errorf("Invalid name in the warm cache list at line %d", 1+lineNo)
+		}
+		qTypesStr := fields[1:]
+		if len(qTypesStr) == 0 {
+			qTypesStr = []string{"A", "AAAA"}
+		}
+		for _, qTypeStr := range qTypesStr {
+			qType, ok := QtypeFromString(qTypeStr)
+			if !ok {
+				return nil, fmt.Errorf("Unsupported record type [%s] in the warm cache list at line %d", qTypeStr, 1+lineNo)
+			}
+			names = append(names, cacheWarmName{name: dns.Fqdn(name), qType: qType})
+		}
+	}
+	return names, nil
+}
+
+// cacheWarmer resolves a list of names at startup, and again shortly before their responses
+// expire from the cache, so that clients never have to wait for them
+func (proxy *Proxy) cacheWarmer(names []cacheWarmName) {
+	go func() {
+		clientAddr := net.Addr(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		for {
+			now := time.Now()
+			next := now.Add(time.Minute)
+			for i := range names {
+				warmName := &names[i]
+				if !now.Before(warmName.next) {
+					warmName.next = time.Now().Add(proxy.warm(warmName, &clientAddr))
+				}
+				if warmName.next.Before(next) {
+					next = warmName.next
+				}
+			}
+			if delay := time.Until(next); delay > 0 {
+				clocksmith.Sleep(delay)
+			}
+			if atomic.LoadInt32(&proxy.stopping) != 0 {
+				return
+			}
+		}
+	}()
+}
+
+// warm resolves a name, bypassing the cache, and returns the delay after which it has to be
+// resolved again: when 90% of the time it is cached for has elapsed
+func (proxy *Proxy) warm(warmName *cacheWarmName, clientAddr *net.Addr) time.Duration {
+	msg := dns.Msg{}
+	msg.SetQuestion(warmName.name, warmName.qType)
+	query, err := msg.Pack()
+	if err != nil {
+		return CacheWarmRetryDelay
+	}
+	response := proxy.resolve(proxy.serversInfo.getOne(), "tcp", proxy.mainProto, query, clientAddr, nil, true)
+	responseMsg := dns.Msg{}
+	if len(response) == 0 || responseMsg.Unpack(response) != nil ||
+		(responseMsg.Rcode != dns.RcodeSuccess && responseMsg.Rcode != dns.RcodeNameError) {
+		dlog.Debugf("Unable to warm up [%s] (%s)", warmName.name, dns.TypeToString[warmName.qType])
+		return CacheWarmRetryDelay
+	}
+	settings := proxy.pluginsSettings()
+	ttl := getMinTTL(&responseMsg, settings.cacheMinTTL, settings.cacheMaxTTL, settings.cacheNegMinTTL, settings.cacheNegMaxTTL)
+	delay := ttl - ttl/10
+	if delay < CacheWarmMinDelay {
+		delay = CacheWarmMinDelay
+	}
+	return delay
+}
@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	// Number of certificates remembered by the bootstrap cache; older ones are forgotten first
+	CertBootstrapCacheSize = 256
+	// A difference between the wall clock and the monotonic clock means that the time was set
+	ClockJumpThreshold = time.Minute
+)
+
+// CertClock checks certificate validity periods against the system clock, that may be wrong
+// on devices without a real-time clock, until it is synchronized
+type CertClock struct {
+	sync.Mutex
+	skew         time.Duration
+	storage      Storage
+	cacheFile    string
+	fingerprints []string
+	known        map[string]bool
+	start        time.Time
+	synchronized bool
+}
+
+func NewCertClock(skew time.Duration, storage Storage, cacheFile string) (*CertClock, error) {
+	certClock := CertClock{
+		skew:      skew,
+		storage:   storage,
+		cacheFile: cacheFile,
+		known:     make(map[string]bool),
+		start:     time.Now(),
+	}
+	if len(cacheFile) == 0 {
+		return &certClock, nil
+	}
+	bin, err := storage.Read(cacheFile)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(bin), "\n") {
+		line = strings.TrimFunc(line, unicode.IsSpace)
+		if len(line) == 0 || strings.HasPrefix(line, "#") || certClock.known[line] {
+			continue
+		}
+		certClock.fingerprints = append(certClock.fingerprints, line)
+		certClock.known[line] = true
+	}
+	return &certClock, nil
+}
+
+func certFingerprint(bin []byte) string {
+	hash := sha256.Sum256(bin)
+	return hex.EncodeToString(hash[:])
+}
+
+// validAt returns true if the current time is within a validity period, give or take the tolerated skew
+func (certClock *CertClock) validAt(notBefore time.Time, notAfter time.Time) bool {
+	now := time.Now()
+	return !now.Add(certClock.skew).Before(notBefore) && !now.Add(-certClock.skew).After(notAfter)
+}
+
+// isSynchronized returns true once the system clock is known to have been set
+func (certClock *CertClock) isSynchronized() bool {
+	certClock.Lock()
+	defer certClock.Unlock()
+	if certClock.synchronized {
+		return true
+	}
+	elapsed, wallElapsed := time.Since(certClock.start), time.Now().Round(0).Sub(certClock.start.Round(0))
+	if jump := wallElapsed - elapsed; jump > ClockJumpThreshold || jump < -ClockJumpThreshold || systemClockSynchronized() {
+		certClock.synchronized = true
+		dlog.Notice("The system clock has been synchronized")
+	}
+	return certClock.synchronized
+}
+
+// trusted returns true if a certificate that is not valid at the current date has already been
+// seen, and the system clock has not been synchronized yet
+func (certClock *CertClock) trusted(fingerprint string) bool {
+	if len(certClock.cacheFile) == 0 || certClock.isSynchronized() {
+		return false
+	}
+	certClock.Lock()
+	defer certClock.Unlock()
+	return certClock.known[fingerprint]
+}
+
+// remember adds a valid certificate to the bootstrap cache
+func (certClock *CertClock) remember(fingerprint string) {
+	if len(certClock.cacheFile) == 0 {
+		return
+	}
+	certClock.Lock()
+	defer certClock.Unlock()
+	if certClock.known[fingerprint] {
+		return
+	}
+	certClock.fingerprints = append(certClock.fingerprints, fingerprint)
+	certClock.known[fingerprint] = true
+	if len(certClock.fingerprints) > CertBootstrapCacheSize {
+		delete(certClock.known, certClock.fingerprints[0])
+		certClock.fingerprints = certClock.fingerprints[1:]
+	}
+	content := "# Certificates trusted until the system clock is synchronized\n" + strings.Join(certClock.fingerprints, "\n") + "\n"
+	if err := certClock.storage.Write(certClock.cacheFile, []byte(content)); err != nil {
+		dlog.Warnf("Unable to update the certificate cache [%s]: %v", certClock.cacheFile, err)
+	}
+}
+
+// reportInvalid explains why a certificate was rejected, as a wrong clock is the most likely cause
+func (certClock *CertClock) reportInvalid(name string, notBefore time.Time, notAfter time.Time) {
+	dlog.Warnf("[%s] Certificate only valid from %s to %s, but the system clock says %s -- Check that the system clock is correct", name, notBefore.UTC().Format(time.RFC3339), notAfter.UTC().Format(time.RFC3339), time.Now().UTC().Format(time.RFC3339))
+}
+
+// verifyTLS verifies a TLS certificate chain, tolerating the configured clock skew, and a wrong
+// clock for certificates in the bootstrap cache
+func (certClock *CertClock) verifyTLS(name string, certs []*x509.Certificate) error {
+	if len(certs) == 0 {
+		return errors.New("No certificates received")
+	}
+	leaf := certs[0]
+	options := x509.VerifyOptions{DNSName: name, Intermediates: x509.NewCertPool()}
+	for _, cert := range certs[1:] {
+		options.Intermediates.AddCert(cert)
+	}
+	options.CurrentTime = time.Now()
+	_, err := leaf.Verify(options)
+	if err == nil {
+		certClock.remember(certFingerprint(leaf.Raw))
+		return nil
+	}
+	if invalid, ok := err.(x509.CertificateInvalidError); !ok || invalid.Reason != x509.Expired {
+		return err
+	}
+	// Within the tolerated skew, the chain is verified at the closest date the leaf is valid at
+	if certClock.skew > 0 && certClock.validAt(leaf.NotBefore, leaf.NotAfter) {
+		options.CurrentTime = closestTime(options.CurrentTime, leaf.NotBefore, leaf.NotAfter)
+		if _, err = leaf.Verify(options); err == nil {
+			certClock.remember(certFingerprint(leaf.Raw))
+			return nil
+		}
+	}
+	fingerprint := certFingerprint(leaf.Raw)
+	if certClock.trusted(fingerprint) {
+		// The rest of the chain still has to be valid
+		options.CurrentTime = leaf.NotBefore.Add(leaf.NotAfter.Sub(leaf.NotBefore) / 2)
+		if _, err := leaf.Verify(options); err == nil {
+			dlog.Noticef("[%s] Certificate not valid at the current date, but trusted until the system clock is synchronized", name)
+			return nil
+		}
+	}
+	certClock.reportInvalid(name, leaf.NotBefore, leaf.NotAfter)
+	return err
+}
+
+func closestTime(t time.Time, notBefore time.Time, notAfter time.Time) time.Time {
+	if t.Before(notBefore) {
+		return notBefore
+	}
+	if t.After(notAfter) {
+		return notAfter
+	}
+	return t
+}
@@ -0,0 +1,14 @@
+package proxy
+
+import "syscall"
+
+const staUnsync = 0x0040
+
+// systemClockSynchronized returns true if the kernel reports that the clock is kept in sync by NTP
+func systemClockSynchronized() bool {
+	var timex syscall.Timex
+	if _, err := syscall.Adjtimex(&timex); err != nil {
+		return false
+	}
+	return timex.Status&staUnsync == 0
+}
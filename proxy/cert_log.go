@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+// CertLogEntry describes a DNSCrypt certificate or the TLS certificate of a DoH server
+type CertLogEntry struct {
+	Server    string
+	Proto     string
+	Serial    string
+	KeyHash   string
+	NotBefore time.Time
+	NotAfter  time.Time
+	Issuer    string
+}
+
+// CertLog is an append-only record of the certificates seen for every server, one per line:
+// time, server, protocol, serial, SHA-256 hash of the public key, validity period and issuer,
+// separated by tabs. A line is only added when a certificate differs from the previous one
+// of the same server, and key changes that don't look like regular renewals are reported.
+type CertLog struct {
+	sync.Mutex
+	storage Storage
+	file    string
+	last    map[string]CertLogEntry
+}
+
+func NewCertLog(storage Storage, file string) (*CertLog, error) {
+	certLog := CertLog{storage: storage, file: file, last: make(map[string]CertLogEntry)}
+	bin, err := storage.Read(file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(bin), "\n") {
+		if entry, ok := parseCertLogLine(line); ok {
+			certLog.last[entry.Proto+"/"+entry.Server] = entry
+		}
+	}
+	return &certLog, nil
+}
+
+func parseCertLogLine(line string) (CertLogEntry, bool) {
+	fields := strings.Split(strings.TrimRight(line, "\r"), "\t")
+	if len(fields) != 8 {
+		return CertLogEntry{}, false
+	}
+	notBefore, err := time.Parse(time.RFC3339, fields[5])
+	if err != nil {
+		return CertLogEntry{}, false
+	}
+	notAfter, err := time.Parse(time.RFC3339, fields[6])
+	if err != nil {
+		return CertLogEntry{}, false
+	}
+	return CertLogEntry{
+		Server:    fields[1],
+		Proto:     fields[2],
+		Serial:    fields[3],
+		KeyHash:   fields[4],
+		NotBefore: notBefore,
+		NotAfter:  notAfter,
+		Issuer:    fields[7],
+	}, true
+}
+
+// record adds a certificate to the log if it hasn't been seen before for that server
+func (certLog *CertLog) record(entry CertLogEntry) {
+	if certLog == nil {
+		return
+	}
+	certLog.Lock()
+	defer certLog.Unlock()
+	key := entry.Proto + "/" + entry.Server
+	previous, known := certLog.last[key]
+	if known && previous.Serial == entry.Serial && previous.KeyHash == entry.KeyHash {
+		return
+	}
+	certLog.last[key] = entry
+	if known {
+		if reason := unexpectedCertChange(&previous, &entry); len(reason) > 0 {
+			dlog.Warnf("[%s] UNEXPECTED KEY CHANGE: %s -- previous key: %s, new key: %s -- this may indicate that the server has been compromised or that connections are being intercepted",
+				entry.Server, reason, previous.KeyHash, entry.KeyHash)
+		} else if previous.KeyHash != entry.KeyHash {
+			dlog.Infof("[%s] New key: %s (serial: %s)", entry.Server, entry.KeyHash, entry.Serial)
+		}
+	}
+	line := strings.Join([]string{
+		time.Now().Format(time.RFC3339),
+		entry.Server,
+		entry.Proto,
+		entry.Serial,
+		entry.KeyHash,
+		entry.NotBefore.UTC().Format(time.RFC3339),
+		entry.NotAfter.UTC().Format(time.RFC3339),
+		entry.Issuer,
+	}, "\t") + "\n"
+	if err := certLog.storage.Append(certLog.file, []byte(line)); err != nil {
+		dlog.Warnf("Unable to update the certificate log: %v", err)
+	}
+}
+
+// unexpectedCertChange tells why a new certificate doesn't look like a regular renewal.
+// DNSCrypt serials must increase, and a serial can't be reused for a different key. TLS
+// certificates are usually renewed during the last third of their validity period, by the
+// same issuer.
+func unexpectedCertChange(previous *CertLogEntry, current *CertLogEntry) string {
+	if current.Proto == "DNSCrypt" {
+		var previousSerial, currentSerial uint32
+		fmt.Sscanf(previous.Serial, "%d", &previousSerial)
+		fmt.Sscanf(current.Serial, "%d", &currentSerial)
+		if currentSerial < previousSerial {
+			return fmt.Sprintf("the certificate serial went back from %s to %s", previous.Serial, current.Serial)
+		}
+		if currentSerial == previousSerial && previous.KeyHash != current.KeyHash {
+			return fmt.Sprintf("serial %s was reused for a different key", current.Serial)
+		}
+		return ""
+	}
+	if previous.KeyHash == current.KeyHash {
+		return ""
+	}
+	if previous.Issuer != current.Issuer {
+		return fmt.Sprintf("the certificate issuer changed from [%s] to [%s]", previous.Issuer, current.Issuer)
+	}
+	renewalStart := previous.NotAfter.Add(-previous.NotAfter.Sub(previous.NotBefore) / 3)
+	if time.Now().Before(renewalStart) {
+		return fmt.Sprintf("the previous certificate was valid until %s", previous.NotAfter.Format(time.RFC3339))
+	}
+	return ""
+}
+
+func keyHash(key []byte) string {
+	h := sha256.Sum256(key)
+	return hex.EncodeToString(h[:])
+}
+
+func dnscryptCertLogEntry(server string, certInfo *CertInfo) CertLogEntry {
+	return CertLogEntry{
+		Server:    server,
+		Proto:     "DNSCrypt",
+		Serial:    fmt.Sprintf("%d", certInfo.Serial),
+		KeyHash:   keyHash(certInfo.ServerPk[:]),
+		NotBefore: certInfo.NotBefore,
+		NotAfter:  certInfo.NotAfter,
+		Issuer:    "-",
+	}
+}
+
+func tlsCertLogEntry(server string, cert *x509.Certificate) CertLogEntry {
+	issuer := strings.Replace(cert.Issuer.String(), "\t", " ", -1)
+	if len(issuer) == 0 {
+		issuer = "-"
+	}
+	return CertLogEntry{
+		Server:    server,
+		Proto:     "DoH",
+		Serial:    cert.SerialNumber.Text(16),
+		KeyHash:   keyHash(cert.RawSubjectPublicKeyInfo),
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+		Issuer:    issuer,
+	}
+}
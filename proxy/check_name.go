@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"unicode"
+
+	"github.com/miekg/dns"
+)
+
+// CheckName runs a name through the query plugins, without sending any queries or writing any
+// logs, and prints the rules that matched, with the file and line they come from, and what
+// the proxy would do with the query.
+func CheckName(proxy *Proxy, name string, qTypeStr string) error {
+	qType := dns.TypeA
+	if len(qTypeStr) > 0 {
+		var ok bool
+		if qType, ok = dns.StringToType[strings.ToUpper(qTypeStr)]; !ok {
+			return fmt.Errorf("Unsupported record type: [%s]", qTypeStr)
+		}
+	}
+	// Only keep the plugins that don't have any side effects
+	proxy.queryLogFile, proxy.queryLogRemote = "", QueryLogRemoteConfig{}
+	proxy.nxLogFile, proxy.blockNameLogFile, proxy.whitelistNameLogFile, proxy.blockIPLogFile = "", "", "", ""
+	proxy.policyHook = PolicyHookConfig{}
+	proxy.clientRateLimit = 0
+	proxy.cache, proxy.peerCache = false, nil
+	if err := InitPluginsGlobals(&proxy.pluginsGlobals, proxy); err != nil {
+		return err
+	}
+	msg := dns.Msg{}
+	msg.SetQuestion(dns.Fqdn(name), qType)
+	msg.RecursionDesired = true
+	query, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Checking [%s] (%s)\n\n", name, dns.TypeToString[qType])
+
+	var clientAddr net.Addr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	pluginsState := NewPluginsState(proxy, "udp", &clientAddr)
+	pluginsState.auditEnabled = true
+	pluginsState.dryRun = true
+	if _, err := pluginsState.ApplyQueryPlugins(&proxy.pluginsGlobals, query); err != nil && pluginsState.action != PluginsActionDrop {
+		return err
+	}
+	if len(pluginsState.auditEntries) == 0 {
+		fmt.Println("No matching rules")
+	}
+	forwardedTo := ""
+	for _, entry := range pluginsState.auditEntries {
+		fmt.Printf("%-10s %-16s %s", entry.action, entry.plugin, entry.rule)
+		if len(entry.target) > 0 {
+			fmt.Printf(" -> %s", entry.target)
+		}
+		if location := proxy.ruleLocation(entry.plugin, entry.rule); len(location) > 0 {
+			fmt.Printf(" (%s)", location)
+		}
+		fmt.Println("")
+		if entry.action == "forwarded" {
+			forwardedTo = entry.target
+		}
+	}
+	fmt.Println("")
+	switch pluginsState.action {
+	case PluginsActionDrop:
+		fmt.Println("Result:         the query would be dropped")
+	case PluginsActionReject:
+		fmt.Printf("Result:         the query would be blocked (%s)\n", pluginsState.rejectReason)
+	case PluginsActionSynth:
+		fmt.Println("Result:         the query would be answered by the local rules")
+		if synth := pluginsState.synthResponse; synth != nil {
+			fmt.Printf("Response code:  %s\n", dns.RcodeToString[synth.Rcode])
+			for _, rr := range synth.Answer {
+				fmt.Println(rr.String())
+			}
+		}
+	default:
+		if len(forwardedTo) > 0 {
+			fmt.Printf("Result:         the query would be forwarded to [%s]\n", forwardedTo)
+		} else if len(pluginsState.serverNames) > 0 {
+			fmt.Printf("Result:         the query would be sent to one of %v\n", pluginsState.serverNames)
+		} else {
+			fmt.Println("Result:         the query would be sent to the configured servers")
+		}
+	}
+	return nil
+}
+
+// ruleLocation returns the file and the line a rule reported by a plugin comes from
+func (proxy *Proxy) ruleLocation(plugin string, rule string) string {
+	var files []string
+	canonical := canonicalPattern
+	switch plugin {
+	case "block_name":
+		files = []string{proxy.blockNameFile, proxy.blockNameCacheFile}
+	case "whitelist_name":
+		files = []string{proxy.whitelistNameFile}
+	case "cloak":
+		files = []string{proxy.cloakFile}
+	case "forward":
+		files = []string{proxy.forwardFile}
+		canonical = func(domain string) string {
+			return strings.Trim(strings.TrimPrefix(strings.ToLower(domain), "*."), ".")
+		}
+	default:
+		return ""
+	}
+	for _, file := range files {
+		if len(file) == 0 {
+			continue
+		}
+		bin, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		in := string(bin)
+		convert := func(line string) []string { return []string{line} }
+		if plugin == "block_name" {
+			switch DetectBlocklistFormat(in) {
+			case BlocklistFormatHosts:
+				convert = convertHostsLine
+			case BlocklistFormatAdBlock:
+				convert = convertAdBlockLine
+			case BlocklistFormatRPZ:
+				convert = newRPZConverter()
+			}
+		}
+		for lineNo, line := range strings.Split(in, "\n") {
+			line = strings.TrimFunc(line, unicode.IsSpace)
+			if len(line) == 0 || strings.HasPrefix(line, "#") {
+				continue
+			}
+			for _, converted := range convert(line) {
+				pattern := strings.SplitN(converted, "@", 2)[0]
+				fields := strings.FieldsFunc(pattern, unicode.IsSpace)
+				if len(fields) > 0 && canonical(fields[0]) == rule {
+					return fmt.Sprintf("%s:%d", file, lineNo+1)
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// canonicalPattern returns a pattern the way the pattern matcher reports it when it matches
+func canonicalPattern(pattern string) string {
+	pattern = strings.ToLower(pattern)
+	switch {
+	case isGlobCandidate(pattern):
+		return pattern
+	case strings.HasSuffix(pattern, "*"):
+		// Prefixes and substrings
+		return pattern
+	case strings.HasPrefix(pattern, "="):
+		return pattern[1:]
+	}
+	return "*." + strings.TrimPrefix(strings.TrimPrefix(pattern, "*"), ".")
+}
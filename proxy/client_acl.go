@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/jedisct1/dlog"
+)
+
+// ClientACL restricts the clients that the listeners accept queries from, so that a proxy
+// listening on a shared network can't be used as an open resolver. Denied networks take
+// precedence; if allowed networks are given, other clients are rejected.
+type ClientACL struct {
+	allowed []*net.IPNet
+	denied  []*net.IPNet
+}
+
+// NewClientACL returns nil if all clients are allowed
+func NewClientACL(allowed []string, denied []string) (*ClientACL, error) {
+	if len(allowed) == 0 && len(denied) == 0 {
+		return nil, nil
+	}
+	acl := ClientACL{}
+	for _, addrStr := range allowed {
+		network, err := ParseIPOrCIDR(addrStr)
+		if err != nil {
+			return nil, fmt.Errorf("[allowed_clients]: %v", err)
+		}
+		acl.allowed = append(acl.allowed, network)
+	}
+	for _, addrStr := range denied {
+		network, err := ParseIPOrCIDR(addrStr)
+		if err != nil {
+			return nil, fmt.Errorf("[denied_clients]: %v", err)
+		}
+		acl.denied = append(acl.denied, network)
+	}
+	return &acl, nil
+}
+
+func (acl *ClientACL) allows(ip net.IP) bool {
+	if acl == nil {
+		return true
+	}
+	for _, network := range acl.denied {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	if len(acl.allowed) == 0 {
+		return true
+	}
+	for _, network := range acl.allowed {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (proxy *Proxy) clientAllowed(clientAddr net.Addr) bool {
+	if proxy.clientACL == nil {
+		return true
+	}
+	var ip net.IP
+	switch addr := clientAddr.(type) {
+	case *net.UDPAddr:
+		ip = addr.IP
+	case *net.TCPAddr:
+		ip = addr.IP
+	default:
+		return false
+	}
+	if !proxy.clientACL.allows(ip) {
+		dlog.Debugf("Query from [%v] rejected by the client access list", ip)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"strings"
+	"sync"
+)
+
+// PendingQueries coalesces identical queries sent while a previous one is still waiting for a
+// response from upstream servers, so that a single query is forwarded, and its response is
+// shared. Queries are identical if they are the same after the query plugins have been
+// applied, except for the transaction ID, and are sent to the same set of servers over the
+// same protocol.
+type PendingQueries struct {
+	sync.Mutex
+	queries map[[32]byte]*pendingQuery
+}
+
+type pendingQuery struct {
+	done       chan struct{}
+	serverInfo *ServerInfo
+	response   []byte
+	err        error
+}
+
+func pendingQueryKey(query []byte, serverProto string, serverNames []string) [32]byte {
+	h := sha256.New()
+	h.Write(query[2:])
+	h.Write([]byte{0})
+	h.Write([]byte(serverProto))
+	h.Write([]byte{0})
+	h.Write([]byte(strings.Join(serverNames, ",")))
+	var key [32]byte
+	h.Sum(key[:0])
+	return key
+}
+
+// do calls forward, unless an identical query is already being forwarded, in which case its
+// response is returned instead, with the transaction ID of the query; shared is then true.
+func (pendingQueries *PendingQueries) do(query []byte, serverProto string, serverNames []string, forward func() (*ServerInfo, []byte, error)) (serverInfo *ServerInfo, response []byte, err error, shared bool) {
+	if len(query) < 2 {
+		serverInfo, response, err = forward()
+		return serverInfo, response, err, false
+	}
+	key := pendingQueryKey(query, serverProto, serverNames)
+	pendingQueries.Lock()
+	if pending, ok := pendingQueries.queries[key]; ok {
+		pendingQueries.Unlock()
+		<-pending.done
+		if pending.err != nil {
+			return pending.serverInfo, nil, pending.err, true
+		}
+		response = append([]byte{}, pending.response...)
+		if len(response) >= 2 {
+			SetTransactionID(response, TransactionID(query))
+		}
+		return pending.serverInfo, response, nil, true
+	}
+	if pendingQueries.queries == nil {
+		pendingQueries.queries = make(map[[32]byte]*pendingQuery)
+	}
+	pending := &pendingQuery{done: make(chan struct{})}
+	pendingQueries.queries[key] = pending
+	pendingQueries.Unlock()
+
+	serverInfo, response, err = forward()
+	// The response is modified by the response plugins of the query that forwarded it
+	pending.serverInfo, pending.err = serverInfo, err
+	if err == nil {
+		pending.response = append([]byte{}, response...)
+	}
+	pendingQueries.Lock()
+	delete(pendingQueries.queries, key)
+	pendingQueries.Unlock()
+	close(pending.done)
+	return serverInfo, response, err, false
+}
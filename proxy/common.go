@@ -1,13 +1,16 @@
-package main
+package proxy
 
 import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 	"unicode"
 )
 
@@ -36,6 +39,15 @@ var (
 	InitialMinQuestionSize = 256
 )
 
+// packetBuffers recycles the buffers that UDP packets are received into, so that queries
+// don't require a new buffer each
+var packetBuffers = sync.Pool{
+	New: func() interface{} {
+		buffer := make([]byte, MaxDNSPacketSize)
+		return &buffer
+	},
+}
+
 func PrefixWithSize(packet []byte) ([]byte, error) {
 	packetLen := len(packet)
 	if packetLen > 0xffff {
@@ -71,6 +83,27 @@ func ReadPrefixed(conn *net.TCPConn) ([]byte, error) {
 	}
 }
 
+// ReadPrefixedFrom reads a single length-prefixed message, without reading past its end, so
+// that several messages can be read from the same stream
+func ReadPrefixedFrom(reader io.Reader) ([]byte, error) {
+	var prefix [2]byte
+	if _, err := io.ReadFull(reader, prefix[:]); err != nil {
+		return nil, err
+	}
+	packetLength := int(binary.BigEndian.Uint16(prefix[:]))
+	if packetLength > MaxDNSPacketSize-1 {
+		return nil, errors.New("Packet too large")
+	}
+	if packetLength < MinDNSPacketSize {
+		return nil, errors.New("Packet too short")
+	}
+	packet := make([]byte, packetLength)
+	if _, err := io.ReadFull(reader, packet); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
 func Min(a, b int) int {
 	if a < b {
 		return a
@@ -99,6 +132,14 @@ func MaxF(a, b float64) float64 {
 	return b
 }
 
+// MinTimeout returns timeout, or limit if it is shorter; a limit of 0 means no limit
+func MinTimeout(timeout time.Duration, limit time.Duration) time.Duration {
+	if limit > 0 && limit < timeout {
+		return limit
+	}
+	return timeout
+}
+
 func StringReverse(s string) string {
 	r := []rune(s)
 	for i, j := 0, len(r)-1; i < len(r)/2; i, j = i+1, j-1 {
@@ -0,0 +1,1633 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/jedisct1/dlog"
+	stamps "github.com/jedisct1/go-dnsstamps"
+)
+
+const (
+	AppVersion            = "2.0.11"
+	DefaultConfigFileName = "dnscrypt-proxy.toml"
+	MaxConfigIncludeDepth = 8
+)
+
+var configEnvVarRegexp = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+type Config struct {
+	Include                   []string                  `toml:"include"`
+	LogLevel                  int                       `toml:"log_level"`
+	LogFile                   *string                   `toml:"log_file"`
+	UseSyslog                 bool                      `toml:"use_syslog"`
+	CrashReportFile           string                    `toml:"crash_report_file"`
+	LogMalformedQueries       bool                      `toml:"log_malformed_queries"`
+	ServerNames               []string                  `toml:"server_names"`
+	DisabledServerNames       []string                  `toml:"disabled_server_names"`
+	ListenAddresses           []string                  `toml:"listen_addresses"`
+	Listeners                 map[string]ListenerConfig `toml:"listeners"`
+	ListenIPv6Only            bool                      `toml:"listen_ipv6_only"`
+	Daemonize                 bool
+	UserName                  string   `toml:"user_name"`
+	Sandbox                   bool     `toml:"sandbox"`
+	ForceTCP                  bool     `toml:"force_tcp"`
+	Timeout                   int      `toml:"timeout"`
+	UDPTimeout                int      `toml:"udp_timeout"`
+	TCPConnectTimeout         int      `toml:"tcp_connect_timeout"`
+	TLSHandshakeTimeout       int      `toml:"tls_handshake_timeout"`
+	DoHTimeout                int      `toml:"doh_timeout"`
+	LatencyBudget             int      `toml:"latency_budget"`
+	EDNSBufferSize            int      `toml:"edns_buffer_size"`
+	QueryRetries              int      `toml:"query_retries"`
+	CoalesceQueries           bool     `toml:"coalesce_queries"`
+	ServerMaxErrorRate        float64  `toml:"server_max_error_rate"`
+	RaceServers               int      `toml:"race_servers"`
+	KeepAlive                 int      `toml:"keepalive"`
+	CertRefreshDelay          int      `toml:"cert_refresh_delay"`
+	CertIgnoreTimestamp       bool     `toml:"cert_ignore_timestamp"`
+	CertClockSkew             int      `toml:"cert_clock_skew"`
+	CertBootstrapCacheFile    string   `toml:"cert_bootstrap_cache_file"`
+	CertLogFile               string   `toml:"certificate_log"`
+	EphemeralKeys             bool     `toml:"dnscrypt_ephemeral_keys"`
+	LBStrategy                string   `toml:"lb_strategy"`
+	LBJitter                  *float64 `toml:"lb_jitter"`
+	LatencyProbeInterval      *int     `toml:"latency_probe_interval"`
+	MaintenanceWindow         string   `toml:"maintenance_window"`
+	MaxActiveServers          int      `toml:"max_active_servers"`
+	BlockIPv6                 bool     `toml:"block_ipv6"`
+	BlockIPv6ForIPv4Clients   bool     `toml:"block_ipv6_for_ipv4_clients"`
+	BlockDoHCanary            bool     `toml:"block_doh_canary"`
+	ChaosResponses            bool     `toml:"chaos_responses"`
+	ChaosPolicy               string   `toml:"chaos_policy"`
+	UpstreamOverride          bool     `toml:"upstream_override"`
+	StripECH                  bool     `toml:"strip_ech"`
+	SanitizeResponses         bool     `toml:"sanitize_responses"`
+	BlockedQtypes             []string `toml:"blocked_query_types"`
+	BlockedQtypesResponse     string   `toml:"blocked_query_types_response"`
+	BlockedQueryResponse      string   `toml:"blocked_query_response"`
+	Cache                     bool
+	CacheSize                 CacheSizeConfig              `toml:"cache_size"`
+	CacheNegTTL               uint32                       `toml:"cache_neg_ttl"`
+	CacheNegMinTTL            uint32                       `toml:"cache_neg_min_ttl"`
+	CacheNegMaxTTL            uint32                       `toml:"cache_neg_max_ttl"`
+	CacheMinTTL               uint32                       `toml:"cache_min_ttl"`
+	CacheMaxTTL               uint32                       `toml:"cache_max_ttl"`
+	CacheOptimisticWindow     int                          `toml:"cache_optimistic_window"`
+	CacheWarmFile             string                       `toml:"cache_warm_file"`
+	CacheSnapshotFile         string                       `toml:"cache_snapshot_file"`
+	CachePeers                CachePeersConfig             `toml:"cache_peers"`
+	QueryLog                  QueryLogConfig               `toml:"query_log"`
+	AuditLog                  AuditLogConfig               `toml:"audit_log"`
+	DNSCryptServer            DNSCryptServerConfig         `toml:"dnscrypt_server"`
+	LocalDoH                  LocalDoHConfig               `toml:"local_doh"`
+	Outgoing                  OutgoingConfig               `toml:"outgoing"`
+	Dashboard                 DashboardConfig              `toml:"dashboard"`
+	ControlSocket             string                       `toml:"control_socket"`
+	HealthCheckAddress        string                       `toml:"healthcheck_listen_address"`
+	HighAvailability          HighAvailabilityConfig       `toml:"high_availability"`
+	DebugAddress              string                       `toml:"debug_listen"`
+	SlowPluginThreshold       int                          `toml:"slow_plugin_threshold"`
+	NxLog                     NxLogConfig                  `toml:"nx_log"`
+	BlockName                 BlockNameConfig              `toml:"blacklist"`
+	WhitelistName             WhitelistNameConfig          `toml:"whitelist"`
+	BlockIP                   BlockIPConfig                `toml:"ip_blacklist"`
+	ForwardFile               string                       `toml:"forwarding_rules"`
+	ForwardSearchDomains      bool                         `toml:"forward_search_domains"`
+	SearchDomainsResolvConf   string                       `toml:"search_domains_resolv_conf"`
+	CloakFile                 string                       `toml:"cloaking_rules"`
+	WatchRuleFiles            bool                         `toml:"watch_rule_files"`
+	TTLRulesFile              string                       `toml:"ttl_rules"`
+	ScriptFile                string                       `toml:"script_file"`
+	PolicyHook                PolicyHookConfig             `toml:"policy_hook"`
+	CaptivePortals            CaptivePortalsConfig         `toml:"captive_portals"`
+	NetworkProfiles           NetworkProfilesConfig        `toml:"network_profiles"`
+	LocalZones                map[string]string            `toml:"local_zones"`
+	ClientGroups              map[string]ClientGroupConfig `toml:"client_groups"`
+	ClientHintsFile           string                       `toml:"client_hints_file"`
+	ClientIdentification      ClientIdentificationConfig   `toml:"client_identification"`
+	SafeSearch                bool                         `toml:"safe_search"`
+	DNSSECValidation          bool                         `toml:"dnssec_validation"`
+	DNSSECTrustAnchorsFile    string                       `toml:"dnssec_trust_anchors_file"`
+	ServersConfig             map[string]StaticConfig      `toml:"static"`
+	ServerWeights             map[string]int               `toml:"server_weights"`
+	SourcesConfig             map[string]SourceConfig      `toml:"sources"`
+	SourcesCacheDir           string                       `toml:"sources_cache_dir"`
+	StateDir                  string                       `toml:"state_dir"`
+	SourceRequireDNSSEC       bool                         `toml:"require_dnssec"`
+	SourceRequireNoLog        bool                         `toml:"require_nolog"`
+	SourceRequireNoFilter     bool                         `toml:"require_nofilter"`
+	SourceRequireFamilyFilter bool                         `toml:"require_family_filter"`
+	SourceDNSCrypt            bool                         `toml:"dnscrypt_servers"`
+	SourceDoH                 bool                         `toml:"doh_servers"`
+	SourceIPv4                bool                         `toml:"ipv4_servers"`
+	SourceIPv6                bool                         `toml:"ipv6_servers"`
+	MaxClients                uint32                       `toml:"max_clients"`
+	AllowedClients            []string                     `toml:"allowed_clients"`
+	DeniedClients             []string                     `toml:"denied_clients"`
+	UDPWorkers                int                          `toml:"udp_workers"`
+	UDPBatchSize              int                          `toml:"udp_batch_size"`
+	TCPIdleTimeout            int                          `toml:"tcp_idle_timeout"`
+	TCPMaxQueries             int                          `toml:"tcp_max_queries"`
+	QueryWorkers              int                          `toml:"query_workers"`
+	OverloadResponse          string                       `toml:"overload_response"`
+	ClientRateLimit           int                          `toml:"client_rate_limit"`
+	ClientRateLimitBurst      int                          `toml:"client_rate_limit_burst"`
+	ResponseRateLimit         ResponseRateLimitConfig      `toml:"response_rate_limit"`
+	ServerLocation            ServerLocationConfig         `toml:"server_location"`
+	DNSCookies                bool                         `toml:"dns_cookies"`
+	DNSCookiesStrict          bool                         `toml:"dns_cookies_strict"`
+	FallbackResolver          string                       `toml:"fallback_resolver"`
+	LastResort                LastResortConfig             `toml:"last_resort"`
+	IgnoreSystemDNS           bool                         `toml:"ignore_system_dns"`
+	BootstrapResolvers        []string                     `toml:"bootstrap_resolvers"`
+	NetprobeAddress           string                       `toml:"netprobe_address"`
+	NetprobeTimeout           int                          `toml:"netprobe_timeout"`
+	OfflineMode               string                       `toml:"offline_mode"`
+	NXRedirectProtection      string                       `toml:"nxdomain_redirect_protection"`
+	SystemDNSMonitor          string                       `toml:"system_dns_monitor"`
+	AllWeeklyRanges           map[string]WeeklyRangesStr   `toml:"schedules"`
+	LogMaxSize                int                          `toml:"log_files_max_size"`
+	LogMaxAge                 int                          `toml:"log_files_max_age"`
+	LogMaxBackups             int                          `toml:"log_files_max_backups"`
+	TLSDisableSessionTickets  bool                         `toml:"tls_disable_session_tickets"`
+	TLSCipherSuite            []uint16                     `toml:"tls_cipher_suite"`
+	DoHUserAgent              string                       `toml:"doh_user_agent"`
+	DownloadRateLimit         int                          `toml:"download_rate_limit"`
+	sourceErrors              map[string]error
+}
+
+func newConfig() Config {
+	return Config{
+		LogLevel:                 int(dlog.LogLevel()),
+		ListenAddresses:          []string{"127.0.0.1:53"},
+		Timeout:                  2500,
+		QueryRetries:             1,
+		EDNSBufferSize:           DefaultEDNSBufferSize,
+		CoalesceQueries:          true,
+		ServerMaxErrorRate:       DefaultServerMaxErrorRate,
+		KeepAlive:                5,
+		CertRefreshDelay:         240,
+		CertIgnoreTimestamp:      false,
+		EphemeralKeys:            false,
+		BlockDoHCanary:           true,
+		ChaosResponses:           true,
+		SearchDomainsResolvConf:  DefaultSearchDomainsResolvConf,
+		Cache:                    true,
+		CacheSize:                CacheSizeConfig{Entries: 512},
+		CacheNegTTL:              0,
+		CacheNegMinTTL:           60,
+		CacheNegMaxTTL:           600,
+		CacheMinTTL:              60,
+		CacheMaxTTL:              8600,
+		SourceRequireNoLog:       true,
+		SourceRequireNoFilter:    true,
+		SourceIPv4:               true,
+		SourceIPv6:               false,
+		SourceDNSCrypt:           true,
+		SourceDoH:                true,
+		MaxClients:               250,
+		TCPIdleTimeout:           10,
+		TCPMaxQueries:            100,
+		FallbackResolver:         DefaultFallbackResolver,
+		IgnoreSystemDNS:          false,
+		NetprobeAddress:          DefaultFallbackResolver,
+		NetprobeTimeout:          60,
+		OfflineMode:              "off",
+		LogMaxSize:               10,
+		LogMaxAge:                7,
+		LogMaxBackups:            1,
+		AuditLog:                 AuditLogConfig{MaxSize: 10},
+		DNSCryptServer:           DNSCryptServerConfig{ProviderKeyFile: "dnscrypt-provider.key", KeyRotation: 12},
+		HighAvailability:         HighAvailabilityConfig{CheckInterval: 2, MaxFailures: 3, StateInterval: 300},
+		TLSDisableSessionTickets: false,
+		TLSCipherSuite:           nil,
+	}
+}
+
+type StaticConfig struct {
+	Stamp        string
+	Address      string
+	ProviderName string            `toml:"provider_name"`
+	PublicKey    string            `toml:"public_key"`
+	Headers      map[string]string `toml:"headers"`
+}
+
+// serverStamp returns the stamp of a static server, either given as-is or built from explicit DNSCrypt parameters
+func (staticConfig *StaticConfig) serverStamp() (stamps.ServerStamp, error) {
+	if len(staticConfig.Stamp) > 0 {
+		if len(staticConfig.Address) > 0 || len(staticConfig.ProviderName) > 0 || len(staticConfig.PublicKey) > 0 {
+			return stamps.ServerStamp{}, errors.New("Both a stamp and explicit parameters are defined")
+		}
+		return stamps.NewServerStampFromString(staticConfig.Stamp)
+	}
+	if len(staticConfig.Address) == 0 || len(staticConfig.ProviderName) == 0 || len(staticConfig.PublicKey) == 0 {
+		return stamps.ServerStamp{}, errors.New("Missing stamp, or address, provider_name and public_key")
+	}
+	return stamps.NewDNSCryptServerStampFromLegacy(staticConfig.Address, staticConfig.PublicKey, staticConfig.ProviderName, 0)
+}
+
+type SourceConfig struct {
+	URL             string
+	URLs            []string
+	MinisignKeyStr  string   `toml:"minisign_key"`
+	MinisignKeyStrs []string `toml:"minisign_keys"`
+	CacheFile       string   `toml:"cache_file"`
+	FormatStr       string   `toml:"format"`
+	RefreshDelay    int      `toml:"refresh_delay"`
+	RefreshJitter   *int     `toml:"refresh_jitter"`
+	MaxStaleness    int      `toml:"max_staleness"`
+	Prefix          string
+	forceRefresh    bool
+}
+
+type QueryLogConfig struct {
+	File             string
+	Format           string
+	IgnoredQtypes    []string `toml:"ignored_qtypes"`
+	IgnoredDomains   []string `toml:"ignored_domains"`
+	IgnoredClients   []string `toml:"ignored_clients"`
+	AnonymizeClients string   `toml:"anonymize_clients"`
+	Retention        int      `toml:"retention"`
+	AggregateFile    string   `toml:"aggregate_file"`
+	Remote           QueryLogRemoteConfig
+}
+
+type AuditLogConfig struct {
+	File       string
+	KeyFile    string `toml:"key_file"`
+	MaxSize    int    `toml:"max_size"`
+	MaxAge     int    `toml:"max_age"`
+	MaxBackups int    `toml:"max_backups"`
+}
+
+type DNSCryptServerConfig struct {
+	ListenAddresses []string `toml:"listen_addresses"`
+	ProviderName    string   `toml:"provider_name"`
+	ProviderKeyFile string   `toml:"provider_key_file"`
+	KeyRotation     int      `toml:"key_rotation"`
+	ExternalAddress string   `toml:"external_address"`
+}
+
+type LocalDoHConfig struct {
+	ListenAddresses []string `toml:"listen_addresses"`
+	Path            string   `toml:"path"`
+	CertFile        string   `toml:"cert_file"`
+	CertKeyFile     string   `toml:"cert_key_file"`
+	ClientCAFile    string   `toml:"client_ca_file"`
+	Tokens          []string `toml:"tokens"`
+}
+
+type OutgoingConfig struct {
+	Addresses []string `toml:"addresses"`
+	Interface string   `toml:"interface"`
+	Fwmark    uint32   `toml:"fwmark"`
+	DSCP      int      `toml:"dscp"`
+}
+
+type DashboardConfig struct {
+	ListenAddress string `toml:"listen_address"`
+}
+
+// CacheSizeConfig is either a number of entries, or an amount of memory such as '64MB'
+type CacheSizeConfig struct {
+	Entries int
+	Bytes   int
+}
+
+func (cacheSize *CacheSizeConfig) UnmarshalTOML(data interface{}) error {
+	switch value := data.(type) {
+	case int64:
+		if value > 0 {
+			*cacheSize = CacheSizeConfig{Entries: int(value)}
+			return nil
+		}
+	case string:
+		value = strings.ToUpper(strings.TrimSpace(value))
+		if strings.HasSuffix(value, "MB") {
+			megabytes, err := strconv.Atoi(strings.TrimSpace(strings.TrimSuffix(value, "MB")))
+			if err == nil && megabytes > 0 && megabytes <= math.MaxInt32>>20 {
+				*cacheSize = CacheSizeConfig{Bytes: megabytes << 20}
+				return nil
+			}
+		} else if entries, err := strconv.Atoi(value); err == nil && entries > 0 {
+			*cacheSize = CacheSizeConfig{Entries: entries}
+			return nil
+		}
+	}
+	return fmt.Errorf("Invalid cache size [%v] -- Use a number of entries, or an amount of memory such as '64MB'", data)
+}
+
+type NxLogConfig struct {
+	File   string
+	Format string
+}
+
+type BlockNameConfig struct {
+	File                 string   `toml:"blacklist_file"`
+	LogFile              string   `toml:"log_file"`
+	Format               string   `toml:"log_format"`
+	BlockedQueryResponse string   `toml:"blocked_query_response"`
+	URLs                 []string `toml:"urls"`
+	MinisignKeyStr       string   `toml:"minisign_key"`
+	CacheFile            string   `toml:"cache_file"`
+	RefreshDelay         int      `toml:"refresh_delay"`
+}
+
+type WhitelistNameConfig struct {
+	File    string `toml:"whitelist_file"`
+	LogFile string `toml:"log_file"`
+	Format  string `toml:"log_format"`
+}
+
+type BlockIPConfig struct {
+	File                 string `toml:"blacklist_file"`
+	LogFile              string `toml:"log_file"`
+	Format               string `toml:"log_format"`
+	BlockedQueryResponse string `toml:"blocked_query_response"`
+}
+
+type ResponseRateLimitConfig struct {
+	ResponsesPerSecond int  `toml:"responses_per_second"`
+	Burst              int  `toml:"burst"`
+	Slip               *int `toml:"slip"`
+	Leak               int  `toml:"leak"`
+	IPv4PrefixLength   int  `toml:"ipv4_prefix_length"`
+	IPv6PrefixLength   int  `toml:"ipv6_prefix_length"`
+}
+
+type ListenerConfig struct {
+	Address     string
+	Proto       string
+	ClientGroup string `toml:"client_group"`
+	IPv6Only    *bool  `toml:"ipv6_only"`
+}
+
+type NetworkProfilesConfig struct {
+	SSIDFile      string                          `toml:"ssid_file"`
+	CheckInterval int                             `toml:"check_interval"`
+	Default       string                          `toml:"default"`
+	Profiles      map[string]NetworkProfileConfig `toml:"profiles"`
+}
+
+type NetworkProfileConfig struct {
+	GatewayMACs     []string `toml:"gateway_macs"`
+	SSIDs           []string `toml:"ssids"`
+	DHCPDomains     []string `toml:"dhcp_domains"`
+	ServerNames     []string `toml:"server_names"`
+	ForwardFile     string   `toml:"forwarding_rules"`
+	ListenAddresses []string `toml:"listen_addresses"`
+}
+
+type CaptivePortalsConfig struct {
+	MapFile  string `toml:"map_file"`
+	Resolver string `toml:"resolver"`
+}
+
+type ClientGroupConfig struct {
+	Addresses      []string
+	HardwareAddrs  []string `toml:"hardware_addresses"`
+	BlacklistFile  string   `toml:"blacklist_file"`
+	AllowedQtypes  []string `toml:"allowed_query_types"`
+	ServerNames    []string `toml:"server_names"`
+	SafeSearch     bool     `toml:"safe_search"`
+	NoFiltering    bool     `toml:"no_filtering"`
+	CacheNamespace string   `toml:"cache_namespace"`
+	QueryLogFile   string   `toml:"query_log_file"`
+}
+
+type ServerSummary struct {
+	Name        string        `json:"name"`
+	Proto       string        `json:"proto"`
+	IPv6        bool          `json:"ipv6"`
+	Addrs       []string      `json:"addrs,omitempty"`
+	Ports       []int         `json:"ports"`
+	DNSSEC      bool          `json:"dnssec"`
+	NoLog       bool          `json:"nolog"`
+	NoFilter    bool          `json:"nofilter"`
+	Description string        `json:"description,omitempty"`
+	Country     string        `json:"country,omitempty"`
+	ASN         uint32        `json:"asn,omitempty"`
+	Latency     *int          `json:"latency_ms,omitempty"`
+	Error       string        `json:"error,omitempty"`
+	Stats       *ServerHealth `json:"stats,omitempty"`
+}
+
+func findConfigFile(configFile *string) (string, error) {
+	if _, err := os.Stat(*configFile); os.IsNotExist(err) {
+		cdLocal()
+		if _, err := os.Stat(*configFile); err != nil {
+			return "", err
+		}
+	}
+	pwd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	if filepath.IsAbs(*configFile) {
+		return *configFile, nil
+	}
+	return path.Join(pwd, *configFile), nil
+}
+
+// expandConfigEnvVars replaces ${VAR} and ${VAR:-default} with the value of environment variables
+func expandConfigEnvVars(in string) (string, error) {
+	lines := strings.Split(in, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		var err error
+		lines[i] = configEnvVarRegexp.ReplaceAllStringFunc(line, func(ref string) string {
+			parts := configEnvVarRegexp.FindStringSubmatch(ref)
+			if value, ok := os.LookupEnv(parts[1]); ok {
+				return value
+			}
+			if len(parts[2]) > 0 {
+				return parts[3]
+			}
+			err = fmt.Errorf("Undefined environment variable [%s] at line %d", parts[1], 1+i)
+			return ref
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// decodeConfigFile decodes a configuration file, then the files it includes, on top of the given configuration
+func decodeConfigFile(file string, config *Config, depth int) error {
+	if depth > MaxConfigIncludeDepth {
+		return fmt.Errorf("Too many nested includes in [%s]", file)
+	}
+	bin, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	in, err := expandConfigEnvVars(string(bin))
+	if err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	config.Include = nil
+	md, err := toml.Decode(in, config)
+	if err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return fmt.Errorf("Unsupported key in configuration file [%s]: [%s]", file, undecoded[0])
+	}
+	includes := config.Include
+	config.Include = nil
+	for _, include := range includes {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(file), include)
+		}
+		matches, err := filepath.Glob(include)
+		if err != nil {
+			return fmt.Errorf("%s: invalid include [%s]", file, include)
+		}
+		if len(matches) == 0 && !strings.ContainsAny(include, "*?[") {
+			return fmt.Errorf("%s: included file [%s] not found", file, include)
+		}
+		for _, match := range matches {
+			dlog.Debugf("Including [%s]", match)
+			if err := decodeConfigFile(match, config, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func ConfigLoad(proxy *Proxy, svcFlag *string) error {
+	version := flag.Bool("version", false, "print current proxy version")
+	resolve := flag.String("resolve", "", "resolve a name using the configured servers, or the server given as the next argument (@name or @stamp)")
+	list := flag.Bool("list", false, "print the list of available resolvers for the enabled filters")
+	listAll := flag.Bool("list-all", false, "print the complete list of available resolvers, ignoring filters")
+	jsonOutput := flag.Bool("json", false, "output list as JSON")
+	tableOutput := flag.Bool("table", false, "output list as a table, including server properties")
+	measure := flag.Bool("measure", false, "measure the latency of every listed server")
+	check := flag.Bool("check", false, "check the configuration file and exit")
+	checkName := flag.String("check-name", "", "print the rules matching a name, optionally followed by a record type, and what would be done with the query, without sending it")
+	selfTest := flag.Bool("self-test", false, "check the configuration, the sources, the certificates of the first servers and every transport, without listening to any sockets, and print a report (-json for a machine-readable one)")
+	selfTestServers := flag.Int("self-test-servers", DefaultSelfTestServers, "number of servers whose certificates are fetched with -self-test")
+	child := flag.Bool("child", false, "Invokes program as a child process")
+	setSystemDNS := flag.Bool("set-system-dns", false, "use the proxy as the DNS resolver of all the active network interfaces, until it stops (Windows and macOS only)")
+	refreshSources := flag.Bool("refresh-sources", false, "download and verify all the sources again, then exit")
+	healthCheck := flag.Bool("healthcheck", false, "resolve a name through the running proxy, and exit with a non-zero status if it fails")
+	ctl := flag.String("ctl", "", "send a command to the running proxy through the control socket (stats, servers, top, tail [name], cache flush, reload, offline [on|off|auto], filtering [on|off], profile [<name>|auto], set-loglevel <level>)")
+	bench := flag.Bool("bench", false, "send queries through the configured servers at a given rate, and report the latency, the cache hit ratio and the servers that were used")
+	benchQueries := flag.String("bench-queries", "", "file with the queries to send with -bench, one name and an optional record type per line (default: popular names)")
+	benchQPS := flag.Int("bench-qps", 50, "number of queries per second to send with -bench")
+	benchCount := flag.Int("bench-count", 1000, "number of queries to send with -bench")
+	verifyAuditLog := flag.String("verify-audit-log", "", "check that the records of an audit log file have not been modified, removed or reordered, and exit")
+	auditLogKey := flag.String("audit-log-key", "", "file with the key of the audit log to verify, if it has one")
+	auditLogHead := flag.String("audit-log-head", "", "hash of the last record logged by the proxy, that the audit log to verify must include")
+	configFile := flag.String("config", DefaultConfigFileName, "Path to the configuration file")
+
+	flag.Parse()
+
+	// Controlling an installed service doesn't require the configuration; installing it only
+	// requires the path to the configuration file
+	if len(*svcFlag) > 0 && *svcFlag != "install" {
+		return nil
+	}
+	if *version {
+		fmt.Println(AppVersion)
+		os.Exit(0)
+	}
+	if len(*verifyAuditLog) > 0 {
+		if err := VerifyAuditLog(*verifyAuditLog, *auditLogKey, *auditLogHead); err != nil {
+			dlog.Fatal(err)
+		}
+		os.Exit(0)
+	}
+	resolveServerName := ""
+	if len(*resolve) > 0 && strings.HasPrefix(flag.Arg(0), "@") {
+		resolveServerName = flag.Arg(0)[1:]
+	}
+
+	var benchQueryList []benchQuery
+	if *bench && len(*benchQueries) > 0 {
+		var err error
+		if benchQueryList, err = LoadBenchQueries(*benchQueries); err != nil {
+			return err
+		}
+	}
+
+	foundConfigFile, err := findConfigFile(configFile)
+	if err != nil {
+		dlog.Fatalf("Unable to load the configuration file [%s] -- Maybe use the -config command-line switch?", *configFile)
+	}
+	config := newConfig()
+	if err := decodeConfigFile(foundConfigFile, &config, 0); err != nil {
+		if *selfTest {
+			report := SelfTestReport{Version: AppVersion, ConfigFile: foundConfigFile, OK: true}
+			report.add("config", time.Now(), "", err)
+			report.print(*jsonOutput)
+		}
+		return err
+	}
+	if *svcFlag == "install" {
+		proxy.configFile = foundConfigFile
+		proxy.setSystemDNS = *setSystemDNS
+		return nil
+	}
+	cdFileDir(foundConfigFile)
+	if *healthCheck {
+		if err := HealthCheck(&config); err != nil {
+			dlog.Fatal(err)
+		}
+		os.Exit(0)
+	}
+	if len(*ctl) > 0 {
+		if err := Control(config.ControlSocket, *ctl, flag.Args()); err != nil {
+			dlog.Fatal(err)
+		}
+		os.Exit(0)
+	}
+	// A server given by name can be used for a diagnostic query even if it doesn't match the filters
+	if *listAll || (len(resolveServerName) > 0 && !strings.HasPrefix(resolveServerName, "sdns:")) {
+		config.ServerNames = nil
+		config.DisabledServerNames = nil
+		config.SourceRequireDNSSEC = false
+		config.SourceRequireNoFilter = false
+		config.SourceRequireNoLog = false
+		config.SourceRequireFamilyFilter = false
+		config.SourceIPv4 = true
+		config.SourceIPv6 = true
+		config.SourceDNSCrypt = true
+		config.SourceDoH = true
+	}
+
+	if *refreshSources {
+		for cfgSourceName, cfgSource := range config.SourcesConfig {
+			cfgSource.forceRefresh = true
+			config.SourcesConfig[cfgSourceName] = cfgSource
+		}
+	}
+	proxy.child = *child
+	proxy.setSystemDNS = *setSystemDNS
+	if *selfTest {
+		SelfTest(proxy, &config, foundConfigFile, *selfTestServers, *jsonOutput)
+	}
+	if err := config.load(proxy, foundConfigFile); err != nil {
+		return err
+	}
+	if *list || *listAll {
+		config.printRegisteredServers(proxy, *jsonOutput, *tableOutput, *measure)
+		os.Exit(0)
+	}
+	if len(*resolve) > 0 {
+		if err := ResolveAndPrint(proxy, *resolve, resolveServerName); err != nil {
+			return err
+		}
+		os.Exit(0)
+	}
+	if len(*checkName) > 0 {
+		if err := CheckName(proxy, *checkName, flag.Arg(0)); err != nil {
+			return err
+		}
+		os.Exit(0)
+	}
+	if *bench {
+		if err := Bench(proxy, benchQueryList, *benchQPS, *benchCount); err != nil {
+			return err
+		}
+		os.Exit(0)
+	}
+	if *refreshSources {
+		dlog.Notice("Sources refreshed")
+		os.Exit(0)
+	}
+	if *check {
+		// Load and compile all the rule files, as the proxy would do when starting
+		if err := InitPluginsGlobals(&proxy.pluginsGlobals, proxy); err != nil {
+			return err
+		}
+		dlog.Notice("Configuration successfully checked")
+		os.Exit(0)
+	}
+	return nil
+}
+
+// ServiceArguments returns the command-line arguments a system service has to be started with,
+// so that it uses the same configuration file, even if it was found using a relative path or
+// in the directory of the executable file
+func (proxy *Proxy) ServiceArguments() []string {
+	var args []string
+	if len(proxy.configFile) > 0 {
+		args = append(args, "-config", proxy.configFile)
+	}
+	if proxy.setSystemDNS {
+		args = append(args, "-set-system-dns")
+	}
+	return args
+}
+
+// Prepare loads the rule files, and detaches the process from the terminal if the
+// configuration requires it. The command-line program calls it before StartProxy().
+func (proxy *Proxy) Prepare() error {
+	if err := InitPluginsGlobals(&proxy.pluginsGlobals, proxy); err != nil {
+		return err
+	}
+	if proxy.daemonize {
+		Daemonize()
+	}
+	return nil
+}
+
+// IsChild returns true if the process was started by a parent that has dropped privileges
+func (proxy *Proxy) IsChild() bool {
+	return proxy.child
+}
+
+// load applies a configuration to a proxy; configFile is the file it was read from, if any
+func (config *Config) load(proxy *Proxy, configFile string) error {
+	var err error
+	if config.LogLevel >= 0 && config.LogLevel < int(dlog.SeverityLast) {
+		dlog.SetLogLevel(dlog.Severity(config.LogLevel))
+	}
+	if dlog.LogLevel() <= dlog.SeverityDebug && os.Getenv("DEBUG") == "" {
+		dlog.SetLogLevel(dlog.SeverityInfo)
+	}
+	if config.UseSyslog {
+		dlog.UseSyslog(true)
+	} else if config.LogFile != nil {
+		dlog.UseLogFile(*config.LogFile)
+		proxy.logFile = *config.LogFile
+	}
+	proxy.crashReportFile = config.CrashReportFile
+	proxy.logMalformedQueries = config.LogMalformedQueries
+	proxy.logMaxSize = config.LogMaxSize
+	proxy.logMaxAge = config.LogMaxAge
+	proxy.logMaxBackups = config.LogMaxBackups
+
+	storage, err := NewFileStorage(config.StateDir)
+	if err != nil {
+		return err
+	}
+	proxy.storage = storage
+	proxy.stateDir = storage.dir
+	if len(storage.dir) > 0 && len(config.SourcesCacheDir) > 0 {
+		config.SourcesCacheDir = storage.path(config.SourcesCacheDir)
+	}
+	outgoing, err := NewOutgoing(&config.Outgoing)
+	if err != nil {
+		return err
+	}
+	proxy.outgoing = outgoing
+	proxy.xTransport = NewXTransport()
+	proxy.xTransport.outgoing = outgoing
+	if config.CertClockSkew < 0 {
+		return errors.New("cert_clock_skew must be a positive number of seconds")
+	}
+	certClock, err := NewCertClock(time.Duration(config.CertClockSkew)*time.Second, proxy.storage, config.CertBootstrapCacheFile)
+	if err != nil {
+		return fmt.Errorf("Unable to load the certificate cache: %v", err)
+	}
+	proxy.certClock = certClock
+	if len(config.CertLogFile) > 0 {
+		certLog, err := NewCertLog(proxy.storage, config.CertLogFile)
+		if err != nil {
+			return err
+		}
+		proxy.certLog = certLog
+	}
+	proxy.xTransport.certClock = certClock
+	proxy.xTransport.tlsDisableSessionTickets = config.TLSDisableSessionTickets
+	proxy.xTransport.tlsCipherSuite = config.TLSCipherSuite
+	if len(config.DoHUserAgent) > 0 {
+		proxy.xTransport.userAgent = config.DoHUserAgent
+	}
+	if config.DownloadRateLimit < 0 {
+		return errors.New("download_rate_limit must be a positive number of kilobytes per second")
+	} else if config.DownloadRateLimit > 0 {
+		proxy.xTransport.downloadLimiter = NewDownloadLimiter(config.DownloadRateLimit)
+	}
+	bootstrapResolvers := config.BootstrapResolvers
+	if len(bootstrapResolvers) == 0 && len(config.FallbackResolver) > 0 {
+		bootstrapResolvers = []string{config.FallbackResolver}
+	}
+	for _, resolver := range bootstrapResolvers {
+		if _, _, err := net.SplitHostPort(resolver); err != nil {
+			return fmt.Errorf("Invalid bootstrap resolver [%s]: %v", resolver, err)
+		}
+	}
+	proxy.xTransport.bootstrapResolvers = bootstrapResolvers
+	if len(bootstrapResolvers) > 0 {
+		proxy.xTransport.ignoreSystemDNS = config.IgnoreSystemDNS
+	}
+	proxy.xTransport.useIPv4 = config.SourceIPv4
+	proxy.xTransport.useIPv6 = config.SourceIPv6
+	proxy.xTransport.keepAlive = time.Duration(config.KeepAlive) * time.Second
+	if config.UDPTimeout < 0 || config.TCPConnectTimeout < 0 || config.TLSHandshakeTimeout < 0 || config.DoHTimeout < 0 {
+		return errors.New("Timeouts must be positive")
+	}
+	proxy.xTransport.connectTimeout = time.Duration(config.TCPConnectTimeout) * time.Millisecond
+	proxy.xTransport.tlsHandshakeTimeout = time.Duration(config.TLSHandshakeTimeout) * time.Millisecond
+	proxy.xTransport.rebuildTransport()
+
+	proxy.timeout = time.Duration(config.Timeout) * time.Millisecond
+	proxy.udpTimeout = time.Duration(config.UDPTimeout) * time.Millisecond
+	proxy.tcpConnectTimeout = time.Duration(config.TCPConnectTimeout) * time.Millisecond
+	proxy.dohTimeout = time.Duration(config.DoHTimeout) * time.Millisecond
+	if config.LatencyBudget < 0 {
+		return errors.New("latency_budget must be positive")
+	}
+	proxy.latencyBudget = time.Duration(config.LatencyBudget) * time.Millisecond
+	if config.EDNSBufferSize < MinEDNSBufferSize || config.EDNSBufferSize > MaxDNSUDPPacketSize {
+		return fmt.Errorf("edns_buffer_size must be between %d and %d", MinEDNSBufferSize, MaxDNSUDPPacketSize)
+	}
+	proxy.ednsBufferSize = config.EDNSBufferSize
+	if len(config.LastResort.Resolver) > 0 {
+		lastResort, err := NewLastResort(&config.LastResort, proxy.outgoing, proxy.timeout)
+		if err != nil {
+			return fmt.Errorf("Invalid last-resort resolver [%s]: %v", config.LastResort.Resolver, err)
+		}
+		proxy.lastResort = lastResort
+	}
+	if config.QueryRetries < 0 {
+		return errors.New("query_retries must be positive")
+	}
+	proxy.queryRetries = config.QueryRetries
+	proxy.coalesceQueries = config.CoalesceQueries
+	if config.ServerMaxErrorRate < 0 || config.ServerMaxErrorRate >= 1 {
+		return errors.New("server_max_error_rate must be between 0 and 1")
+	}
+	proxy.serverMaxErrorRate = config.ServerMaxErrorRate
+	proxy.raceServers = config.RaceServers
+	proxy.maxClients = config.MaxClients
+	if config.MaxClients == 0 {
+		return errors.New("[max_clients] must be at least 1")
+	}
+	if proxy.clientACL, err = NewClientACL(config.AllowedClients, config.DeniedClients); err != nil {
+		return err
+	}
+	proxy.queryWorkers = config.QueryWorkers
+	if proxy.queryWorkers <= 0 || proxy.queryWorkers > int(config.MaxClients) {
+		proxy.queryWorkers = int(config.MaxClients)
+	}
+	switch strings.ToLower(config.OverloadResponse) {
+	case "", "refused":
+		proxy.overloadRefuse = true
+	case "drop":
+		proxy.overloadRefuse = false
+	default:
+		return fmt.Errorf("Unsupported [overload_response]: [%s] -- Use 'refused' or 'drop'", config.OverloadResponse)
+	}
+	proxy.udpWorkers = config.UDPWorkers
+	if proxy.udpWorkers <= 0 {
+		proxy.udpWorkers = runtime.GOMAXPROCS(0)
+	}
+	if config.TCPIdleTimeout <= 0 {
+		return errors.New("[tcp_idle_timeout] must be at least 1")
+	}
+	proxy.tcpIdleTimeout = time.Duration(config.TCPIdleTimeout) * time.Second
+	if config.TCPMaxQueries <= 0 {
+		return errors.New("[tcp_max_queries] must be at least 1")
+	}
+	proxy.tcpMaxQueries = config.TCPMaxQueries
+	proxy.udpBatchSize = config.UDPBatchSize
+	if proxy.udpBatchSize <= 0 {
+		proxy.udpBatchSize = DefaultUDPBatchSize
+	}
+	proxy.mainProto = "udp"
+	if config.ForceTCP {
+		proxy.mainProto = "tcp"
+	}
+	proxy.certRefreshDelay = time.Duration(config.CertRefreshDelay) * time.Minute
+	proxy.certRefreshDelayAfterFailure = time.Duration(10 * time.Second)
+	proxy.certIgnoreTimestamp = config.CertIgnoreTimestamp
+	proxy.ephemeralKeys = config.EphemeralKeys
+	if len(config.ListenAddresses) == 0 {
+		dlog.Debug("No local IP/port configured")
+	}
+	if len(config.Dashboard.ListenAddress) > 0 {
+		if err := checkLoopbackAddress(config.Dashboard.ListenAddress); err != nil {
+			return fmt.Errorf("Dashboard: %v", err)
+		}
+		proxy.dashboardAddress = config.Dashboard.ListenAddress
+	}
+	proxy.controlSocket = config.ControlSocket
+	if config.ResponseRateLimit.ResponsesPerSecond < 0 || config.ResponseRateLimit.Leak < 0 ||
+		(config.ResponseRateLimit.Slip != nil && *config.ResponseRateLimit.Slip < 0) {
+		return errors.New("response_rate_limit settings must be positive")
+	}
+	if config.ResponseRateLimit.ResponsesPerSecond > 0 {
+		if proxy.responseRateLimiter, err = NewResponseRateLimiter(config.ResponseRateLimit); err != nil {
+			return err
+		}
+	}
+	proxy.watchRuleFilesEnabled = config.WatchRuleFiles
+	proxy.healthCheckAddress = config.HealthCheckAddress
+	switch config.HighAvailability.Role {
+	case "":
+	case "primary":
+		if len(proxy.healthCheckAddress) == 0 || len(config.HighAvailability.Secret) == 0 {
+			return errors.New("A primary proxy requires healthcheck_listen_address and a secret")
+		}
+		proxy.haKey = haKey(config.HighAvailability.Secret)
+	case "standby":
+		standby, err := NewStandby(&config.HighAvailability)
+		if err != nil {
+			return err
+		}
+		proxy.standby = standby
+	default:
+		return fmt.Errorf("Unsupported high availability role [%s] -- Use primary or standby", config.HighAvailability.Role)
+	}
+	if len(config.HighAvailability.VirtualIP) > 0 {
+		if len(config.HighAvailability.Role) == 0 {
+			return errors.New("A virtual IP requires a high availability role")
+		}
+		if len(config.UserName) > 0 {
+			return errors.New("[virtual_ip] can't be used with [user_name], since adding the address requires privileges -- Use the User and AmbientCapabilities=CAP_NET_ADMIN CAP_NET_RAW directives of a systemd unit instead")
+		}
+		if proxy.virtualIP, err = NewVirtualIP(config.HighAvailability.VirtualIP, config.HighAvailability.Interface); err != nil {
+			return err
+		}
+	}
+	proxy.debugAddress = config.DebugAddress
+	if len(proxy.dashboardAddress) > 0 || len(proxy.controlSocket) > 0 {
+		proxy.stats = NewStats()
+		proxy.pluginTimings = NewPluginTimings()
+	}
+	if len(config.AuditLog.File) > 0 {
+		if proxy.auditLog, err = NewAuditLog(&config.AuditLog); err != nil {
+			return err
+		}
+	}
+	if len(config.DNSCryptServer.ListenAddresses) > 0 {
+		dnscryptServer, err := NewDNSCryptServer(&config.DNSCryptServer)
+		if err != nil {
+			return fmt.Errorf("DNSCrypt server: %v", err)
+		}
+		proxy.dnscryptServer = dnscryptServer
+		proxy.dnscryptServerAddress = config.DNSCryptServer.ExternalAddress
+		if len(proxy.dnscryptServerAddress) == 0 {
+			proxy.dnscryptServerAddress = config.DNSCryptServer.ListenAddresses[0]
+		}
+	}
+	if len(config.LocalDoH.ListenAddresses) > 0 {
+		if proxy.localDoHServer, err = NewLocalDoHServer(&config.LocalDoH); err != nil {
+			return fmt.Errorf("Local DoH server: %v", err)
+		}
+	}
+	if len(config.CachePeers.Peers) > 0 || len(config.CachePeers.ListenAddress) > 0 {
+		if !config.Cache {
+			return errors.New("[cache_peers] requires the cache to be enabled")
+		}
+		peerCache, err := NewPeerCache(&config.CachePeers)
+		if err != nil {
+			return fmt.Errorf("Cache peers: %v", err)
+		}
+		proxy.peerCache = peerCache
+	}
+
+	lbStrategy := DefaultLBStrategy
+	switch strings.ToLower(config.LBStrategy) {
+	case "":
+		// default
+	case "p2":
+		lbStrategy = LBStrategyP2
+	case "ph":
+		lbStrategy = LBStrategyPH
+	case "fastest":
+		lbStrategy = LBStrategyFastest
+	case "random":
+		lbStrategy = LBStrategyRandom
+	default:
+		dlog.Warnf("Unknown load balancing strategy: [%s]", config.LBStrategy)
+	}
+	proxy.serversInfo.lbStrategy = lbStrategy
+	proxy.latencyProbeInterval = DefaultLatencyProbeInterval
+	if config.LatencyProbeInterval != nil {
+		proxy.latencyProbeInterval = time.Duration(*config.LatencyProbeInterval) * time.Second
+	}
+	proxy.serversInfo.lbJitter = DefaultLBJitter
+	if config.LBJitter != nil {
+		if *config.LBJitter < 0 {
+			return errors.New("lb_jitter must be positive")
+		}
+		proxy.serversInfo.lbJitter = *config.LBJitter
+	}
+	if config.MaxActiveServers < 0 {
+		return errors.New("max_active_servers must be positive")
+	}
+	proxy.serversInfo.maxActiveServers = config.MaxActiveServers
+	for name, weight := range config.ServerWeights {
+		if weight < 0 || weight > 100 {
+			return fmt.Errorf("The weight of server [%s] must be between 0 and 100", name)
+		}
+	}
+	proxy.serversInfo.weights = config.ServerWeights
+
+	if len(config.NetworkProfiles.Profiles) > 0 {
+		if err := config.loadNetworkProfiles(proxy); err != nil {
+			return err
+		}
+	}
+	if err := config.loadListeners(proxy); err != nil {
+		return err
+	}
+	proxy.daemonize = config.Daemonize
+	proxy.userName = config.UserName
+	proxy.sandbox = config.Sandbox
+	proxy.configFile = configFile
+	if err := config.loadPluginSettings(proxy); err != nil {
+		return err
+	}
+	if len(config.MaintenanceWindow) > 0 {
+		window, ok := (*proxy.allWeeklyRanges)[config.MaintenanceWindow]
+		if !ok {
+			return fmt.Errorf("Maintenance window [%s] not found in the schedules", config.MaintenanceWindow)
+		}
+		proxy.maintenanceWindow = &window
+	}
+	if len(config.CacheWarmFile) > 0 {
+		if !proxy.cache {
+			return errors.New("cache_warm_file requires the cache to be enabled")
+		}
+		if proxy.cacheWarmNames, err = loadCacheWarmNames(config.CacheWarmFile); err != nil {
+			return err
+		}
+	}
+	if len(config.CacheSnapshotFile) > 0 && !proxy.cache {
+		return errors.New("cache_snapshot_file requires the cache to be enabled")
+	}
+	proxy.cacheSnapshotFile = config.CacheSnapshotFile
+	proxy.config = config
+
+	for _, pattern := range append(append([]string{}, config.ServerNames...), config.DisabledServerNames...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid server name pattern [%s]", pattern)
+		}
+	}
+
+	if proxy.systemDNSMonitor, err = parseSystemDNSMonitor(config.SystemDNSMonitor); err != nil {
+		return err
+	}
+	offlineMode, err := parseOfflineMode(config.OfflineMode)
+	if err != nil {
+		return err
+	}
+	if len(config.NXRedirectProtection) > 0 {
+		if proxy.nxRedirectProtection, err = parseNXRedirectProtection(config.NXRedirectProtection); err != nil {
+			return err
+		}
+	}
+	proxy.netprobeAddress = config.NetprobeAddress
+	if offlineMode != OfflineModeOff {
+		if err := proxy.setOfflineMode(offlineMode); err != nil {
+			return err
+		}
+	}
+	// The network has already been probed by the parent process. In automatic offline mode,
+	// queries are answered locally until it is available, instead of waiting for it.
+	if !proxy.child && offlineMode != OfflineModeAuto {
+		if err := NetProbe(proxy.outgoing, config.NetprobeAddress, config.NetprobeTimeout); err != nil {
+			return err
+		}
+	}
+	if len(config.ServerLocation.Database) > 0 {
+		if proxy.serverLocations, err = NewServerLocations(config.ServerLocation); err != nil {
+			return err
+		}
+	}
+	if err := config.loadSources(proxy); err != nil {
+		return err
+	}
+	if len(proxy.registeredServers) == 0 {
+		return errors.New("No servers configured")
+	}
+	return nil
+}
+
+// loadPluginSettings applies the settings used by plugins; they can be changed without a restart
+func (config *Config) loadPluginSettings(proxy *Proxy) error {
+	var err error
+	proxy.clientRateLimit = config.ClientRateLimit
+	proxy.clientRateLimitBurst = config.ClientRateLimitBurst
+	proxy.dnsCookies = config.DNSCookies
+	proxy.dnsCookiesStrict = config.DNSCookiesStrict
+	proxy.pluginBlockIPv6 = config.BlockIPv6
+	proxy.blockIPv6ForIPv4Clients = config.BlockIPv6ForIPv4Clients
+	proxy.stripECH = config.StripECH
+	proxy.sanitizeResponses = config.SanitizeResponses
+	proxy.blockDoHCanary = config.BlockDoHCanary
+	proxy.chaosResponses = config.ChaosResponses
+	proxy.chaosPolicy = config.ChaosPolicy
+	proxy.upstreamOverride = config.UpstreamOverride
+	proxy.blockedQtypes = config.BlockedQtypes
+	if len(config.BlockedQueryResponse) == 0 {
+		config.BlockedQueryResponse = "refused"
+	}
+	if proxy.blockedQueryResponse, err = ParseBlockedResponse(config.BlockedQueryResponse); err != nil {
+		return err
+	}
+	if len(config.BlockedQtypesResponse) > 0 {
+		if proxy.blockedQtypesResponse, err = ParseBlockedResponse(config.BlockedQtypesResponse); err != nil {
+			return err
+		}
+	}
+	proxy.cache = config.Cache
+	proxy.cacheSize, proxy.cacheMaxBytes = config.CacheSize.Entries, config.CacheSize.Bytes
+
+	if config.CacheNegTTL > 0 {
+		proxy.cacheNegMinTTL = config.CacheNegTTL
+		proxy.cacheNegMaxTTL = config.CacheNegTTL
+	} else {
+		proxy.cacheNegMinTTL = config.CacheNegMinTTL
+		proxy.cacheNegMaxTTL = config.CacheNegMaxTTL
+	}
+
+	proxy.cacheMinTTL = config.CacheMinTTL
+	proxy.cacheMaxTTL = config.CacheMaxTTL
+	if config.CacheOptimisticWindow < 0 {
+		return errors.New("cache_optimistic_window must be positive")
+	}
+	proxy.cacheOptimisticWindow = time.Duration(config.CacheOptimisticWindow) * time.Second
+	proxy.slowPluginThreshold = time.Duration(config.SlowPluginThreshold) * time.Millisecond
+
+	if len(config.QueryLog.Format) == 0 {
+		config.QueryLog.Format = "tsv"
+	} else {
+		config.QueryLog.Format = strings.ToLower(config.QueryLog.Format)
+	}
+	if config.QueryLog.Format != "tsv" && config.QueryLog.Format != "ltsv" {
+		return errors.New("Unsupported query log format")
+	}
+	proxy.queryLogFile = config.QueryLog.File
+	proxy.queryLogFormat = config.QueryLog.Format
+	proxy.queryLogIgnoredQtypes = config.QueryLog.IgnoredQtypes
+	proxy.queryLogIgnoredDomains = nil
+	for _, domain := range config.QueryLog.IgnoredDomains {
+		domain = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(domain)), "*.")
+		if domain = strings.Trim(domain, "."); len(domain) > 0 {
+			proxy.queryLogIgnoredDomains = append(proxy.queryLogIgnoredDomains, domain)
+		}
+	}
+	proxy.queryLogIgnoredClients = nil
+	for _, client := range config.QueryLog.IgnoredClients {
+		network, err := ParseIPOrCIDR(client)
+		if err != nil {
+			return fmt.Errorf("[query_log] ignored_clients: %v", err)
+		}
+		proxy.queryLogIgnoredClients = append(proxy.queryLogIgnoredClients, network)
+	}
+	switch config.QueryLog.AnonymizeClients {
+	case "", "truncate", "hash":
+		proxy.queryLogAnonymizeClients = config.QueryLog.AnonymizeClients
+	default:
+		return fmt.Errorf("Unsupported value for [query_log] anonymize_clients: [%s] -- Use truncate or hash", config.QueryLog.AnonymizeClients)
+	}
+	if config.QueryLog.Retention < 0 {
+		return errors.New("[query_log] retention must be positive")
+	}
+	proxy.queryLogRetention = time.Duration(config.QueryLog.Retention) * time.Hour
+	proxy.queryLogAggregateFile = config.QueryLog.AggregateFile
+	proxy.queryLogRemote = config.QueryLog.Remote
+
+	if len(config.NxLog.Format) == 0 {
+		config.NxLog.Format = "tsv"
+	} else {
+		config.NxLog.Format = strings.ToLower(config.NxLog.Format)
+	}
+	if config.NxLog.Format != "tsv" && config.NxLog.Format != "ltsv" {
+		return errors.New("Unsupported NX log format")
+	}
+	proxy.nxLogFile = config.NxLog.File
+	proxy.nxLogFormat = config.NxLog.Format
+
+	if len(config.BlockName.Format) == 0 {
+		config.BlockName.Format = "tsv"
+	} else {
+		config.BlockName.Format = strings.ToLower(config.BlockName.Format)
+	}
+	if config.BlockName.Format != "tsv" && config.BlockName.Format != "ltsv" {
+		return errors.New("Unsupported block log format")
+	}
+	proxy.blockNameFile = config.BlockName.File
+	proxy.blockNameFormat = config.BlockName.Format
+	proxy.blockNameLogFile = config.BlockName.LogFile
+	proxy.blockNameURLs = config.BlockName.URLs
+	proxy.blockNameMinisignKey = config.BlockName.MinisignKeyStr
+	proxy.blockNameCacheFile = config.BlockName.CacheFile
+	proxy.blockNameRefreshDelay = time.Duration(config.BlockName.RefreshDelay) * time.Hour
+	if len(config.BlockName.BlockedQueryResponse) > 0 {
+		if proxy.blockNameResponse, err = ParseBlockedResponse(config.BlockName.BlockedQueryResponse); err != nil {
+			return err
+		}
+	}
+
+	if len(config.WhitelistName.Format) == 0 {
+		config.WhitelistName.Format = "tsv"
+	} else {
+		config.WhitelistName.Format = strings.ToLower(config.WhitelistName.Format)
+	}
+	if config.WhitelistName.Format != "tsv" && config.WhitelistName.Format != "ltsv" {
+		return errors.New("Unsupported whitelist log format")
+	}
+	proxy.whitelistNameFile = config.WhitelistName.File
+	proxy.whitelistNameFormat = config.WhitelistName.Format
+	proxy.whitelistNameLogFile = config.WhitelistName.LogFile
+
+	if len(config.BlockIP.Format) == 0 {
+		config.BlockIP.Format = "tsv"
+	} else {
+		config.BlockIP.Format = strings.ToLower(config.BlockIP.Format)
+	}
+	if config.BlockIP.Format != "tsv" && config.BlockIP.Format != "ltsv" {
+		return errors.New("Unsupported IP block log format")
+	}
+	proxy.blockIPFile = config.BlockIP.File
+	proxy.blockIPFormat = config.BlockIP.Format
+	proxy.blockIPLogFile = config.BlockIP.LogFile
+	if len(config.BlockIP.BlockedQueryResponse) > 0 {
+		if proxy.blockIPResponse, err = ParseBlockedResponse(config.BlockIP.BlockedQueryResponse); err != nil {
+			return err
+		}
+	}
+
+	proxy.forwardFile = config.ForwardFile
+	proxy.forwardSearchDomains = config.ForwardSearchDomains
+	proxy.searchDomainsResolvConf = config.SearchDomainsResolvConf
+	proxy.cloakFile = config.CloakFile
+	proxy.ttlRulesFile = config.TTLRulesFile
+	proxy.scriptFile = config.ScriptFile
+	if len(config.PolicyHook.Command) > 0 && proxy.sandbox && sandboxForbidsExec {
+		return errors.New("The policy helper can't be started with sandbox = true -- Use [policy_hook] url instead")
+	}
+	proxy.policyHook = config.PolicyHook
+	proxy.dnssecValidation = config.DNSSECValidation
+	proxy.dnssecTrustAnchorsFile = config.DNSSECTrustAnchorsFile
+	proxy.localZones = config.LocalZones
+	proxy.captivePortalFile = config.CaptivePortals.MapFile
+	proxy.captivePortalResolver = config.CaptivePortals.Resolver
+	if len(proxy.captivePortalResolver) == 0 {
+		if len(config.BootstrapResolvers) > 0 {
+			proxy.captivePortalResolver = config.BootstrapResolvers[0]
+		} else {
+			proxy.captivePortalResolver = config.FallbackResolver
+		}
+	}
+	proxy.clientGroupsConfig = config.ClientGroups
+	proxy.clientHintsFile = config.ClientHintsFile
+	proxy.clientIdentification = config.ClientIdentification
+	proxy.safeSearch = config.SafeSearch
+
+	allWeeklyRanges, err := ParseAllWeeklyRanges(config.AllWeeklyRanges)
+	if err != nil {
+		return err
+	}
+	proxy.allWeeklyRanges = allWeeklyRanges
+	return nil
+}
+
+func (config *Config) loadListeners(proxy *Proxy) error {
+	proxy.listeners = nil
+	for _, listenAddrStr := range config.ListenAddresses {
+		proxy.listeners = append(proxy.listeners, Listener{address: listenAddrStr, udp: true, tcp: true, ipv6Only: config.ListenIPv6Only})
+	}
+	for name, listenerConfig := range config.Listeners {
+		listener := Listener{address: listenerConfig.Address, clientGroup: listenerConfig.ClientGroup, ipv6Only: config.ListenIPv6Only}
+		if listenerConfig.IPv6Only != nil {
+			listener.ipv6Only = *listenerConfig.IPv6Only
+		}
+		switch strings.ToLower(listenerConfig.Proto) {
+		case "", "both":
+			listener.udp, listener.tcp = true, true
+		case "udp":
+			listener.udp = true
+		case "tcp":
+			listener.tcp = true
+		default:
+			return fmt.Errorf("Listener [%s]: unsupported protocol [%s]", name, listenerConfig.Proto)
+		}
+		if len(listener.clientGroup) > 0 {
+			if _, ok := config.ClientGroups[listener.clientGroup]; !ok {
+				return fmt.Errorf("Listener [%s]: undefined client group [%s]", name, listener.clientGroup)
+			}
+		}
+		proxy.listeners = append(proxy.listeners, listener)
+	}
+	for _, listenAddrStr := range config.DNSCryptServer.ListenAddresses {
+		proxy.listeners = append(proxy.listeners, Listener{address: listenAddrStr, udp: true, tcp: true, dnscrypt: true, ipv6Only: config.ListenIPv6Only})
+	}
+	for _, listener := range proxy.listeners {
+		if _, err := net.ResolveUDPAddr("udp", listener.address); err != nil {
+			return fmt.Errorf("Invalid listen address [%s]: %v", listener.address, err)
+		}
+	}
+	return nil
+}
+
+func (config *Config) loadNetworkProfiles(proxy *Proxy) error {
+	profilesConfig := config.NetworkProfiles
+	if len(profilesConfig.Default) > 0 {
+		if _, ok := profilesConfig.Profiles[profilesConfig.Default]; !ok {
+			return fmt.Errorf("Default network profile [%s] is not defined", profilesConfig.Default)
+		}
+	}
+	for name, profileConfig := range profilesConfig.Profiles {
+		for _, mac := range profileConfig.GatewayMACs {
+			if _, err := net.ParseMAC(mac); err != nil {
+				return fmt.Errorf("Invalid gateway MAC address [%s] in network profile [%s]", mac, name)
+			}
+		}
+		// Servers of all the profiles must be available, so that profiles can be switched without a restart
+		if len(config.ServerNames) > 0 {
+			for _, serverName := range profileConfig.ServerNames {
+				if !includesName(config.ServerNames, serverName) {
+					config.ServerNames = append(config.ServerNames, serverName)
+				}
+			}
+		}
+	}
+	if profilesConfig.CheckInterval == 0 {
+		profilesConfig.CheckInterval = DefaultNetworkProfilesCheckInterval
+	}
+	proxy.networkProfiles = NewNetworkProfiles(profilesConfig)
+	proxy.networkProfiles.Update()
+	if active := proxy.networkProfiles.Active(); active != nil && len(active.listenAddresses) > 0 {
+		config.ListenAddresses = active.listenAddresses
+	}
+	return nil
+}
+
+func (config *Config) printRegisteredServers(proxy *Proxy, jsonOutput bool, tableOutput bool, measure bool) {
+	var latencies []*int
+	var errs []error
+	if measure {
+		latencies, errs = measureRegisteredServers(proxy)
+	}
+	// Error rates and latencies are only known by a running proxy
+	var serversHealth map[string]ServerHealth
+	if jsonOutput {
+		serversHealth = runningServersHealth(config.ControlSocket)
+	}
+	var summary []ServerSummary
+	for i, registeredServer := range proxy.registeredServers {
+		addrStr, port := registeredServer.stamp.ServerAddrStr, stamps.DefaultPort
+		port = ExtractPort(addrStr, port)
+		addrs := make([]string, 0)
+		if registeredServer.stamp.Proto == stamps.StampProtoTypeDoH && len(registeredServer.stamp.ProviderName) > 0 {
+			providerName := registeredServer.stamp.ProviderName
+			var host string
+			host, port = ExtractHostAndPort(providerName, port)
+			addrs = append(addrs, host)
+		}
+		if len(addrStr) > 0 {
+			addrs = append(addrs, ExtractHost(addrStr))
+		}
+		serverSummary := ServerSummary{
+			Name:        registeredServer.name,
+			Proto:       registeredServer.stamp.Proto.String(),
+			IPv6:        strings.HasPrefix(addrStr, "["),
+			Ports:       []int{port},
+			Addrs:       addrs,
+			DNSSEC:      registeredServer.stamp.Props&stamps.ServerInformalPropertyDNSSEC != 0,
+			NoLog:       registeredServer.stamp.Props&stamps.ServerInformalPropertyNoLog != 0,
+			NoFilter:    registeredServer.stamp.Props&stamps.ServerInformalPropertyNoFilter != 0,
+			Description: registeredServer.description,
+		}
+		serverSummary.Country, serverSummary.ASN, _ = proxy.serverLocations.locate(&registeredServer.stamp)
+		if measure {
+			serverSummary.Latency = latencies[i]
+			if errs[i] != nil {
+				serverSummary.Error = errs[i].Error()
+			}
+		}
+		if health, ok := serversHealth[serverSummary.Name]; ok {
+			serverSummary.Stats = &health
+		}
+		if jsonOutput || tableOutput {
+			summary = append(summary, serverSummary)
+		} else {
+			fmt.Println(serverSummary.Name)
+		}
+	}
+	if jsonOutput {
+		jsonStr, err := json.MarshalIndent(summary, "", " ")
+		if err != nil {
+			dlog.Fatal(err)
+		}
+		fmt.Print(string(jsonStr))
+	} else if tableOutput {
+		printServersTable(summary, measure)
+	}
+}
+
+func printServersTable(summary []ServerSummary, measure bool) {
+	yesNo := func(b bool) string {
+		if b {
+			return "yes"
+		}
+		return "no"
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	header := "NAME\tPROTO\tADDRESS\tDNSSEC\tNOLOG\tNOFILTER"
+	if measure {
+		header += "\tLATENCY"
+	}
+	fmt.Fprintln(w, header)
+	for _, serverSummary := range summary {
+		addr := "-"
+		if len(serverSummary.Addrs) > 0 {
+			addr = fmt.Sprintf("%s:%d", serverSummary.Addrs[0], serverSummary.Ports[0])
+			if serverSummary.IPv6 && !strings.HasPrefix(addr, "[") {
+				addr = fmt.Sprintf("[%s]:%d", serverSummary.Addrs[0], serverSummary.Ports[0])
+			}
+		}
+		line := fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%s", serverSummary.Name, serverSummary.Proto, addr,
+			yesNo(serverSummary.DNSSEC), yesNo(serverSummary.NoLog), yesNo(serverSummary.NoFilter))
+		if measure {
+			if serverSummary.Latency != nil {
+				line += fmt.Sprintf("\t%dms", *serverSummary.Latency)
+			} else {
+				line += "\tunreachable"
+			}
+		}
+		fmt.Fprintln(w, line)
+	}
+	w.Flush()
+}
+
+// measureRegisteredServers retrieves the certificate or a test response from every registered server, to measure its latency
+func measureRegisteredServers(proxy *Proxy) ([]*int, []error) {
+	const maxConcurrency = 16
+	latencies := make([]*int, len(proxy.registeredServers))
+	errs := make([]error, len(proxy.registeredServers))
+	semaphore := make(chan struct{}, maxConcurrency)
+	var wg sync.WaitGroup
+	for i, registeredServer := range proxy.registeredServers {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(i int, registeredServer RegisteredServer) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			serverInfo, err := proxy.serversInfo.fetchServerInfo(proxy, registeredServer.name, registeredServer.stamp, false)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			latency := serverInfo.initialRtt
+			latencies[i] = &latency
+		}(i, registeredServer)
+	}
+	wg.Wait()
+	return latencies, errs
+}
+
+func (config *Config) loadSources(proxy *Proxy) error {
+	var requiredProps stamps.ServerInformalProperties
+	if config.SourceRequireDNSSEC {
+		requiredProps |= stamps.ServerInformalPropertyDNSSEC
+	}
+	if config.SourceRequireNoLog {
+		requiredProps |= stamps.ServerInformalPropertyNoLog
+	}
+	if config.SourceRequireNoFilter && !config.SourceRequireFamilyFilter {
+		requiredProps |= stamps.ServerInformalPropertyNoFilter
+	}
+	for cfgSourceName, cfgSource := range config.SourcesConfig {
+		if err := config.loadSource(proxy, requiredProps, cfgSourceName, &cfgSource); err != nil {
+			return err
+		}
+	}
+	proxy.serverHeaders = make(map[string]map[string]string)
+	for serverName, staticConfig := range config.ServersConfig {
+		if !config.isWantedServerName(serverName) {
+			continue
+		}
+		stamp, err := staticConfig.serverStamp()
+		if err != nil {
+			return fmt.Errorf("Static server [%s]: %v", serverName, err)
+		}
+		if len(staticConfig.Headers) > 0 {
+			if stamp.Proto != stamps.StampProtoTypeDoH {
+				return fmt.Errorf("Static server [%s]: HTTP headers can only be set for DoH servers", serverName)
+			}
+			proxy.serverHeaders[serverName] = staticConfig.Headers
+		}
+		proxy.registeredServers = append(proxy.registeredServers, RegisteredServer{name: serverName, stamp: stamp})
+	}
+	return nil
+}
+
+func (config *Config) loadSource(proxy *Proxy, requiredProps stamps.ServerInformalProperties, cfgSourceName string, cfgSource *SourceConfig) error {
+	if len(cfgSource.URLs) == 0 {
+		if len(cfgSource.URL) == 0 {
+			dlog.Debugf("Missing URLs for source [%s]", cfgSourceName)
+		} else {
+			cfgSource.URLs = []string{cfgSource.URL}
+		}
+	}
+	minisignKeyStrs := cfgSource.MinisignKeyStrs
+	if cfgSource.MinisignKeyStr != "" {
+		minisignKeyStrs = append([]string{cfgSource.MinisignKeyStr}, minisignKeyStrs...)
+	}
+	if len(minisignKeyStrs) == 0 {
+		return fmt.Errorf("Missing Minisign key for source [%s]", cfgSourceName)
+	}
+	if cfgSource.CacheFile == "" {
+		return fmt.Errorf("Missing cache file for source [%s]", cfgSourceName)
+	}
+	if len(config.SourcesCacheDir) > 0 && !filepath.IsAbs(cfgSource.CacheFile) {
+		if err := os.MkdirAll(config.SourcesCacheDir, 0755); err != nil {
+			return fmt.Errorf("Unable to create the sources cache directory [%s]: %v", config.SourcesCacheDir, err)
+		}
+		cfgSource.CacheFile = filepath.Join(config.SourcesCacheDir, cfgSource.CacheFile)
+	}
+	if cfgSource.FormatStr == "" {
+		cfgSource.FormatStr = "v2"
+	}
+	if cfgSource.RefreshDelay <= 0 {
+		cfgSource.RefreshDelay = 72
+	}
+	refreshDelay := time.Duration(cfgSource.RefreshDelay) * time.Hour
+	refreshJitter := refreshDelay / 10
+	if cfgSource.RefreshJitter != nil {
+		refreshJitter = time.Duration(*cfgSource.RefreshJitter) * time.Minute
+	}
+	if cfgSource.forceRefresh {
+		refreshDelay = 0
+	}
+	maxStaleness := time.Duration(cfgSource.MaxStaleness) * time.Hour
+	source, sourceUrlsToPrefetch, err := NewSource(proxy.xTransport, proxy.storage, cfgSource.URLs, minisignKeyStrs, cfgSource.CacheFile, cfgSource.FormatStr, refreshDelay, refreshJitter, maxStaleness)
+	proxy.urlsToPrefetch = append(proxy.urlsToPrefetch, sourceUrlsToPrefetch...)
+	if err != nil {
+		config.sourceFailed(cfgSourceName, err)
+		return nil
+	}
+	registeredServers, err := source.Parse(cfgSource.Prefix)
+	if err != nil {
+		config.sourceFailed(cfgSourceName, err)
+		return nil
+	}
+	for _, registeredServer := range registeredServers {
+		if !config.isWantedServerName(registeredServer.name) {
+			continue
+		}
+		if !config.isExplicitServerName(registeredServer.name) {
+			if registeredServer.stamp.Props&requiredProps != requiredProps {
+				continue
+			}
+			if config.SourceRequireFamilyFilter && !isFamilyFilter(&registeredServer) {
+				continue
+			}
+			if !proxy.serverLocations.allowed(&registeredServer) {
+				continue
+			}
+		}
+		if config.SourceIPv4 || config.SourceIPv6 {
+			isIPv4, isIPv6 := true, false
+			if registeredServer.stamp.Proto == stamps.StampProtoTypeDoH {
+				isIPv4, isIPv6 = true, true
+			}
+			if strings.HasPrefix(registeredServer.stamp.ServerAddrStr, "[") {
+				isIPv4, isIPv6 = false, true
+			}
+			if !(config.SourceIPv4 == isIPv4 || config.SourceIPv6 == isIPv6) {
+				continue
+			}
+		}
+		if !((config.SourceDNSCrypt && registeredServer.stamp.Proto == stamps.StampProtoTypeDNSCrypt) ||
+			(config.SourceDoH && registeredServer.stamp.Proto == stamps.StampProtoTypeDoH)) {
+			continue
+		}
+		dlog.Debugf("Adding [%s] to the set of wanted resolvers", registeredServer.name)
+		proxy.registeredServers = append(proxy.registeredServers, registeredServer)
+	}
+	return nil
+}
+
+// sourceFailed reports a source that can't be used; the proxy can still start with the other ones
+func (config *Config) sourceFailed(cfgSourceName string, err error) {
+	dlog.Criticalf("Unable to use source [%s]: [%s]", cfgSourceName, err)
+	if config.sourceErrors == nil {
+		config.sourceErrors = make(map[string]error)
+	}
+	config.sourceErrors[cfgSourceName] = err
+}
+
+// isFamilyFilter tells whether a server filters content, and is described as a family-friendly resolver
+func isFamilyFilter(registeredServer *RegisteredServer) bool {
+	if registeredServer.stamp.Props&stamps.ServerInformalPropertyNoFilter != 0 {
+		return false
+	}
+	return strings.Contains(strings.ToLower(registeredServer.name), "family") ||
+		strings.Contains(strings.ToLower(registeredServer.description), "family")
+}
+
+// isWantedServerName tells whether a server name matches `server_names` (if set) and doesn't match `disabled_server_names`
+func (config *Config) isWantedServerName(name string) bool {
+	if len(config.ServerNames) > 0 && !matchesName(config.ServerNames, name) {
+		return false
+	}
+	return !matchesName(config.DisabledServerNames, name)
+}
+
+// isExplicitServerName tells whether a server is listed by name in server_names, not only matched by a
+// glob pattern. Servers picked explicitly don't have to match the require_* and location filters.
+func (config *Config) isExplicitServerName(name string) bool {
+	for _, serverName := range config.ServerNames {
+		if !strings.ContainsAny(serverName, "*?[") && strings.EqualFold(serverName, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesName tells whether a name matches one of the given names, that can include glob patterns
+func matchesName(patterns []string, name string) bool {
+	name = strings.ToLower(name)
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(strings.ToLower(pattern), name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func includesName(names []string, name string) bool {
+	for _, found := range names {
+		if strings.EqualFold(found, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func cdFileDir(fileName string) {
+	os.Chdir(filepath.Dir(fileName))
+}
+
+func cdLocal() {
+	exeFileName, err := os.Executable()
+	if err != nil {
+		dlog.Warnf("Unable to determine the executable directory: [%s] -- You will need to specify absolute paths in the configuration file", err)
+		return
+	}
+	os.Chdir(filepath.Dir(exeFileName))
+}
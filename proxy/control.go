@@ -0,0 +1,372 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const ControlTimeout = time.Duration(30) * time.Second
+
+// ControlRequest is a command sent to the control socket, as a single line of JSON
+type ControlRequest struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+}
+
+// ControlResponse is the answer to a ControlRequest, also sent as a single line of JSON
+type ControlResponse struct {
+	OK     bool        `json:"ok"`
+	Error  string      `json:"error,omitempty"`
+	Result interface{} `json:"result,omitempty"`
+}
+
+// startControlSocket accepts commands on a Unix socket, or on a named pipe on Windows, so that
+// a running proxy can be inspected and controlled by scripts and graphical frontends
+func (proxy *Proxy) startControlSocket() error {
+	listener, err := listenControlSocket(proxy.controlSocket)
+	if err != nil {
+		return err
+	}
+	proxy.trackListener(listener)
+	dlog.Noticef("Control socket available at [%s]", proxy.controlSocket)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if atomic.LoadInt32(&proxy.stopping) == 0 {
+					dlog.Errorf("Control socket: %v", err)
+				}
+				return
+			}
+			go proxy.handleControlConnection(conn)
+		}
+	}()
+	return nil
+}
+
+func (proxy *Proxy) handleControlConnection(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(ControlTimeout))
+	scanner := bufio.NewScanner(conn)
+	encoder := json.NewEncoder(conn)
+	for scanner.Scan() {
+		var request ControlRequest
+		var response ControlResponse
+		if err := json.Unmarshal(scanner.Bytes(), &request); err != nil {
+			response.Error = fmt.Sprintf("Invalid request: %v", err)
+		} else if request.Command == "tail" {
+			proxy.controlTail(conn, encoder, request.Args)
+			return
+		} else if result, err := proxy.controlCommand(request); err != nil {
+			response.Error = err.Error()
+		} else {
+			response.OK, response.Result = true, result
+		}
+		if err := encoder.Encode(response); err != nil {
+			return
+		}
+	}
+}
+
+func (proxy *Proxy) controlCommand(request ControlRequest) (interface{}, error) {
+	switch request.Command {
+	case "stats":
+		return proxy.stats.Snapshot(proxy), nil
+	case "servers":
+		return proxy.serversInfo.health(), nil
+	case "top":
+		return proxy.controlTop(request.Args)
+	case "cache":
+		return proxy.controlCache(request.Args)
+	case "reload":
+		dlog.Notice("Reload requested through the control socket")
+		if err := proxy.Reload(); err != nil {
+			return nil, fmt.Errorf("Configuration not reloaded: %v", err)
+		}
+		dlog.Notice("Configuration reloaded")
+		return nil, nil
+	case "offline":
+		if len(request.Args) > 1 {
+			return nil, errors.New("Usage: offline [on|off|auto]")
+		}
+		if len(request.Args) == 1 {
+			mode, err := parseOfflineMode(request.Args[0])
+			if err != nil {
+				return nil, err
+			}
+			if err := proxy.setOfflineMode(mode); err != nil {
+				return nil, err
+			}
+		}
+		return map[string]interface{}{
+			"mode":    offlineModeNames[atomic.LoadInt32(&proxy.offlineMode)],
+			"offline": proxy.isOffline(),
+		}, nil
+	case "filtering":
+		if len(request.Args) > 1 || (len(request.Args) == 1 && request.Args[0] != "on" && request.Args[0] != "off") {
+			return nil, errors.New("Usage: filtering [on|off]")
+		}
+		if len(request.Args) == 1 {
+			if request.Args[0] == "off" {
+				atomic.StoreInt32(&proxy.filteringDisabled, 1)
+				dlog.Notice("Filtering disabled through the control socket")
+			} else {
+				atomic.StoreInt32(&proxy.filteringDisabled, 0)
+				dlog.Notice("Filtering enabled through the control socket")
+			}
+		}
+		return map[string]bool{"filtering": atomic.LoadInt32(&proxy.filteringDisabled) == 0}, nil
+	case "profile":
+		if proxy.networkProfiles == nil {
+			return nil, errors.New("No network profiles are configured")
+		}
+		if len(request.Args) > 1 {
+			return nil, errors.New("Usage: profile [<name>|auto]")
+		}
+		if len(request.Args) == 1 {
+			name := request.Args[0]
+			if name == "auto" {
+				name = ""
+			}
+			if err := proxy.networkProfiles.Pin(name); err != nil {
+				return nil, err
+			}
+		}
+		active, pinned, profiles := proxy.networkProfiles.Status()
+		return map[string]interface{}{
+			"active":   active,
+			"pinned":   pinned,
+			"profiles": profiles,
+		}, nil
+	case "set-loglevel":
+		if len(request.Args) != 1 {
+			return nil, errors.New("Usage: set-loglevel <level>")
+		}
+		level, err := strconv.Atoi(request.Args[0])
+		if err != nil || level < 0 || level >= int(dlog.SeverityLast) {
+			return nil, fmt.Errorf("Invalid log level [%s] -- Use a value between 0 and %d", request.Args[0], int(dlog.SeverityLast)-1)
+		}
+		dlog.SetLogLevel(dlog.Severity(level))
+		dlog.Noticef("Log level set to %d", level)
+		return nil, nil
+	}
+	return nil, fmt.Errorf("Unknown command [%s] -- Supported commands: stats, servers, top, tail, cache, reload, offline, filtering, profile, set-loglevel", request.Command)
+}
+
+// controlTail streams the queries being processed, until the client disconnects
+func (proxy *Proxy) controlTail(conn net.Conn, encoder *json.Encoder, args []string) {
+	if len(args) > 1 {
+		encoder.Encode(ControlResponse{Error: "Usage: tail [name]"})
+		return
+	}
+	filter := ""
+	if len(args) == 1 {
+		filter = args[0]
+	}
+	conn.SetDeadline(time.Time{})
+	events := proxy.queryTail.subscribe(filter)
+	defer proxy.queryTail.unsubscribe(events)
+	// The client doesn't send anything else: reading only returns once it is gone
+	disconnected := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		close(disconnected)
+	}()
+	for {
+		select {
+		case event := <-events:
+			if err := encoder.Encode(ControlResponse{OK: true, Result: event}); err != nil {
+				return
+			}
+		case <-disconnected:
+			return
+		}
+	}
+}
+
+// controlCache handles "cache flush", "cache export <file>" and "cache import <file>"
+func (proxy *Proxy) controlCache(args []string) (interface{}, error) {
+	usage := errors.New("Usage: cache flush | cache export <file> | cache import <file>")
+	if len(args) == 1 && args[0] == "flush" {
+		flushed := cachedResponses.purge()
+		dlog.Noticef("Cache flushed (%d entries)", flushed)
+		return map[string]int{"flushed": flushed}, nil
+	}
+	if len(args) != 2 {
+		return nil, usage
+	}
+	switch args[0] {
+	case "export":
+		exported, err := cachedResponses.export(proxy.storage, args[1])
+		if err != nil {
+			return nil, err
+		}
+		dlog.Noticef("Cache exported to [%s] (%d entries)", args[1], exported)
+		return map[string]int{"exported": exported}, nil
+	case "import":
+		if !proxy.pluginsSettings().cache {
+			return nil, errors.New("The cache is disabled")
+		}
+		imported, err := cachedResponses.load(proxy, args[1])
+		if err != nil {
+			return nil, err
+		}
+		dlog.Noticef("Cache imported from [%s] (%d entries)", args[1], imported)
+		return map[string]int{"imported": imported}, nil
+	}
+	return nil, usage
+}
+
+// controlTop handles "top [queried|blocked] [window] [count]"
+func (proxy *Proxy) controlTop(args []string) (interface{}, error) {
+	usage := errors.New("Usage: top [queried|blocked] [window] [count]")
+	blocked, window, count := false, time.Hour, StatsTopNames
+	if len(args) > 0 {
+		switch args[0] {
+		case "queried":
+		case "blocked":
+			blocked = true
+		default:
+			return nil, usage
+		}
+	}
+	if len(args) > 1 {
+		var err error
+		if window, err = ParseTopNamesWindow(args[1]); err != nil {
+			return nil, err
+		}
+	}
+	if len(args) > 2 {
+		var err error
+		if count, err = strconv.Atoi(args[2]); err != nil || count <= 0 {
+			return nil, usage
+		}
+	}
+	if len(args) > 3 {
+		return nil, usage
+	}
+	return proxy.stats.TopNames(blocked, window, count), nil
+}
+
+// Control sends a command to a running proxy, and prints the result
+func Control(controlSocket string, command string, args []string) error {
+	if len(controlSocket) == 0 {
+		return errors.New("[control_socket] is not set in the configuration file")
+	}
+	conn, err := dialControlSocket(controlSocket, ControlTimeout)
+	if err != nil {
+		return fmt.Errorf("Unable to connect to the control socket -- Is dnscrypt-proxy running? (%v)", err)
+	}
+	defer conn.Close()
+	if strings.EqualFold(command, "tail") {
+		if err := json.NewEncoder(conn).Encode(ControlRequest{Command: "tail", Args: args}); err != nil {
+			return err
+		}
+		return controlTailClient(conn)
+	}
+	rawResult, err := controlExchange(conn, command, args)
+	if err != nil {
+		return err
+	}
+	if len(rawResult) == 0 {
+		fmt.Println("OK")
+		return nil
+	}
+	var result interface{}
+	if err := json.Unmarshal(rawResult, &result); err != nil {
+		return err
+	}
+	output, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(output))
+	return nil
+}
+
+// controlExchange sends a command over a connection to the control socket, and returns its result
+func controlExchange(conn net.Conn, command string, args []string) (json.RawMessage, error) {
+	conn.SetDeadline(time.Now().Add(ControlTimeout))
+	if err := json.NewEncoder(conn).Encode(ControlRequest{Command: strings.ToLower(command), Args: args}); err != nil {
+		return nil, err
+	}
+	var response struct {
+		OK     bool            `json:"ok"`
+		Error  string          `json:"error"`
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		return nil, err
+	}
+	if !response.OK {
+		return nil, errors.New(response.Error)
+	}
+	return response.Result, nil
+}
+
+// runningServersHealth returns the state of the servers used by a running proxy, by name, or
+// nil if the proxy is not running
+func runningServersHealth(controlSocket string) map[string]ServerHealth {
+	if len(controlSocket) == 0 {
+		return nil
+	}
+	conn, err := dialControlSocket(controlSocket, ControlTimeout)
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	rawResult, err := controlExchange(conn, "servers", nil)
+	if err != nil {
+		return nil
+	}
+	var servers []ServerHealth
+	if err := json.Unmarshal(rawResult, &servers); err != nil {
+		return nil
+	}
+	health := make(map[string]ServerHealth, len(servers))
+	for _, server := range servers {
+		health[server.Name] = server
+	}
+	return health
+}
+
+func controlTailClient(conn net.Conn) error {
+	decoder := json.NewDecoder(conn)
+	for {
+		var response struct {
+			OK     bool      `json:"ok"`
+			Error  string    `json:"error"`
+			Result TailEvent `json:"result"`
+		}
+		if err := decoder.Decode(&response); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if !response.OK {
+			return errors.New(response.Error)
+		}
+		event := response.Result
+		server, rcode := event.Server, event.Rcode
+		if len(server) == 0 {
+			server = "-"
+		}
+		if len(rcode) == 0 {
+			rcode = "-"
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\t%s\t%s\t%s\t%dms\n", event.Time.Local().Format("2006-01-02 15:04:05"),
+			event.Client, StringQuote(event.Name), event.Type, event.Action, server, rcode, event.Duration)
+	}
+}
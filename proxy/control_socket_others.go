@@ -0,0 +1,40 @@
+// +build !windows
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+func listenControlSocket(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("[%s] already exists and is not a socket", path)
+		}
+		// Left behind by a previous instance that didn't exit cleanly
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("[%s] is already used by another process", path)
+		}
+		os.Remove(path)
+	}
+	// Anyone who can connect can reload the configuration. The socket is created with the right
+	// permissions, as changing them afterwards would leave a window during which anyone could
+	// connect. The umask is global, but files created by other goroutines in the meantime can
+	// only end up with stricter permissions.
+	oldUmask := syscall.Umask(0177)
+	listener, err := net.Listen("unix", path)
+	syscall.Umask(oldUmask)
+	if err != nil {
+		return nil, err
+	}
+	return listener, nil
+}
+
+func dialControlSocket(path string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("unix", path, timeout)
+}
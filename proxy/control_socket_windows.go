@@ -0,0 +1,331 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// The control socket is a named pipe on Windows. Only elevated administrators and the system
+// account can connect to it.
+const controlPipeSDDL = "D:P(A;;GA;;;BA)(A;;GA;;;SY)"
+
+const (
+	pipeAccessDuplex          = 0x3
+	fileFlagFirstPipeInstance = 0x80000
+	pipeRejectRemoteClients   = 0x8
+	pipeUnlimitedInstances    = 255
+	pipeBufferSize            = 65536
+
+	errorIOPending        = syscall.Errno(997)
+	errorOperationAborted = syscall.Errno(995)
+	errorPipeBusy         = syscall.Errno(231)
+	errorPipeConnected    = syscall.Errno(535)
+	errorNoData           = syscall.Errno(232)
+	waitTimeout           = 258
+	infinite              = 0xffffffff
+	sddlRevision1         = 1
+	pipeBusyRetryDelay    = 100 * time.Millisecond
+)
+
+var (
+	modKernel32                                              = windows.NewLazySystemDLL("kernel32.dll")
+	modAdvapi32                                              = windows.NewLazySystemDLL("advapi32.dll")
+	procCreateNamedPipeW                                     = modKernel32.NewProc("CreateNamedPipeW")
+	procConnectNamedPipe                                     = modKernel32.NewProc("ConnectNamedPipe")
+	procDisconnectNamedPipe                                  = modKernel32.NewProc("DisconnectNamedPipe")
+	procGetOverlappedResult                                  = modKernel32.NewProc("GetOverlappedResult")
+	procConvertStringSecurityDescriptorToSecurityDescriptorW = modAdvapi32.NewProc("ConvertStringSecurityDescriptorToSecurityDescriptorW")
+)
+
+var errPipeClosed = errors.New("The pipe has been closed")
+
+type pipeTimeoutError struct{}
+
+func (pipeTimeoutError) Error() string   { return "i/o timeout" }
+func (pipeTimeoutError) Timeout() bool   { return true }
+func (pipeTimeoutError) Temporary() bool { return true }
+
+type pipeAddr string
+
+func (addr pipeAddr) Network() string { return "pipe" }
+func (addr pipeAddr) String() string  { return string(addr) }
+
+// pipeListener creates a new instance of the pipe for every client, the next one being
+// created before the previous client is handed over
+type pipeListener struct {
+	sync.Mutex
+	path               string
+	securityAttributes windows.SecurityAttributes
+	next               windows.Handle
+	closed             bool
+}
+
+func listenControlSocket(path string) (net.Listener, error) {
+	listener := pipeListener{path: path}
+	var securityDescriptor uintptr
+	sddl, err := windows.UTF16PtrFromString(controlPipeSDDL)
+	if err != nil {
+		return nil, err
+	}
+	if ret, _, err := procConvertStringSecurityDescriptorToSecurityDescriptorW.Call(uintptr(unsafe.Pointer(sddl)), sddlRevision1, uintptr(unsafe.Pointer(&securityDescriptor)), 0); ret == 0 {
+		return nil, err
+	}
+	listener.securityAttributes.Length = uint32(unsafe.Sizeof(listener.securityAttributes))
+	listener.securityAttributes.SecurityDescriptor = securityDescriptor
+	next, err := listener.createInstance(true)
+	if err != nil {
+		windows.LocalFree(windows.Handle(securityDescriptor))
+		if err == windows.ERROR_ACCESS_DENIED {
+			return nil, fmt.Errorf("[%s] is already used by another process", path)
+		}
+		return nil, err
+	}
+	listener.next = next
+	return &listener, nil
+}
+
+func (listener *pipeListener) createInstance(first bool) (windows.Handle, error) {
+	path, err := windows.UTF16PtrFromString(listener.path)
+	if err != nil {
+		return windows.InvalidHandle, err
+	}
+	openMode := uint32(pipeAccessDuplex | windows.FILE_FLAG_OVERLAPPED)
+	if first {
+		openMode |= fileFlagFirstPipeInstance
+	}
+	handle, _, err := procCreateNamedPipeW.Call(uintptr(unsafe.Pointer(path)), uintptr(openMode), pipeRejectRemoteClients, pipeUnlimitedInstances, pipeBufferSize, pipeBufferSize, 0, uintptr(unsafe.Pointer(&listener.securityAttributes)))
+	if windows.Handle(handle) == windows.InvalidHandle {
+		return windows.InvalidHandle, err
+	}
+	return windows.Handle(handle), nil
+}
+
+func (listener *pipeListener) Accept() (net.Conn, error) {
+	listener.Lock()
+	handle := listener.next
+	listener.Unlock()
+	// Started with the lock held, so that Close() can't miss it
+	_, err := overlappedIO(handle, time.Time{}, func(overlapped *windows.Overlapped) error {
+		listener.Lock()
+		defer listener.Unlock()
+		if listener.closed {
+			return errPipeClosed
+		}
+		if ret, _, err := procConnectNamedPipe.Call(uintptr(handle), uintptr(unsafe.Pointer(overlapped))); ret == 0 {
+			return err
+		}
+		return nil
+	})
+	if err == errorPipeConnected {
+		err = nil
+	}
+	listener.Lock()
+	defer listener.Unlock()
+	if listener.closed {
+		return nil, errPipeClosed
+	}
+	if err != nil {
+		return nil, err
+	}
+	if listener.next, err = listener.createInstance(false); err != nil {
+		listener.next = windows.InvalidHandle
+		listener.closed = true
+		windows.CloseHandle(handle)
+		return nil, err
+	}
+	return newPipeConn(handle, listener.path, true), nil
+}
+
+func (listener *pipeListener) Close() error {
+	listener.Lock()
+	defer listener.Unlock()
+	if listener.closed {
+		return nil
+	}
+	listener.closed = true
+	if listener.next != windows.InvalidHandle {
+		windows.CancelIoEx(listener.next, nil)
+		windows.CloseHandle(listener.next)
+	}
+	windows.LocalFree(windows.Handle(listener.securityAttributes.SecurityDescriptor))
+	return nil
+}
+
+func (listener *pipeListener) Addr() net.Addr {
+	return pipeAddr(listener.path)
+}
+
+func dialControlSocket(path string, timeout time.Duration) (net.Conn, error) {
+	name, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		handle, err := windows.CreateFile(name, windows.GENERIC_READ|windows.GENERIC_WRITE, 0, nil, windows.OPEN_EXISTING, windows.FILE_FLAG_OVERLAPPED, 0)
+		if err == nil {
+			return newPipeConn(handle, path, false), nil
+		}
+		// All the instances are busy until the proxy creates a new one
+		if err != errorPipeBusy || time.Now().After(deadline) {
+			return nil, err
+		}
+		time.Sleep(pipeBusyRetryDelay)
+	}
+}
+
+type pipeConn struct {
+	handle        windows.Handle
+	path          string
+	server        bool
+	readLock      sync.Mutex
+	writeLock     sync.Mutex
+	deadlinesLock sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+	closeLock     sync.Mutex
+	closed        bool
+}
+
+func newPipeConn(handle windows.Handle, path string, server bool) *pipeConn {
+	return &pipeConn{handle: handle, path: path, server: server}
+}
+
+// overlappedIO starts an asynchronous operation, and waits for its completion until the
+// deadline. The operation is cancelled if the handle is closed.
+func overlappedIO(handle windows.Handle, deadline time.Time, start func(*windows.Overlapped) error) (uint32, error) {
+	event, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer windows.CloseHandle(event)
+	overlapped := windows.Overlapped{HEvent: event}
+	if err := start(&overlapped); err != nil && err != errorIOPending {
+		return 0, err
+	}
+	wait := uint32(infinite)
+	if !deadline.IsZero() {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			remaining = 0
+		}
+		wait = uint32(remaining / time.Millisecond)
+	}
+	timedOut := false
+	if ret, err := windows.WaitForSingleObject(event, wait); err != nil {
+		return 0, err
+	} else if ret == waitTimeout {
+		timedOut = true
+		windows.CancelIoEx(handle, &overlapped)
+	}
+	var transferred uint32
+	if ret, _, err := procGetOverlappedResult.Call(uintptr(handle), uintptr(unsafe.Pointer(&overlapped)), uintptr(unsafe.Pointer(&transferred)), 1); ret == 0 {
+		if err == errorOperationAborted {
+			if timedOut {
+				return transferred, pipeTimeoutError{}
+			}
+			return transferred, errPipeClosed
+		}
+		return transferred, err
+	}
+	return transferred, nil
+}
+
+func (conn *pipeConn) Read(b []byte) (int, error) {
+	conn.readLock.Lock()
+	defer conn.readLock.Unlock()
+	conn.deadlinesLock.Lock()
+	deadline := conn.readDeadline
+	conn.deadlinesLock.Unlock()
+	n, err := overlappedIO(conn.handle, deadline, func(overlapped *windows.Overlapped) error {
+		return conn.start(func() error {
+			return windows.ReadFile(conn.handle, b, nil, overlapped)
+		})
+	})
+	if err == windows.ERROR_BROKEN_PIPE || err == errorNoData {
+		return int(n), io.EOF
+	}
+	return int(n), err
+}
+
+func (conn *pipeConn) Write(b []byte) (int, error) {
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
+	conn.deadlinesLock.Lock()
+	deadline := conn.writeDeadline
+	conn.deadlinesLock.Unlock()
+	n, err := overlappedIO(conn.handle, deadline, func(overlapped *windows.Overlapped) error {
+		return conn.start(func() error {
+			return windows.WriteFile(conn.handle, b, nil, overlapped)
+		})
+	})
+	return int(n), err
+}
+
+// start issues an operation unless the connection has been closed; Close() cancels the
+// operations that have already been issued
+func (conn *pipeConn) start(operation func() error) error {
+	conn.closeLock.Lock()
+	defer conn.closeLock.Unlock()
+	if conn.closed {
+		return errPipeClosed
+	}
+	return operation()
+}
+
+func (conn *pipeConn) Close() error {
+	conn.closeLock.Lock()
+	if conn.closed {
+		conn.closeLock.Unlock()
+		return nil
+	}
+	conn.closed = true
+	windows.CancelIoEx(conn.handle, nil)
+	conn.closeLock.Unlock()
+	// Pending reads and writes have to complete before the handle is released
+	conn.readLock.Lock()
+	conn.writeLock.Lock()
+	defer conn.readLock.Unlock()
+	defer conn.writeLock.Unlock()
+	if conn.server {
+		procDisconnectNamedPipe.Call(uintptr(conn.handle))
+	}
+	return windows.CloseHandle(conn.handle)
+}
+
+func (conn *pipeConn) LocalAddr() net.Addr {
+	return pipeAddr(conn.path)
+}
+
+func (conn *pipeConn) RemoteAddr() net.Addr {
+	return pipeAddr(conn.path)
+}
+
+func (conn *pipeConn) SetDeadline(t time.Time) error {
+	conn.deadlinesLock.Lock()
+	conn.readDeadline, conn.writeDeadline = t, t
+	conn.deadlinesLock.Unlock()
+	return nil
+}
+
+func (conn *pipeConn) SetReadDeadline(t time.Time) error {
+	conn.deadlinesLock.Lock()
+	conn.readDeadline = t
+	conn.deadlinesLock.Unlock()
+	return nil
+}
+
+func (conn *pipeConn) SetWriteDeadline(t time.Time) error {
+	conn.deadlinesLock.Lock()
+	conn.writeDeadline = t
+	conn.deadlinesLock.Unlock()
+	return nil
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	// Number of log lines included in a crash report
+	CrashReportLogLines = 100
+	// Largest stack dump of all the goroutines included in a crash report
+	CrashReportMaxStacksSize = 4 * 1024 * 1024
+)
+
+// ReportPanic has to be deferred at the top of goroutines. If the goroutine panics, the stack
+// trace is logged, a crash report is written to the file set with crash_report_file, and the
+// process exits. The report includes the version, the platform, the stack of every goroutine
+// and the last lines of the log file, so that users can attach it to bug reports.
+func (proxy *Proxy) ReportPanic() {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+	stack := debug.Stack()
+	dlog.Criticalf("Panic: %v\n%s", recovered, stack)
+	if len(proxy.crashReportFile) > 0 {
+		if err := proxy.writeCrashReport(recovered, stack); err != nil {
+			dlog.Criticalf("Unable to write the crash report: %v", err)
+		} else {
+			dlog.Criticalf("Crash report written to [%s] - Please attach it to bug reports", proxy.crashReportFile)
+		}
+	}
+	os.Exit(255)
+}
+
+func (proxy *Proxy) writeCrashReport(recovered interface{}, stack []byte) error {
+	var report bytes.Buffer
+	fmt.Fprintf(&report, "dnscrypt-proxy %s crashed at %s\n", AppVersion, time.Now().Format(time.RFC3339))
+	fmt.Fprintf(&report, "Go version: %s - Platform: %s/%s - CPUs: %d - Goroutines: %d\n", runtime.Version(), runtime.GOOS, runtime.GOARCH, runtime.NumCPU(), runtime.NumGoroutine())
+	fmt.Fprintf(&report, "\nPanic: %v\n\n%s\n", recovered, stack)
+	stacks := make([]byte, CrashReportMaxStacksSize)
+	stacks = stacks[:runtime.Stack(stacks, true)]
+	fmt.Fprintf(&report, "All goroutines:\n\n%s\n", stacks)
+	if len(proxy.logFile) > 0 {
+		lines, err := lastLines(proxy.logFile, CrashReportLogLines)
+		if err != nil {
+			fmt.Fprintf(&report, "Unable to read the log file: %v\n", err)
+		} else {
+			fmt.Fprintf(&report, "Last log lines:\n\n%s\n", strings.Join(lines, "\n"))
+		}
+	}
+	return AtomicFileWrite(proxy.crashReportFile, report.Bytes())
+}
+
+// lastLines returns up to the last count lines of a file, reading at most 64 KB
+func lastLines(file string, count int) ([]string, error) {
+	fp, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	fi, err := fp.Stat()
+	if err != nil {
+		return nil, err
+	}
+	offset := fi.Size() - 64*1024
+	if offset < 0 {
+		offset = 0
+	}
+	if _, err := fp.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var tail bytes.Buffer
+	if _, err := tail.ReadFrom(fp); err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimRight(tail.String(), "\n"), "\n")
+	if offset > 0 && len(lines) > 1 {
+		// The first line is likely to be incomplete
+		lines = lines[1:]
+	}
+	if len(lines) > count {
+		lines = lines[len(lines)-count:]
+	}
+	return lines, nil
+}
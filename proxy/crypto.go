@@ -1,10 +1,11 @@
-package main
+package proxy
 
 import (
 	"bytes"
 	"crypto/rand"
 	"crypto/sha512"
 	"errors"
+	"sync"
 
 	"github.com/jedisct1/dlog"
 	"github.com/jedisct1/xsecretbox"
@@ -57,10 +58,45 @@ func ComputeSharedKey(cryptoConstruction CryptoConstruction, secretKey *[32]byte
 	return
 }
 
+// Maximum number of shared keys kept by SharedKeyCache; servers rotate their keys, so that
+// keys that are not used any more are eventually dropped
+const SharedKeyCacheSize = 1024
+
+// SharedKeyCache keeps the shared keys computed for each pair of client and server keys, so
+// that fetching certificates again doesn't require new scalar multiplications as long as the
+// server keeps using the same key
+type SharedKeyCache struct {
+	sync.Mutex
+	keys map[sharedKeyCacheKey][32]byte
+}
+
+type sharedKeyCacheKey struct {
+	cryptoConstruction CryptoConstruction
+	clientPk           [32]byte
+	serverPk           [32]byte
+}
+
+func (proxy *Proxy) sharedKey(cryptoConstruction CryptoConstruction, serverPk *[32]byte, providerName *string) [32]byte {
+	cacheKey := sharedKeyCacheKey{cryptoConstruction: cryptoConstruction, clientPk: proxy.proxyPublicKey, serverPk: *serverPk}
+	cache := &proxy.sharedKeys
+	cache.Lock()
+	defer cache.Unlock()
+	if sharedKey, found := cache.keys[cacheKey]; found {
+		return sharedKey
+	}
+	if cache.keys == nil || len(cache.keys) >= SharedKeyCacheSize {
+		cache.keys = make(map[sharedKeyCacheKey][32]byte)
+	}
+	sharedKey := ComputeSharedKey(cryptoConstruction, &proxy.proxySecretKey, serverPk, providerName)
+	cache.keys[cacheKey] = sharedKey
+	return sharedKey
+}
+
 func (proxy *Proxy) Encrypt(serverInfo *ServerInfo, packet []byte, proto string) (sharedKey *[32]byte, encrypted []byte, clientNonce []byte, err error) {
-	nonce, clientNonce := make([]byte, NonceSize), make([]byte, HalfNonceSize)
+	var nonce [NonceSize]byte
+	clientNonce = make([]byte, HalfNonceSize)
 	rand.Read(clientNonce)
-	copy(nonce, clientNonce)
+	copy(nonce[:], clientNonce)
 	var publicKey *[PublicKeySize]byte
 	if proxy.ephemeralKeys {
 		h := sha512.New512_256()
@@ -90,15 +126,16 @@ func (proxy *Proxy) Encrypt(serverInfo *ServerInfo, packet []byte, proto string)
 		err = errors.New("Question too large; cannot be padded")
 		return
 	}
-	encrypted = append(serverInfo.MagicQuery[:], publicKey[:]...)
+	// Allocate the whole packet at once, so that sealing doesn't need to grow it
+	encrypted = make([]byte, 0, paddedLength)
+	encrypted = append(encrypted, serverInfo.MagicQuery[:]...)
+	encrypted = append(encrypted, publicKey[:]...)
 	encrypted = append(encrypted, nonce[:HalfNonceSize]...)
 	padded := pad(packet, paddedLength-QueryOverhead)
 	if serverInfo.CryptoConstruction == XChacha20Poly1305 {
-		encrypted = xsecretbox.Seal(encrypted, nonce, padded, sharedKey[:])
+		encrypted = xsecretbox.Seal(encrypted, nonce[:], padded, sharedKey[:])
 	} else {
-		var xsalsaNonce [24]byte
-		copy(xsalsaNonce[:], nonce)
-		encrypted = secretbox.Seal(encrypted, padded, &xsalsaNonce, sharedKey)
+		encrypted = secretbox.Seal(encrypted, padded, &nonce, sharedKey)
 	}
 	return
 }
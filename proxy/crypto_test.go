@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// BenchmarkSharedKey compares computing a shared key with finding it in the shared key cache,
+// as when the certificate of a server is fetched again
+func BenchmarkSharedKey(b *testing.B) {
+	proxy := &Proxy{}
+	var serverSk, serverPk [32]byte
+	if _, err := rand.Read(proxy.proxySecretKey[:]); err != nil {
+		b.Fatal(err)
+	}
+	if _, err := rand.Read(serverSk[:]); err != nil {
+		b.Fatal(err)
+	}
+	curve25519.ScalarBaseMult(&proxy.proxyPublicKey, &proxy.proxySecretKey)
+	curve25519.ScalarBaseMult(&serverPk, &serverSk)
+	for _, construction := range []struct {
+		name               string
+		cryptoConstruction CryptoConstruction
+	}{{"xsalsa20", XSalsa20Poly1305}, {"xchacha20", XChacha20Poly1305}} {
+		b.Run(construction.name+"/compute", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				ComputeSharedKey(construction.cryptoConstruction, &proxy.proxySecretKey, &serverPk, nil)
+			}
+		})
+		b.Run(construction.name+"/cached", func(b *testing.B) {
+			expected := ComputeSharedKey(construction.cryptoConstruction, &proxy.proxySecretKey, &serverPk, nil)
+			if proxy.sharedKey(construction.cryptoConstruction, &serverPk, nil) != expected {
+				b.Fatal("The cached shared key is different from the computed one")
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				proxy.sharedKey(construction.cryptoConstruction, &serverPk, nil)
+			}
+		})
+	}
+}
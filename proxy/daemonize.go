@@ -1,6 +1,6 @@
 // +build linux
 
-package main
+package proxy
 
 import "github.com/VividCortex/godaemon"
 
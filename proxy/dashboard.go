@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+// checkLoopbackAddress verifies that a local service can't be reached from other hosts
+func checkLoopbackAddress(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if !isLoopbackHost(host) {
+		return fmt.Errorf("[%s] is not a loopback address", address)
+	}
+	return nil
+}
+
+func isLoopbackHost(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"))
+	return ip != nil && ip.IsLoopback()
+}
+
+// startDashboard serves a read-only web page with live statistics
+func (proxy *Proxy) startDashboard() error {
+	listener, err := net.Listen("tcp", proxy.dashboardAddress)
+	if err != nil {
+		return err
+	}
+	proxy.trackListener(listener)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", readOnly(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(dashboardPage))
+	}))
+	mux.HandleFunc("/stats", readOnly(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(proxy.stats.Snapshot(proxy))
+	}))
+	mux.HandleFunc("/metrics", readOnly(proxy.serveMetrics))
+	server := &http.Server{Handler: mux, ReadTimeout: 10 * time.Second, WriteTimeout: 10 * time.Second}
+	dlog.Noticef("Dashboard available at http://%s/", proxy.dashboardAddress)
+	go func() {
+		if err := server.Serve(listener); err != nil && atomic.LoadInt32(&proxy.stopping) == 0 {
+			dlog.Errorf("Dashboard: %v", err)
+		}
+	}()
+	return nil
+}
+
+func readOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// Prevent other websites from reading the statistics through DNS rebinding
+		host := r.Host
+		if hostOnly, _, err := net.SplitHostPort(host); err == nil {
+			host = hostOnly
+		}
+		if !isLoopbackHost(host) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+const dashboardPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>dnscrypt-proxy</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+h1 { font-size: 1.4em; }
+h2 { font-size: 1.1em; margin-top: 1.5em; }
+table { border-collapse: collapse; min-width: 24em; }
+td, th { text-align: left; padding: 0.2em 1em 0.2em 0; }
+td.n { text-align: right; }
+#qps { display: flex; align-items: flex-end; height: 60px; gap: 1px; }
+#qps div { background: #4a7; width: 6px; }
+.down { color: #b30; }
+</style>
+</head>
+<body>
+<h1>dnscrypt-proxy</h1>
+<p id="summary">Loading...</p>
+<div id="qps"></div>
+<h2>Servers</h2>
+<table id="servers"></table>
+<h2>Cache</h2>
+<p id="cache"></p>
+<h2>Top queried domains (last hour)</h2>
+<table id="top_queried"></table>
+<h2>Top blocked domains (last hour)</h2>
+<table id="top_blocked"></table>
+<script>
+function text(s) { return String(s).replace(/[&<>"]/g, function (c) { return "&#" + c.charCodeAt(0) + ";"; }); }
+function names(id, list) {
+  document.getElementById(id).innerHTML = list.length ? list.map(function (e) {
+    return "<tr><td>" + text(e.name) + "</td><td class=n>" + e.count + "</td></tr>";
+  }).join("") : "<tr><td>-</td></tr>";
+}
+function update() {
+  fetch("stats").then(function (r) { return r.json(); }).then(function (s) {
+    document.getElementById("summary").textContent = s.qps.toFixed(2) + " queries/s - " + s.queries + " queries, " +
+      s.blocked + " blocked, " + s.failures + " failed - " + s.active_clients + " active clients - uptime: " + s.uptime_s + "s";
+    var max = Math.max.apply(null, s.qps_history.concat([1]));
+    document.getElementById("qps").innerHTML = s.qps_history.map(function (n) {
+      return "<div style='height:" + Math.round(n * 60 / max) + "px' title='" + n + "'></div>";
+    }).join("");
+    document.getElementById("servers").innerHTML = "<tr><th>Name</th><th>Protocol</th><th>RTT</th><th>p50/p90/p99</th>" +
+      "<th>Errors</th><th>Timeouts</th><th>Status</th></tr>" + (s.servers || []).map(function (e) {
+        return "<tr><td>" + text(e.name) + "</td><td>" + text(e.proto) + "</td><td class=n>" + e.rtt_ms + "ms</td><td class=n>" +
+          e.latency_p50_ms + "/" + e.latency_p90_ms + "/" + e.latency_p99_ms + "ms</td><td class=n>" +
+          (100 * e.error_rate).toFixed(1) + "%</td><td class=n>" + (100 * e.timeout_rate).toFixed(1) + "%</td><td" +
+          (e.down ? " class=down>down" : ">" + (e.consecutive_failures ? e.consecutive_failures + " recent failures" : "ok")) +
+          "</td></tr>";
+      }).join("");
+    var c = s.cache;
+    document.getElementById("cache").textContent = c.enabled ? c.entries + (c.capacity ? "/" + c.capacity : "") +
+      " entries (~" + Math.round(c.memory_estimate_bytes / 1024) + " KB" +
+      (c.capacity_bytes ? "/" + Math.round(c.capacity_bytes / 1024) + " KB" : "") + ") - hit ratio: " + (100 * c.hit_ratio).toFixed(1) + "% - " + c.hits +
+      " hits, " + c.misses + " misses, " + c.expired + " expired, " + c.evictions + " evictions" : "disabled";
+    names("top_queried", s.top_queried);
+    names("top_blocked", s.top_blocked);
+  }).catch(function () {
+    document.getElementById("summary").textContent = "dnscrypt-proxy is not responding";
+  });
+}
+update();
+setInterval(update, 2000);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"sync/atomic"
+
+	"github.com/jedisct1/dlog"
+)
+
+// startDebugServer serves the Go profiling handlers, to investigate the memory and CPU usage of
+// a running proxy with `go tool pprof http://<address>/debug/pprof/heap`
+func (proxy *Proxy) startDebugServer() error {
+	if err := checkLoopbackAddress(proxy.debugAddress); err != nil {
+		dlog.Warnf("[debug_listen] is not a loopback address: profiles and the command line will be visible to other hosts")
+	}
+	listener, err := net.Listen("tcp", proxy.debugAddress)
+	if err != nil {
+		return err
+	}
+	proxy.trackListener(listener)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	dlog.Noticef("Profiling data available at http://%s/debug/pprof/", proxy.debugAddress)
+	go func() {
+		// CPU profiles and traces take a while to be collected: no write timeout
+		if err := http.Serve(listener, mux); err != nil && atomic.LoadInt32(&proxy.stopping) == 0 {
+			dlog.Errorf("Debug server: %v", err)
+		}
+	}()
+	return nil
+}
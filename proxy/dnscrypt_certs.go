@@ -1,4 +1,4 @@
-package main
+package proxy
 
 import (
 	"bytes"
@@ -18,8 +18,18 @@ type CertInfo struct {
 	MagicQuery         [ClientMagicLen]byte
 	CryptoConstruction CryptoConstruction
 	ForwardSecurity    bool
+	Serial             uint32
+	NotBefore          time.Time
+	NotAfter           time.Time
 }
 
+const (
+	// Validity period (in seconds) above which a certificate is considered suspicious
+	CertSuspiciousValidity = 365 * 86400
+	// Certificates are refreshed that long before they expire
+	CertRefreshBeforeExpiry = time.Duration(1) * time.Hour
+)
+
 func FetchCurrentDNSCryptCert(proxy *Proxy, serverName *string, proto string, pk ed25519.PublicKey, serverAddress string, providerName string, isNew bool) (CertInfo, int, error) {
 	if len(pk) != ed25519.PublicKeySize {
 		return CertInfo{}, 0, errors.New("Invalid public key length")
@@ -33,15 +43,26 @@ func FetchCurrentDNSCryptCert(proxy *Proxy, serverName *string, proto string, pk
 	query := new(dns.Msg)
 	query.SetQuestion(providerName, dns.TypeTXT)
 	client := dns.Client{Net: proto, UDPSize: uint16(MaxDNSUDPPacketSize)}
-	in, rtt, err := client.Exchange(query, serverAddress)
+	in, rtt, err := proxy.outgoing.Exchange(&client, query, serverAddress)
+	if proto == "udp" && (err == dns.ErrTruncated || (err == nil && in.Truncated)) {
+		// Servers may refuse to send certificates in a UDP response larger than the query
+		dlog.Debugf("[%s] Truncated certificate response, retrying over TCP", *serverName)
+		client.Net = "tcp"
+		in, rtt, err = proxy.outgoing.Exchange(&client, query, serverAddress)
+	}
 	if err != nil {
 		dlog.Noticef("[%s] TIMEOUT", *serverName)
 		return CertInfo{}, 0, err
 	}
+	if len(in.Question) != 1 || in.Question[0].Qtype != dns.TypeTXT || !strings.EqualFold(in.Question[0].Name, providerName) {
+		dlog.Warnf("[%s] Response doesn't match the certificate query", *serverName)
+		return CertInfo{}, 0, errResponseMismatch
+	}
 	now := uint32(time.Now().Unix())
 	certInfo := CertInfo{CryptoConstruction: UndefinedConstruction}
 	highestSerial := uint32(0)
 	var certCountStr string
+	var outOfDate []time.Time
 	for _, answerRr := range in.Answer {
 		binCert, err := packTxtString(strings.Join(answerRr.(*dns.TXT).Txt, ""))
 		if err != nil {
@@ -80,6 +101,9 @@ func FetchCurrentDNSCryptCert(proxy *Proxy, serverName *string, proto string, pk
 			continue
 		}
 		ttl := tsEnd - tsBegin
+		if ttl > CertSuspiciousValidity {
+			dlog.Warnf("[%v] the certificate is valid for %d days, which is suspicious -- the server's key may have been compromised, or its operator may not be rotating keys", providerName, ttl/86400)
+		}
 		if ttl > 86400*7 {
 			dlog.Infof("[%v] the key validity period for this server is excessively long (%d days), significantly reducing reliability and forward security.", providerName, ttl/86400)
 			daysLeft := (tsEnd - now) / 86400
@@ -95,8 +119,15 @@ func FetchCurrentDNSCryptCert(proxy *Proxy, serverName *string, proto string, pk
 			certInfo.ForwardSecurity = true
 		}
 		if !proxy.certIgnoreTimestamp {
-			if now > tsEnd || now < tsBegin {
+			fingerprint := certFingerprint(binCert)
+			notBefore, notAfter := time.Unix(int64(tsBegin), 0), time.Unix(int64(tsEnd), 0)
+			if proxy.certClock.validAt(notBefore, notAfter) {
+				proxy.certClock.remember(fingerprint)
+			} else if proxy.certClock.trusted(fingerprint) {
+				dlog.Noticef("[%v] Certificate not valid at the current date, but trusted until the system clock is synchronized", providerName)
+			} else {
 				dlog.Debugf("[%v] Certificate not valid at the current date", providerName)
+				outOfDate = []time.Time{notBefore, notAfter}
 				continue
 			}
 		}
@@ -116,13 +147,12 @@ func FetchCurrentDNSCryptCert(proxy *Proxy, serverName *string, proto string, pk
 			dlog.Noticef("[%v] Cryptographic construction %v not supported", providerName, cryptoConstruction)
 			continue
 		}
-		var serverPk [32]byte
-		copy(serverPk[:], binCert[72:104])
-		sharedKey := ComputeSharedKey(cryptoConstruction, &proxy.proxySecretKey, &serverPk, &providerName)
-		certInfo.SharedKey = sharedKey
 		highestSerial = serial
+		certInfo.Serial = serial
+		certInfo.NotBefore = time.Unix(int64(tsBegin), 0)
+		certInfo.NotAfter = time.Unix(int64(tsEnd), 0)
 		certInfo.CryptoConstruction = cryptoConstruction
-		copy(certInfo.ServerPk[:], serverPk[:])
+		copy(certInfo.ServerPk[:], binCert[72:104])
 		copy(certInfo.MagicQuery[:], binCert[104:112])
 		if isNew {
 			dlog.Noticef("[%s] OK (crypto v%d) - rtt: %dms%s", *serverName, cryptoConstruction, rtt.Nanoseconds()/1000000, certCountStr)
@@ -132,8 +162,13 @@ func FetchCurrentDNSCryptCert(proxy *Proxy, serverName *string, proto string, pk
 		certCountStr = " - additional certificate"
 	}
 	if certInfo.CryptoConstruction == UndefinedConstruction {
+		if outOfDate != nil {
+			proxy.certClock.reportInvalid(*serverName, outOfDate[0], outOfDate[1])
+		}
 		return certInfo, 0, errors.New("No useable certificate found")
 	}
+	// Only for the certificate that has been retained
+	certInfo.SharedKey = proxy.sharedKey(certInfo.CryptoConstruction, &certInfo.ServerPk, &providerName)
 	return certInfo, int(rtt.Nanoseconds() / 1000000), nil
 }
 
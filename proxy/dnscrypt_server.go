@@ -0,0 +1,496 @@
+package proxy
+
+import (
+	"bytes"
+	crypto_rand "crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/jedisct1/dlog"
+	clocksmith "github.com/jedisct1/go-clocksmith"
+	stamps "github.com/jedisct1/go-dnsstamps"
+	"github.com/jedisct1/xsecretbox"
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const (
+	DNSCryptServerCertPrefix       = "2.dnscrypt-cert."
+	DNSCryptServerCertSize         = 124
+	DNSCryptServerCertTTL          = 600
+	DNSCryptServerSharedKeysCached = 4096
+)
+
+// DNSCryptServer exposes the proxy as a DNSCrypt server, so that other proxies can use it as a
+// resolver. The provider key is long-term, and signs certificates for short-term keys, that are
+// replaced every key_rotation hours. A certificate remains valid for two rotation periods, so that
+// clients have plenty of time to retrieve the next one. Short-term keys are kept in a file next to
+// the provider key, so that clients can keep using their certificates after a restart.
+type DNSCryptServer struct {
+	sync.RWMutex
+	providerName string
+	providerSk   ed25519.PrivateKey
+	keysFile     string
+	keyRotation  time.Duration
+	certs        map[[ClientMagicLen]byte]*dnscryptServerCert
+	current      []*dnscryptServerCert
+	sharedKeys   *lru.Cache
+}
+
+type dnscryptServerCert struct {
+	bin                []byte
+	cryptoConstruction CryptoConstruction
+	publicKey          [PublicKeySize]byte
+	secretKey          [32]byte
+	notBefore          time.Time
+	notAfter           time.Time
+}
+
+// dnscryptSession holds what is required to encrypt the response to a query
+type dnscryptSession struct {
+	cryptoConstruction CryptoConstruction
+	sharedKey          [32]byte
+	clientNonce        [HalfNonceSize]byte
+	queryLength        int
+}
+
+func NewDNSCryptServer(config *DNSCryptServerConfig) (*DNSCryptServer, error) {
+	if len(config.ProviderName) == 0 {
+		return nil, errors.New("[dnscrypt_server] requires a provider name")
+	}
+	providerName := strings.ToLower(dns.Fqdn(config.ProviderName))
+	if _, ok := dns.IsDomainName(providerName); !ok {
+		return nil, fmt.Errorf("Invalid provider name [%s]", config.ProviderName)
+	}
+	if !strings.HasPrefix(providerName, DNSCryptServerCertPrefix) {
+		providerName = DNSCryptServerCertPrefix + providerName
+	}
+	if config.KeyRotation <= 0 {
+		return nil, errors.New("[dnscrypt_server] key_rotation must be at least 1 hour")
+	}
+	providerSk, err := loadProviderKey(config.ProviderKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	sharedKeys, err := lru.New(DNSCryptServerSharedKeysCached)
+	if err != nil {
+		return nil, err
+	}
+	server := DNSCryptServer{
+		providerName: providerName,
+		providerSk:   providerSk,
+		keysFile:     config.ProviderKeyFile + ".keys",
+		keyRotation:  time.Duration(config.KeyRotation) * time.Hour,
+		certs:        make(map[[ClientMagicLen]byte]*dnscryptServerCert),
+		sharedKeys:   sharedKeys,
+	}
+	server.loadKeys()
+	if server.nextRotation() <= 0 {
+		if err := server.rotate(); err != nil {
+			return nil, err
+		}
+	}
+	return &server, nil
+}
+
+// loadProviderKey reads the secret provider key, or creates it if the file doesn't exist yet
+func loadProviderKey(file string) (ed25519.PrivateKey, error) {
+	encoded, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		_, providerSk, err := ed25519.GenerateKey(crypto_rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		fp, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return nil, err
+		}
+		_, err = fp.WriteString(hex.EncodeToString(providerSk) + "\n")
+		if closeErr := fp.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, err
+		}
+		dlog.Noticef("A new DNSCrypt provider key has been stored into [%s]", file)
+		return providerSk, nil
+	} else if err != nil {
+		return nil, err
+	}
+	providerSk, err := hex.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil || len(providerSk) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("[%s] doesn't contain a valid provider key", file)
+	}
+	return ed25519.PrivateKey(providerSk), nil
+}
+
+// rotate creates a new short-term key, with a certificate for each supported construction, and
+// forgets the keys whose certificates have expired
+func (server *DNSCryptServer) rotate() error {
+	var secretKey, publicKey [32]byte
+	if _, err := crypto_rand.Read(secretKey[:]); err != nil {
+		return err
+	}
+	curve25519.ScalarBaseMult(&publicKey, &secretKey)
+	now := time.Now()
+	notAfter := now.Add(2 * server.keyRotation)
+	var current []*dnscryptServerCert
+	for _, cryptoConstruction := range []CryptoConstruction{XSalsa20Poly1305, XChacha20Poly1305} {
+		cert := dnscryptServerCert{
+			bin:                make([]byte, DNSCryptServerCertSize),
+			cryptoConstruction: cryptoConstruction,
+			publicKey:          publicKey,
+			secretKey:          secretKey,
+			notBefore:          time.Unix(now.Unix(), 0),
+			notAfter:           time.Unix(notAfter.Unix(), 0),
+		}
+		copy(cert.bin, CertMagic[:4])
+		binary.BigEndian.PutUint16(cert.bin[4:6], uint16(cryptoConstruction))
+		copy(cert.bin[72:104], publicKey[:])
+		if _, err := crypto_rand.Read(cert.bin[104:112]); err != nil {
+			return err
+		}
+		binary.BigEndian.PutUint32(cert.bin[112:116], uint32(now.Unix()))
+		binary.BigEndian.PutUint32(cert.bin[116:120], uint32(now.Unix()))
+		binary.BigEndian.PutUint32(cert.bin[120:124], uint32(notAfter.Unix()))
+		copy(cert.bin[8:72], ed25519.Sign(server.providerSk, cert.bin[72:]))
+		current = append(current, &cert)
+	}
+	server.Lock()
+	server.addCerts(current, now)
+	server.Unlock()
+	dlog.Infof("New DNSCrypt server key, valid until %s", notAfter.Format(time.RFC3339))
+	if err := server.saveKeys(); err != nil {
+		dlog.Warnf("Unable to save the DNSCrypt server keys into [%s]: %v", server.keysFile, err)
+	}
+	return nil
+}
+
+// addCerts makes a set of certificates the current ones; it must be called with the lock held
+func (server *DNSCryptServer) addCerts(current []*dnscryptServerCert, now time.Time) {
+	for magic, cert := range server.certs {
+		if now.After(cert.notAfter) {
+			delete(server.certs, magic)
+		}
+	}
+	for _, cert := range current {
+		var magic [ClientMagicLen]byte
+		copy(magic[:], cert.bin[104:112])
+		server.certs[magic] = cert
+	}
+	server.current = current
+}
+
+// nextRotation returns how long the current key can still be used before being replaced
+func (server *DNSCryptServer) nextRotation() time.Duration {
+	server.RLock()
+	defer server.RUnlock()
+	if len(server.current) == 0 {
+		return 0
+	}
+	return time.Until(server.current[0].notBefore.Add(server.keyRotation))
+}
+
+func (server *DNSCryptServer) rotateKeys() {
+	for {
+		clocksmith.Sleep(server.nextRotation())
+		if err := server.rotate(); err != nil {
+			dlog.Errorf("Unable to create a new DNSCrypt server key: %v", err)
+			clocksmith.Sleep(time.Minute)
+		}
+	}
+}
+
+// loadKeys reads the short-term keys that haven't expired yet. Every line of the file has a
+// secret key and a certificate for it; certificates that were not signed by the provider key,
+// or that don't match their key, are ignored.
+func (server *DNSCryptServer) loadKeys() {
+	encoded, err := ioutil.ReadFile(server.keysFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			dlog.Warnf("Unable to read the DNSCrypt server keys from [%s]: %v", server.keysFile, err)
+		}
+		return
+	}
+	now := time.Now()
+	providerPk := server.providerSk.Public().(ed25519.PublicKey)
+	var current []*dnscryptServerCert
+	server.Lock()
+	defer server.Unlock()
+	for _, line := range strings.Split(string(encoded), "\n") {
+		parts := strings.Fields(line)
+		if len(parts) != 2 {
+			continue
+		}
+		secretKey, err := hex.DecodeString(parts[0])
+		if err != nil || len(secretKey) != 32 {
+			continue
+		}
+		bin, err := hex.DecodeString(parts[1])
+		if err != nil || len(bin) != DNSCryptServerCertSize || !ed25519.Verify(providerPk, bin[72:], bin[8:72]) {
+			continue
+		}
+		cert := dnscryptServerCert{
+			bin:                bin,
+			cryptoConstruction: CryptoConstruction(binary.BigEndian.Uint16(bin[4:6])),
+			notBefore:          time.Unix(int64(binary.BigEndian.Uint32(bin[116:120])), 0),
+			notAfter:           time.Unix(int64(binary.BigEndian.Uint32(bin[120:124])), 0),
+		}
+		copy(cert.secretKey[:], secretKey)
+		curve25519.ScalarBaseMult(&cert.publicKey, &cert.secretKey)
+		if !bytes.Equal(cert.publicKey[:], bin[72:104]) || now.After(cert.notAfter) {
+			continue
+		}
+		if len(current) > 0 && cert.notBefore.After(current[0].notBefore) {
+			current = nil
+		}
+		if len(current) == 0 || cert.notBefore.Equal(current[0].notBefore) {
+			current = append(current, &cert)
+		}
+		var magic [ClientMagicLen]byte
+		copy(magic[:], bin[104:112])
+		server.certs[magic] = &cert
+	}
+	if len(current) > 0 {
+		server.current = current
+	}
+}
+
+// saveKeys writes the keys that are still valid. They can decrypt the queries of every client, and
+// must be kept as secret as the provider key.
+func (server *DNSCryptServer) saveKeys() error {
+	var encoded bytes.Buffer
+	server.RLock()
+	for _, cert := range server.certs {
+		fmt.Fprintf(&encoded, "%s %s\n", hex.EncodeToString(cert.secretKey[:]), hex.EncodeToString(cert.bin))
+	}
+	server.RUnlock()
+	return ioutil.WriteFile(server.keysFile, encoded.Bytes(), 0600)
+}
+
+// Stamp returns the stamp clients can use to connect to the server
+func (server *DNSCryptServer) Stamp(address string) string {
+	stamp := stamps.ServerStamp{
+		Proto:         stamps.StampProtoTypeDNSCrypt,
+		ServerAddrStr: address,
+		ServerPk:      server.providerSk.Public().(ed25519.PublicKey),
+		ProviderName:  strings.TrimSuffix(server.providerName, "."),
+	}
+	return stamp.String()
+}
+
+// certResponse answers the plaintext query clients send to retrieve the current certificates
+func (server *DNSCryptServer) certResponse(packet []byte) ([]byte, error) {
+	msg := dns.Msg{}
+	if err := msg.Unpack(packet); err != nil {
+		return nil, err
+	}
+	if msg.Response || len(msg.Question) != 1 {
+		return nil, errors.New("Not a certificate query")
+	}
+	question := msg.Question[0]
+	if question.Qtype != dns.TypeTXT || question.Qclass != dns.ClassINET || !strings.EqualFold(question.Name, server.providerName) {
+		return nil, errors.New("Not a certificate query")
+	}
+	response := new(dns.Msg)
+	response.SetReply(&msg)
+	response.Authoritative = true
+	server.RLock()
+	for _, cert := range server.current {
+		rr := &dns.TXT{
+			Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: DNSCryptServerCertTTL},
+			Txt: []string{escapeTxtString(cert.bin)},
+		}
+		response.Answer = append(response.Answer, rr)
+	}
+	server.RUnlock()
+	return response.Pack()
+}
+
+// escapeTxtString encodes binary data the way the DNS library expects TXT strings to be
+func escapeTxtString(bin []byte) string {
+	var escaped bytes.Buffer
+	for _, c := range bin {
+		switch {
+		case c == '"' || c == '\\':
+			escaped.WriteByte('\\')
+			escaped.WriteByte(c)
+		case c < 0x20 || c > 0x7e:
+			fmt.Fprintf(&escaped, "\\%03d", c)
+		default:
+			escaped.WriteByte(c)
+		}
+	}
+	return escaped.String()
+}
+
+// decrypt returns the plaintext of an encrypted query, or an error if it wasn't encrypted for
+// one of the current keys
+func (server *DNSCryptServer) decrypt(encrypted []byte) (*dnscryptSession, []byte, error) {
+	if len(encrypted) < QueryOverhead+MinDNSPacketSize {
+		return nil, nil, errors.New("Short query")
+	}
+	var magic [ClientMagicLen]byte
+	copy(magic[:], encrypted)
+	server.RLock()
+	cert, ok := server.certs[magic]
+	server.RUnlock()
+	if !ok || time.Now().After(cert.notAfter) {
+		return nil, nil, errors.New("Unknown or expired key")
+	}
+	cacheKey := sharedKeyCacheKey{cryptoConstruction: cert.cryptoConstruction, serverPk: cert.publicKey}
+	copy(cacheKey.clientPk[:], encrypted[ClientMagicLen:ClientMagicLen+PublicKeySize])
+	session := dnscryptSession{cryptoConstruction: cert.cryptoConstruction, queryLength: len(encrypted)}
+	if sharedKey, ok := server.sharedKeys.Get(cacheKey); ok {
+		session.sharedKey = sharedKey.([32]byte)
+	} else {
+		if cert.cryptoConstruction == XChacha20Poly1305 {
+			var err error
+			if session.sharedKey, err = xsecretbox.SharedKey(cert.secretKey, cacheKey.clientPk); err != nil {
+				return nil, nil, err
+			}
+		} else {
+			box.Precompute(&session.sharedKey, &cacheKey.clientPk, &cert.secretKey)
+		}
+		server.sharedKeys.Add(cacheKey, session.sharedKey)
+	}
+	copy(session.clientNonce[:], encrypted[ClientMagicLen+PublicKeySize:])
+	var nonce [NonceSize]byte
+	copy(nonce[:], session.clientNonce[:])
+	sealed := encrypted[ClientMagicLen+PublicKeySize+HalfNonceSize:]
+	var packet []byte
+	if cert.cryptoConstruction == XChacha20Poly1305 {
+		var err error
+		if packet, err = xsecretbox.Open(nil, nonce[:], sealed, session.sharedKey[:]); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		if packet, ok = secretbox.Open(nil, sealed, &nonce, &session.sharedKey); !ok {
+			return nil, nil, errors.New("Incorrect tag")
+		}
+	}
+	packet, err := unpad(packet)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &session, packet, nil
+}
+
+// encrypt seals a response. Over UDP, the response can't be larger than the query, so that the
+// server can't be used to amplify attacks; clients get a truncated response, and retry over TCP.
+func (session *dnscryptSession) encrypt(packet []byte, proto string) ([]byte, error) {
+	maxLength := ResponseOverhead + MaxDNSPacketSize
+	minLength := ResponseOverhead + len(packet) + 1
+	if proto == "udp" {
+		maxLength = session.queryLength
+	} else {
+		var xpad [1]byte
+		crypto_rand.Read(xpad[:])
+		minLength += int(xpad[0])
+	}
+	if ResponseOverhead+len(packet)+1 > maxLength {
+		var err error
+		if packet, err = TruncatedResponse(packet); err != nil {
+			return nil, err
+		}
+		if ResponseOverhead+len(packet)+1 > maxLength {
+			return nil, errors.New("Response too large")
+		}
+	}
+	paddedLength := Min((minLength+63)&^63, maxLength)
+	var nonce [NonceSize]byte
+	copy(nonce[:], session.clientNonce[:])
+	if _, err := crypto_rand.Read(nonce[HalfNonceSize:]); err != nil {
+		return nil, err
+	}
+	encrypted := make([]byte, 0, paddedLength)
+	encrypted = append(encrypted, ServerMagic[:]...)
+	encrypted = append(encrypted, nonce[:]...)
+	padded := pad(packet, paddedLength-ResponseOverhead)
+	if session.cryptoConstruction == XChacha20Poly1305 {
+		encrypted = xsecretbox.Seal(encrypted, nonce[:], padded, session.sharedKey[:])
+	} else {
+		encrypted = secretbox.Seal(encrypted, padded, &nonce, &session.sharedKey)
+	}
+	return encrypted, nil
+}
+
+// dnscryptUDPConn encrypts the response sent to a DNSCrypt client over UDP
+type dnscryptUDPConn struct {
+	*net.UDPConn
+	session *dnscryptSession
+}
+
+func (clientPc *dnscryptUDPConn) WriteTo(packet []byte, addr net.Addr) (int, error) {
+	encrypted, err := clientPc.session.encrypt(packet, "udp")
+	if err != nil {
+		return 0, err
+	}
+	return clientPc.UDPConn.WriteTo(encrypted, addr)
+}
+
+// dnscryptTCPConn encrypts the response sent to a DNSCrypt client over TCP
+type dnscryptTCPConn struct {
+	net.Conn
+	session *dnscryptSession
+}
+
+func (clientPc *dnscryptTCPConn) Write(packet []byte) (int, error) {
+	if len(packet) < 2 {
+		return 0, errors.New("Short packet")
+	}
+	encrypted, err := clientPc.session.encrypt(packet[2:], "tcp")
+	if err != nil {
+		return 0, err
+	}
+	if encrypted, err = PrefixWithSize(encrypted); err != nil {
+		return 0, err
+	}
+	return clientPc.Conn.Write(encrypted)
+}
+
+// unwrapDNSCryptUDPQuery returns the plaintext of a query received on a DNSCrypt listener, and the
+// connection its response has to be written to. Certificate queries are answered right away, and
+// nil is returned for them as well as for anything that can't be decrypted.
+func (proxy *Proxy) unwrapDNSCryptUDPQuery(packet []byte, clientPc *net.UDPConn, clientAddr net.Addr) ([]byte, net.Conn) {
+	session, query, err := proxy.dnscryptServer.decrypt(packet)
+	if err == nil {
+		return query, &dnscryptUDPConn{UDPConn: clientPc, session: session}
+	}
+	if response, err := proxy.dnscryptServer.certResponse(packet); err == nil && proxy.clientAllowed(clientAddr) {
+		// Certificates are not sent over UDP in a response larger than the query, so that the
+		// listener can't be used for amplification; clients retry over TCP
+		if len(response) > len(packet) {
+			if response, err = TruncatedResponse(packet); err != nil {
+				return nil, nil
+			}
+		}
+		clientPc.WriteTo(response, clientAddr)
+	}
+	return nil, nil
+}
+
+func (proxy *Proxy) unwrapDNSCryptTCPQuery(packet []byte, clientPc net.Conn) ([]byte, net.Conn) {
+	session, query, err := proxy.dnscryptServer.decrypt(packet)
+	if err == nil {
+		return query, &dnscryptTCPConn{Conn: clientPc, session: session}
+	}
+	if response, err := proxy.dnscryptServer.certResponse(packet); err == nil {
+		if response, err = PrefixWithSize(response); err == nil {
+			clientPc.Write(response)
+		}
+	}
+	return nil, nil
+}
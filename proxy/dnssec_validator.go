@@ -0,0 +1,642 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/jedisct1/dlog"
+	stamps "github.com/jedisct1/go-dnsstamps"
+	"github.com/miekg/dns"
+)
+
+const (
+	DNSSECValidatorCacheSize = 4096
+	DNSSECValidatorMaxDepth  = 24
+	DNSSECValidatorMinTTL    = 60
+	DNSSECValidatorMaxTTL    = 3600
+)
+
+type DNSSECStatus int
+
+const (
+	DNSSECStatusSecure DNSSECStatus = iota
+	DNSSECStatusInsecure
+	DNSSECStatusBogus
+)
+
+func (status DNSSECStatus) String() string {
+	switch status {
+	case DNSSECStatusSecure:
+		return "secure"
+	case DNSSECStatusInsecure:
+		return "insecure"
+	default:
+		return "bogus"
+	}
+}
+
+type DNSSECValidator struct {
+	proxy        *Proxy
+	trustAnchors *TrustAnchors
+	queryCache   *lru.Cache
+	keysCache    *lru.Cache
+}
+
+type dnssecCachedMsg struct {
+	msg        *dns.Msg
+	expiration time.Time
+}
+
+type dnssecCachedKeys struct {
+	keys       []*dns.DNSKEY
+	status     DNSSECStatus
+	expiration time.Time
+}
+
+func NewDNSSECValidator(proxy *Proxy) (*DNSSECValidator, error) {
+	trustAnchors, err := NewTrustAnchors(proxy.dnssecTrustAnchorsFile)
+	if err != nil {
+		return nil, err
+	}
+	queryCache, err := lru.New(DNSSECValidatorCacheSize)
+	if err != nil {
+		return nil, err
+	}
+	keysCache, err := lru.New(DNSSECValidatorCacheSize)
+	if err != nil {
+		return nil, err
+	}
+	return &DNSSECValidator{proxy: proxy, trustAnchors: trustAnchors, queryCache: queryCache, keysCache: keysCache}, nil
+}
+
+// query sends a DNSSEC-enabled query directly to an upstream server, bypassing the plugins
+func (validator *DNSSECValidator) query(name string, qtype uint16) (*dns.Msg, error) {
+	name = strings.ToLower(dns.Fqdn(name))
+	cacheKey := fmt.Sprintf("%s/%d", name, qtype)
+	if cached, ok := validator.queryCache.Get(cacheKey); ok {
+		cachedMsg := cached.(dnssecCachedMsg)
+		if time.Now().Before(cachedMsg.expiration) {
+			return cachedMsg.msg, nil
+		}
+	}
+	proxy := validator.proxy
+	serverInfo := proxy.serversInfo.getOne()
+	if serverInfo == nil {
+		return nil, errors.New("No live servers")
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, qtype)
+	msg.SetEdns0(uint16(MaxDNSPacketSize), true)
+	query, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	response, err := proxy.exchangeWithServer(serverInfo, proxy.mainProto, query, proxy.timeout)
+	if err == nil && HasTCFlag(response) && serverInfo.Proto == stamps.StampProtoTypeDNSCrypt {
+		response, err = proxy.exchangeWithServer(serverInfo, "tcp", query, proxy.timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	serverInfo.noticeSuccess(proxy)
+	responseMsg := new(dns.Msg)
+	if err := responseMsg.Unpack(response); err != nil {
+		return nil, err
+	}
+	if responseMsg.Rcode != dns.RcodeSuccess && responseMsg.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("Query for [%s] returned %s", name, dns.RcodeToString[responseMsg.Rcode])
+	}
+	ttl := getMinTTL(responseMsg, DNSSECValidatorMinTTL, DNSSECValidatorMaxTTL, DNSSECValidatorMinTTL, DNSSECValidatorMaxTTL)
+	validator.queryCache.Add(cacheKey, dnssecCachedMsg{msg: responseMsg, expiration: time.Now().Add(ttl)})
+	return responseMsg, nil
+}
+
+type rrsetKey struct {
+	name  string
+	rtype uint16
+}
+
+// splitRRsets groups records by owner and type, and collects the signatures covering every set
+func splitRRsets(rrs []dns.RR) (map[rrsetKey][]dns.RR, map[rrsetKey][]*dns.RRSIG) {
+	rrsets := make(map[rrsetKey][]dns.RR)
+	sigs := make(map[rrsetKey][]*dns.RRSIG)
+	for _, rr := range rrs {
+		header := rr.Header()
+		name := strings.ToLower(header.Name)
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			key := rrsetKey{name: name, rtype: sig.TypeCovered}
+			sigs[key] = append(sigs[key], sig)
+			continue
+		}
+		if header.Rrtype == dns.TypeOPT {
+			continue
+		}
+		key := rrsetKey{name: name, rtype: header.Rrtype}
+		rrsets[key] = append(rrsets[key], rr)
+	}
+	return rrsets, sigs
+}
+
+// Validate returns the DNSSEC status of a response
+func (validator *DNSSECValidator) Validate(msg *dns.Msg) DNSSECStatus {
+	if len(msg.Question) != 1 {
+		return DNSSECStatusInsecure
+	}
+	question := msg.Question[0]
+	qName := strings.ToLower(question.Name)
+	rrsets, sigs := splitRRsets(msg.Answer)
+	if len(rrsets) > 0 {
+		hasDNAME := false
+		for key := range rrsets {
+			if key.rtype == dns.TypeDNAME {
+				hasDNAME = true
+			}
+		}
+		status := DNSSECStatusSecure
+		for key, rrset := range rrsets {
+			var rrsetStatus DNSSECStatus
+			if key.rtype == dns.TypeCNAME && hasDNAME && len(sigs[key]) == 0 {
+				continue // synthesized from a DNAME record
+			} else if len(sigs[key]) == 0 {
+				rrsetStatus = validator.provenInsecure(key.name, 0)
+			} else {
+				rrsetStatus = validator.verifyRRset(key.name, rrset, sigs[key], 0)
+				if sigLabels := expandedLabels(key.name, sigs[key]); rrsetStatus == DNSSECStatusSecure && sigLabels >= 0 {
+					rrsetStatus = validator.verifyExpansion(msg, key.name, key.rtype, sigLabels, 0)
+				}
+			}
+			if rrsetStatus == DNSSECStatusBogus {
+				dlog.Debugf("DNSSEC: bogus [%s] record set for [%s]", dns.TypeToString[key.rtype], key.name)
+				return DNSSECStatusBogus
+			}
+			if rrsetStatus == DNSSECStatusInsecure {
+				status = DNSSECStatusInsecure
+			}
+		}
+		return status
+	}
+	if msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError {
+		return DNSSECStatusInsecure
+	}
+	status, _ := validator.verifyDenial(msg, qName, question.Qtype, 0)
+	if status == DNSSECStatusBogus {
+		if validator.provenInsecure(qName, 0) == DNSSECStatusInsecure {
+			return DNSSECStatusInsecure
+		}
+		dlog.Debugf("DNSSEC: unable to prove the nonexistence of [%s]", qName)
+	}
+	return status
+}
+
+// verifyRRset checks that at least one signature of a record set was made by a validated key of its signer
+func (validator *DNSSECValidator) verifyRRset(owner string, rrset []dns.RR, sigs []*dns.RRSIG, depth int) DNSSECStatus {
+	if depth > DNSSECValidatorMaxDepth {
+		return DNSSECStatusBogus
+	}
+	now := time.Now()
+	status := DNSSECStatusBogus
+	for _, sig := range sigs {
+		signer := strings.ToLower(sig.SignerName)
+		if !dns.IsSubDomain(signer, owner) || !sig.ValidityPeriod(now) {
+			continue
+		}
+		keys, keysStatus := validator.validatedKeys(signer, depth+1)
+		if keysStatus == DNSSECStatusInsecure {
+			status = DNSSECStatusInsecure
+			continue
+		} else if keysStatus != DNSSECStatusSecure {
+			continue
+		}
+		for _, key := range keys {
+			if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+				continue
+			}
+			if err := sig.Verify(key, rrset); err == nil {
+				return DNSSECStatusSecure
+			}
+		}
+	}
+	return status
+}
+
+// validatedKeys returns the DNSKEY set of a zone once it has been authenticated by the parent DS set
+func (validator *DNSSECValidator) validatedKeys(zone string, depth int) ([]*dns.DNSKEY, DNSSECStatus) {
+	if depth > DNSSECValidatorMaxDepth {
+		return nil, DNSSECStatusBogus
+	}
+	if cached, ok := validator.keysCache.Get(zone); ok {
+		cachedKeys := cached.(dnssecCachedKeys)
+		if time.Now().Before(cachedKeys.expiration) {
+			return cachedKeys.keys, cachedKeys.status
+		}
+	}
+	keys, status, ttl := validator.fetchValidatedKeys(zone, depth)
+	validator.keysCache.Add(zone, dnssecCachedKeys{keys: keys, status: status, expiration: time.Now().Add(ttl)})
+	return keys, status
+}
+
+func (validator *DNSSECValidator) fetchValidatedKeys(zone string, depth int) ([]*dns.DNSKEY, DNSSECStatus, time.Duration) {
+	failureTTL := time.Duration(DNSSECValidatorMinTTL) * time.Second
+	var dsSet []*dns.DS
+	if zone == "." {
+		dsSet = validator.trustAnchors.ValidDS()
+	} else {
+		var status DNSSECStatus
+		dsSet, status, _ = validator.validatedDS(zone, depth)
+		if status != DNSSECStatusSecure {
+			return nil, status, failureTTL
+		}
+	}
+	msg, err := validator.query(zone, dns.TypeDNSKEY)
+	if err != nil {
+		dlog.Debugf("DNSSEC: unable to retrieve the keys for [%s]: %v", zone, err)
+		return nil, DNSSECStatusBogus, failureTTL
+	}
+	rrsets, sigs := splitRRsets(msg.Answer)
+	key := rrsetKey{name: zone, rtype: dns.TypeDNSKEY}
+	keysRRs, keysSigs := rrsets[key], sigs[key]
+	keys := []*dns.DNSKEY{}
+	for _, rr := range keysRRs {
+		keys = append(keys, rr.(*dns.DNSKEY))
+	}
+	now := time.Now()
+	for _, ds := range dsSet {
+		for _, key := range keys {
+			if key.Flags&DNSKEYFlagRevoke != 0 || !dsMatchesKey(ds, key) || !keySignsSet(key, keysRRs, keysSigs, now) {
+				continue
+			}
+			if zone == "." {
+				validator.trustAnchors.Observe(keys, keysRRs, keysSigs)
+			}
+			ttl := time.Duration(DNSSECValidatorMaxTTL) * time.Second
+			for _, rr := range keysRRs {
+				if rrTTL := time.Duration(rr.Header().Ttl) * time.Second; rrTTL < ttl {
+					ttl = rrTTL
+				}
+			}
+			return keys, DNSSECStatusSecure, ttl
+		}
+	}
+	dlog.Debugf("DNSSEC: no valid key found for [%s]", zone)
+	return nil, DNSSECStatusBogus, failureTTL
+}
+
+// validatedDS returns the authenticated DS set of a zone.
+// If the absence of a DS set is proven, the status is insecure, and delegation tells whether the name is a zone cut.
+func (validator *DNSSECValidator) validatedDS(zone string, depth int) ([]*dns.DS, DNSSECStatus, bool) {
+	msg, err := validator.query(zone, dns.TypeDS)
+	if err != nil {
+		dlog.Debugf("DNSSEC: unable to retrieve the DS set for [%s]: %v", zone, err)
+		return nil, DNSSECStatusBogus, false
+	}
+	rrsets, sigs := splitRRsets(msg.Answer)
+	key := rrsetKey{name: zone, rtype: dns.TypeDS}
+	if dsRRs := rrsets[key]; len(dsRRs) > 0 {
+		status := validator.verifyRRset(zone, dsRRs, sigs[key], depth+1)
+		if status != DNSSECStatusSecure {
+			return nil, status, true
+		}
+		dsSet := []*dns.DS{}
+		for _, rr := range dsRRs {
+			dsSet = append(dsSet, rr.(*dns.DS))
+		}
+		return dsSet, DNSSECStatusSecure, true
+	}
+	status, delegation := validator.verifyDenial(msg, zone, dns.TypeDS, depth+1)
+	if status == DNSSECStatusSecure {
+		return nil, DNSSECStatusInsecure, delegation
+	}
+	if status == DNSSECStatusBogus && depth < DNSSECValidatorMaxDepth {
+		if parent, ok := parentZone(zone); ok && validator.provenInsecure(parent, depth+1) == DNSSECStatusInsecure {
+			return nil, DNSSECStatusInsecure, true
+		}
+	}
+	return nil, status, true
+}
+
+// provenInsecure walks down from the root to check that a name belongs to an unsigned zone
+func (validator *DNSSECValidator) provenInsecure(name string, depth int) DNSSECStatus {
+	labels := dns.SplitDomainName(name)
+	for i := len(labels) - 1; i >= 0; i-- {
+		candidate := strings.ToLower(strings.Join(labels[i:], ".") + ".")
+		_, status, delegation := validator.validatedDS(candidate, depth+1)
+		if status == DNSSECStatusBogus {
+			return DNSSECStatusBogus
+		}
+		if status == DNSSECStatusInsecure && delegation {
+			return DNSSECStatusInsecure
+		}
+	}
+	return DNSSECStatusBogus
+}
+
+func parentZone(zone string) (string, bool) {
+	if zone == "." {
+		return "", false
+	}
+	labels := dns.SplitDomainName(zone)
+	if len(labels) <= 1 {
+		return ".", true
+	}
+	return strings.Join(labels[1:], ".") + ".", true
+}
+
+// denialProof holds the authenticated NSEC and NSEC3 records of a response, and the zone that signed them
+type denialProof struct {
+	zone   string
+	nsecs  []*dns.NSEC
+	nsec3s []*dns.NSEC3
+}
+
+// authenticatedDenial verifies the NSEC and NSEC3 records of the authority section.
+// They must all have been signed by the closest zone that qName belongs to, and the absence of a DS set can
+// only be proven by the parent zone.
+func (validator *DNSSECValidator) authenticatedDenial(msg *dns.Msg, qName string, qtype uint16, depth int) (*denialProof, DNSSECStatus) {
+	rrsets, sigs := splitRRsets(msg.Ns)
+	proof := denialProof{}
+	for key := range rrsets {
+		if key.rtype != dns.TypeNSEC && key.rtype != dns.TypeNSEC3 {
+			continue
+		}
+		for _, sig := range sigs[key] {
+			signer := strings.ToLower(sig.SignerName)
+			if !dns.IsSubDomain(signer, qName) || (qtype == dns.TypeDS && signer == qName) {
+				continue
+			}
+			if len(proof.zone) == 0 || dns.CountLabel(signer) > dns.CountLabel(proof.zone) {
+				proof.zone = signer
+			}
+		}
+	}
+	if len(proof.zone) == 0 {
+		return nil, DNSSECStatusBogus
+	}
+	for key, rrset := range rrsets {
+		if key.rtype != dns.TypeNSEC && key.rtype != dns.TypeNSEC3 {
+			continue
+		}
+		zoneSigs := []*dns.RRSIG{}
+		for _, sig := range sigs[key] {
+			if strings.EqualFold(sig.SignerName, proof.zone) {
+				zoneSigs = append(zoneSigs, sig)
+			}
+		}
+		if len(zoneSigs) == 0 {
+			return nil, DNSSECStatusBogus
+		}
+		if status := validator.verifyRRset(key.name, rrset, zoneSigs, depth); status != DNSSECStatusSecure {
+			return nil, status
+		}
+		for _, rr := range rrset {
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				proof.nsecs = append(proof.nsecs, rr)
+			case *dns.NSEC3:
+				if zone, ok := parentZone(strings.ToLower(rr.Hdr.Name)); !ok || zone != proof.zone {
+					return nil, DNSSECStatusBogus
+				}
+				proof.nsec3s = append(proof.nsec3s, rr)
+			}
+		}
+	}
+	return &proof, DNSSECStatusSecure
+}
+
+// verifyDenial checks the NSEC or NSEC3 records proving that a name or a type doesn't exist, including the
+// absence of a wildcard that could have been expanded instead.
+// It also returns whether the proven name is a delegation point.
+func (validator *DNSSECValidator) verifyDenial(msg *dns.Msg, qName string, qtype uint16, depth int) (DNSSECStatus, bool) {
+	proof, status := validator.authenticatedDenial(msg, qName, qtype, depth)
+	if status != DNSSECStatusSecure {
+		return status, false
+	}
+	nxDomain := msg.Rcode == dns.RcodeNameError
+	if len(proof.nsecs) > 0 {
+		return proof.nsecDenial(qName, qtype, nxDomain)
+	}
+	return proof.nsec3Denial(qName, qtype, nxDomain)
+}
+
+// nsecDenial checks a denial of existence using NSEC records (RFC 4035 section 5.4)
+func (proof *denialProof) nsecDenial(qName string, qtype uint16, nxDomain bool) (DNSSECStatus, bool) {
+	for _, nsec := range proof.nsecs {
+		if !strings.EqualFold(nsec.Hdr.Name, qName) {
+			continue
+		}
+		if nxDomain || !typeAbsent(nsec.TypeBitMap, qtype) {
+			return DNSSECStatusBogus, false
+		}
+		return DNSSECStatusSecure, isDelegation(nsec.TypeBitMap)
+	}
+	var covering *dns.NSEC
+	for _, nsec := range proof.nsecs {
+		if nsecCovers(nsec, qName, proof.zone) {
+			covering = nsec
+			break
+		}
+	}
+	if covering == nil {
+		return DNSSECStatusBogus, false
+	}
+	// An empty non-terminal exists, but has no records
+	if !nxDomain && dns.IsSubDomain(qName, covering.NextDomain) && !strings.EqualFold(qName, covering.NextDomain) {
+		return DNSSECStatusSecure, false
+	}
+	closestEncloser := commonAncestor(qName, covering.Hdr.Name)
+	if nextAncestor := commonAncestor(qName, covering.NextDomain); dns.CountLabel(nextAncestor) > dns.CountLabel(closestEncloser) {
+		closestEncloser = nextAncestor
+	}
+	wildcard := wildcardName(closestEncloser)
+	for _, nsec := range proof.nsecs {
+		if strings.EqualFold(nsec.Hdr.Name, wildcard) {
+			if nxDomain || !typeAbsent(nsec.TypeBitMap, qtype) {
+				return DNSSECStatusBogus, false
+			}
+			return DNSSECStatusSecure, false
+		}
+	}
+	if !nxDomain {
+		return DNSSECStatusBogus, false
+	}
+	for _, nsec := range proof.nsecs {
+		if nsecCovers(nsec, wildcard, proof.zone) {
+			return DNSSECStatusSecure, false
+		}
+	}
+	return DNSSECStatusBogus, false
+}
+
+// nsec3Denial checks a denial of existence using NSEC3 records (RFC 5155 sections 8.4 to 8.7).
+// A response relying on an opt-out span is insecure, since the name may be an unsigned delegation.
+func (proof *denialProof) nsec3Denial(qName string, qtype uint16, nxDomain bool) (DNSSECStatus, bool) {
+	for _, nsec3 := range proof.nsec3s {
+		if !nsec3.Match(qName) {
+			continue
+		}
+		if nxDomain || !typeAbsent(nsec3.TypeBitMap, qtype) {
+			return DNSSECStatusBogus, false
+		}
+		return DNSSECStatusSecure, isDelegation(nsec3.TypeBitMap)
+	}
+	// Closest encloser proof: an ancestor must exist, and the next closer name must be covered
+	closestEncloser, nextCloser := "", (*dns.NSEC3)(nil)
+	labels := dns.SplitDomainName(qName)
+	for i := 1; i <= len(labels); i++ {
+		candidate := strings.Join(labels[i:], ".") + "."
+		if !dns.IsSubDomain(proof.zone, candidate) {
+			break
+		}
+		for _, nsec3 := range proof.nsec3s {
+			if !nsec3.Match(candidate) {
+				continue
+			}
+			// Names below a delegation or a DNAME don't belong to the zone
+			if isDelegation(nsec3.TypeBitMap) || hasType(nsec3.TypeBitMap, dns.TypeDNAME) {
+				return DNSSECStatusBogus, false
+			}
+			closestEncloser = candidate
+			break
+		}
+		if len(closestEncloser) == 0 {
+			continue
+		}
+		for _, nsec3 := range proof.nsec3s {
+			if nsec3.Cover(strings.Join(labels[i-1:], ".") + ".") {
+				nextCloser = nsec3
+				break
+			}
+		}
+		break
+	}
+	if nextCloser == nil {
+		return DNSSECStatusBogus, false
+	}
+	optOut := nextCloser.Flags&1 != 0
+	wildcard := wildcardName(closestEncloser)
+	if nxDomain {
+		for _, nsec3 := range proof.nsec3s {
+			if nsec3.Cover(wildcard) {
+				if optOut {
+					return DNSSECStatusInsecure, true
+				}
+				return DNSSECStatusSecure, false
+			}
+		}
+		return DNSSECStatusBogus, false
+	}
+	if qtype == dns.TypeDS && optOut {
+		return DNSSECStatusInsecure, true
+	}
+	for _, nsec3 := range proof.nsec3s {
+		if nsec3.Match(wildcard) && typeAbsent(nsec3.TypeBitMap, qtype) {
+			return DNSSECStatusSecure, false
+		}
+	}
+	return DNSSECStatusBogus, false
+}
+
+// verifyExpansion checks that a record set synthesized from a wildcard was not hiding a name that exists
+// (RFC 4035 section 5.3.4)
+func (validator *DNSSECValidator) verifyExpansion(msg *dns.Msg, owner string, rtype uint16, sigLabels int, depth int) DNSSECStatus {
+	proof, status := validator.authenticatedDenial(msg, owner, rtype, depth)
+	if status != DNSSECStatusSecure {
+		return status
+	}
+	for _, nsec := range proof.nsecs {
+		if nsecCovers(nsec, owner, proof.zone) {
+			return DNSSECStatusSecure
+		}
+	}
+	labels := dns.SplitDomainName(owner)
+	if sigLabels >= len(labels) {
+		return DNSSECStatusBogus
+	}
+	nextCloser := strings.Join(labels[len(labels)-sigLabels-1:], ".") + "."
+	for _, nsec3 := range proof.nsec3s {
+		if nsec3.Cover(nextCloser) {
+			return DNSSECStatusSecure
+		}
+	}
+	return DNSSECStatusBogus
+}
+
+// expandedLabels returns the number of labels of the wildcard a record set was synthesized from, or -1
+func expandedLabels(owner string, sigs []*dns.RRSIG) int {
+	ownerLabels := dns.CountLabel(owner)
+	if strings.HasPrefix(owner, "*.") {
+		ownerLabels--
+	}
+	labels := -1
+	for _, sig := range sigs {
+		if int(sig.Labels) < ownerLabels && (labels < 0 || int(sig.Labels) < labels) {
+			labels = int(sig.Labels)
+		}
+	}
+	return labels
+}
+
+func hasType(typeBitMap []uint16, rtype uint16) bool {
+	for _, t := range typeBitMap {
+		if t == rtype {
+			return true
+		}
+	}
+	return false
+}
+
+// typeAbsent tells whether a type bitmap proves that a type doesn't exist, and isn't replaced by a CNAME.
+// At a delegation point, the parent zone is only authoritative for the DS set.
+func typeAbsent(typeBitMap []uint16, qtype uint16) bool {
+	if hasType(typeBitMap, qtype) || hasType(typeBitMap, dns.TypeCNAME) {
+		return false
+	}
+	return qtype == dns.TypeDS || !isDelegation(typeBitMap)
+}
+
+func isDelegation(typeBitMap []uint16) bool {
+	return hasType(typeBitMap, dns.TypeNS) && !hasType(typeBitMap, dns.TypeSOA)
+}
+
+// nsecCovers tells whether a name of a zone falls strictly between the owner and the next name of an NSEC record.
+// Only the last NSEC record of the zone wraps around to the apex, and names below a delegation or a DNAME
+// are not covered by the records of the parent zone.
+func nsecCovers(nsec *dns.NSEC, name string, zone string) bool {
+	owner, next := nsec.Hdr.Name, nsec.NextDomain
+	if !dns.IsSubDomain(zone, name) || canonicalCompare(owner, name) >= 0 {
+		return false
+	}
+	if (isDelegation(nsec.TypeBitMap) || hasType(nsec.TypeBitMap, dns.TypeDNAME)) && dns.IsSubDomain(owner, name) {
+		return false
+	}
+	if canonicalCompare(owner, next) < 0 {
+		return canonicalCompare(name, next) < 0
+	}
+	return strings.EqualFold(next, zone)
+}
+
+// commonAncestor returns the longest name both names belong to
+func commonAncestor(a, b string) string {
+	labels := dns.SplitDomainName(strings.ToLower(a))
+	return strings.Join(labels[len(labels)-dns.CompareDomainName(a, b):], ".") + "."
+}
+
+func wildcardName(closestEncloser string) string {
+	if closestEncloser == "." {
+		return "*."
+	}
+	return "*." + closestEncloser
+}
+
+// canonicalCompare compares two names using the canonical DNS ordering (RFC 4034 section 6.1)
+func canonicalCompare(a, b string) int {
+	labelsA, labelsB := dns.SplitDomainName(strings.ToLower(a)), dns.SplitDomainName(strings.ToLower(b))
+	for i, j := len(labelsA)-1, len(labelsB)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(labelsA[i], labelsB[j]); c != 0 {
+			return c
+		}
+	}
+	return len(labelsA) - len(labelsB)
+}
@@ -1,25 +1,98 @@
-package main
+package proxy
 
 import (
 	"encoding/binary"
+	"errors"
 	"strings"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
+const (
+	DNSTypeSVCB  uint16 = 64
+	DNSTypeHTTPS uint16 = 65
+)
+
+// questionEnd returns the offset right after the question section of a packet, which can only
+// have zero or one question. Names in a question can't be compressed, since they immediately
+// follow the header, so the records never need to be parsed.
+func questionEnd(packet []byte) (int, error) {
+	if len(packet) < 12 {
+		return 0, errors.New("Short packet")
+	}
+	qdCount := binary.BigEndian.Uint16(packet[4:6])
+	if qdCount == 0 {
+		return 12, nil
+	} else if qdCount > 1 {
+		return 0, errors.New("Unexpected number of questions")
+	}
+	offset := 12
+	for {
+		if offset >= len(packet) {
+			return 0, errors.New("Short packet")
+		}
+		labelLen := int(packet[offset])
+		if labelLen == 0 {
+			break
+		}
+		if labelLen > 63 {
+			return 0, errors.New("Unexpected label in the question")
+		}
+		offset += 1 + labelLen
+	}
+	offset += 1 + 4
+	if offset > len(packet) {
+		return 0, errors.New("Short packet")
+	}
+	return offset, nil
+}
+
+// emptyResponse copies the header and the question of a packet, turning it into a response
+// with no records
+func emptyResponse(packet []byte) ([]byte, error) {
+	end, err := questionEnd(packet)
+	if err != nil {
+		return nil, err
+	}
+	response := make([]byte, end)
+	copy(response, packet[:end])
+	response[2] |= 0x80
+	for i := 6; i < 12; i++ {
+		response[i] = 0
+	}
+	return response, nil
+}
+
+// TruncatedResponse builds a response with the TC flag set, only keeping the header and the
+// question
 func TruncatedResponse(packet []byte) ([]byte, error) {
-	srcMsg := new(dns.Msg)
-	if err := srcMsg.Unpack(packet); err != nil {
+	response, err := emptyResponse(packet)
+	if err != nil {
 		return nil, err
 	}
-	dstMsg := srcMsg
-	dstMsg.Response = true
-	dstMsg.Answer = make([]dns.RR, 0)
-	dstMsg.Ns = make([]dns.RR, 0)
-	dstMsg.Extra = make([]dns.RR, 0)
-	dstMsg.Truncated = true
-	return dstMsg.Pack()
+	response[2] |= 2
+	return response, nil
+}
+
+// RefusedResponse builds a REFUSED response to a query, without parsing the records
+func RefusedResponse(packet []byte) ([]byte, error) {
+	response, err := emptyResponse(packet)
+	if err != nil {
+		return nil, err
+	}
+	response[3] = response[3]&0xf0 | dns.RcodeRefused
+	return response, nil
+}
+
+// ServerFailureResponse builds a SERVFAIL response to a query, without parsing the records
+func ServerFailureResponse(packet []byte) ([]byte, error) {
+	response, err := emptyResponse(packet)
+	if err != nil {
+		return nil, err
+	}
+	response[3] = response[3]&0xf0 | dns.RcodeServerFailure
+	return response, nil
 }
 
 func EmptyResponseFromMessage(srcMsg *dns.Msg) (*dns.Msg, error) {
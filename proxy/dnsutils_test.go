@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func benchmarkQuery(b *testing.B) []byte {
+	msg := new(dns.Msg)
+	msg.SetQuestion("www.example.com.", dns.TypeA)
+	msg.SetEdns0(4096, true)
+	packet, err := msg.Pack()
+	if err != nil {
+		b.Fatal(err)
+	}
+	return packet
+}
+
+// BenchmarkUDPReceive compares receiving queries into buffers taken from packetBuffers with
+// allocating a new buffer for each of them
+func BenchmarkUDPReceive(b *testing.B) {
+	serverPc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer serverPc.Close()
+	clientPc, err := net.DialUDP("udp", nil, serverPc.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer clientPc.Close()
+	query := benchmarkQuery(b)
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			clientPc.Write(query)
+			buffer := packetBuffers.Get().(*[]byte)
+			if _, _, err := serverPc.ReadFrom((*buffer)[:MaxDNSPacketSize-1]); err != nil {
+				b.Fatal(err)
+			}
+			packetBuffers.Put(buffer)
+		}
+	})
+	b.Run("allocated", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			clientPc.Write(query)
+			buffer := make([]byte, MaxDNSPacketSize-1)
+			if _, _, err := serverPc.ReadFrom(buffer); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkTruncatedResponse compares building a truncated response from the header and the
+// question with parsing and packing the whole query
+func BenchmarkTruncatedResponse(b *testing.B) {
+	query := benchmarkQuery(b)
+	b.Run("header", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := TruncatedResponse(query); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("message", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			msg := new(dns.Msg)
+			if err := msg.Unpack(query); err != nil {
+				b.Fatal(err)
+			}
+			response, _ := EmptyResponseFromMessage(msg)
+			response.Truncated = true
+			if _, err := response.Pack(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestTruncatedResponse(t *testing.T) {
+	msg := new(dns.Msg)
+	msg.SetQuestion("www.example.com.", dns.TypeA)
+	msg.SetEdns0(4096, true)
+	query, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet, err := TruncatedResponse(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := new(dns.Msg)
+	if err := response.Unpack(packet); err != nil && err != dns.ErrTruncated {
+		t.Fatal(err)
+	}
+	if !response.Response || !response.Truncated || response.Id != msg.Id {
+		t.Fatal("Unexpected header in the truncated response")
+	}
+	if len(response.Question) != 1 || response.Question[0] != msg.Question[0] || len(response.Extra) != 0 {
+		t.Fatal("The truncated response should only include the question")
+	}
+	if _, err := TruncatedResponse(query[:len(query)-15]); err == nil {
+		t.Fatal("A short packet should be rejected")
+	}
+}
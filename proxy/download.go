@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	DownloadTimeout = 30 * time.Second
+	// Maximum number of requests made to download a file, as long as each one makes progress
+	DownloadMaxAttempts = 10
+	DownloadChunkSize   = 16384
+)
+
+// DownloadLimiter is a token bucket limiting the bandwidth used by all the downloads of sources
+// and lists, so that they don't saturate slow links
+type DownloadLimiter struct {
+	sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewDownloadLimiter returns a limiter allowing `rate` kilobytes per second
+func NewDownloadLimiter(rate int) *DownloadLimiter {
+	bytesPerSecond := float64(rate) * 1024
+	return &DownloadLimiter{rate: bytesPerSecond, burst: bytesPerSecond, tokens: bytesPerSecond, last: time.Now()}
+}
+
+// wait takes `n` tokens from the bucket, and waits until the bucket is no longer in debt
+func (limiter *DownloadLimiter) wait(n int) {
+	limiter.Lock()
+	defer limiter.Unlock()
+	now := time.Now()
+	limiter.tokens += now.Sub(limiter.last).Seconds() * limiter.rate
+	if limiter.tokens > limiter.burst {
+		limiter.tokens = limiter.burst
+	}
+	limiter.last = now
+	limiter.tokens -= float64(n)
+	if limiter.tokens < 0 {
+		time.Sleep(time.Duration(-limiter.tokens / limiter.rate * float64(time.Second)))
+	}
+}
+
+type rateLimitedReader struct {
+	reader  io.Reader
+	limiter *DownloadLimiter
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > DownloadChunkSize {
+		p = p[:DownloadChunkSize]
+	}
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.limiter.wait(n)
+	}
+	return n, err
+}
+
+// partialDownload is the beginning of a file whose download was interrupted, along with the
+// ETag or the modification date of the file, required to resume it
+type partialDownload struct {
+	validator string
+	data      []byte
+}
+
+type PartialDownloads struct {
+	sync.Mutex
+	downloads map[string]partialDownload
+}
+
+// Download retrieves a file, at the rate allowed by the download limiter, if there is one.
+// Interrupted downloads are resumed with range requests, if the server supports them and the
+// file hasn't changed in the meantime. What has already been received is kept in memory, so
+// that the next attempt to download the same file can also resume it.
+func (xTransport *XTransport) Download(url *url.URL) ([]byte, error) {
+	key := url.String()
+	xTransport.partialDownloads.Lock()
+	partial := xTransport.partialDownloads.downloads[key]
+	delete(xTransport.partialDownloads.downloads, key)
+	xTransport.partialDownloads.Unlock()
+
+	var err error
+	for attempt := 0; attempt < DownloadMaxAttempts; attempt++ {
+		var headers map[string]string
+		if len(partial.data) > 0 {
+			dlog.Infof("Resuming the download of [%s] after %d bytes", url, len(partial.data))
+			headers = map[string]string{
+				"Range":    fmt.Sprintf("bytes=%d-", len(partial.data)),
+				"If-Range": partial.validator,
+			}
+		}
+		var resp *http.Response
+		resp, _, err = xTransport.Fetch("GET", url, "", "", nil, DownloadTimeout, nil, headers)
+		if err != nil {
+			if resp != nil {
+				resp.Body.Close()
+				if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+					partial = partialDownload{}
+					continue
+				}
+			}
+			break
+		}
+		if resp.StatusCode != http.StatusPartialContent ||
+			!strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", len(partial.data))) {
+			partial = partialDownload{}
+		}
+		if len(partial.data) == 0 {
+			partial.validator = resp.Header.Get("ETag")
+			if len(partial.validator) == 0 || strings.HasPrefix(partial.validator, "W/") {
+				partial.validator = resp.Header.Get("Last-Modified")
+			}
+			// Ranges of transparently decompressed responses can't be requested
+			if resp.Uncompressed {
+				partial.validator = ""
+			}
+		}
+		var reader io.Reader = resp.Body
+		if xTransport.downloadLimiter != nil {
+			reader = &rateLimitedReader{reader: reader, limiter: xTransport.downloadLimiter}
+		}
+		bin, readErr := ioutil.ReadAll(io.LimitReader(reader, int64(MaxHTTPBodyLength-len(partial.data))))
+		resp.Body.Close()
+		partial.data = append(partial.data, bin...)
+		if readErr == nil {
+			return partial.data, nil
+		}
+		err = readErr
+		if len(bin) == 0 || len(partial.validator) == 0 {
+			break
+		}
+	}
+	if len(partial.data) > 0 && len(partial.validator) > 0 {
+		xTransport.partialDownloads.Lock()
+		xTransport.partialDownloads.downloads[key] = partial
+		xTransport.partialDownloads.Unlock()
+	}
+	return nil, err
+}
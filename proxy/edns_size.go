@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+const (
+	DefaultEDNSBufferSize = 1232
+	MinEDNSBufferSize     = 512
+	// Consecutive UDP timeouts of a server that is otherwise responsive before its buffer size is lowered
+	EDNSSizeMaxTimeouts = 3
+	// A server is considered responsive if it answered over UDP this recently
+	EDNSSizeResponsiveWindow = time.Minute
+)
+
+// Buffer sizes successively advertised to a server whose large responses get lost, presumably
+// because they are fragmented
+var ednsFallbackSizes = []int{1024, 768, MinEDNSBufferSize}
+
+// EDNSSize keeps track of the largest UDP response a DNSCrypt server can send without it being
+// lost. It is kept when the server information is refreshed.
+// A nil *EDNSSize is valid, and never lowers the buffer size.
+type EDNSSize struct {
+	sync.Mutex
+	size        int
+	timeouts    int
+	lastSuccess time.Time
+}
+
+// limit returns the size of the UDP responses the server can send, 0 meaning no other limit than
+// edns_buffer_size
+func (ednsSize *EDNSSize) limit() int {
+	if ednsSize == nil {
+		return 0
+	}
+	ednsSize.Lock()
+	defer ednsSize.Unlock()
+	return ednsSize.size
+}
+
+// observe accounts for the result of a UDP exchange, and lowers the buffer size after a number of
+// consecutive timeouts while the server keeps answering other queries
+func (ednsSize *EDNSSize) observe(serverName string, configuredSize int, err error) {
+	if ednsSize == nil {
+		return
+	}
+	ednsSize.Lock()
+	defer ednsSize.Unlock()
+	if err == nil {
+		ednsSize.timeouts, ednsSize.lastSuccess = 0, time.Now()
+		return
+	}
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		return
+	}
+	if time.Since(ednsSize.lastSuccess) > EDNSSizeResponsiveWindow {
+		return
+	}
+	if ednsSize.timeouts++; ednsSize.timeouts < EDNSSizeMaxTimeouts {
+		return
+	}
+	ednsSize.timeouts = 0
+	current := ednsSize.size
+	if current == 0 {
+		current = configuredSize
+	}
+	for _, size := range ednsFallbackSizes {
+		if size < current {
+			ednsSize.size = size
+			dlog.Noticef("[%s] UDP responses seem to get lost - Lowering the EDNS buffer size to %d", serverName, size)
+			return
+		}
+	}
+}
+
+// withEDNSPayloadSize returns a copy of a query whose advertised payload size doesn't exceed maxSize
+func withEDNSPayloadSize(query []byte, maxSize int) []byte {
+	msg := dns.Msg{}
+	if err := msg.Unpack(query); err != nil {
+		return query
+	}
+	opt := msg.IsEdns0()
+	if opt == nil || int(opt.UDPSize()) <= maxSize {
+		return query
+	}
+	opt.SetUDPSize(uint16(maxSize))
+	packet, err := msg.Pack()
+	if err != nil {
+		return query
+	}
+	return packet
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+// startHealthCheckServer serves /healthz, for load balancers and orchestrators, and /metrics.
+// The health check fails as long as no upstream servers are usable.
+func (proxy *Proxy) startHealthCheckServer() error {
+	listener, err := net.Listen("tcp", proxy.healthCheckAddress)
+	if err != nil {
+		return err
+	}
+	proxy.trackListener(listener)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Cache-Control", "no-store")
+		if atomic.LoadInt32(&proxy.stopping) != 0 {
+			http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		if proxy.serversInfo.usableServers() == 0 {
+			http.Error(w, "No upstream servers are reachable", http.StatusServiceUnavailable)
+			return
+		}
+		if proxy.standby != nil && !proxy.standby.isActive() {
+			fmt.Fprintln(w, "OK - standing by")
+			return
+		}
+		fmt.Fprintln(w, "OK")
+	})
+	mux.HandleFunc("/metrics", proxy.serveMetrics)
+	if proxy.haKey != nil {
+		mux.HandleFunc("/ha/state", proxy.serveHAState)
+	}
+	server := &http.Server{Handler: mux, ReadTimeout: 10 * time.Second, WriteTimeout: 10 * time.Second}
+	dlog.Noticef("Health check available at http://%s/healthz", proxy.healthCheckAddress)
+	go func() {
+		if err := server.Serve(listener); err != nil && atomic.LoadInt32(&proxy.stopping) == 0 {
+			dlog.Errorf("Health check: %v", err)
+		}
+	}()
+	return nil
+}
+
+// usableServers returns the number of live servers that are not temporarily disabled
+func (serversInfo *ServersInfo) usableServers() int {
+	serversInfo.RLock()
+	defer serversInfo.RUnlock()
+	usable := 0
+	for _, serverInfo := range serversInfo.inner {
+		if !serverInfo.isDown() {
+			usable++
+		}
+	}
+	return usable
+}
+
+// HealthCheck sends a query to a running proxy, using its first listening address, so that
+// the whole path, including the plugins and the upstream servers, is verified
+func HealthCheck(config *Config) error {
+	if len(config.ListenAddresses) == 0 {
+		return errors.New("No listening addresses are configured")
+	}
+	host, port, err := net.SplitHostPort(config.ListenAddresses[0])
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		if ip != nil && ip.To4() == nil {
+			host = "::1"
+		} else {
+			host = "127.0.0.1"
+		}
+	}
+	address := net.JoinHostPort(host, port)
+	msg := new(dns.Msg)
+	msg.SetQuestion(".", dns.TypeNS)
+	// Leave enough time for the proxy to retry with other servers
+	client := dns.Client{Net: "udp", Timeout: time.Duration(config.Timeout)*time.Millisecond + time.Second}
+	response, rtt, err := client.Exchange(msg, address)
+	if err == nil && response.Truncated {
+		client.Net = "tcp"
+		response, rtt, err = client.Exchange(msg, address)
+	}
+	if err != nil {
+		return fmt.Errorf("No response from [%s]: %v", address, err)
+	}
+	if response.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("[%s] returned %s", address, dns.RcodeToString[response.Rcode])
+	}
+	fmt.Printf("OK - rtt: %dms\n", rtt.Nanoseconds()/1000000)
+	return nil
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+const (
+	// Responses of the last-resort resolver are not cached longer than this, so that the
+	// regular servers are used again as soon as they are back
+	LastResortMaxTTL = 60
+	// Minimum interval between two warnings about queries sent to the last-resort resolver
+	LastResortWarningInterval = time.Minute
+)
+
+type LastResortConfig struct {
+	Resolver string `toml:"resolver"`
+	Enabled  bool   `toml:"enabled"`
+}
+
+// LastResort is a resolver, usually a plaintext one, that queries are sent to when none of the
+// servers answered them. It trades privacy for availability, so it has to be explicitly
+// enabled, and its use is always reported.
+type LastResort struct {
+	sync.Mutex
+	address     string
+	outgoing    *Outgoing
+	timeout     time.Duration
+	lastWarning time.Time
+	unreported  int
+}
+
+func NewLastResort(config *LastResortConfig, outgoing *Outgoing, timeout time.Duration) (*LastResort, error) {
+	if _, _, err := net.SplitHostPort(config.Resolver); err != nil {
+		return nil, err
+	}
+	if !config.Enabled {
+		dlog.Noticef("The last-resort resolver [%s] is not enabled -- Set `enabled = true` to use it", config.Resolver)
+		return nil, nil
+	}
+	dlog.Warnf("WARNING: queries will be sent UNENCRYPTED to the last-resort resolver [%s] when no servers respond", config.Resolver)
+	return &LastResort{address: config.Resolver, outgoing: outgoing, timeout: timeout}, nil
+}
+
+// exchange sends a query to the last-resort resolver
+func (lastResort *LastResort) exchange(query []byte) ([]byte, error) {
+	msg := dns.Msg{}
+	if err := msg.Unpack(query); err != nil {
+		return nil, err
+	}
+	if len(msg.Question) != 1 {
+		return nil, errors.New("Unexpected number of questions")
+	}
+	client := dns.Client{Net: "udp", Timeout: lastResort.timeout}
+	response, _, err := PlaintextExchange(lastResort.outgoing, &client, &msg, lastResort.address)
+	if err != nil {
+		dlog.Warnf("The last-resort resolver [%s] failed too: %v", lastResort.address, err)
+		return nil, err
+	}
+	lastResort.report(msg.Question[0].Name)
+	setMaxTTL(response, LastResortMaxTTL)
+	response.Id = msg.Id
+	return response.Pack()
+}
+
+// report logs the queries answered by the last-resort resolver, at most once per interval
+func (lastResort *LastResort) report(qName string) {
+	lastResort.Lock()
+	defer lastResort.Unlock()
+	lastResort.unreported++
+	if time.Since(lastResort.lastWarning) < LastResortWarningInterval {
+		return
+	}
+	dlog.Warnf("WARNING: no servers responded -- %d queries (latest: [%s]) sent UNENCRYPTED to the last-resort resolver [%s]",
+		lastResort.unreported, StripTrailingDot(qName), lastResort.address)
+	lastResort.lastWarning = time.Now()
+	lastResort.unreported = 0
+}
@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// overBudgetResponse is sent when a query couldn't be resolved within the latency budget:
+// the expired response from the cache if there is one, or SERVFAIL. Answering right away
+// prevents clients from retrying while the proxy is still waiting for the same servers.
+func (proxy *Proxy) overBudgetResponse(pluginsState *PluginsState, query []byte) ([]byte, error) {
+	if proxy.pluginsSettings().cache {
+		msg := dns.Msg{}
+		if err := msg.Unpack(query); err == nil {
+			if cacheKey, err := computeCacheKey(pluginsState, &msg); err == nil {
+				if stale, ok := cachedResponses.stale(cacheKey); ok {
+					updateTTL(stale, time.Now().Add(OptimisticStaleTTL))
+					stale.Id = msg.Id
+					stale.Response = true
+					stale.Compress = true
+					stale.Question = msg.Question
+					return stale.Pack()
+				}
+			}
+		}
+	}
+	return ServerFailureResponse(query)
+}
+
+// stale returns a copy of a cached response, even if it has expired
+func (cachedResponses *CachedResponses) stale(cacheKey [32]byte) (*dns.Msg, bool) {
+	shard := cachedResponses.shard(cacheKey)
+	shard.Lock()
+	defer shard.Unlock()
+	if shard.cache == nil {
+		return nil, false
+	}
+	cached, ok := shard.cache.Get(cacheKey)
+	if !ok {
+		return nil, false
+	}
+	return cached.msg.Copy(), true
+}
@@ -0,0 +1,229 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const localDoHContentType = "application/dns-message"
+
+// LocalDoHServer accepts DNS-over-HTTPS queries from clients, that can be required to present
+// a certificate signed by a given authority, a bearer token, or both
+type LocalDoHServer struct {
+	listenAddresses []string
+	path            string
+	tlsConfig       *tls.Config
+	tokens          [][]byte
+	// Sockets bound before privileges are dropped, or inherited from systemd
+	listeners map[string]*net.TCPListener
+}
+
+func NewLocalDoHServer(config *LocalDoHConfig) (*LocalDoHServer, error) {
+	if len(config.CertFile) == 0 || len(config.CertKeyFile) == 0 {
+		return nil, errors.New("cert_file and cert_key_file are required")
+	}
+	cert, err := tls.LoadX509KeyPair(config.CertFile, config.CertKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	server := LocalDoHServer{
+		listenAddresses: config.ListenAddresses,
+		path:            config.Path,
+		tlsConfig:       &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12},
+		listeners:       make(map[string]*net.TCPListener),
+	}
+	if len(server.path) == 0 {
+		server.path = "/dns-query"
+	}
+	if len(config.ClientCAFile) > 0 {
+		bin, err := ioutil.ReadFile(config.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(bin) {
+			return nil, fmt.Errorf("No certificates found in [%s]", config.ClientCAFile)
+		}
+		server.tlsConfig.ClientCAs = clientCAs
+		server.tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	for _, token := range config.Tokens {
+		if len(token) < 16 {
+			return nil, errors.New("Tokens must be at least 16 characters long")
+		}
+		server.tokens = append(server.tokens, []byte(token))
+	}
+	// Clients beyond the local host have to authenticate
+	if server.tlsConfig.ClientCAs == nil && len(server.tokens) == 0 {
+		for _, address := range server.listenAddresses {
+			if err := checkLoopbackAddress(address); err != nil {
+				return nil, fmt.Errorf("%v -- client_ca_file or tokens must be set to accept remote clients", err)
+			}
+		}
+	}
+	return &server, nil
+}
+
+// authorized checks the bearer token of a request, if tokens are required. Client certificates
+// are verified during the TLS handshake.
+func (server *LocalDoHServer) authorized(r *http.Request) bool {
+	if len(server.tokens) == 0 {
+		return true
+	}
+	authorization := r.Header.Get("Authorization")
+	if len(authorization) < 7 || !strings.EqualFold(authorization[:7], "Bearer ") {
+		return false
+	}
+	token := []byte(strings.TrimSpace(authorization[7:]))
+	found := 0
+	for _, candidate := range server.tokens {
+		found |= subtle.ConstantTimeCompare(token, candidate)
+	}
+	return found == 1
+}
+
+// readQuery extracts the query of a GET or POST request, as described in RFC 8484
+func readQuery(r *http.Request) ([]byte, int) {
+	switch r.Method {
+	case http.MethodGet:
+		query, err := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		if err != nil || len(query) == 0 {
+			return nil, http.StatusBadRequest
+		}
+		return query, 0
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != localDoHContentType {
+			return nil, http.StatusUnsupportedMediaType
+		}
+		query, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(MaxDNSPacketSize+1)))
+		if err != nil || len(query) == 0 {
+			return nil, http.StatusBadRequest
+		}
+		if len(query) > MaxDNSPacketSize {
+			return nil, http.StatusRequestEntityTooLarge
+		}
+		return query, 0
+	}
+	return nil, http.StatusMethodNotAllowed
+}
+
+func (proxy *Proxy) serveLocalDoH(w http.ResponseWriter, r *http.Request) {
+	server := proxy.localDoHServer
+	if r.URL.Path != server.path {
+		http.NotFound(w, r)
+		return
+	}
+	clientAddr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	if !proxy.clientAllowed(clientAddr) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if !server.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	query, status := readQuery(r)
+	if query == nil {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	if !proxy.clientsCountInc() {
+		proxy.warnOverload()
+		http.Error(w, "Too many clients", http.StatusServiceUnavailable)
+		return
+	}
+	defer proxy.clientsCountDec()
+	addr := net.Addr(clientAddr)
+	response := proxy.resolveQuery(proxy.serversInfo.getOne(), "doh", "tcp", query, &addr, nil)
+	if response == nil {
+		http.Error(w, "The query was dropped", http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", localDoHContentType)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(response)
+}
+
+// adopt keeps a socket inherited from systemd, or from the parent process after privileges were
+// dropped, if it is bound to one of the DoH addresses
+func (server *LocalDoHServer) adopt(listener *net.TCPListener) bool {
+	key := listenerKey(listener.Addr())
+	for _, address := range server.listenAddresses {
+		if addr, err := net.ResolveTCPAddr("tcp", address); err == nil && listenerKey(addr) == key {
+			server.listeners[key] = listener
+			return true
+		}
+	}
+	return false
+}
+
+// bind binds the DoH addresses that were not inherited, and returns the new sockets
+func (server *LocalDoHServer) bind(proxy *Proxy) ([]*net.TCPListener, error) {
+	var bound []*net.TCPListener
+	for _, address := range server.listenAddresses {
+		addr, err := net.ResolveTCPAddr("tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		key := listenerKey(addr)
+		if _, ok := server.listeners[key]; ok {
+			continue
+		}
+		var listener *net.TCPListener
+		if proxy.freebind(addr.IP) {
+			listener, err = listenTCPFreebind(addr, false)
+		} else {
+			listener, err = net.ListenTCP("tcp", addr)
+		}
+		if err != nil {
+			return nil, err
+		}
+		server.listeners[key] = listener
+		bound = append(bound, listener)
+	}
+	return bound, nil
+}
+
+// startLocalDoH serves DNS-over-HTTPS on the sockets bound to the addresses of the [local_doh] section
+func (proxy *Proxy) startLocalDoH() {
+	server := proxy.localDoHServer
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", proxy.serveLocalDoH)
+	for _, listener := range server.listeners {
+		listener := listener
+		proxy.trackListener(listener)
+		httpServer := &http.Server{
+			Handler:      mux,
+			TLSConfig:    server.tlsConfig,
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: proxy.timeout + 10*time.Second,
+			IdleTimeout:  proxy.tcpIdleTimeout,
+		}
+		dlog.Noticef("Now listening to https://%v%s [DoH]", listener.Addr(), server.path)
+		go func() {
+			if err := httpServer.ServeTLS(listener, "", ""); err != nil && atomic.LoadInt32(&proxy.stopping) == 0 {
+				dlog.Errorf("DoH server: %v", err)
+			}
+		}()
+	}
+	// The sockets are closed on shutdown, and bound again if the proxy is restarted
+	server.listeners = make(map[string]*net.TCPListener)
+}
@@ -0,0 +1,24 @@
+package proxy
+
+import "time"
+
+// Interval between two checks of the maintenance window, by tasks waiting for it to open
+const MaintenanceWindowCheckInterval = time.Minute
+
+// inMaintenanceWindow returns true if background downloads and disk writes are allowed now
+func (proxy *Proxy) inMaintenanceWindow() bool {
+	return proxy.maintenanceWindow == nil || proxy.maintenanceWindow.Match()
+}
+
+// waitForMaintenanceWindow blocks until the maintenance window, if there is one, is open, and
+// returns false if stop is closed first
+func waitForMaintenanceWindow(window *WeeklyRanges, stop chan struct{}) bool {
+	for window != nil && !window.Match() {
+		select {
+		case <-time.After(MaintenanceWindowCheckInterval):
+		case <-stop:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+// Number of bytes of a malformed packet that are logged
+const MalformedSampleSize = 64
+
+// Reasons why a query sent by a client can be rejected
+const (
+	MalformedShort = iota
+	MalformedLong
+	MalformedResponse
+	MalformedOpcode
+	MalformedQuestionCount
+	MalformedQuestion
+	MalformedRecords
+	malformedReasons
+)
+
+var malformedNames = [malformedReasons]string{
+	MalformedShort:         "too_short",
+	MalformedLong:          "too_long",
+	MalformedResponse:      "response",
+	MalformedOpcode:        "unsupported_opcode",
+	MalformedQuestionCount: "question_count",
+	MalformedQuestion:      "invalid_question",
+	MalformedRecords:       "invalid_records",
+}
+
+// MalformedCounters counts the queries dropped because they were malformed, per reason
+type MalformedCounters struct {
+	counts [malformedReasons]uint64
+}
+
+// MalformedStats maps the reasons why queries were dropped to their number
+type MalformedStats map[string]uint64
+
+func (counters *MalformedCounters) snapshot() MalformedStats {
+	snapshot := make(MalformedStats)
+	for reason, name := range malformedNames {
+		if count := atomic.LoadUint64(&counters.counts[reason]); count > 0 {
+			snapshot[name] = count
+		}
+	}
+	return snapshot
+}
+
+// validateQuery checks a query sent by a client before it is processed, and returns -1 if it
+// is valid, or the reason why it is not. It never panics, even on arbitrary input.
+func validateQuery(packet []byte) (reason int) {
+	defer func() {
+		if recover() != nil {
+			reason = MalformedRecords
+		}
+	}()
+	if len(packet) < MinDNSPacketSize {
+		return MalformedShort
+	}
+	if len(packet) > MaxDNSPacketSize {
+		return MalformedLong
+	}
+	if packet[2]&0x80 != 0 {
+		return MalformedResponse
+	}
+	if opcode := (packet[2] >> 3) & 0x0f; opcode != dns.OpcodeQuery {
+		return MalformedOpcode
+	}
+	// Queries without a question are valid when they only carry a DNS cookie
+	if binary.BigEndian.Uint16(packet[4:6]) > 1 {
+		return MalformedQuestionCount
+	}
+	if _, err := questionEnd(packet); err != nil {
+		return MalformedQuestion
+	}
+	msg := dns.Msg{}
+	if err := msg.Unpack(packet); err != nil {
+		return MalformedRecords
+	}
+	return -1
+}
+
+// rejectMalformedQuery returns true, after counting it, if a query is malformed
+func (proxy *Proxy) rejectMalformedQuery(packet []byte, clientAddr *net.Addr) bool {
+	reason := validateQuery(packet)
+	if reason < 0 {
+		return false
+	}
+	atomic.AddUint64(&proxy.malformed.counts[reason], 1)
+	if proxy.logMalformedQueries {
+		sample := packet
+		if len(sample) > MalformedSampleSize {
+			sample = sample[:MalformedSampleSize]
+		}
+		client := "-"
+		if clientAddr != nil {
+			client = fmt.Sprint(*clientAddr)
+		}
+		dlog.Debugf("Malformed query (%s) from [%s], %d bytes: %s", malformedNames[reason], client, len(packet), hex.EncodeToString(sample))
+	}
+	return true
+}
@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var metricsLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// serveMetrics exposes the statistics, including the per-server ones, in the Prometheus text
+// format
+func (proxy *Proxy) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	snapshot := proxy.stats.Snapshot(proxy)
+	var buf bytes.Buffer
+	metric := func(name string, kind string, help string) {
+		fmt.Fprintf(&buf, "# HELP dnscrypt_proxy_%s %s\n# TYPE dnscrypt_proxy_%s %s\n", name, help, name, kind)
+	}
+	metric("uptime_seconds", "gauge", "Time since the proxy started")
+	fmt.Fprintf(&buf, "dnscrypt_proxy_uptime_seconds %d\n", snapshot.Uptime)
+	metric("queries_total", "counter", "Queries received")
+	fmt.Fprintf(&buf, "dnscrypt_proxy_queries_total %d\n", snapshot.Queries)
+	metric("blocked_queries_total", "counter", "Queries blocked by a filter")
+	fmt.Fprintf(&buf, "dnscrypt_proxy_blocked_queries_total %d\n", snapshot.Blocked)
+	metric("failed_queries_total", "counter", "Queries no server could answer")
+	fmt.Fprintf(&buf, "dnscrypt_proxy_failed_queries_total %d\n", snapshot.Failures)
+	metric("active_clients", "gauge", "Queries being processed")
+	fmt.Fprintf(&buf, "dnscrypt_proxy_active_clients %d\n", snapshot.ActiveConns)
+	metric("cache_entries", "gauge", "Entries in the cache")
+	fmt.Fprintf(&buf, "dnscrypt_proxy_cache_entries %d\n", snapshot.Cache.Entries)
+	metric("cache_lookups_total", "counter", "Cache lookups, by result")
+	fmt.Fprintf(&buf, "dnscrypt_proxy_cache_lookups_total{result=\"hit\"} %d\n", snapshot.Cache.Hits)
+	fmt.Fprintf(&buf, "dnscrypt_proxy_cache_lookups_total{result=\"miss\"} %d\n", snapshot.Cache.Misses)
+
+	metric("server_up", "gauge", "Whether a live server is currently used")
+	for _, server := range snapshot.Servers {
+		up := 1
+		if server.Down {
+			up = 0
+		}
+		fmt.Fprintf(&buf, "dnscrypt_proxy_server_up{%s} %d\n", serverMetricLabels(&server), up)
+	}
+	metric("server_rtt_milliseconds", "gauge", "Smoothed round-trip time of a server")
+	for _, server := range snapshot.Servers {
+		fmt.Fprintf(&buf, "dnscrypt_proxy_server_rtt_milliseconds{%s} %d\n", serverMetricLabels(&server), server.RTT)
+	}
+	metric("server_exchanges_total", "counter", "Exchanges with a server, by result; errors include timeouts")
+	for _, server := range snapshot.Servers {
+		labels := serverMetricLabels(&server)
+		fmt.Fprintf(&buf, "dnscrypt_proxy_server_exchanges_total{%s,result=\"success\"} %d\n", labels, server.Successes)
+		fmt.Fprintf(&buf, "dnscrypt_proxy_server_exchanges_total{%s,result=\"error\"} %d\n", labels, server.Errors)
+	}
+	metric("server_timeouts_total", "counter", "Exchanges with a server that timed out")
+	for _, server := range snapshot.Servers {
+		fmt.Fprintf(&buf, "dnscrypt_proxy_server_timeouts_total{%s} %d\n", serverMetricLabels(&server), server.Timeouts)
+	}
+	metric("server_latency_milliseconds", "gauge", "Latency percentiles of the most recent successful exchanges with a server")
+	for _, server := range snapshot.Servers {
+		labels := serverMetricLabels(&server)
+		fmt.Fprintf(&buf, "dnscrypt_proxy_server_latency_milliseconds{%s,quantile=\"0.5\"} %d\n", labels, server.LatencyP50)
+		fmt.Fprintf(&buf, "dnscrypt_proxy_server_latency_milliseconds{%s,quantile=\"0.9\"} %d\n", labels, server.LatencyP90)
+		fmt.Fprintf(&buf, "dnscrypt_proxy_server_latency_milliseconds{%s,quantile=\"0.99\"} %d\n", labels, server.LatencyP99)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(buf.Bytes())
+}
+
+func serverMetricLabels(server *ServerHealth) string {
+	return fmt.Sprintf("server=\"%s\",proto=\"%s\"", metricsLabelEscaper.Replace(server.Name), server.Proto)
+}
@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Maximum age of the neighbor tables
+	NeighborsRefreshInterval = 30 * time.Second
+	// Minimum delay between two refreshes, when clients are not found
+	NeighborsMinRefreshInterval = 5 * time.Second
+)
+
+// Neighbors maps the IP addresses of the devices of the local networks to their MAC address,
+// using the ARP and NDP tables of the system. The tables are read again in the background when
+// they get old, or when a client is not found.
+type Neighbors struct {
+	sync.Mutex
+	hardwareAddrs map[string]string
+	lastRefresh   time.Time
+	refreshing    bool
+}
+
+// lookup returns the MAC address of a client, or an empty string if it is not known yet
+func (neighbors *Neighbors) lookup(ip net.IP) string {
+	neighbors.Lock()
+	defer neighbors.Unlock()
+	hardwareAddr, found := neighbors.hardwareAddrs[ip.String()]
+	age := time.Since(neighbors.lastRefresh)
+	if !neighbors.refreshing && (age >= NeighborsRefreshInterval || (!found && age >= NeighborsMinRefreshInterval)) {
+		neighbors.refreshing = true
+		go neighbors.refresh()
+	}
+	return hardwareAddr
+}
+
+func (neighbors *Neighbors) refresh() {
+	hardwareAddrs := parseNeighbors(neighborTables())
+	neighbors.Lock()
+	neighbors.hardwareAddrs = hardwareAddrs
+	neighbors.lastRefresh = time.Now()
+	neighbors.refreshing = false
+	neighbors.Unlock()
+}
+
+// parseNeighbors extracts the IP and MAC addresses from the neighbor tables, whatever tool they
+// come from: on every line, the first IP address is mapped to the first unicast MAC address
+func parseNeighbors(tables [][]byte) map[string]string {
+	hardwareAddrs := make(map[string]string)
+	for _, table := range tables {
+		for _, line := range strings.Split(string(table), "\n") {
+			var ip net.IP
+			var hardwareAddr net.HardwareAddr
+			for _, token := range strings.Fields(line) {
+				token = strings.Trim(token, "()[]")
+				if ip == nil {
+					if zone := strings.IndexByte(token, '%'); zone >= 0 {
+						token = token[:zone]
+					}
+					if ip = net.ParseIP(token); ip != nil {
+						continue
+					}
+				}
+				if hardwareAddr = parseNeighborHardwareAddr(token); hardwareAddr != nil {
+					break
+				}
+			}
+			if ip != nil && hardwareAddr != nil {
+				if ipv4 := ip.To4(); ipv4 != nil {
+					ip = ipv4
+				}
+				hardwareAddrs[ip.String()] = hardwareAddr.String()
+			}
+		}
+	}
+	return hardwareAddrs
+}
+
+// parseNeighborHardwareAddr parses a unicast MAC address, whose leading zeros can be omitted
+func parseNeighborHardwareAddr(str string) net.HardwareAddr {
+	separator := ":"
+	if strings.Contains(str, "-") {
+		separator = "-"
+	}
+	parts := strings.Split(str, separator)
+	if len(parts) != 6 {
+		return nil
+	}
+	for i, part := range parts {
+		if len(part) == 1 {
+			parts[i] = "0" + part
+		}
+	}
+	hardwareAddr, err := net.ParseMAC(strings.Join(parts, ":"))
+	if err != nil || hardwareAddr[0]&1 != 0 {
+		return nil
+	}
+	for _, b := range hardwareAddr {
+		if b != 0 {
+			return hardwareAddr
+		}
+	}
+	return nil
+}
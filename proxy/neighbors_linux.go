@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	sizeofNdMsg = 12
+	ndaDst      = 1
+	ndaLladdr   = 2
+)
+
+const neighborsRequireExec = false
+
+// neighborTables returns the ARP table, and the NDP table. The NDP table is dumped over a netlink
+// socket, so that no command has to be executed, which the sandbox wouldn't allow.
+func neighborTables() [][]byte {
+	var tables [][]byte
+	if bin, err := ioutil.ReadFile("/proc/net/arp"); err == nil {
+		tables = append(tables, bin)
+	}
+	if table, err := netlinkNeighbors(syscall.AF_INET6); err == nil {
+		tables = append(tables, table)
+	}
+	return tables
+}
+
+// netlinkNeighbors returns the neighbors of an address family, as `<IP address> <MAC address>`
+// lines
+func netlinkNeighbors(family int) ([]byte, error) {
+	rib, err := syscall.NetlinkRIB(syscall.RTM_GETNEIGH, family)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return nil, err
+	}
+	var table bytes.Buffer
+	for _, msg := range msgs {
+		if msg.Header.Type != syscall.RTM_NEWNEIGH || len(msg.Data) < sizeofNdMsg {
+			continue
+		}
+		var ip net.IP
+		var hardwareAddr net.HardwareAddr
+		for attrs := msg.Data[sizeofNdMsg:]; len(attrs) >= syscall.SizeofRtAttr; {
+			attr := (*syscall.RtAttr)(unsafe.Pointer(&attrs[0]))
+			attrLen := int(attr.Len)
+			if attrLen < syscall.SizeofRtAttr || attrLen > len(attrs) {
+				break
+			}
+			value := attrs[syscall.SizeofRtAttr:attrLen]
+			switch attr.Type {
+			case ndaDst:
+				ip = net.IP(value)
+			case ndaLladdr:
+				hardwareAddr = net.HardwareAddr(value)
+			}
+			attrLen = (attrLen + syscall.RTA_ALIGNTO - 1) &^ (syscall.RTA_ALIGNTO - 1)
+			if attrLen > len(attrs) {
+				break
+			}
+			attrs = attrs[attrLen:]
+		}
+		if len(ip) == net.IPv6len && len(hardwareAddr) == 6 {
+			fmt.Fprintf(&table, "%s %s\n", ip, hardwareAddr)
+		}
+	}
+	return table.Bytes(), nil
+}
@@ -0,0 +1,19 @@
+// +build !linux,!windows
+
+package proxy
+
+import "os/exec"
+
+// The tables are read with the arp and ndp commands
+const neighborsRequireExec = true
+
+func neighborTables() [][]byte {
+	var tables [][]byte
+	if output, err := exec.Command("arp", "-an").Output(); err == nil {
+		tables = append(tables, output)
+	}
+	if output, err := exec.Command("ndp", "-an").Output(); err == nil {
+		tables = append(tables, output)
+	}
+	return tables
+}
@@ -0,0 +1,17 @@
+package proxy
+
+import "os/exec"
+
+// The tables are read with the arp and netsh commands
+const neighborsRequireExec = true
+
+func neighborTables() [][]byte {
+	var tables [][]byte
+	if output, err := exec.Command("arp", "-a").Output(); err == nil {
+		tables = append(tables, output)
+	}
+	if output, err := exec.Command("netsh", "interface", "ipv6", "show", "neighbors").Output(); err == nil {
+		tables = append(tables, output)
+	}
+	return tables
+}
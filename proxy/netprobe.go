@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"net"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const MaxNetprobeTimeout = 600
+
+// NetProbe waits until a route to the given address is available, for up to timeout seconds.
+// A negative timeout waits for the maximum allowed time; a zero timeout disables the probe.
+func NetProbe(outgoing *Outgoing, address string, timeout int) error {
+	if len(address) == 0 || timeout == 0 {
+		return nil
+	}
+	if _, err := net.ResolveUDPAddr("udp", address); err != nil {
+		return err
+	}
+	if timeout < 0 || timeout > MaxNetprobeTimeout {
+		timeout = MaxNetprobeTimeout
+	}
+	retried := false
+	for tries := timeout; tries > 0; tries-- {
+		pc, err := outgoing.Dial("udp", address, 0)
+		if err != nil {
+			if !retried {
+				retried = true
+				dlog.Notice("Network not available yet -- waiting...")
+			}
+			dlog.Debug(err)
+			time.Sleep(1 * time.Second)
+			continue
+		}
+		pc.Close()
+		if retried {
+			dlog.Notice("Network connectivity detected")
+		}
+		return nil
+	}
+	dlog.Error("Timeout while waiting for network connectivity")
+	return nil
+}
@@ -0,0 +1,294 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/jedisct1/dlog"
+)
+
+const DefaultNetworkProfilesCheckInterval = 30
+
+type NetworkProfile struct {
+	name            string
+	gatewayMACs     []string
+	ssids           []string
+	dhcpDomains     []string
+	serverNames     []string
+	forwardFile     string
+	listenAddresses []string
+}
+
+type NetworkInfo struct {
+	gatewayMAC string
+	ssid       string
+	dhcpDomain string
+}
+
+type NetworkProfiles struct {
+	sync.RWMutex
+	profiles       []NetworkProfile
+	defaultProfile string
+	ssidFile       string
+	checkInterval  time.Duration
+	active         *NetworkProfile
+	pinned         bool
+}
+
+func NewNetworkProfiles(config NetworkProfilesConfig) *NetworkProfiles {
+	networkProfiles := NetworkProfiles{
+		defaultProfile: config.Default,
+		ssidFile:       config.SSIDFile,
+		checkInterval:  time.Duration(config.CheckInterval) * time.Second,
+	}
+	for name, profileConfig := range config.Profiles {
+		networkProfiles.profiles = append(networkProfiles.profiles, NetworkProfile{
+			name:            name,
+			gatewayMACs:     profileConfig.GatewayMACs,
+			ssids:           profileConfig.SSIDs,
+			dhcpDomains:     profileConfig.DHCPDomains,
+			serverNames:     profileConfig.ServerNames,
+			forwardFile:     profileConfig.ForwardFile,
+			listenAddresses: profileConfig.ListenAddresses,
+		})
+	}
+	sort.Slice(networkProfiles.profiles, func(i, j int) bool {
+		return networkProfiles.profiles[i].name < networkProfiles.profiles[j].name
+	})
+	return &networkProfiles
+}
+
+// Active returns the profile matching the current network, or nil if none matches
+func (networkProfiles *NetworkProfiles) Active() *NetworkProfile {
+	if networkProfiles == nil {
+		return nil
+	}
+	networkProfiles.RLock()
+	active := networkProfiles.active
+	networkProfiles.RUnlock()
+	return active
+}
+
+func (networkProfiles *NetworkProfiles) hasForwardingRules() bool {
+	if networkProfiles == nil {
+		return false
+	}
+	for _, profile := range networkProfiles.profiles {
+		if len(profile.forwardFile) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (networkProfiles *NetworkProfiles) profile(name string) *NetworkProfile {
+	for i := range networkProfiles.profiles {
+		if networkProfiles.profiles[i].name == name {
+			return &networkProfiles.profiles[i]
+		}
+	}
+	return nil
+}
+
+// Pin forces a profile to be used regardless of the current network, until Pin("") is called
+func (networkProfiles *NetworkProfiles) Pin(name string) error {
+	if len(name) == 0 {
+		networkProfiles.Lock()
+		networkProfiles.pinned = false
+		networkProfiles.Unlock()
+		dlog.Notice("The network profile is now selected automatically")
+		networkProfiles.Update()
+		return nil
+	}
+	found := networkProfiles.profile(name)
+	if found == nil {
+		return fmt.Errorf("Network profile [%s] not found", name)
+	}
+	networkProfiles.Lock()
+	networkProfiles.active, networkProfiles.pinned = found, true
+	networkProfiles.Unlock()
+	dlog.Noticef("Switching to the [%s] network profile until it is changed back", name)
+	return nil
+}
+
+// Status returns the active profile, whether it has been pinned, and the names of all the profiles
+func (networkProfiles *NetworkProfiles) Status() (string, bool, []string) {
+	names := make([]string, len(networkProfiles.profiles))
+	for i := range networkProfiles.profiles {
+		names[i] = networkProfiles.profiles[i].name
+	}
+	networkProfiles.RLock()
+	defer networkProfiles.RUnlock()
+	active := ""
+	if networkProfiles.active != nil {
+		active = networkProfiles.active.name
+	}
+	return active, networkProfiles.pinned, names
+}
+
+// Update detects the current network and switches to the matching profile, unless a profile
+// has been pinned. It returns true if the active profile changed.
+func (networkProfiles *NetworkProfiles) Update() bool {
+	networkProfiles.RLock()
+	pinned := networkProfiles.pinned
+	networkProfiles.RUnlock()
+	if pinned {
+		return false
+	}
+	networkInfo := DetectNetworkInfo(networkProfiles.ssidFile)
+	var found *NetworkProfile
+	for i := range networkProfiles.profiles {
+		if networkProfiles.profiles[i].matches(&networkInfo) {
+			found = &networkProfiles.profiles[i]
+			break
+		}
+	}
+	if found == nil && len(networkProfiles.defaultProfile) > 0 {
+		found = networkProfiles.profile(networkProfiles.defaultProfile)
+	}
+	networkProfiles.Lock()
+	previous := networkProfiles.active
+	networkProfiles.active = found
+	networkProfiles.Unlock()
+	if previous == found {
+		return false
+	}
+	if found == nil {
+		dlog.Noticef("No network profile matches the current network (gateway: [%s], SSID: [%s], domain: [%s])", networkInfo.gatewayMAC, networkInfo.ssid, networkInfo.dhcpDomain)
+		return true
+	}
+	dlog.Noticef("Switching to the [%s] network profile", found.name)
+	if previous != nil && !sameStrings(previous.listenAddresses, found.listenAddresses) {
+		dlog.Warnf("The [%s] network profile uses different listen addresses -- restart the proxy to apply them", found.name)
+	}
+	return true
+}
+
+// Monitor periodically checks whether the network changed
+func (networkProfiles *NetworkProfiles) Monitor() {
+	if networkProfiles.checkInterval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			time.Sleep(networkProfiles.checkInterval)
+			networkProfiles.Update()
+		}
+	}()
+}
+
+func (profile *NetworkProfile) matches(networkInfo *NetworkInfo) bool {
+	if len(networkInfo.gatewayMAC) > 0 {
+		for _, mac := range profile.gatewayMACs {
+			if hw, err := net.ParseMAC(mac); err == nil && hw.String() == networkInfo.gatewayMAC {
+				return true
+			}
+		}
+	}
+	if len(networkInfo.ssid) > 0 {
+		for _, ssid := range profile.ssids {
+			if ssid == networkInfo.ssid {
+				return true
+			}
+		}
+	}
+	if len(networkInfo.dhcpDomain) > 0 {
+		for _, domain := range profile.dhcpDomains {
+			if strings.EqualFold(StripTrailingDot(domain), networkInfo.dhcpDomain) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func sameStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// DetectNetworkInfo collects what can be used to recognize the current network.
+// The SSID can't be reliably retrieved without platform-specific tools, so it is
+// read from a hint file that an external script is expected to keep up to date.
+func DetectNetworkInfo(ssidFile string) NetworkInfo {
+	networkInfo := NetworkInfo{
+		gatewayMAC: defaultGatewayMAC(),
+		dhcpDomain: searchDomain("/etc/resolv.conf"),
+	}
+	if len(ssidFile) > 0 {
+		if bin, err := ioutil.ReadFile(ssidFile); err == nil {
+			networkInfo.ssid = strings.TrimFunc(string(bin), unicode.IsSpace)
+		}
+	}
+	return networkInfo
+}
+
+// defaultGatewayMAC returns the hardware address of the IPv4 default gateway, using the Linux procfs
+func defaultGatewayMAC() string {
+	bin, err := ioutil.ReadFile("/proc/net/route")
+	if err != nil {
+		return ""
+	}
+	var gateway net.IP
+	for _, line := range strings.Split(string(bin), "\n")[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		gatewayBin, err := hex.DecodeString(fields[2])
+		if err != nil || len(gatewayBin) != 4 {
+			continue
+		}
+		gateway = make(net.IP, 4)
+		binary.BigEndian.PutUint32(gateway, binary.LittleEndian.Uint32(gatewayBin))
+		break
+	}
+	if gateway == nil {
+		return ""
+	}
+	bin, err = ioutil.ReadFile("/proc/net/arp")
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(bin), "\n")[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || !gateway.Equal(net.ParseIP(fields[0])) {
+			continue
+		}
+		if hw, err := net.ParseMAC(fields[3]); err == nil {
+			return hw.String()
+		}
+	}
+	return ""
+}
+
+// searchDomain returns the domain pushed by the DHCP server, as found in a resolv.conf file
+func searchDomain(resolvConf string) string {
+	bin, err := ioutil.ReadFile(resolvConf)
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(bin), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || (fields[0] != "domain" && fields[0] != "search") {
+			continue
+		}
+		return strings.ToLower(StripTrailingDot(fields[1]))
+	}
+	return ""
+}
@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+// Some servers, usually run by ISPs, answer queries for names that don't exist with the address
+// of their own web server. Servers are probed with random names to find them out, and their
+// forged answers can be turned back into NXDOMAIN responses.
+const (
+	NXRedirectOff = iota
+	NXRedirectDetect
+	NXRedirectStrip
+)
+
+var nxRedirectNames = []string{"off", "detect", "strip"}
+
+func parseNXRedirectProtection(str string) (int, error) {
+	for mode, name := range nxRedirectNames {
+		if str == name {
+			return mode, nil
+		}
+	}
+	return NXRedirectOff, fmt.Errorf("Unsupported NXDOMAIN redirect protection [%s] -- Use off, detect or strip", str)
+}
+
+// NXRedirect keeps the addresses a server returned for names that don't exist. It is kept when
+// the server information is refreshed.
+type NXRedirect struct {
+	sync.Mutex
+	ips map[string]bool
+}
+
+func (nxRedirect *NXRedirect) detected() bool {
+	if nxRedirect == nil {
+		return false
+	}
+	nxRedirect.Lock()
+	defer nxRedirect.Unlock()
+	return len(nxRedirect.ips) > 0
+}
+
+// randomNonexistentName returns a name that can't reasonably have been registered
+func randomNonexistentName() (string, error) {
+	var bin [16]byte
+	if _, err := rand.Read(bin[:]); err != nil {
+		return "", err
+	}
+	label := make([]byte, len(bin))
+	for i, b := range bin {
+		label[i] = 'a' + b%26
+	}
+	return "nx-" + string(label) + ".com.", nil
+}
+
+// detectNXRedirects sends a query for a random name to every live server, and records the
+// addresses of the servers that answer it
+func (serversInfo *ServersInfo) detectNXRedirects(proxy *Proxy) {
+	serversInfo.RLock()
+	inner := append([]*ServerInfo{}, serversInfo.inner...)
+	serversInfo.RUnlock()
+	for _, serverInfo := range inner {
+		if serverInfo.isDown() || serverInfo.nxRedirect == nil {
+			continue
+		}
+		name, err := randomNonexistentName()
+		if err != nil {
+			return
+		}
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		msg.RecursionDesired = true
+		query, err := msg.Pack()
+		if err != nil {
+			return
+		}
+		response, err := proxy.exchangeWithServer(serverInfo, proxy.mainProto, query, proxy.timeout)
+		if err != nil {
+			dlog.Debugf("NXDOMAIN redirect probe for [%s] failed: %v", serverInfo.Name, err)
+			continue
+		}
+		responseMsg := dns.Msg{}
+		if err := responseMsg.Unpack(response); err != nil || responseMsg.Rcode != dns.RcodeSuccess {
+			continue
+		}
+		ips := answerIPs(&responseMsg)
+		if len(ips) == 0 {
+			continue
+		}
+		nxRedirect := serverInfo.nxRedirect
+		nxRedirect.Lock()
+		if nxRedirect.ips == nil {
+			dlog.Warnf("Server [%s] answers queries for names that don't exist with [%s] -- Its NXDOMAIN responses are redirected", serverInfo.Name, strings.Join(ips, ", "))
+			nxRedirect.ips = make(map[string]bool)
+		}
+		for _, ip := range ips {
+			nxRedirect.ips[ip] = true
+		}
+		nxRedirect.Unlock()
+	}
+}
+
+func answerIPs(msg *dns.Msg) []string {
+	var ips []string
+	for _, rr := range msg.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		ips = append(ips, ip.String())
+	}
+	return ips
+}
+
+// strip turns a response into a NXDOMAIN response if all its addresses are the ones the server
+// returns for names that don't exist
+func (nxRedirect *NXRedirect) strip(response []byte) []byte {
+	if !nxRedirect.detected() || Rcode(response) != dns.RcodeSuccess {
+		return response
+	}
+	msg := dns.Msg{}
+	if err := msg.Unpack(response); err != nil {
+		return response
+	}
+	ips := answerIPs(&msg)
+	if len(ips) == 0 {
+		return response
+	}
+	nxRedirect.Lock()
+	for _, ip := range ips {
+		if !nxRedirect.ips[ip] {
+			nxRedirect.Unlock()
+			return response
+		}
+	}
+	nxRedirect.Unlock()
+	msg.Rcode = dns.RcodeNameError
+	msg.Answer = nil
+	stripped, err := msg.PackBuffer(response)
+	if err != nil {
+		return response
+	}
+	return stripped
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	clocksmith "github.com/jedisct1/go-clocksmith"
+)
+
+// In offline mode, queries are only answered using the cache, cloaking rules, local zones and
+// forwarding rules. Anything that would have been sent to an upstream server gets a SERVFAIL
+// response right away, instead of waiting for a timeout.
+const (
+	OfflineModeOff int32 = iota
+	OfflineModeOn
+	OfflineModeAuto
+)
+
+var offlineModeNames = []string{"off", "on", "auto"}
+
+// Interval between connectivity checks, when the offline mode is automatic
+const OfflineProbeInterval = 10 * time.Second
+
+// TTL of the expired cache entries that are served in offline mode (RFC 8767)
+const OfflineStaleTTL = 30 * time.Second
+
+func parseOfflineMode(str string) (int32, error) {
+	for mode, name := range offlineModeNames {
+		if str == name {
+			return int32(mode), nil
+		}
+	}
+	return OfflineModeOff, fmt.Errorf("Unsupported offline mode [%s] -- Use off, on or auto", str)
+}
+
+// isOffline returns true if queries shouldn't be sent to upstream servers
+func (proxy *Proxy) isOffline() bool {
+	switch atomic.LoadInt32(&proxy.offlineMode) {
+	case OfflineModeOn:
+		return true
+	case OfflineModeAuto:
+		return atomic.LoadInt32(&proxy.networkDown) != 0
+	}
+	return false
+}
+
+func (proxy *Proxy) setOfflineMode(mode int32) error {
+	if mode == OfflineModeAuto && len(proxy.netprobeAddress) == 0 {
+		return errors.New("The automatic offline mode requires a netprobe_address")
+	}
+	atomic.StoreInt32(&proxy.offlineMode, mode)
+	dlog.Noticef("Offline mode: %s", offlineModeNames[mode])
+	return nil
+}
+
+// probeConnectivity checks if a route to the netprobe address is available, and switches to
+// the offline mode when it's not, if the offline mode is automatic
+func (proxy *Proxy) probeConnectivity() {
+	networkDown := int32(0)
+	pc, err := proxy.outgoing.Dial("udp", proxy.netprobeAddress, 0)
+	if err != nil {
+		dlog.Debug(err)
+		networkDown = 1
+	} else {
+		pc.Close()
+	}
+	if atomic.SwapInt32(&proxy.networkDown, networkDown) == networkDown {
+		return
+	}
+	if atomic.LoadInt32(&proxy.offlineMode) != OfflineModeAuto {
+		return
+	}
+	if networkDown != 0 {
+		dlog.Notice("Network not available -- Switching to offline mode")
+	} else {
+		dlog.Notice("Network connectivity detected -- Leaving offline mode")
+	}
+}
+
+func (proxy *Proxy) monitorConnectivity() {
+	proxy.probeConnectivity()
+	go func() {
+		for {
+			clocksmith.Sleep(OfflineProbeInterval)
+			if atomic.LoadInt32(&proxy.stopping) != 0 {
+				return
+			}
+			proxy.probeConnectivity()
+		}
+	}()
+}
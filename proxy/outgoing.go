@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Default timeout of exchanges using a DNS client without a timeout, same as the DNS library
+const OutgoingDefaultTimeout = 2 * time.Second
+
+// Outgoing describes how sockets to upstream servers, bootstrap resolvers and forwarding
+// targets are created: from a given source address, bound to an interface, and/or with a
+// firewall mark that policy routing rules can match. Packets can also be marked with a
+// DSCP value, for QoS policies.
+// A nil *Outgoing uses the default settings of the system.
+type Outgoing struct {
+	ipv4   net.IP
+	ipv6   net.IP
+	iface  string
+	fwmark uint32
+	dscp   int
+}
+
+func NewOutgoing(config *OutgoingConfig) (*Outgoing, error) {
+	if len(config.Addresses) == 0 && len(config.Interface) == 0 && config.Fwmark == 0 && config.DSCP == 0 {
+		return nil, nil
+	}
+	if config.DSCP < 0 || config.DSCP > 63 {
+		return nil, fmt.Errorf("Invalid DSCP value: [%d] - It must be between 0 and 63", config.DSCP)
+	}
+	outgoing := Outgoing{iface: config.Interface, fwmark: config.Fwmark, dscp: config.DSCP}
+	for _, address := range config.Addresses {
+		ip := net.ParseIP(strings.TrimSpace(address))
+		if ip == nil {
+			return nil, fmt.Errorf("Invalid outgoing address: [%s]", address)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			if outgoing.ipv4 != nil {
+				return nil, errors.New("Only one IPv4 outgoing address can be set")
+			}
+			outgoing.ipv4 = ip4
+		} else {
+			if outgoing.ipv6 != nil {
+				return nil, errors.New("Only one IPv6 outgoing address can be set")
+			}
+			outgoing.ipv6 = ip
+		}
+	}
+	if (len(config.Interface) > 0 || config.Fwmark != 0) && !outgoingSocketOptionsSupported {
+		return nil, errors.New("Outgoing interfaces and fwmarks are only supported on Linux")
+	}
+	return &outgoing, nil
+}
+
+// Dial connects to a remote address; the timeout only applies to the connection itself
+func (outgoing *Outgoing) Dial(network string, address string, timeout time.Duration) (net.Conn, error) {
+	return outgoing.DialFromPort(network, address, timeout, 0)
+}
+
+// DialFromPort is like Dial, using a given local port; 0 lets the system choose it
+func (outgoing *Outgoing) DialFromPort(network string, address string, timeout time.Duration, localPort int) (net.Conn, error) {
+	conn, err := outgoing.dial(network, address, timeout, localPort)
+	if err != nil || outgoing == nil || outgoing.dscp == 0 {
+		return conn, err
+	}
+	if err := outgoing.setDSCP(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// setDSCP sets the DSCP value of the packets sent over a connection. The ECN bits are left unset.
+func (outgoing *Outgoing) setDSCP(conn net.Conn) error {
+	var ip net.IP
+	switch remoteAddr := conn.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		ip = remoteAddr.IP
+	case *net.TCPAddr:
+		ip = remoteAddr.IP
+	}
+	if ip.To4() != nil {
+		return ipv4.NewConn(conn).SetTOS(outgoing.dscp << 2)
+	}
+	return ipv6.NewConn(conn).SetTrafficClass(outgoing.dscp << 2)
+}
+
+func (outgoing *Outgoing) dial(network string, address string, timeout time.Duration, localPort int) (net.Conn, error) {
+	if outgoing == nil {
+		if localPort == 0 {
+			return net.DialTimeout(network, address, timeout)
+		}
+		dialer := net.Dialer{Timeout: timeout, LocalAddr: localAddr(network, nil, localPort)}
+		return dialer.Dial(network, address)
+	}
+	var ip net.IP
+	var port int
+	if strings.HasPrefix(network, "udp") {
+		udpAddr, err := net.ResolveUDPAddr(network, address)
+		if err != nil {
+			return nil, err
+		}
+		ip, port = udpAddr.IP, udpAddr.Port
+	} else {
+		tcpAddr, err := net.ResolveTCPAddr(network, address)
+		if err != nil {
+			return nil, err
+		}
+		ip, port = tcpAddr.IP, tcpAddr.Port
+	}
+	localIP := outgoing.ipv6
+	if ip.To4() != nil {
+		localIP = outgoing.ipv4
+	}
+	if len(outgoing.iface) > 0 || outgoing.fwmark != 0 {
+		return outgoing.dialWithSocketOptions(network, ip, port, localIP, localPort, timeout)
+	}
+	dialer := net.Dialer{Timeout: timeout}
+	if localIP != nil || localPort != 0 {
+		dialer.LocalAddr = localAddr(network, localIP, localPort)
+	}
+	return dialer.Dial(network, net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+}
+
+func localAddr(network string, ip net.IP, port int) net.Addr {
+	if strings.HasPrefix(network, "udp") {
+		return &net.UDPAddr{IP: ip, Port: port}
+	}
+	return &net.TCPAddr{IP: ip, Port: port}
+}
+
+// Exchange is the equivalent of client.Exchange(), using the outgoing settings. Only the
+// network, the timeout and the UDP buffer size of the client are taken into account.
+func (outgoing *Outgoing) Exchange(client *dns.Client, msg *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	if outgoing == nil {
+		return client.Exchange(msg, address)
+	}
+	network := client.Net
+	if len(network) == 0 {
+		network = "udp"
+	}
+	timeout := client.Timeout
+	if timeout <= 0 {
+		timeout = OutgoingDefaultTimeout
+	}
+	conn, err := outgoing.Dial(network, address, timeout)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	co := dns.Conn{Conn: conn, UDPSize: client.UDPSize}
+	if opt := msg.IsEdns0(); opt != nil && opt.UDPSize() >= dns.MinMsgSize {
+		co.UDPSize = opt.UDPSize()
+	}
+	start := time.Now()
+	co.SetDeadline(start.Add(timeout))
+	if err := co.WriteMsg(msg); err != nil {
+		return nil, 0, err
+	}
+	response, err := co.ReadMsg()
+	rtt := time.Since(start)
+	if err == nil && response.Id != msg.Id {
+		err = dns.ErrId
+	}
+	return response, rtt, err
+}
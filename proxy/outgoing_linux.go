@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const outgoingSocketOptionsSupported = true
+
+// dialWithSocketOptions creates a socket with SO_MARK and SO_BINDTODEVICE set before it is
+// connected. Connecting is a blocking call, whose timeout is set with SO_SNDTIMEO.
+func (outgoing *Outgoing) dialWithSocketOptions(network string, ip net.IP, port int, localIP net.IP, localPort int, timeout time.Duration) (net.Conn, error) {
+	family := syscall.AF_INET
+	var sockaddr, localSockaddr syscall.Sockaddr
+	if ip4 := ip.To4(); ip4 != nil {
+		sockaddr4 := &syscall.SockaddrInet4{Port: port}
+		copy(sockaddr4.Addr[:], ip4)
+		sockaddr = sockaddr4
+		if localIP != nil || localPort != 0 {
+			localSockaddr4 := &syscall.SockaddrInet4{Port: localPort}
+			if localIP != nil {
+				copy(localSockaddr4.Addr[:], localIP.To4())
+			}
+			localSockaddr = localSockaddr4
+		}
+	} else {
+		family = syscall.AF_INET6
+		sockaddr6 := &syscall.SockaddrInet6{Port: port}
+		copy(sockaddr6.Addr[:], ip.To16())
+		sockaddr = sockaddr6
+		if localIP != nil || localPort != 0 {
+			localSockaddr6 := &syscall.SockaddrInet6{Port: localPort}
+			if localIP != nil {
+				copy(localSockaddr6.Addr[:], localIP.To16())
+			}
+			localSockaddr = localSockaddr6
+		}
+	}
+	sotype, proto := syscall.SOCK_STREAM, syscall.IPPROTO_TCP
+	if strings.HasPrefix(network, "udp") {
+		sotype, proto = syscall.SOCK_DGRAM, syscall.IPPROTO_UDP
+	}
+	fd, err := syscall.Socket(family, sotype, proto)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	syscall.CloseOnExec(fd)
+	if outgoing.fwmark != 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_MARK, int(outgoing.fwmark)); err != nil {
+			syscall.Close(fd)
+			return nil, os.NewSyscallError("setsockopt", err)
+		}
+	}
+	if len(outgoing.iface) > 0 {
+		if err := syscall.BindToDevice(fd, outgoing.iface); err != nil {
+			syscall.Close(fd)
+			return nil, os.NewSyscallError("setsockopt", err)
+		}
+	}
+	if localSockaddr != nil {
+		if err := syscall.Bind(fd, localSockaddr); err != nil {
+			syscall.Close(fd)
+			return nil, os.NewSyscallError("bind", err)
+		}
+	}
+	if timeout > 0 {
+		tv := syscall.NsecToTimeval(timeout.Nanoseconds())
+		syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_SNDTIMEO, &tv)
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		err = syscall.Connect(fd, sockaddr)
+		// An interrupted connection keeps going; connecting again waits for it to complete
+		if err == syscall.EINTR && (timeout <= 0 || time.Now().Before(deadline)) {
+			continue
+		}
+		break
+	}
+	switch err {
+	case nil, syscall.EISCONN:
+	case syscall.EINPROGRESS, syscall.EALREADY, syscall.EAGAIN, syscall.EINTR:
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("connect", syscall.ETIMEDOUT)
+	default:
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("connect", err)
+	}
+	if timeout > 0 {
+		var tv syscall.Timeval
+		syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_SNDTIMEO, &tv)
+	}
+	file := os.NewFile(uintptr(fd), net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+	defer file.Close()
+	return net.FileConn(file)
+}
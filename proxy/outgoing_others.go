@@ -0,0 +1,15 @@
+// +build !linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+const outgoingSocketOptionsSupported = false
+
+func (outgoing *Outgoing) dialWithSocketOptions(network string, ip net.IP, port int, localIP net.IP, localPort int, timeout time.Duration) (net.Conn, error) {
+	return nil, errors.New("Outgoing interfaces and fwmarks are not supported on this platform")
+}
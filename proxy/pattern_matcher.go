@@ -1,9 +1,10 @@
-package main
+package proxy
 
 import (
 	"fmt"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/k-sone/critbitgo"
 
@@ -23,23 +24,29 @@ const (
 
 type PatternMatcher struct {
 	blockedPrefixes   *critbitgo.Trie
-	blockedSuffixes   *critbitgo.Trie
+	blockedSuffixes   *SuffixSet
 	blockedSubstrings []string
 	blockedPatterns   []string
-	blockedExact      map[string]interface{}
+	blockedExact      *SuffixSet
 	indirectVals      map[string]interface{}
+	compileOnce       sync.Once
 }
 
 func NewPatternPatcher() *PatternMatcher {
 	patternMatcher := PatternMatcher{
 		blockedPrefixes: critbitgo.NewTrie(),
-		blockedSuffixes: critbitgo.NewTrie(),
-		blockedExact:    make(map[string]interface{}),
+		blockedSuffixes: NewSuffixSet(),
+		blockedExact:    NewSuffixSet(),
 		indirectVals:    make(map[string]interface{}),
 	}
 	return &patternMatcher
 }
 
+func (patternMatcher *PatternMatcher) compile() {
+	patternMatcher.blockedSuffixes.Compile()
+	patternMatcher.blockedExact.Compile()
+}
+
 func isGlobCandidate(str string) bool {
 	for i, c := range str {
 		if c == '?' || c == '[' {
@@ -92,6 +99,7 @@ func (patternMatcher *PatternMatcher) Add(pattern string, val interface{}, posit
 	}
 
 	pattern = strings.ToLower(pattern)
+	patternMatcher.compileOnce = sync.Once{}
 	switch patternType {
 	case PatternTypeSubstring:
 		patternMatcher.blockedSubstrings = append(patternMatcher.blockedSubstrings, pattern)
@@ -106,9 +114,9 @@ func (patternMatcher *PatternMatcher) Add(pattern string, val interface{}, posit
 	case PatternTypePrefix:
 		patternMatcher.blockedPrefixes.Insert([]byte(pattern), val)
 	case PatternTypeSuffix:
-		patternMatcher.blockedSuffixes.Insert([]byte(StringReverse(pattern)), val)
+		patternMatcher.blockedSuffixes.Insert(StringReverse(pattern), val)
 	case PatternTypeExact:
-		patternMatcher.blockedExact[pattern] = val
+		patternMatcher.blockedExact.Insert(pattern, val)
 	default:
 		dlog.Fatal("Unexpected block type")
 	}
@@ -120,20 +128,12 @@ func (patternMatcher *PatternMatcher) Eval(qName string) (reject bool, reason st
 		return false, "", nil
 	}
 
+	patternMatcher.compileOnce.Do(patternMatcher.compile)
+
 	revQname := StringReverse(qName)
-	if match, xval, found := patternMatcher.blockedSuffixes.LongestPrefix([]byte(revQname)); found {
-		if len(match) == len(qName) || revQname[len(match)] == '.' {
-			return true, "*." + StringReverse(string(match)), xval
-		}
-		if len(match) < len(revQname) && len(revQname) > 0 {
-			if i := strings.LastIndex(revQname, "."); i > 0 {
-				pName := revQname[:i]
-				if match, _, found := patternMatcher.blockedSuffixes.LongestPrefix([]byte(pName)); found {
-					if len(match) == len(pName) || pName[len(match)] == '.' {
-						return true, "*." + StringReverse(string(match)), xval
-					}
-				}
-			}
+	for i := len(revQname); i > 0; i = strings.LastIndexByte(revQname[:i], '.') {
+		if xval, found := patternMatcher.blockedSuffixes.Get(revQname[:i]); found {
+			return true, "*." + StringReverse(revQname[:i]), xval
 		}
 	}
 
@@ -153,7 +153,7 @@ func (patternMatcher *PatternMatcher) Eval(qName string) (reject bool, reason st
 		}
 	}
 
-	if xval := patternMatcher.blockedExact[qName]; xval != nil {
+	if xval, found := patternMatcher.blockedExact.Get(qName); found {
 		return true, qName, xval
 	}
 
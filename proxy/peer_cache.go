@@ -0,0 +1,241 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	crypto_rand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const (
+	PeerCacheMinSecretLength = 16
+	// Queries whose timestamp differs more than this from the local clock are ignored
+	PeerCacheMaxClockSkew   = 30 * time.Second
+	DefaultPeerCacheTimeout = 50 * time.Millisecond
+	// Responses received over TCP can be larger than UDP responses
+	PeerCacheMaxPacketSize = 65535
+	// Upper bound for the number of recent queries remembered to detect replays
+	PeerCacheMaxReplayEntries = 100000
+)
+
+const (
+	peerCacheQuery = iota + 1
+	peerCacheHit
+	peerCacheMiss
+)
+
+var peerCacheMagic = [4]byte{'D', 'C', 'P', 'C'}
+
+type CachePeersConfig struct {
+	ListenAddress string   `toml:"listen_address"`
+	Peers         []string `toml:"peers"`
+	Secret        string   `toml:"secret"`
+	Timeout       int      `toml:"timeout"`
+}
+
+// PeerCache lets proxies of the same site look up the cache of each other before sending a query
+// upstream. Peers are queried over UDP, with packets encrypted and authenticated using a key
+// derived from a shared secret:
+//
+//	magic (4) || nonce (24) || secretbox(type (1) || timestamp (8) || cache key (32) || [ttl (4) || response])
+//
+// Responses repeat the timestamp and the cache key of the query, so that they can't be replayed
+// for another query, and queries seen within the allowed clock skew are not answered twice.
+// Only fresh entries are shared, and peers don't forward lookups further.
+type PeerCache struct {
+	listenAddress string
+	peers         []*net.UDPAddr
+	key           [32]byte
+	timeout       time.Duration
+	hits          uint64
+	served        uint64
+}
+
+func NewPeerCache(config *CachePeersConfig) (*PeerCache, error) {
+	if len(config.Secret) < PeerCacheMinSecretLength {
+		return nil, errors.New("[cache_peers] requires a secret of at least 16 characters")
+	}
+	peerCache := PeerCache{
+		listenAddress: config.ListenAddress,
+		key:           deriveKey([]byte(config.Secret), "dnscrypt-proxy cache peers"),
+		timeout:       DefaultPeerCacheTimeout,
+	}
+	if config.Timeout > 0 {
+		peerCache.timeout = time.Duration(config.Timeout) * time.Millisecond
+	}
+	for _, peer := range config.Peers {
+		peerAddr, err := net.ResolveUDPAddr("udp", peer)
+		if err != nil {
+			return nil, err
+		}
+		peerCache.peers = append(peerCache.peers, peerAddr)
+	}
+	return &peerCache, nil
+}
+
+// deriveKey derives a 256-bit key from a shared secret with HKDF-SHA256 (RFC 5869), the info
+// string making keys used for different purposes independent
+func deriveKey(secret []byte, info string) [32]byte {
+	extract := hmac.New(sha256.New, make([]byte, sha256.Size))
+	extract.Write(secret)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte(info))
+	expand.Write([]byte{1})
+	var key [32]byte
+	copy(key[:], expand.Sum(nil))
+	return key
+}
+
+func (peerCache *PeerCache) seal(kind byte, ts uint64, cacheKey [32]byte, payload []byte) ([]byte, error) {
+	var nonce [24]byte
+	if _, err := crypto_rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	content := make([]byte, 41, 41+len(payload))
+	content[0] = kind
+	binary.BigEndian.PutUint64(content[1:9], ts)
+	copy(content[9:41], cacheKey[:])
+	content = append(content, payload...)
+	packet := append(peerCacheMagic[:], nonce[:]...)
+	return secretbox.Seal(packet, content, &nonce, &peerCache.key), nil
+}
+
+func (peerCache *PeerCache) open(packet []byte) (byte, uint64, [32]byte, []byte, error) {
+	var cacheKey [32]byte
+	if len(packet) < 4+24+secretbox.Overhead+41 || !bytes.Equal(packet[:4], peerCacheMagic[:]) {
+		return 0, 0, cacheKey, nil, errors.New("Short or unexpected packet")
+	}
+	var nonce [24]byte
+	copy(nonce[:], packet[4:28])
+	content, ok := secretbox.Open(nil, packet[28:], &nonce, &peerCache.key)
+	if !ok {
+		return 0, 0, cacheKey, nil, errors.New("Unauthenticated packet")
+	}
+	copy(cacheKey[:], content[9:41])
+	return content[0], binary.BigEndian.Uint64(content[1:9]), cacheKey, content[41:], nil
+}
+
+// lookup asks all the peers for a cached response, and returns the first one received
+func (peerCache *PeerCache) lookup(cacheKey [32]byte) (*dns.Msg, time.Time, bool) {
+	if len(peerCache.peers) == 0 {
+		return nil, time.Time{}, false
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, time.Time{}, false
+	}
+	defer conn.Close()
+	ts := uint64(time.Now().UnixNano())
+	query, err := peerCache.seal(peerCacheQuery, ts, cacheKey, nil)
+	if err != nil {
+		return nil, time.Time{}, false
+	}
+	for _, peer := range peerCache.peers {
+		conn.WriteToUDP(query, peer)
+	}
+	conn.SetReadDeadline(time.Now().Add(peerCache.timeout))
+	buf := make([]byte, PeerCacheMaxPacketSize)
+	for misses := 0; misses < len(peerCache.peers); {
+		length, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return nil, time.Time{}, false
+		}
+		kind, responseTs, responseKey, payload, err := peerCache.open(buf[:length])
+		if err != nil || responseTs != ts || responseKey != cacheKey {
+			continue
+		}
+		if kind == peerCacheMiss {
+			misses++
+			continue
+		}
+		if kind != peerCacheHit || len(payload) < 4 {
+			continue
+		}
+		ttl := binary.BigEndian.Uint32(payload[0:4])
+		msg := dns.Msg{}
+		if ttl == 0 || msg.Unpack(payload[4:]) != nil {
+			misses++
+			continue
+		}
+		atomic.AddUint64(&peerCache.hits, 1)
+		return &msg, time.Now().Add(time.Duration(ttl) * time.Second), true
+	}
+	return nil, time.Time{}, false
+}
+
+// serve answers the lookups of the peers from the local cache
+func (peerCache *PeerCache) serve(proxy *Proxy) error {
+	if len(peerCache.listenAddress) == 0 {
+		return nil
+	}
+	listenAddr, err := net.ResolveUDPAddr("udp", peerCache.listenAddress)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", listenAddr)
+	if err != nil {
+		return err
+	}
+	proxy.trackListener(conn)
+	dlog.Noticef("Sharing the cache with peers on %v", listenAddr)
+	go func() {
+		buf := make([]byte, PeerCacheMaxPacketSize)
+		// Nonces of the queries received within the allowed clock skew, and their timestamps
+		seen := make(map[[24]byte]time.Time)
+		lastPurge := time.Now()
+		for {
+			length, clientAddr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				if atomic.LoadInt32(&proxy.stopping) == 0 {
+					dlog.Warnf("Cache peers: %v", err)
+				}
+				return
+			}
+			kind, ts, cacheKey, _, err := peerCache.open(buf[:length])
+			if err != nil || kind != peerCacheQuery {
+				continue
+			}
+			queryTime := time.Unix(0, int64(ts))
+			if skew := time.Since(queryTime); skew > PeerCacheMaxClockSkew || skew < -PeerCacheMaxClockSkew {
+				continue
+			}
+			if time.Since(lastPurge) > PeerCacheMaxClockSkew {
+				for nonce, seenTime := range seen {
+					if time.Since(seenTime) > PeerCacheMaxClockSkew {
+						delete(seen, nonce)
+					}
+				}
+				lastPurge = time.Now()
+			}
+			var nonce [24]byte
+			copy(nonce[:], buf[4:28])
+			if _, replayed := seen[nonce]; replayed || len(seen) >= PeerCacheMaxReplayEntries {
+				continue
+			}
+			seen[nonce] = queryTime
+			response, err := peerCache.seal(peerCacheMiss, ts, cacheKey, nil)
+			if msg, expiration, ok := cachedResponses.fresh(cacheKey); ok {
+				// Responses that wouldn't fit in a UDP response to a client are not shared
+				if packed, packErr := msg.Pack(); packErr == nil && len(packed) <= MaxDNSUDPPacketSize {
+					payload := make([]byte, 4, 4+len(packed))
+					binary.BigEndian.PutUint32(payload, uint32(time.Until(expiration)/time.Second))
+					response, err = peerCache.seal(peerCacheHit, ts, cacheKey, append(payload, packed...))
+					atomic.AddUint64(&peerCache.served, 1)
+				}
+			}
+			if err == nil {
+				conn.WriteToUDP(response, clientAddr)
+			}
+		}
+	}()
+	return nil
+}
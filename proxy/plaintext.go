@@ -0,0 +1,254 @@
+package proxy
+
+import (
+	"bytes"
+	crypto_rand "crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+const (
+	// Number of attempts to bind a random source port before letting the system choose one
+	PlaintextSourcePortAttempts = 8
+	// Maximum number of queries sent at the same time to a resolver over UDP, each of them
+	// using a different source port
+	PlaintextMaxPortsPerServer = 32
+)
+
+var (
+	errResponseMismatch = errors.New("Response doesn't match the query")
+	errCaseNotPreserved = errors.New("The case of the name was not preserved")
+)
+
+// PlaintextExchange sends a query to a resolver that doesn't support encryption, such as a
+// bootstrap resolver or a forwarding target. Over UDP, every query is sent from a new, random
+// source port with a cryptographically random ID, and the case of the letters of the name is
+// randomized (DNS 0x20) and must be echoed back, so that off-path attackers have to guess many
+// more bits in order to spoof a response. Responses that don't match are ignored rather than
+// failing the query, and a question is never sent more than once at a time to the same
+// resolver, so that attackers can't improve their odds by triggering many identical queries.
+// Resolvers that don't preserve the case of names are queried again over TCP.
+// The response is returned with the ID and the name of the original query.
+func PlaintextExchange(outgoing *Outgoing, client *dns.Client, msg *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	if len(msg.Question) != 1 {
+		return nil, 0, errors.New("Unexpected number of questions")
+	}
+	udp := client.Net == "" || client.Net == "udp"
+	response, rtt, err := plaintextExchange(outgoing, client, msg, address, udp)
+	if err == errCaseNotPreserved {
+		dlog.Debugf("[%s] didn't preserve the case of [%s] -- Retrying over TCP", address, msg.Question[0].Name)
+		tcpClient := dns.Client{Net: "tcp", Timeout: client.Timeout, Dialer: client.Dialer}
+		response, rtt, err = plaintextExchange(outgoing, &tcpClient, msg, address, false)
+	}
+	return response, rtt, err
+}
+
+func plaintextExchange(outgoing *Outgoing, client *dns.Client, msg *dns.Msg, address string, udp bool) (*dns.Msg, time.Duration, error) {
+	query := msg.Copy()
+	query.Id = secureQueryID()
+	name := msg.Question[0].Name
+	var response *dns.Msg
+	var rtt time.Duration
+	var err error
+	if udp {
+		query.Question[0].Name = randomizeCase(name)
+		release := plaintextInflight.acquire(address, &query.Question[0])
+		response, rtt, err = plaintextUDPExchange(outgoing, client, query, address)
+		release()
+	} else {
+		response, rtt, err = outgoing.Exchange(client, query, address)
+		if err == nil && !plaintextResponseMatches(query, response) {
+			err = errResponseMismatch
+		}
+	}
+	if err != nil {
+		return nil, rtt, err
+	}
+	question := query.Question[0]
+	if response.Question[0].Name != question.Name {
+		return nil, rtt, errCaseNotPreserved
+	}
+	response.Id = msg.Id
+	response.Question[0].Name = name
+	for _, section := range [][]dns.RR{response.Answer, response.Ns, response.Extra} {
+		for _, rr := range section {
+			if header := rr.Header(); header.Name == question.Name {
+				header.Name = name
+			}
+		}
+	}
+	return response, rtt, nil
+}
+
+// plaintextResponseMatches checks the ID and the question of a response; names are compared
+// regardless of their case, that is checked separately
+func plaintextResponseMatches(query *dns.Msg, response *dns.Msg) bool {
+	if response.Id != query.Id || len(response.Question) != 1 {
+		return false
+	}
+	question, responseQuestion := query.Question[0], response.Question[0]
+	return responseQuestion.Qtype == question.Qtype && responseQuestion.Qclass == question.Qclass &&
+		strings.EqualFold(responseQuestion.Name, question.Name)
+}
+
+// plaintextUDPExchange sends a query from a random source port, and waits for a matching
+// response until the timeout; other packets are ignored
+func plaintextUDPExchange(outgoing *Outgoing, client *dns.Client, query *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	timeout := client.Timeout
+	if timeout <= 0 {
+		timeout = OutgoingDefaultTimeout
+	}
+	var conn net.Conn
+	var err error
+	for attempt := 0; attempt < PlaintextSourcePortAttempts; attempt++ {
+		// The port may already be in use
+		if conn, err = outgoing.DialFromPort("udp", address, timeout, randomSourcePort()); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		if conn, err = outgoing.Dial("udp", address, timeout); err != nil {
+			return nil, 0, err
+		}
+	}
+	defer conn.Close()
+	co := dns.Conn{Conn: conn, UDPSize: client.UDPSize}
+	if opt := query.IsEdns0(); opt != nil && opt.UDPSize() >= dns.MinMsgSize {
+		co.UDPSize = opt.UDPSize()
+	}
+	start := time.Now()
+	co.SetDeadline(start.Add(timeout))
+	if err := co.WriteMsg(query); err != nil {
+		return nil, 0, err
+	}
+	for {
+		response, err := co.ReadMsg()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok {
+				return nil, time.Since(start), netErr
+			}
+			// Malformed packets may have been sent by an attacker
+			continue
+		}
+		if !plaintextResponseMatches(query, response) {
+			dlog.Debugf("Unexpected response from [%s] ignored", address)
+			continue
+		}
+		return response, time.Since(start), nil
+	}
+}
+
+// randomSourcePort returns a port number above the privileged ports, that doesn't rely on the
+// allocator of the system, that may be sequential
+func randomSourcePort() int {
+	var bin [2]byte
+	if _, err := crypto_rand.Read(bin[:]); err != nil {
+		return 0
+	}
+	return 1024 + int(binary.BigEndian.Uint16(bin[:]))%(65536-1024)
+}
+
+func secureQueryID() uint16 {
+	var bin [2]byte
+	if _, err := crypto_rand.Read(bin[:]); err != nil {
+		return dns.Id()
+	}
+	return binary.BigEndian.Uint16(bin[:])
+}
+
+// PlaintextInflight limits the queries sent at the same time to a plaintext resolver over UDP
+type PlaintextInflight struct {
+	sync.Mutex
+	servers   map[string]chan struct{}
+	questions map[string]chan struct{}
+}
+
+var plaintextInflight = PlaintextInflight{
+	servers:   make(map[string]chan struct{}),
+	questions: make(map[string]chan struct{}),
+}
+
+// acquire waits until the question is not being asked to the server any more, and until the
+// server has a free port; the returned function has to be called once the exchange is over
+func (inflight *PlaintextInflight) acquire(address string, question *dns.Question) func() {
+	key := fmt.Sprintf("%s/%s/%d/%d", address, strings.ToLower(question.Name), question.Qtype, question.Qclass)
+	inflight.Lock()
+	ports, ok := inflight.servers[address]
+	if !ok {
+		ports = make(chan struct{}, PlaintextMaxPortsPerServer)
+		inflight.servers[address] = ports
+	}
+	for {
+		pending, busy := inflight.questions[key]
+		if !busy {
+			break
+		}
+		inflight.Unlock()
+		<-pending
+		inflight.Lock()
+	}
+	done := make(chan struct{})
+	inflight.questions[key] = done
+	inflight.Unlock()
+	ports <- struct{}{}
+	return func() {
+		<-ports
+		inflight.Lock()
+		delete(inflight.questions, key)
+		inflight.Unlock()
+		close(done)
+	}
+}
+
+// randomizeCase flips the case of every letter of a name with a probability of 1/2
+func randomizeCase(name string) string {
+	randomized := []byte(name)
+	bits := make([]byte, (len(randomized)+7)/8)
+	if _, err := crypto_rand.Read(bits); err != nil {
+		return name
+	}
+	for i, c := range randomized {
+		if ((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')) && bits[i/8]&(1<<uint(i%8)) != 0 {
+			randomized[i] = c ^ 0x20
+		}
+	}
+	return string(randomized)
+}
+
+// responseMatchesQuery checks that a response has the ID and the question of the query it is
+// supposed to answer
+func responseMatchesQuery(query []byte, response []byte) bool {
+	queryEnd, err := questionEnd(query)
+	if err != nil {
+		return false
+	}
+	responseEnd, err := questionEnd(response)
+	if err != nil || responseEnd != queryEnd {
+		return false
+	}
+	if !bytes.Equal(query[:2], response[:2]) || !bytes.Equal(query[4:6], response[4:6]) {
+		return false
+	}
+	for i := 12; i < queryEnd-4; i++ {
+		if asciiLower(query[i]) != asciiLower(response[i]) {
+			return false
+		}
+	}
+	return bytes.Equal(query[queryEnd-4:queryEnd], response[responseEnd-4:responseEnd])
+}
+
+// asciiLower only folds ASCII letters; label lengths are below 64, and are thus never affected
+func asciiLower(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c | 0x20
+	}
+	return c
+}
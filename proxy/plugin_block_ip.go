@@ -1,9 +1,8 @@
-package main
+package proxy
 
 import (
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net"
 	"strings"
 	"time"
@@ -20,6 +19,7 @@ type PluginBlockIP struct {
 	blockedIPs      map[string]interface{}
 	logger          *lumberjack.Logger
 	format          string
+	blockedResponse *BlockedResponse
 }
 
 func (plugin *PluginBlockIP) Name() string {
@@ -32,12 +32,13 @@ func (plugin *PluginBlockIP) Description() string {
 
 func (plugin *PluginBlockIP) Init(proxy *Proxy) error {
 	dlog.Noticef("Loading the set of IP blocking rules from [%s]", proxy.blockIPFile)
-	bin, err := ioutil.ReadFile(proxy.blockIPFile)
+	bin, err := ReadRuleFile(proxy.blockIPFile)
 	if err != nil {
 		return err
 	}
 	plugin.blockedPrefixes = iradix.New()
 	plugin.blockedIPs = make(map[string]interface{})
+	plugin.blockedResponse = proxy.blockIPResponse
 	for lineNo, line := range strings.Split(string(bin), "\n") {
 		line = strings.TrimFunc(line, unicode.IsSpace)
 		if len(line) == 0 || strings.HasPrefix(line, "#") {
@@ -80,6 +81,9 @@ func (plugin *PluginBlockIP) Init(proxy *Proxy) error {
 }
 
 func (plugin *PluginBlockIP) Drop() error {
+	if plugin.logger != nil {
+		return plugin.logger.Close()
+	}
 	return nil
 }
 
@@ -121,6 +125,10 @@ func (plugin *PluginBlockIP) Eval(pluginsState *PluginsState, msg *dns.Msg) erro
 	}
 	if reject {
 		pluginsState.action = PluginsActionReject
+		pluginsState.rejectReason = reason
+		if plugin.blockedResponse != nil {
+			pluginsState.blockedResponse = plugin.blockedResponse
+		}
 		if plugin.logger != nil {
 			questions := msg.Question
 			if len(questions) != 1 {
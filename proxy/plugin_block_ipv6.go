@@ -1,8 +1,10 @@
-package main
+package proxy
 
 import "github.com/miekg/dns"
 
-type PluginBlockIPv6 struct{}
+type PluginBlockIPv6 struct {
+	ipv4ClientsOnly bool
+}
 
 func (plugin *PluginBlockIPv6) Name() string {
 	return "block_ipv6"
@@ -13,6 +15,7 @@ func (plugin *PluginBlockIPv6) Description() string {
 }
 
 func (plugin *PluginBlockIPv6) Init(proxy *Proxy) error {
+	plugin.ipv4ClientsOnly = !proxy.pluginBlockIPv6
 	return nil
 }
 
@@ -33,6 +36,11 @@ func (plugin *PluginBlockIPv6) Eval(pluginsState *PluginsState, msg *dns.Msg) er
 	if question.Qclass != dns.ClassINET || question.Qtype != dns.TypeAAAA {
 		return nil
 	}
+	// Clients connected over IPv4 may not have IPv6 connectivity, even if the proxy does
+	if plugin.ipv4ClientsOnly && pluginsState.ClientIP().To4() == nil {
+		return nil
+	}
+	hasEdns0 := msg.IsEdns0() != nil
 	synth, err := EmptyResponseFromMessage(msg)
 	if err != nil {
 		return err
@@ -42,7 +50,12 @@ func (plugin *PluginBlockIPv6) Eval(pluginsState *PluginsState, msg *dns.Msg) er
 		Class: dns.ClassINET, Ttl: 86400}
 	hinfo.Cpu = "AAAA queries have been locally blocked by dnscrypt-proxy"
 	hinfo.Os = "Set block_ipv6 to false to disable this feature"
+	if plugin.ipv4ClientsOnly {
+		hinfo.Os = "Set block_ipv6_for_ipv4_clients to false to disable this feature"
+	}
 	synth.Answer = []dns.RR{hinfo}
+	pluginsState.blockedResponse.explain(synth, hasEdns0, ExtendedErrorCodeBlocked, "AAAA queries are blocked")
+	pluginsState.audit("blocked", plugin.Name(), "AAAA", "")
 	pluginsState.synthResponse = synth
 	pluginsState.action = PluginsActionSynth
 	return nil
@@ -1,11 +1,11 @@
-package main
+package proxy
 
 import (
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net"
 	"strings"
+	"sync"
 	"time"
 	"unicode"
 
@@ -15,10 +15,13 @@ import (
 )
 
 type PluginBlockName struct {
+	sync.RWMutex
 	allWeeklyRanges *map[string]WeeklyRanges
 	patternMatcher  *PatternMatcher
 	logger          *lumberjack.Logger
+	remoteList      *RemoteList
 	format          string
+	blockedResponse *BlockedResponse
 }
 
 func (plugin *PluginBlockName) Name() string {
@@ -30,14 +33,58 @@ func (plugin *PluginBlockName) Description() string {
 }
 
 func (plugin *PluginBlockName) Init(proxy *Proxy) error {
-	dlog.Noticef("Loading the set of blocking rules from [%s]", proxy.blockNameFile)
-	bin, err := ioutil.ReadFile(proxy.blockNameFile)
-	if err != nil {
-		return err
-	}
 	plugin.allWeeklyRanges = proxy.allWeeklyRanges
-	plugin.patternMatcher = NewPatternPatcher()
-	for lineNo, line := range strings.Split(string(bin), "\n") {
+	plugin.blockedResponse = proxy.blockNameResponse
+	var localIn string
+	if len(proxy.blockNameFile) > 0 {
+		dlog.Noticef("Loading the set of blocking rules from [%s]", proxy.blockNameFile)
+		bin, err := ReadRuleFile(proxy.blockNameFile)
+		if err != nil {
+			return err
+		}
+		localIn = NormalizeBlocklist(string(bin))
+	}
+	var remoteIn string
+	if len(proxy.blockNameURLs) > 0 {
+		remoteList, err := NewRemoteList("blacklist", proxy.storage, proxy.blockNameURLs, proxy.blockNameMinisignKey, proxy.blockNameCacheFile, proxy.blockNameRefreshDelay)
+		if err != nil {
+			return err
+		}
+		remoteList.transform = NormalizeBlocklist
+		remoteList.window = proxy.maintenanceWindow
+		in, delayTillNextUpdate, err := remoteList.LoadCache()
+		if err != nil {
+			dlog.Debugf("Remote blacklist cache not available: %s", err)
+			if in, err = remoteList.Fetch(proxy.xTransport); err != nil {
+				dlog.Warnf("Unable to load the remote blacklist: %s", err)
+			}
+			delayTillNextUpdate = remoteList.refreshDelay
+			if err != nil {
+				delayTillNextUpdate = RemoteListRetryDelay
+			}
+		}
+		remoteIn = in
+		plugin.remoteList = remoteList
+		remoteList.Refresher(proxy.xTransport, delayTillNextUpdate, func(in string) {
+			patternMatcher := plugin.compile(localIn + "\n" + in)
+			plugin.Lock()
+			plugin.patternMatcher = patternMatcher
+			plugin.Unlock()
+		})
+	}
+	plugin.patternMatcher = plugin.compile(localIn + "\n" + remoteIn)
+	if len(proxy.blockNameLogFile) == 0 {
+		return nil
+	}
+	plugin.logger = &lumberjack.Logger{LocalTime: true, MaxSize: proxy.logMaxSize, MaxAge: proxy.logMaxAge, MaxBackups: proxy.logMaxBackups, Filename: proxy.blockNameLogFile, Compress: true}
+	plugin.format = proxy.blockNameFormat
+
+	return nil
+}
+
+func (plugin *PluginBlockName) compile(in string) *PatternMatcher {
+	patternMatcher := NewPatternPatcher()
+	for lineNo, line := range strings.Split(in, "\n") {
 		line = strings.TrimFunc(line, unicode.IsSpace)
 		if len(line) == 0 || strings.HasPrefix(line, "#") {
 			continue
@@ -51,7 +98,7 @@ func (plugin *PluginBlockName) Init(proxy *Proxy) error {
 			dlog.Errorf("Syntax error in block rules at line %d -- Unexpected @ character", 1+lineNo)
 			continue
 		}
-		var weeklyRanges *WeeklyRanges
+		var weeklyRanges interface{}
 		if len(timeRangeName) > 0 {
 			weeklyRangesX, ok := (*plugin.allWeeklyRanges)[timeRangeName]
 			if !ok {
@@ -60,21 +107,21 @@ func (plugin *PluginBlockName) Init(proxy *Proxy) error {
 				weeklyRanges = &weeklyRangesX
 			}
 		}
-		if _, err := plugin.patternMatcher.Add(line, weeklyRanges, lineNo+1); err != nil {
+		if _, err := patternMatcher.Add(line, weeklyRanges, lineNo+1); err != nil {
 			dlog.Error(err)
 			continue
 		}
 	}
-	if len(proxy.blockNameLogFile) == 0 {
-		return nil
-	}
-	plugin.logger = &lumberjack.Logger{LocalTime: true, MaxSize: proxy.logMaxSize, MaxAge: proxy.logMaxAge, MaxBackups: proxy.logMaxBackups, Filename: proxy.blockNameLogFile, Compress: true}
-	plugin.format = proxy.blockNameFormat
-
-	return nil
+	return patternMatcher
 }
 
 func (plugin *PluginBlockName) Drop() error {
+	if plugin.remoteList != nil {
+		plugin.remoteList.Stop()
+	}
+	if plugin.logger != nil {
+		return plugin.logger.Close()
+	}
 	return nil
 }
 
@@ -90,8 +137,10 @@ func (plugin *PluginBlockName) Eval(pluginsState *PluginsState, msg *dns.Msg) er
 	if len(questions) != 1 {
 		return nil
 	}
-	qName := strings.ToLower(StripTrailingDot(questions[0].Name))
+	qName := pluginsState.qName
+	plugin.RLock()
 	reject, reason, xweeklyRanges := plugin.patternMatcher.Eval(qName)
+	plugin.RUnlock()
 	var weeklyRanges *WeeklyRanges
 	if xweeklyRanges != nil {
 		weeklyRanges = xweeklyRanges.(*WeeklyRanges)
@@ -103,6 +152,10 @@ func (plugin *PluginBlockName) Eval(pluginsState *PluginsState, msg *dns.Msg) er
 	}
 	if reject {
 		pluginsState.action = PluginsActionReject
+		pluginsState.rejectReason = reason
+		if plugin.blockedResponse != nil {
+			pluginsState.blockedResponse = plugin.blockedResponse
+		}
 		if plugin.logger != nil {
 			var clientIPStr string
 			if pluginsState.clientProto == "udp" {
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+type PluginBlockQtype struct {
+	blockedQtypes   map[uint16]bool
+	blockedResponse *BlockedResponse
+}
+
+func (plugin *PluginBlockQtype) Name() string {
+	return "block_qtype"
+}
+
+func (plugin *PluginBlockQtype) Description() string {
+	return "Block queries for specific record types."
+}
+
+func (plugin *PluginBlockQtype) Init(proxy *Proxy) error {
+	plugin.blockedQtypes = make(map[uint16]bool)
+	for _, qtypeStr := range proxy.blockedQtypes {
+		qtype, ok := QtypeFromString(qtypeStr)
+		if !ok {
+			return fmt.Errorf("Unsupported query type: [%s]", qtypeStr)
+		}
+		plugin.blockedQtypes[qtype] = true
+	}
+	plugin.blockedResponse = proxy.blockedQtypesResponse
+	return nil
+}
+
+func (plugin *PluginBlockQtype) Drop() error {
+	return nil
+}
+
+func (plugin *PluginBlockQtype) Reload() error {
+	return nil
+}
+
+func (plugin *PluginBlockQtype) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	questions := msg.Question
+	if len(questions) != 1 {
+		return nil
+	}
+	question := questions[0]
+	if !plugin.blockedQtypes[question.Qtype] {
+		return nil
+	}
+	pluginsState.action = PluginsActionReject
+	pluginsState.rejectReason = dns.TypeToString[question.Qtype]
+	if plugin.blockedResponse != nil {
+		pluginsState.blockedResponse = plugin.blockedResponse
+	}
+	return nil
+}
+
+func QtypeFromString(str string) (uint16, bool) {
+	str = strings.ToUpper(strings.TrimSpace(str))
+	if qtype, ok := dns.StringToType[str]; ok {
+		return qtype, true
+	}
+	switch str {
+	case "SVCB":
+		return DNSTypeSVCB, true
+	case "HTTPS":
+		return DNSTypeHTTPS, true
+	}
+	if strings.HasPrefix(str, "TYPE") {
+		if qtype, err := strconv.ParseUint(str[4:], 10, 16); err == nil {
+			return uint16(qtype), true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,27 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestQtypeFromString(t *testing.T) {
+	valid := map[string]uint16{
+		"A":         dns.TypeA,
+		" aaaa ":    dns.TypeAAAA,
+		"HTTPS":     DNSTypeHTTPS,
+		"TYPE65":    65,
+		"type65535": 65535,
+	}
+	for str, expected := range valid {
+		if qtype, ok := QtypeFromString(str); !ok || qtype != expected {
+			t.Errorf("[%s] parsed as %d, %v instead of %d", str, qtype, ok, expected)
+		}
+	}
+	for _, str := range []string{"", "NOTATYPE", "TYPE", "TYPE65abc", "TYPE65536", "TYPE-1", "TYPE+1", "TYPE 1"} {
+		if qtype, ok := QtypeFromString(str); ok {
+			t.Errorf("[%s] accepted as %d", str, qtype)
+		}
+	}
+}
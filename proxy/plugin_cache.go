@@ -0,0 +1,341 @@
+package proxy
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type CachedResponse struct {
+	expiration time.Time
+	msg        dns.Msg
+}
+
+// Rough memory overhead of a cached entry, in addition to the size of the response itself:
+// key, expiration, bookkeeping of the cache, and unpacked representation of the records
+const CacheEntryOverhead = 256
+
+// Number of independently locked parts of the cache, so that concurrent lookups of different
+// names don't serialize on a single lock
+const CacheShards = 16
+
+// TTL of the stale responses sent while they are being refreshed, as suggested by RFC 8767
+const OptimisticStaleTTL = 30 * time.Second
+
+type CachedResponses struct {
+	// Updated atomically; kept first so that they are aligned on 32-bit platforms
+	hits      uint64
+	misses    uint64
+	expired   uint64
+	evictions uint64
+
+	shards [CacheShards]cacheShard
+
+	// Keys of the stale entries being refreshed in the background
+	refreshing sync.Map
+}
+
+type cacheShard struct {
+	sync.Mutex
+	cache *SegmentedLRU
+}
+
+func (cachedResponses *CachedResponses) shard(cacheKey [32]byte) *cacheShard {
+	return &cachedResponses.shards[int(cacheKey[0])%CacheShards]
+}
+
+// cacheShardCapacity splits the capacity of the cache among its shards
+func cacheShardCapacity(cacheSize int, cacheMaxBytes int) (int, bool) {
+	if cacheMaxBytes > 0 {
+		return (cacheMaxBytes + CacheShards - 1) / CacheShards, true
+	}
+	return (cacheSize + CacheShards - 1) / CacheShards, false
+}
+
+func newCacheShard(pluginsState *PluginsState) *SegmentedLRU {
+	return NewSegmentedLRU(cacheShardCapacity(pluginsState.cacheSize, pluginsState.cacheMaxBytes))
+}
+
+// resize applies a new capacity to the shards that have already been created, and returns the
+// number of entries that no longer fit
+func (cachedResponses *CachedResponses) resize(cacheSize int, cacheMaxBytes int) int {
+	capacity, bySize := cacheShardCapacity(cacheSize, cacheMaxBytes)
+	evicted := 0
+	for i := range cachedResponses.shards {
+		shard := &cachedResponses.shards[i]
+		shard.Lock()
+		if shard.cache != nil {
+			evicted += shard.cache.Resize(capacity, bySize)
+		}
+		shard.Unlock()
+	}
+	atomic.AddUint64(&cachedResponses.evictions, uint64(evicted))
+	return evicted
+}
+
+// usage returns the number of entries, and their estimated size
+func (cachedResponses *CachedResponses) usage() (int, int) {
+	entries, size := 0, 0
+	for i := range cachedResponses.shards {
+		shard := &cachedResponses.shards[i]
+		shard.Lock()
+		if shard.cache != nil {
+			entries += shard.cache.Len()
+			size += shard.cache.Size()
+		}
+		shard.Unlock()
+	}
+	return entries, size
+}
+
+// purge removes all the entries, and returns how many there were
+func (cachedResponses *CachedResponses) purge() int {
+	purged := 0
+	for i := range cachedResponses.shards {
+		shard := &cachedResponses.shards[i]
+		shard.Lock()
+		if shard.cache != nil {
+			purged += shard.cache.Len()
+			shard.cache.Purge()
+		}
+		shard.Unlock()
+	}
+	return purged
+}
+
+func (cachedResponses *CachedResponses) stats(proxy *Proxy) CacheStats {
+	settings := proxy.pluginsSettings()
+	cacheStats := CacheStats{
+		Enabled:   settings.cache,
+		Hits:      atomic.LoadUint64(&cachedResponses.hits),
+		Misses:    atomic.LoadUint64(&cachedResponses.misses),
+		Expired:   atomic.LoadUint64(&cachedResponses.expired),
+		Evictions: atomic.LoadUint64(&cachedResponses.evictions),
+	}
+	if settings.cacheMaxBytes > 0 {
+		cacheStats.CapacityBytes = uint64(settings.cacheMaxBytes)
+	} else {
+		cacheStats.Capacity = settings.cacheSize
+	}
+	if proxy.peerCache != nil {
+		cacheStats.PeerHits = atomic.LoadUint64(&proxy.peerCache.hits)
+		cacheStats.PeerServed = atomic.LoadUint64(&proxy.peerCache.served)
+	}
+	if lookups := cacheStats.Hits + cacheStats.Misses; lookups > 0 {
+		cacheStats.HitRatio = float64(cacheStats.Hits) / float64(lookups)
+	}
+	entries, size := cachedResponses.usage()
+	cacheStats.Entries, cacheStats.MemoryEstimate = entries, uint64(size)
+	return cacheStats
+}
+
+// cacheEntrySize estimates the memory used by a cached response
+func cacheEntrySize(msg *dns.Msg) int {
+	return msg.Len() + CacheEntryOverhead
+}
+
+var cachedResponses CachedResponses
+
+type PluginCacheResponse struct {
+	cachedResponses *CachedResponses
+}
+
+func (plugin *PluginCacheResponse) Name() string {
+	return "cache_response"
+}
+
+func (plugin *PluginCacheResponse) Description() string {
+	return "DNS cache (writer)."
+}
+
+func (plugin *PluginCacheResponse) Init(proxy *Proxy) error {
+	return nil
+}
+
+func (plugin *PluginCacheResponse) Drop() error {
+	return nil
+}
+
+func (plugin *PluginCacheResponse) Reload() error {
+	return nil
+}
+
+func (plugin *PluginCacheResponse) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	plugin.cachedResponses = &cachedResponses
+	// Responses from a server chosen by the client are not shared with other clients
+	if len(pluginsState.upstreamOverride) > 0 {
+		return nil
+	}
+	if msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError && msg.Rcode != dns.RcodeNotAuth {
+		return nil
+	}
+	cacheKey, err := computeCacheKey(pluginsState, msg)
+	if err != nil {
+		return err
+	}
+	ttl := getMinTTL(msg, pluginsState.cacheMinTTL, pluginsState.cacheMaxTTL, pluginsState.cacheNegMinTTL, pluginsState.cacheNegMaxTTL)
+	expiration := time.Now().Add(ttl)
+	plugin.cachedResponses.store(pluginsState, cacheKey, msg, expiration)
+	updateTTL(msg, expiration)
+
+	return nil
+}
+
+func (cachedResponses *CachedResponses) store(pluginsState *PluginsState, cacheKey [32]byte, msg *dns.Msg, expiration time.Time) {
+	cachedResponse := CachedResponse{
+		expiration: expiration,
+		msg:        *msg,
+	}
+	shard := cachedResponses.shard(cacheKey)
+	shard.Lock()
+	defer shard.Unlock()
+	if shard.cache == nil {
+		shard.cache = newCacheShard(pluginsState)
+	}
+	if evicted := shard.cache.Add(cacheKey, cachedResponse, cacheEntrySize(msg)); evicted > 0 {
+		atomic.AddUint64(&cachedResponses.evictions, uint64(evicted))
+	}
+}
+
+// fresh returns a copy of a cached response that hasn't expired yet, without updating the
+// statistics
+func (cachedResponses *CachedResponses) fresh(cacheKey [32]byte) (*dns.Msg, time.Time, bool) {
+	shard := cachedResponses.shard(cacheKey)
+	shard.Lock()
+	defer shard.Unlock()
+	if shard.cache == nil {
+		return nil, time.Time{}, false
+	}
+	cached, ok := shard.cache.Get(cacheKey)
+	if !ok || time.Now().After(cached.expiration) {
+		return nil, time.Time{}, false
+	}
+	return cached.msg.Copy(), cached.expiration, true
+}
+
+type PluginCache struct {
+	cachedResponses *CachedResponses
+}
+
+func (plugin *PluginCache) Name() string {
+	return "cache"
+}
+
+func (plugin *PluginCache) Description() string {
+	return "DNS cache (reader)."
+}
+
+func (plugin *PluginCache) Init(proxy *Proxy) error {
+	return nil
+}
+
+func (plugin *PluginCache) Drop() error {
+	return nil
+}
+
+func (plugin *PluginCache) Reload() error {
+	return nil
+}
+
+func (plugin *PluginCache) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	plugin.cachedResponses = &cachedResponses
+	if pluginsState.cacheBypass || pluginsState.backgroundRefresh || len(pluginsState.upstreamOverride) > 0 {
+		return nil
+	}
+
+	cacheKey, err := computeCacheKey(pluginsState, msg)
+	if err != nil {
+		return nil
+	}
+	if plugin.lookup(pluginsState, msg, cacheKey) || pluginsState.peerCache == nil || pluginsState.offline {
+		return nil
+	}
+	// Peers are looked up without holding the lock of the shard
+	peerMsg, expiration, ok := pluginsState.peerCache.lookup(cacheKey)
+	if !ok {
+		return nil
+	}
+	plugin.cachedResponses.store(pluginsState, cacheKey, peerMsg.Copy(), expiration)
+	plugin.synth(pluginsState, msg, peerMsg, expiration)
+	return nil
+}
+
+// lookup answers a query from the local cache, and returns whether it did
+func (plugin *PluginCache) lookup(pluginsState *PluginsState, msg *dns.Msg, cacheKey [32]byte) bool {
+	shard := plugin.cachedResponses.shard(cacheKey)
+	shard.Lock()
+	defer shard.Unlock()
+	if shard.cache == nil {
+		atomic.AddUint64(&plugin.cachedResponses.misses, 1)
+		return false
+	}
+	cached, ok := shard.cache.Get(cacheKey)
+	if !ok {
+		atomic.AddUint64(&plugin.cachedResponses.misses, 1)
+		return false
+	}
+	expiration := cached.expiration
+	if now := time.Now(); now.After(expiration) {
+		atomic.AddUint64(&plugin.cachedResponses.expired, 1)
+		if pluginsState.offline {
+			// An expired response is still better than an error when servers can't be reached
+			expiration = now.Add(OfflineStaleTTL)
+		} else if pluginsState.cacheOptimisticWindow > 0 && now.Sub(expiration) <= pluginsState.cacheOptimisticWindow {
+			// Answer right away, and let the response be refreshed in the background
+			expiration = now.Add(OptimisticStaleTTL)
+			if _, refreshing := plugin.cachedResponses.refreshing.LoadOrStore(cacheKey, true); !refreshing {
+				pluginsState.cacheRefreshKey = &cacheKey
+			}
+		} else {
+			atomic.AddUint64(&plugin.cachedResponses.misses, 1)
+			return false
+		}
+	}
+	atomic.AddUint64(&plugin.cachedResponses.hits, 1)
+	plugin.synth(pluginsState, msg, &cached.msg, expiration)
+	return true
+}
+
+func (plugin *PluginCache) synth(pluginsState *PluginsState, msg *dns.Msg, cachedMsg *dns.Msg, expiration time.Time) {
+	updateTTL(cachedMsg, expiration)
+
+	synth := *cachedMsg
+	synth.Id = msg.Id
+	synth.Response = true
+	synth.Compress = true
+	synth.Question = msg.Question
+	pluginsState.synthResponse = &synth
+	pluginsState.action = PluginsActionSynth
+	pluginsState.cacheHit = true
+}
+
+func computeCacheKey(pluginsState *PluginsState, msg *dns.Msg) ([32]byte, error) {
+	questions := msg.Question
+	if len(questions) != 1 {
+		return [32]byte{}, errors.New("No question present")
+	}
+	question := questions[0]
+	h := sha512.New512_256()
+	var tmp [5]byte
+	binary.LittleEndian.PutUint16(tmp[0:2], question.Qtype)
+	binary.LittleEndian.PutUint16(tmp[2:4], question.Qclass)
+	if pluginsState.dnssec {
+		tmp[4] = 1
+	}
+	h.Write(tmp[:])
+	normalizedName := []byte(question.Name)
+	NormalizeName(&normalizedName)
+	h.Write(normalizedName)
+	if group := pluginsState.clientGroup; group != nil && len(group.cacheNamespace) > 0 {
+		h.Write([]byte{0})
+		h.Write([]byte(group.cacheNamespace))
+	}
+	var sum [32]byte
+	h.Sum(sum[:0])
+	return sum, nil
+}
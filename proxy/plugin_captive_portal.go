@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+type CaptivePortalEntry struct {
+	ipv4 []net.IP
+	ipv6 []net.IP
+}
+
+type PluginCaptivePortal struct {
+	entries  map[string]*CaptivePortalEntry
+	resolver string
+	ttl      uint32
+}
+
+func (plugin *PluginCaptivePortal) Name() string {
+	return "captive_portal"
+}
+
+func (plugin *PluginCaptivePortal) Description() string {
+	return "Answer captive portal detection queries before encrypted DNS is usable."
+}
+
+func (plugin *PluginCaptivePortal) Init(proxy *Proxy) error {
+	dlog.Noticef("Loading the set of captive portal names from [%s]", proxy.captivePortalFile)
+	bin, err := ioutil.ReadFile(proxy.captivePortalFile)
+	if err != nil {
+		return err
+	}
+	plugin.ttl = proxy.cacheMinTTL
+	plugin.resolver = proxy.captivePortalResolver
+	plugin.entries = make(map[string]*CaptivePortalEntry)
+	for lineNo, line := range strings.Split(string(bin), "\n") {
+		line = strings.TrimFunc(line, unicode.IsSpace)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, ipsStr, ok := StringTwoFields(line)
+		if !ok {
+			name, ipsStr = line, ""
+		}
+		entry := CaptivePortalEntry{}
+		for _, ipStr := range strings.Split(ipsStr, ",") {
+			ipStr = strings.TrimFunc(ipStr, unicode.IsSpace)
+			if len(ipStr) == 0 {
+				continue
+			}
+			ip := net.ParseIP(ipStr)
+			if ip == nil {
+				return fmt.Errorf("Syntax error for a captive portal rule at line %d", 1+lineNo)
+			}
+			if ipv4 := ip.To4(); ipv4 != nil {
+				entry.ipv4 = append(entry.ipv4, ipv4)
+			} else {
+				entry.ipv6 = append(entry.ipv6, ip)
+			}
+		}
+		plugin.entries[strings.ToLower(StripTrailingDot(name))] = &entry
+		if len(entry.ipv4) == 0 && len(entry.ipv6) == 0 {
+			if _, _, err := net.SplitHostPort(plugin.resolver); err != nil {
+				return fmt.Errorf("Captive portal name [%s] has no IP addresses and requires a valid resolver: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (plugin *PluginCaptivePortal) Drop() error {
+	return nil
+}
+
+func (plugin *PluginCaptivePortal) Reload() error {
+	return nil
+}
+
+func (plugin *PluginCaptivePortal) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	questions := msg.Question
+	if len(questions) != 1 {
+		return nil
+	}
+	question := questions[0]
+	if question.Qclass != dns.ClassINET {
+		return nil
+	}
+	entry, ok := plugin.entries[pluginsState.qName]
+	if !ok {
+		return nil
+	}
+	if len(entry.ipv4) == 0 && len(entry.ipv6) == 0 {
+		timeout := time.Until(pluginsState.deadline)
+		if timeout <= 0 {
+			return errors.New("Query deadline exceeded")
+		}
+		respMsg, _, err := PlaintextExchange(nil, &dns.Client{Net: "udp", Timeout: timeout}, msg, plugin.resolver)
+		if err != nil {
+			return err
+		}
+		pluginsState.synthResponse = respMsg
+		pluginsState.action = PluginsActionSynth
+		return nil
+	}
+	synth, err := EmptyResponseFromMessage(msg)
+	if err != nil {
+		return err
+	}
+	synth.Answer = []dns.RR{}
+	if question.Qtype == dns.TypeA {
+		for _, ip := range entry.ipv4 {
+			rr := new(dns.A)
+			rr.Hdr = dns.RR_Header{Name: question.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: plugin.ttl}
+			rr.A = ip
+			synth.Answer = append(synth.Answer, rr)
+		}
+	} else if question.Qtype == dns.TypeAAAA {
+		for _, ip := range entry.ipv6 {
+			rr := new(dns.AAAA)
+			rr.Hdr = dns.RR_Header{Name: question.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: plugin.ttl}
+			rr.AAAA = ip
+			synth.Answer = append(synth.Answer, rr)
+		}
+	}
+	pluginsState.synthResponse = synth
+	pluginsState.action = PluginsActionSynth
+	return nil
+}
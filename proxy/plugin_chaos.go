@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+type PluginChaos struct {
+	hostname        string
+	policy          string
+	networkProfiles *NetworkProfiles
+}
+
+func (plugin *PluginChaos) Name() string {
+	return "chaos"
+}
+
+func (plugin *PluginChaos) Description() string {
+	return "Answer CHAOS-class queries for the version, host name and policy of the proxy."
+}
+
+func (plugin *PluginChaos) Init(proxy *Proxy) error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	plugin.hostname = hostname
+	plugin.policy = proxy.chaosPolicy
+	plugin.networkProfiles = proxy.networkProfiles
+	return nil
+}
+
+func (plugin *PluginChaos) Drop() error {
+	return nil
+}
+
+func (plugin *PluginChaos) Reload() error {
+	return nil
+}
+
+func (plugin *PluginChaos) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	questions := msg.Question
+	if len(questions) != 1 {
+		return nil
+	}
+	question := questions[0]
+	if question.Qclass != dns.ClassCHAOS {
+		return nil
+	}
+	// Remote clients get the answers of the upstream servers, if any
+	if !pluginsState.ClientIP().IsLoopback() {
+		return nil
+	}
+	var txt []string
+	switch pluginsState.qName {
+	case "version.bind", "version.server":
+		txt = []string{"dnscrypt-proxy " + AppVersion}
+	case "hostname.bind", "id.server":
+		txt = []string{plugin.hostname}
+	case "policy.bind":
+		txt = plugin.policyStrings(pluginsState)
+	default:
+		return nil
+	}
+	synth, err := EmptyResponseFromMessage(msg)
+	if err != nil {
+		return err
+	}
+	synth.Authoritative = true
+	if question.Qtype == dns.TypeTXT || question.Qtype == dns.TypeANY {
+		rr := new(dns.TXT)
+		rr.Hdr = dns.RR_Header{Name: question.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS, Ttl: 0}
+		rr.Txt = txt
+		synth.Answer = []dns.RR{rr}
+	}
+	pluginsState.synthResponse = synth
+	pluginsState.action = PluginsActionSynth
+	return nil
+}
+
+func (plugin *PluginChaos) policyStrings(pluginsState *PluginsState) []string {
+	var txt []string
+	if len(plugin.policy) > 0 {
+		txt = append(txt, plugin.policy)
+	}
+	if profile := plugin.networkProfiles.Active(); profile != nil {
+		txt = append(txt, "profile="+profile.name)
+	}
+	if pluginsState.filteringDisabled {
+		txt = append(txt, "filtering=off")
+	} else {
+		txt = append(txt, "filtering=on")
+	}
+	return []string{strings.Join(txt, " ")}
+}
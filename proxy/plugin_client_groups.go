@@ -0,0 +1,277 @@
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+const ClientHintsCheckDelay = time.Duration(60) * time.Second
+
+type ClientGroup struct {
+	name           string
+	networks       []*net.IPNet
+	hardwareAddrs  []string
+	patternMatcher *PatternMatcher
+	allowedQtypes  map[uint16]bool
+	serverNames    []string
+	safeSearch     bool
+	noFiltering    bool
+	cacheNamespace string
+}
+
+type PluginClientGroups struct {
+	sync.RWMutex
+	groups              []*ClientGroup
+	hintsFile           string
+	hintsModTime        time.Time
+	hintsLastCheck      time.Time
+	hardwareAddrsGroups map[string]*ClientGroup
+}
+
+func (plugin *PluginClientGroups) Name() string {
+	return "client_groups"
+}
+
+func (plugin *PluginClientGroups) Description() string {
+	return "Apply per-client policies based on the source address."
+}
+
+func (plugin *PluginClientGroups) Init(proxy *Proxy) error {
+	// Groups are kept sorted by name, so that the group of a client matching several of them
+	// doesn't change from one run to the next
+	var groupNames []string
+	for groupName := range proxy.clientGroupsConfig {
+		groupNames = append(groupNames, groupName)
+	}
+	sort.Strings(groupNames)
+	for _, groupName := range groupNames {
+		groupConfig := proxy.clientGroupsConfig[groupName]
+		group := ClientGroup{name: groupName, serverNames: groupConfig.ServerNames, safeSearch: groupConfig.SafeSearch,
+			noFiltering: groupConfig.NoFiltering, cacheNamespace: groupConfig.CacheNamespace}
+		for _, addrStr := range groupConfig.Addresses {
+			network, err := ParseIPOrCIDR(addrStr)
+			if err != nil {
+				return fmt.Errorf("Client group [%s]: %s", groupName, err)
+			}
+			group.networks = append(group.networks, network)
+		}
+		for _, hardwareAddrStr := range groupConfig.HardwareAddrs {
+			hardwareAddr, err := net.ParseMAC(hardwareAddrStr)
+			if err != nil {
+				return fmt.Errorf("Client group [%s]: %s", groupName, err)
+			}
+			group.hardwareAddrs = append(group.hardwareAddrs, hardwareAddr.String())
+		}
+		if len(groupConfig.AllowedQtypes) > 0 {
+			group.allowedQtypes = make(map[uint16]bool)
+			for _, qtypeStr := range groupConfig.AllowedQtypes {
+				qtype, ok := QtypeFromString(qtypeStr)
+				if !ok {
+					return fmt.Errorf("Client group [%s]: unsupported query type [%s]", groupName, qtypeStr)
+				}
+				group.allowedQtypes[qtype] = true
+			}
+		}
+		if len(groupConfig.BlacklistFile) > 0 {
+			dlog.Noticef("Loading the set of blocking rules for client group [%s] from [%s]", groupName, groupConfig.BlacklistFile)
+			bin, err := ReadRuleFile(groupConfig.BlacklistFile)
+			if err != nil {
+				return err
+			}
+			group.patternMatcher = NewPatternPatcher()
+			for lineNo, line := range strings.Split(NormalizeBlocklist(string(bin)), "\n") {
+				line = strings.TrimFunc(line, unicode.IsSpace)
+				if len(line) == 0 || strings.HasPrefix(line, "#") {
+					continue
+				}
+				if _, err := group.patternMatcher.Add(line, true, lineNo+1); err != nil {
+					dlog.Error(err)
+					continue
+				}
+			}
+		}
+		plugin.groups = append(plugin.groups, &group)
+	}
+	plugin.hintsFile = proxy.clientHintsFile
+	if len(plugin.hintsFile) > 0 {
+		if err := plugin.loadHints(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (plugin *PluginClientGroups) Drop() error {
+	return nil
+}
+
+func (plugin *PluginClientGroups) Reload() error {
+	return nil
+}
+
+func (plugin *PluginClientGroups) loadHints() error {
+	fi, err := os.Stat(plugin.hintsFile)
+	if err != nil {
+		return err
+	}
+	bin, err := ioutil.ReadFile(plugin.hintsFile)
+	if err != nil {
+		return err
+	}
+	hardwareAddrsGroups := make(map[string]*ClientGroup)
+	for lineNo, line := range strings.Split(string(bin), "\n") {
+		line = strings.TrimFunc(line, unicode.IsSpace)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hardwareAddrStr, ipStr, ok := StringTwoFields(line)
+		if !ok {
+			dlog.Errorf("Syntax error in client hints at line %d -- Expected syntax: <MAC address> <IP address>", 1+lineNo)
+			continue
+		}
+		hardwareAddr, err := net.ParseMAC(hardwareAddrStr)
+		if err != nil {
+			dlog.Errorf("Invalid MAC address in client hints at line %d", 1+lineNo)
+			continue
+		}
+		ip := net.ParseIP(ipStr)
+		if ip == nil {
+			dlog.Errorf("Invalid IP address in client hints at line %d", 1+lineNo)
+			continue
+		}
+		for _, group := range plugin.groups {
+			if includesName(group.hardwareAddrs, hardwareAddr.String()) {
+				hardwareAddrsGroups[ip.String()] = group
+				break
+			}
+		}
+	}
+	plugin.Lock()
+	plugin.hardwareAddrsGroups = hardwareAddrsGroups
+	plugin.hintsModTime = fi.ModTime()
+	plugin.Unlock()
+	return nil
+}
+
+func (plugin *PluginClientGroups) checkHints(now time.Time) {
+	plugin.Lock()
+	if now.Sub(plugin.hintsLastCheck) < ClientHintsCheckDelay {
+		plugin.Unlock()
+		return
+	}
+	plugin.hintsLastCheck = now
+	hintsModTime := plugin.hintsModTime
+	plugin.Unlock()
+	fi, err := os.Stat(plugin.hintsFile)
+	if err != nil || !fi.ModTime().After(hintsModTime) {
+		return
+	}
+	dlog.Infof("Reloading client hints from [%s]", plugin.hintsFile)
+	if err := plugin.loadHints(); err != nil {
+		dlog.Warnf("Unable to reload client hints: [%s]", err)
+	}
+}
+
+// findGroup returns the group of a client, looking up its MAC address first, if it is known
+func (plugin *PluginClientGroups) findGroup(ip net.IP, hardwareAddr string) *ClientGroup {
+	if len(hardwareAddr) > 0 {
+		for _, group := range plugin.groups {
+			if includesName(group.hardwareAddrs, hardwareAddr) {
+				return group
+			}
+		}
+	}
+	if len(plugin.hintsFile) > 0 {
+		plugin.checkHints(time.Now())
+		plugin.RLock()
+		group := plugin.hardwareAddrsGroups[ip.String()]
+		plugin.RUnlock()
+		if group != nil {
+			return group
+		}
+	}
+	var bestGroup *ClientGroup
+	bestPrefixLen := -1
+	for _, group := range plugin.groups {
+		for _, network := range group.networks {
+			if !network.Contains(ip) {
+				continue
+			}
+			if prefixLen, _ := network.Mask.Size(); prefixLen > bestPrefixLen {
+				bestGroup, bestPrefixLen = group, prefixLen
+			}
+		}
+	}
+	return bestGroup
+}
+
+func (plugin *PluginClientGroups) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	var group *ClientGroup
+	if len(pluginsState.listenerClientGroup) > 0 {
+		for _, candidate := range plugin.groups {
+			if candidate.name == pluginsState.listenerClientGroup {
+				group = candidate
+				break
+			}
+		}
+	} else {
+		group = plugin.findGroup(pluginsState.ClientIP(), pluginsState.clientMAC)
+	}
+	if group == nil {
+		return nil
+	}
+	pluginsState.clientGroup = group
+	pluginsState.serverNames = group.serverNames
+	if group.noFiltering {
+		pluginsState.filteringDisabled = true
+	}
+	if pluginsState.sessionData["whitelisted"] != nil {
+		return nil
+	}
+	questions := msg.Question
+	if len(questions) != 1 {
+		return nil
+	}
+	question := questions[0]
+	if group.allowedQtypes != nil && !group.allowedQtypes[question.Qtype] {
+		pluginsState.action = PluginsActionReject
+		pluginsState.rejectReason = dns.TypeToString[question.Qtype]
+		pluginsState.rejectInfoCode = ExtendedErrorCodeFiltered
+		return nil
+	}
+	if group.patternMatcher != nil {
+		qName := pluginsState.qName
+		if reject, reason, _ := group.patternMatcher.Eval(qName); reject {
+			pluginsState.action = PluginsActionReject
+			pluginsState.rejectReason = reason
+			pluginsState.rejectInfoCode = ExtendedErrorCodeFiltered
+		}
+	}
+	return nil
+}
+
+func ParseIPOrCIDR(str string) (*net.IPNet, error) {
+	str = strings.TrimFunc(str, unicode.IsSpace)
+	if strings.Contains(str, "/") {
+		_, network, err := net.ParseCIDR(str)
+		return network, err
+	}
+	ip := net.ParseIP(str)
+	if ip == nil {
+		return nil, fmt.Errorf("Invalid address: [%s]", str)
+	}
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return &net.IPNet{IP: ipv4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
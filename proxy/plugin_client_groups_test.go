@@ -0,0 +1,32 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestClientGroupsOverlappingMatches(t *testing.T) {
+	shared := ClientGroupConfig{Addresses: []string{"192.168.1.0/24"}, HardwareAddrs: []string{"00:11:22:33:44:55"}}
+	proxy := Proxy{clientGroupsConfig: map[string]ClientGroupConfig{
+		"phones":  shared,
+		"kids":    shared,
+		"tablets": shared,
+		"laptop":  {Addresses: []string{"192.168.1.20"}},
+	}}
+	// Maps are iterated in a different order every time
+	for i := 0; i < 20; i++ {
+		plugin := new(PluginClientGroups)
+		if err := plugin.Init(&proxy); err != nil {
+			t.Fatal(err)
+		}
+		if group := plugin.findGroup(net.ParseIP("192.168.1.10"), "00:11:22:33:44:55"); group == nil || group.name != "kids" {
+			t.Fatalf("MAC address matched %v instead of [kids]", group)
+		}
+		if group := plugin.findGroup(net.ParseIP("192.168.1.10"), ""); group == nil || group.name != "kids" {
+			t.Fatalf("Address matched %v instead of [kids]", group)
+		}
+		if group := plugin.findGroup(net.ParseIP("192.168.1.20"), ""); group == nil || group.name != "laptop" {
+			t.Fatalf("Address matched %v instead of the most specific network", group)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// EDNS option used by dnsmasq (--add-mac) and other routers to send the MAC address of clients
+const EDNS0MAC = 65001
+
+type ClientIdentificationConfig struct {
+	EDNSFrom  []string `toml:"edns_mac_from"`
+	Neighbors bool     `toml:"neighbors"`
+}
+
+// PluginClientMAC identifies clients by their MAC address, so that devices can be recognized
+// even when their IP address changes. The address is sent by a router, in an EDNS option, or
+// found in the neighbor tables of the system. The option is only trusted from the configured
+// routers, and is always removed before the query is forwarded.
+type PluginClientMAC struct {
+	ednsFrom  []*net.IPNet
+	neighbors *Neighbors
+}
+
+func (plugin *PluginClientMAC) Name() string {
+	return "client_mac"
+}
+
+func (plugin *PluginClientMAC) Description() string {
+	return "Identify clients by their MAC address."
+}
+
+func (plugin *PluginClientMAC) Init(proxy *Proxy) error {
+	for _, addrStr := range proxy.clientIdentification.EDNSFrom {
+		network, err := ParseIPOrCIDR(addrStr)
+		if err != nil {
+			return fmt.Errorf("edns_mac_from: %s", err)
+		}
+		plugin.ednsFrom = append(plugin.ednsFrom, network)
+	}
+	if proxy.clientIdentification.Neighbors {
+		if proxy.sandbox && sandboxForbidsExec && neighborsRequireExec {
+			return errors.New("The neighbor tables can't be read with sandbox = true on this platform")
+		}
+		plugin.neighbors = &Neighbors{}
+	}
+	return nil
+}
+
+func (plugin *PluginClientMAC) Drop() error {
+	return nil
+}
+
+func (plugin *PluginClientMAC) Reload() error {
+	return nil
+}
+
+// parseEDNSHardwareAddr decodes the MAC address sent by a router, in binary, text or base64
+func parseEDNSHardwareAddr(data []byte) string {
+	if len(data) == 6 {
+		return net.HardwareAddr(data).String()
+	}
+	if hardwareAddr, err := net.ParseMAC(string(data)); err == nil && len(hardwareAddr) == 6 {
+		return hardwareAddr.String()
+	}
+	if bin, err := base64.StdEncoding.DecodeString(string(data)); err == nil && len(bin) == 6 {
+		return net.HardwareAddr(bin).String()
+	}
+	return ""
+}
+
+func (plugin *PluginClientMAC) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	clientIP := pluginsState.ClientIP()
+	if opt := msg.IsEdns0(); opt != nil && len(plugin.ednsFrom) > 0 {
+		trusted := false
+		for _, network := range plugin.ednsFrom {
+			if network.Contains(clientIP) {
+				trusted = true
+				break
+			}
+		}
+		options := opt.Option[:0]
+		for _, option := range opt.Option {
+			if local, ok := option.(*dns.EDNS0_LOCAL); ok && local.Code == EDNS0MAC {
+				if trusted {
+					pluginsState.clientMAC = parseEDNSHardwareAddr(local.Data)
+				}
+				continue
+			}
+			options = append(options, option)
+		}
+		opt.Option = options
+	}
+	if len(pluginsState.clientMAC) == 0 && plugin.neighbors != nil {
+		pluginsState.clientMAC = plugin.neighbors.lookup(clientIP)
+	}
+	return nil
+}
@@ -1,8 +1,12 @@
-package main
+package proxy
 
 import (
-	"io/ioutil"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -18,8 +22,17 @@ type CloakedName struct {
 	ipv6       *net.IP
 	lastUpdate *time.Time
 	isIP       bool
+	alpn       []string
+	port       uint16
 }
 
+const (
+	SvcParamKeyALPN     uint16 = 1
+	SvcParamKeyPort     uint16 = 3
+	SvcParamKeyIPv4Hint uint16 = 4
+	SvcParamKeyIPv6Hint uint16 = 6
+)
+
 type PluginCloak struct {
 	sync.RWMutex
 	patternMatcher *PatternMatcher
@@ -36,7 +49,7 @@ func (plugin *PluginCloak) Description() string {
 
 func (plugin *PluginCloak) Init(proxy *Proxy) error {
 	dlog.Noticef("Loading the set of cloaking rules from [%s]", proxy.cloakFile)
-	bin, err := ioutil.ReadFile(proxy.cloakFile)
+	bin, err := ReadRuleFile(proxy.cloakFile)
 	if err != nil {
 		return err
 	}
@@ -48,13 +61,12 @@ func (plugin *PluginCloak) Init(proxy *Proxy) error {
 			continue
 		}
 		var target string
+		var hints []string
 		parts := strings.FieldsFunc(line, unicode.IsSpace)
-		if len(parts) == 2 {
+		if len(parts) >= 2 {
 			line = strings.TrimFunc(parts[0], unicode.IsSpace)
 			target = strings.TrimFunc(parts[1], unicode.IsSpace)
-		} else if len(parts) > 2 {
-			dlog.Errorf("Syntax error in cloaking rules at line %d -- Unexpected space character", 1+lineNo)
-			continue
+			hints = parts[2:]
 		}
 		if len(line) == 0 || len(target) == 0 {
 			dlog.Errorf("Syntax error in cloaking rules at line %d -- Missing name or target", 1+lineNo)
@@ -62,6 +74,10 @@ func (plugin *PluginCloak) Init(proxy *Proxy) error {
 		}
 		line = strings.ToLower(line)
 		cloakedName := CloakedName{}
+		if err := cloakedName.parseHints(hints); err != nil {
+			dlog.Errorf("Syntax error in cloaking rules at line %d -- %v", 1+lineNo, err)
+			continue
+		}
 		if ip := net.ParseIP(target); ip != nil {
 			if ipv4 := ip.To4(); ipv4 != nil {
 				cloakedName.ipv4 = &ipv4
@@ -94,21 +110,26 @@ func (plugin *PluginCloak) Eval(pluginsState *PluginsState, msg *dns.Msg) error
 		return nil
 	}
 	question := questions[0]
-	if question.Qclass != dns.ClassINET || (question.Qtype != dns.TypeA && question.Qtype != dns.TypeAAAA) {
+	if question.Qclass != dns.ClassINET || (question.Qtype != dns.TypeA && question.Qtype != dns.TypeAAAA && question.Qtype != DNSTypeHTTPS) {
 		return nil
 	}
-	qName := strings.ToLower(StripTrailingDot(questions[0].Name))
+	qName := pluginsState.qName
 	if len(qName) < 2 {
 		return nil
 	}
 	now := time.Now()
 	plugin.RLock()
-	_, _, xcloakedName := plugin.patternMatcher.Eval(qName)
+	_, rule, xcloakedName := plugin.patternMatcher.Eval(qName)
 	if xcloakedName == nil {
 		plugin.RUnlock()
 		return nil
 	}
 	cloakedName := xcloakedName.(*CloakedName)
+	// HTTPS records are only synthesized for names that have hints; the other ones are resolved
+	if question.Qtype == DNSTypeHTTPS && !cloakedName.hasHints() {
+		plugin.RUnlock()
+		return nil
+	}
 	ttl, expired := plugin.ttl, false
 	if cloakedName.lastUpdate != nil {
 		if elapsed := uint32(now.Sub(*cloakedName.lastUpdate).Seconds()); elapsed < ttl {
@@ -150,7 +171,13 @@ func (plugin *PluginCloak) Eval(pluginsState *PluginsState, msg *dns.Msg) error
 	if err != nil {
 		return err
 	}
-	if ip == nil {
+	if question.Qtype == DNSTypeHTTPS {
+		plugin.RLock()
+		rr := &dns.RFC3597{Rdata: hex.EncodeToString(cloakedName.httpsRdata())}
+		plugin.RUnlock()
+		rr.Hdr = dns.RR_Header{Name: question.Name, Rrtype: DNSTypeHTTPS, Class: dns.ClassINET, Ttl: ttl}
+		synth.Answer = []dns.RR{rr}
+	} else if ip == nil {
 		synth.Answer = []dns.RR{}
 	} else if question.Qtype == dns.TypeA {
 		rr := new(dns.A)
@@ -163,7 +190,76 @@ func (plugin *PluginCloak) Eval(pluginsState *PluginsState, msg *dns.Msg) error
 		rr.AAAA = *ip
 		synth.Answer = []dns.RR{rr}
 	}
+	target := cloakedName.target
+	if ip != nil {
+		target = ip.String()
+	}
+	pluginsState.audit("cloaked", plugin.Name(), rule, target)
 	pluginsState.synthResponse = synth
 	pluginsState.action = PluginsActionSynth
 	return nil
 }
+
+// parseHints reads the optional `alpn=` and `port=` parameters of a rule, used to synthesize
+// HTTPS records, so that clients connect to services running on non-default ports
+func (cloakedName *CloakedName) parseHints(hints []string) error {
+	for _, hint := range hints {
+		kv := strings.SplitN(hint, "=", 2)
+		if len(kv) != 2 || len(kv[1]) == 0 {
+			return errors.New("Unexpected space character")
+		}
+		switch strings.ToLower(kv[0]) {
+		case "alpn":
+			for _, alpn := range strings.Split(kv[1], ",") {
+				if len(alpn) == 0 || len(alpn) > 255 {
+					return fmt.Errorf("Invalid ALPN identifier [%s]", alpn)
+				}
+				cloakedName.alpn = append(cloakedName.alpn, alpn)
+			}
+		case "port":
+			port, err := strconv.ParseUint(kv[1], 10, 16)
+			if err != nil || port == 0 {
+				return fmt.Errorf("Invalid port [%s]", kv[1])
+			}
+			cloakedName.port = uint16(port)
+		default:
+			return fmt.Errorf("Unsupported parameter [%s]", kv[0])
+		}
+	}
+	return nil
+}
+
+func (cloakedName *CloakedName) hasHints() bool {
+	return len(cloakedName.alpn) > 0 || cloakedName.port != 0
+}
+
+// httpsRdata returns the data of an HTTPS record for the name itself (RFC 9460), with the
+// hints and the addresses of the target; parameters are sorted by key, as required
+func (cloakedName *CloakedName) httpsRdata() []byte {
+	rdata := []byte{0, 1, 0} // priority 1, target name "."
+	addParam := func(key uint16, value []byte) {
+		var header [4]byte
+		binary.BigEndian.PutUint16(header[0:2], key)
+		binary.BigEndian.PutUint16(header[2:4], uint16(len(value)))
+		rdata = append(append(rdata, header[:]...), value...)
+	}
+	if len(cloakedName.alpn) > 0 {
+		var value []byte
+		for _, alpn := range cloakedName.alpn {
+			value = append(append(value, byte(len(alpn))), alpn...)
+		}
+		addParam(SvcParamKeyALPN, value)
+	}
+	if cloakedName.port != 0 {
+		var value [2]byte
+		binary.BigEndian.PutUint16(value[:], cloakedName.port)
+		addParam(SvcParamKeyPort, value[:])
+	}
+	if cloakedName.ipv4 != nil {
+		addParam(SvcParamKeyIPv4Hint, cloakedName.ipv4.To4())
+	}
+	if cloakedName.ipv6 != nil {
+		addParam(SvcParamKeyIPv6Hint, cloakedName.ipv6.To16())
+	}
+	return rdata
+}
@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+const (
+	DNSCookiesMaxClients  = 8192
+	ClientCookieSize      = 8
+	ServerCookieSize      = 16
+	ServerCookieVersion   = 1
+	ServerCookieMaxAge    = 3600
+	ServerCookieRenewAge  = 1800
+	ServerCookieClockSkew = 300
+)
+
+// PluginDNSCookies implements DNS Cookies (RFC 7873) for local clients. Server cookies are
+// computed as described in RFC 9018, so that they can be verified without keeping any state;
+// the only state is the set of the most recent clients known to send valid cookies, used in
+// strict mode.
+type PluginDNSCookies struct {
+	secret  [32]byte
+	strict  bool
+	clients *lru.Cache
+}
+
+func (plugin *PluginDNSCookies) Name() string {
+	return "dns_cookies"
+}
+
+func (plugin *PluginDNSCookies) Description() string {
+	return "Send and verify DNS cookies to protect local clients against spoofed responses."
+}
+
+func (plugin *PluginDNSCookies) Init(proxy *Proxy) error {
+	if _, err := rand.Read(plugin.secret[:]); err != nil {
+		return err
+	}
+	plugin.strict = proxy.dnsCookiesStrict
+	var err error
+	plugin.clients, err = lru.New(DNSCookiesMaxClients)
+	return err
+}
+
+func (plugin *PluginDNSCookies) Drop() error {
+	return nil
+}
+
+func (plugin *PluginDNSCookies) Reload() error {
+	return nil
+}
+
+// cookie returns the client cookie followed by the server cookie for the given timestamp
+func (plugin *PluginDNSCookies) cookie(clientCookie []byte, clientIP net.IP, timestamp uint32) []byte {
+	cookie := make([]byte, ClientCookieSize, ClientCookieSize+ServerCookieSize+sha256.Size)
+	copy(cookie, clientCookie)
+	cookie = append(cookie, ServerCookieVersion, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(cookie[ClientCookieSize+4:], timestamp)
+	mac := hmac.New(sha256.New, plugin.secret[:])
+	mac.Write(cookie)
+	mac.Write(clientIP.To16())
+	return mac.Sum(cookie)[:ClientCookieSize+ServerCookieSize]
+}
+
+// verify checks a cookie sent by a client, and returns its age
+func (plugin *PluginDNSCookies) verify(cookie []byte, clientIP net.IP, now uint32) (int32, bool) {
+	if len(cookie) != ClientCookieSize+ServerCookieSize || cookie[ClientCookieSize] != ServerCookieVersion {
+		return 0, false
+	}
+	timestamp := binary.BigEndian.Uint32(cookie[ClientCookieSize+4:])
+	age := int32(now - timestamp)
+	if age > ServerCookieMaxAge || age < -ServerCookieClockSkew {
+		return 0, false
+	}
+	return age, hmac.Equal(plugin.cookie(cookie[:ClientCookieSize], clientIP, timestamp), cookie)
+}
+
+func (plugin *PluginDNSCookies) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	var cookie []byte
+	var cookieErr error
+	hasCookie := false
+	// Cookies are between the proxy and its clients; they are never sent to upstream servers
+	if opt := msg.IsEdns0(); opt != nil {
+		options := opt.Option[:0]
+		for _, option := range opt.Option {
+			if option.Option() != dns.EDNS0COOKIE {
+				options = append(options, option)
+			} else if !hasCookie {
+				cookie, cookieErr = hex.DecodeString(option.(*dns.EDNS0_COOKIE).Cookie)
+				hasCookie = true
+			}
+		}
+		opt.Option = options
+	}
+	clientIP := pluginsState.ClientIP()
+	enforce := plugin.strict && pluginsState.clientProto == "udp"
+	if !hasCookie {
+		if enforce {
+			if _, known := plugin.clients.Get(clientIP.String()); known {
+				dlog.Debugf("Dropping a query without a cookie from client [%s]", clientIP)
+				pluginsState.action = PluginsActionDrop
+			}
+		}
+		return nil
+	}
+	if cookieErr != nil || (len(cookie) != ClientCookieSize &&
+		(len(cookie) < ClientCookieSize+8 || len(cookie) > ClientCookieSize+32)) {
+		synth := new(dns.Msg)
+		synth.SetRcode(msg, dns.RcodeFormatError)
+		pluginsState.synthResponse = synth
+		pluginsState.action = PluginsActionSynth
+		return nil
+	}
+	now := uint32(time.Now().Unix())
+	age, valid := plugin.verify(cookie, clientIP, now)
+	if valid && age >= 0 && age < ServerCookieRenewAge {
+		pluginsState.dnsCookie = hex.EncodeToString(cookie)
+	} else {
+		pluginsState.dnsCookie = hex.EncodeToString(plugin.cookie(cookie[:ClientCookieSize], clientIP, now))
+	}
+	if !enforce {
+		return nil
+	}
+	if valid {
+		plugin.clients.Add(clientIP.String(), struct{}{})
+		return nil
+	}
+	dlog.Debugf("Missing or invalid server cookie from client [%s]", clientIP)
+	synth := new(dns.Msg)
+	synth.SetRcode(msg, dns.RcodeBadCookie)
+	pluginsState.synthResponse = synth
+	pluginsState.action = PluginsActionSynth
+	return nil
+}
+
+type PluginDNSCookiesResponse struct{}
+
+func (plugin *PluginDNSCookiesResponse) Name() string {
+	return "dns_cookies"
+}
+
+func (plugin *PluginDNSCookiesResponse) Description() string {
+	return "Add DNS cookies to responses."
+}
+
+func (plugin *PluginDNSCookiesResponse) Init(proxy *Proxy) error {
+	return nil
+}
+
+func (plugin *PluginDNSCookiesResponse) Drop() error {
+	return nil
+}
+
+func (plugin *PluginDNSCookiesResponse) Reload() error {
+	return nil
+}
+
+func (plugin *PluginDNSCookiesResponse) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if len(pluginsState.dnsCookie) > 0 {
+		setDNSCookie(msg, pluginsState.dnsCookie)
+	}
+	return nil
+}
+
+// setDNSCookie adds a cookie to a response, replacing the one it may already have. The
+// additional section and the OPT record are copied, as they can be shared with cached responses.
+func setDNSCookie(msg *dns.Msg, cookie string) {
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	opt.SetUDPSize(uint16(MaxDNSUDPPacketSize))
+	extra := make([]dns.RR, 0, len(msg.Extra)+1)
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+			continue
+		}
+		opt = dns.Copy(rr).(*dns.OPT)
+		options := make([]dns.EDNS0, 0, len(opt.Option)+1)
+		for _, option := range opt.Option {
+			if option.Option() != dns.EDNS0COOKIE {
+				options = append(options, option)
+			}
+		}
+		opt.Option = options
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+	msg.Extra = append(extra, opt)
+}
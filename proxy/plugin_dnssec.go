@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+const ExtendedErrorCodeDNSSECBogus = 6
+
+type PluginDNSSECValidation struct {
+	validator *DNSSECValidator
+}
+
+func (plugin *PluginDNSSECValidation) Name() string {
+	return "dnssec_validation"
+}
+
+func (plugin *PluginDNSSECValidation) Description() string {
+	return "Validates DNSSEC signatures locally."
+}
+
+func (plugin *PluginDNSSECValidation) Init(proxy *Proxy) error {
+	validator, err := NewDNSSECValidator(proxy)
+	if err != nil {
+		return err
+	}
+	plugin.validator = validator
+	return nil
+}
+
+func (plugin *PluginDNSSECValidation) Drop() error {
+	return nil
+}
+
+func (plugin *PluginDNSSECValidation) Reload() error {
+	return nil
+}
+
+func (plugin *PluginDNSSECValidation) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if msg.CheckingDisabled || len(msg.Question) != 1 {
+		return nil
+	}
+	status := plugin.validator.Validate(msg)
+	switch status {
+	case DNSSECStatusSecure:
+		msg.AuthenticatedData = true
+	case DNSSECStatusInsecure:
+		msg.AuthenticatedData = false
+	default:
+		dlog.Infof("DNSSEC validation failed for [%s]", msg.Question[0].Name)
+		msg.AuthenticatedData = false
+		msg.Rcode = dns.RcodeServerFailure
+		msg.Answer = make([]dns.RR, 0)
+		msg.Ns = make([]dns.RR, 0)
+		msg.Extra = make([]dns.RR, 0)
+		AddExtendedDNSError(msg, ExtendedErrorCodeDNSSECBogus, "")
+		return nil
+	}
+	if !pluginsState.dnssec {
+		stripDNSSECRecords(msg)
+	}
+	return nil
+}
+
+// stripDNSSECRecords removes the records that were only retrieved for validation
+func stripDNSSECRecords(msg *dns.Msg) {
+	qtype := msg.Question[0].Qtype
+	strip := func(rrs []dns.RR) []dns.RR {
+		rrs2 := []dns.RR{}
+		for _, rr := range rrs {
+			switch rtype := rr.Header().Rrtype; rtype {
+			case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+				if rtype != qtype {
+					continue
+				}
+			}
+			rrs2 = append(rrs2, rr)
+		}
+		return rrs2
+	}
+	msg.Answer = strip(msg.Answer)
+	msg.Ns = strip(msg.Ns)
+	msg.Extra = strip(msg.Extra)
+	if opt := msg.IsEdns0(); opt != nil {
+		opt.SetDo(false)
+	}
+}
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const DoHCanaryDomain = "use-application-dns.net"
+
+type PluginDoHCanary struct{}
+
+func (plugin *PluginDoHCanary) Name() string {
+	return "doh_canary"
+}
+
+func (plugin *PluginDoHCanary) Description() string {
+	return "Answer the Firefox DoH canary domain with NXDOMAIN."
+}
+
+func (plugin *PluginDoHCanary) Init(proxy *Proxy) error {
+	return nil
+}
+
+func (plugin *PluginDoHCanary) Drop() error {
+	return nil
+}
+
+func (plugin *PluginDoHCanary) Reload() error {
+	return nil
+}
+
+func (plugin *PluginDoHCanary) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	questions := msg.Question
+	if len(questions) != 1 {
+		return nil
+	}
+	question := questions[0]
+	if question.Qclass != dns.ClassINET {
+		return nil
+	}
+	qName := pluginsState.qName
+	if qName != DoHCanaryDomain && !strings.HasSuffix(qName, "."+DoHCanaryDomain) {
+		return nil
+	}
+	hasEdns0 := msg.IsEdns0() != nil
+	synth, err := EmptyResponseFromMessage(msg)
+	if err != nil {
+		return err
+	}
+	synth.Rcode = dns.RcodeNameError
+	pluginsState.blockedResponse.explain(synth, hasEdns0, ExtendedErrorCodeBlocked, "DoH canary")
+	pluginsState.audit("blocked", plugin.Name(), DoHCanaryDomain, "")
+	pluginsState.synthResponse = synth
+	pluginsState.action = PluginsActionSynth
+	return nil
+}
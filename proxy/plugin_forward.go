@@ -0,0 +1,222 @@
+package proxy
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+type PluginForwardEntry struct {
+	domain  string
+	servers []string
+	// Only queries for these types are forwarded; nil means all types
+	qTypes map[uint16]bool
+}
+
+type PluginForward struct {
+	sync.RWMutex
+	forwardMap              []PluginForwardEntry
+	networkProfiles         *NetworkProfiles
+	profileForwardMaps      map[string][]PluginForwardEntry
+	searchDomainsResolvConf string
+	searchDomains           []PluginForwardEntry
+	stop                    chan struct{}
+}
+
+func (plugin *PluginForward) Name() string {
+	return "forward"
+}
+
+func (plugin *PluginForward) Description() string {
+	return "Route queries matching specific domains to a dedicated set of servers"
+}
+
+func (plugin *PluginForward) Init(proxy *Proxy) error {
+	if len(proxy.forwardFile) > 0 {
+		forwardMap, err := loadForwardingRules(proxy.forwardFile)
+		if err != nil {
+			return err
+		}
+		plugin.forwardMap = forwardMap
+	}
+	if proxy.networkProfiles != nil {
+		plugin.networkProfiles = proxy.networkProfiles
+		plugin.profileForwardMaps = make(map[string][]PluginForwardEntry)
+		for _, profile := range proxy.networkProfiles.profiles {
+			if len(profile.forwardFile) == 0 {
+				continue
+			}
+			forwardMap, err := loadForwardingRules(profile.forwardFile)
+			if err != nil {
+				return err
+			}
+			plugin.profileForwardMaps[profile.name] = forwardMap
+		}
+	}
+	if proxy.forwardSearchDomains {
+		plugin.searchDomainsResolvConf = proxy.searchDomainsResolvConf
+		plugin.updateSearchDomains()
+		plugin.stop = make(chan struct{})
+		go plugin.monitorSearchDomains()
+	}
+	return nil
+}
+
+// updateSearchDomains follows the search domains announced by DHCP, that may change with the network
+func (plugin *PluginForward) updateSearchDomains() {
+	searchDomains := systemSearchDomains(plugin.searchDomainsResolvConf)
+	plugin.Lock()
+	previous := plugin.searchDomains
+	plugin.searchDomains = searchDomains
+	plugin.Unlock()
+	if reflect.DeepEqual(previous, searchDomains) {
+		return
+	}
+	if len(searchDomains) == 0 {
+		dlog.Notice("No search domains to forward to the system resolvers")
+	}
+	for _, entry := range searchDomains {
+		dlog.Noticef("Forwarding the [%s] search domain to %v", entry.domain, entry.servers)
+	}
+}
+
+func (plugin *PluginForward) monitorSearchDomains() {
+	ticker := time.NewTicker(SearchDomainsRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			plugin.updateSearchDomains()
+		case <-plugin.stop:
+			return
+		}
+	}
+}
+
+func loadForwardingRules(file string) ([]PluginForwardEntry, error) {
+	dlog.Noticef("Loading the set of forwarding rules from [%s]", file)
+	bin, err := ReadRuleFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var forwardMap []PluginForwardEntry
+	for lineNo, line := range strings.Split(string(bin), "\n") {
+		line = strings.TrimFunc(line, unicode.IsSpace)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		domain, serversStr, ok := StringTwoFields(line)
+		if !ok {
+			return nil, fmt.Errorf("Syntax error for a forwarding rule in [%s] at line %d. Expected syntax: example.com: 9.9.9.9,8.8.8.8", file, 1+lineNo)
+		}
+		domain = strings.ToLower(domain)
+		var qTypes map[uint16]bool
+		if qTypesStr, rest, ok := StringTwoFields(serversStr); ok {
+			if qTypes = parseForwardQTypes(qTypesStr); qTypes != nil {
+				serversStr = rest
+			}
+		}
+		var servers []string
+		for _, server := range strings.Split(serversStr, ",") {
+			server = strings.TrimFunc(server, unicode.IsSpace)
+			if net.ParseIP(server) != nil {
+				server = fmt.Sprintf("%s:%d", server, 53)
+			}
+			servers = append(servers, server)
+		}
+		if len(servers) == 0 {
+			continue
+		}
+		forwardMap = append(forwardMap, PluginForwardEntry{
+			domain: domain, servers: servers, qTypes: qTypes,
+		})
+	}
+	return forwardMap, nil
+}
+
+// parseForwardQTypes parses an optional list of record types such as SRV,TXT, and returns nil
+// if the string is not one
+func parseForwardQTypes(str string) map[uint16]bool {
+	qTypes := make(map[uint16]bool)
+	for _, qTypeStr := range strings.Split(str, ",") {
+		qType, ok := dns.StringToType[strings.ToUpper(strings.TrimFunc(qTypeStr, unicode.IsSpace))]
+		if !ok {
+			return nil
+		}
+		qTypes[qType] = true
+	}
+	return qTypes
+}
+
+func (plugin *PluginForward) Drop() error {
+	if plugin.stop != nil {
+		close(plugin.stop)
+	}
+	return nil
+}
+
+func (plugin *PluginForward) Reload() error {
+	return nil
+}
+
+func (plugin *PluginForward) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if len(pluginsState.upstreamOverride) > 0 {
+		return nil
+	}
+	questions := msg.Question
+	if len(questions) != 1 {
+		return nil
+	}
+	question, qType := strings.ToLower(StripTrailingDot(questions[0].Name)), questions[0].Qtype
+	forwardMap := plugin.forwardMap
+	if profile := plugin.networkProfiles.Active(); profile != nil {
+		if profileForwardMap, ok := plugin.profileForwardMaps[profile.name]; ok {
+			forwardMap = profileForwardMap
+		}
+	}
+	servers, rule := matchForwardingRule(forwardMap, question, qType)
+	if len(servers) == 0 && plugin.stop != nil {
+		plugin.RLock()
+		servers, rule = matchForwardingRule(plugin.searchDomains, question, qType)
+		plugin.RUnlock()
+	}
+	if len(servers) == 0 {
+		return nil
+	}
+	server := servers[rand.Intn(len(servers))]
+	pluginsState.audit("forwarded", plugin.Name(), rule, server)
+	if pluginsState.dryRun {
+		return nil
+	}
+	respMsg, _, err := PlaintextExchange(nil, &dns.Client{Net: "udp"}, msg, server)
+	if err != nil {
+		return err
+	}
+	pluginsState.synthResponse = respMsg
+	pluginsState.action = PluginsActionSynth
+	return nil
+}
+
+// matchForwardingRule returns the servers of the first rule matching a name, or its parent
+// domains, and the query type
+func matchForwardingRule(forwardMap []PluginForwardEntry, question string, qType uint16) ([]string, string) {
+	questionLen := len(question)
+	for _, candidate := range forwardMap {
+		candidateLen := len(candidate.domain)
+		if candidateLen > questionLen || (candidate.qTypes != nil && !candidate.qTypes[qType]) {
+			continue
+		}
+		if question[questionLen-candidateLen:] == candidate.domain && (candidateLen == questionLen || (question[questionLen-candidateLen-1] == '.')) {
+			return candidate.servers, candidate.domain
+		}
+	}
+	return nil, ""
+}
@@ -1,8 +1,11 @@
-package main
+package proxy
 
 import "github.com/miekg/dns"
 
-type PluginGetSetPayloadSize struct{}
+type PluginGetSetPayloadSize struct {
+	forceDNSSEC    bool
+	ednsBufferSize int
+}
 
 func (plugin *PluginGetSetPayloadSize) Name() string {
 	return "get_set_payload_size"
@@ -13,6 +16,8 @@ func (plugin *PluginGetSetPayloadSize) Description() string {
 }
 
 func (plugin *PluginGetSetPayloadSize) Init(proxy *Proxy) error {
+	plugin.forceDNSSEC = proxy.dnssecValidation
+	plugin.ednsBufferSize = proxy.ednsBufferSize
 	return nil
 }
 
@@ -33,8 +38,8 @@ func (plugin *PluginGetSetPayloadSize) Eval(pluginsState *PluginsState, msg *dns
 		dnssec = opt.Do()
 	}
 	pluginsState.dnssec = dnssec
-	pluginsState.maxPayloadSize = Min(MaxDNSUDPPacketSize-ResponseOverhead, Max(pluginsState.originalMaxPayloadSize, pluginsState.maxPayloadSize))
-	if pluginsState.maxPayloadSize > 512 {
+	pluginsState.maxPayloadSize = Min(plugin.ednsBufferSize-ResponseOverhead, Max(pluginsState.originalMaxPayloadSize, pluginsState.maxPayloadSize))
+	if pluginsState.maxPayloadSize > 512 || plugin.forceDNSSEC {
 		extra2 := []dns.RR{}
 		for _, extra := range msg.Extra {
 			if extra.Header().Rrtype != dns.TypeOPT {
@@ -42,7 +47,7 @@ func (plugin *PluginGetSetPayloadSize) Eval(pluginsState *PluginsState, msg *dns
 			}
 		}
 		msg.Extra = extra2
-		msg.SetEdns0(uint16(pluginsState.maxPayloadSize), dnssec)
+		msg.SetEdns0(uint16(pluginsState.maxPayloadSize), dnssec || plugin.forceDNSSEC)
 	}
 	return nil
 }
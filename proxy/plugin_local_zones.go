@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+type LocalZone struct {
+	origin  string
+	soa     *dns.SOA
+	records map[string]map[uint16][]dns.RR
+}
+
+type PluginLocalZones struct {
+	zones map[string]*LocalZone
+}
+
+func (plugin *PluginLocalZones) Name() string {
+	return "local_zones"
+}
+
+func (plugin *PluginLocalZones) Description() string {
+	return "Answers authoritatively for local zones"
+}
+
+func (plugin *PluginLocalZones) Init(proxy *Proxy) error {
+	plugin.zones = make(map[string]*LocalZone)
+	for origin, file := range proxy.localZones {
+		dlog.Noticef("Loading the local zone [%s] from [%s]", origin, file)
+		zone, err := LoadLocalZone(origin, file)
+		if err != nil {
+			return err
+		}
+		plugin.zones[zone.origin] = zone
+	}
+	return nil
+}
+
+func LoadLocalZone(origin string, file string) (*LocalZone, error) {
+	fp, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	origin = strings.ToLower(dns.Fqdn(origin))
+	zone := LocalZone{origin: origin, records: make(map[string]map[uint16][]dns.RR)}
+	for token := range dns.ParseZone(fp, origin, file) {
+		if token.Error != nil {
+			return nil, token.Error
+		}
+		header := token.RR.Header()
+		header.Name = strings.ToLower(header.Name)
+		if !dns.IsSubDomain(origin, header.Name) {
+			return nil, fmt.Errorf("Record [%s] is out of zone [%s]", header.Name, origin)
+		}
+		if soa, ok := token.RR.(*dns.SOA); ok && header.Name == origin {
+			zone.soa = soa
+		}
+		rrsets, ok := zone.records[header.Name]
+		if !ok {
+			rrsets = make(map[uint16][]dns.RR)
+			zone.records[header.Name] = rrsets
+		}
+		rrsets[header.Rrtype] = append(rrsets[header.Rrtype], token.RR)
+	}
+	if zone.soa == nil {
+		return nil, fmt.Errorf("No SOA record found for zone [%s] in [%s]", origin, file)
+	}
+	return &zone, nil
+}
+
+func (plugin *PluginLocalZones) Drop() error {
+	return nil
+}
+
+func (plugin *PluginLocalZones) Reload() error {
+	return nil
+}
+
+func (plugin *PluginLocalZones) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	questions := msg.Question
+	if len(questions) != 1 {
+		return nil
+	}
+	question := questions[0]
+	if question.Qclass != dns.ClassINET {
+		return nil
+	}
+	qName := strings.ToLower(question.Name)
+	var zone *LocalZone
+	for name := qName; ; {
+		if zone = plugin.zones[name]; zone != nil {
+			break
+		}
+		offset, end := dns.NextLabel(name, 0)
+		if end {
+			return nil
+		}
+		name = name[offset:]
+	}
+	synth, err := EmptyResponseFromMessage(msg)
+	if err != nil {
+		return err
+	}
+	synth.Authoritative = true
+	zone.answer(synth, qName, question.Qtype)
+	pluginsState.synthResponse = synth
+	pluginsState.action = PluginsActionSynth
+	return nil
+}
+
+func (zone *LocalZone) answer(synth *dns.Msg, qName string, qtype uint16) {
+	rrsets, found := zone.records[qName]
+	if !found && !zone.hasDescendants(qName) {
+		if rrsets, found = zone.wildcardRecords(qName); !found {
+			synth.Rcode = dns.RcodeNameError
+		}
+	}
+	if !found {
+		synth.Ns = []dns.RR{zone.negativeSOA()}
+		return
+	}
+	var answer []dns.RR
+	if qtype == dns.TypeANY {
+		for _, rrset := range rrsets {
+			answer = append(answer, rrset...)
+		}
+	} else if rrset, ok := rrsets[qtype]; ok {
+		answer = rrset
+	} else if cname, ok := rrsets[dns.TypeCNAME]; ok {
+		answer = cname
+	}
+	if len(answer) == 0 {
+		synth.Ns = []dns.RR{zone.negativeSOA()}
+		return
+	}
+	for _, rr := range answer {
+		rr = dns.Copy(rr)
+		rr.Header().Name = qName
+		synth.Answer = append(synth.Answer, rr)
+	}
+	// Follow CNAME records pointing to names of the same zone
+	for i := 0; i < 8 && qtype != dns.TypeCNAME && qtype != dns.TypeANY; i++ {
+		cname, ok := synth.Answer[len(synth.Answer)-1].(*dns.CNAME)
+		if !ok {
+			break
+		}
+		target := strings.ToLower(cname.Target)
+		if !dns.IsSubDomain(zone.origin, target) {
+			break
+		}
+		rrsets := zone.records[target]
+		rrset, ok := rrsets[qtype]
+		if !ok {
+			rrset = rrsets[dns.TypeCNAME]
+		}
+		if len(rrset) == 0 {
+			break
+		}
+		synth.Answer = append(synth.Answer, rrset...)
+	}
+}
+
+// wildcardRecords returns the records of the closest wildcard matching a name that doesn't exist
+func (zone *LocalZone) wildcardRecords(qName string) (map[uint16][]dns.RR, bool) {
+	for name := qName; name != zone.origin; {
+		offset, end := dns.NextLabel(name, 0)
+		if end {
+			break
+		}
+		name = name[offset:]
+		if rrsets, found := zone.records["*."+name]; found {
+			return rrsets, true
+		}
+		if _, found := zone.records[name]; found {
+			break
+		}
+	}
+	return nil, false
+}
+
+// hasDescendants tells whether a name without records is an empty non-terminal
+func (zone *LocalZone) hasDescendants(qName string) bool {
+	suffix := "." + qName
+	for name := range zone.records {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (zone *LocalZone) negativeSOA() dns.RR {
+	soa := dns.Copy(zone.soa).(*dns.SOA)
+	if soa.Minttl < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+	return soa
+}
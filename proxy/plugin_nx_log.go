@@ -1,4 +1,4 @@
-package main
+package proxy
 
 import (
 	"errors"
@@ -32,6 +32,9 @@ func (plugin *PluginNxLog) Init(proxy *Proxy) error {
 }
 
 func (plugin *PluginNxLog) Drop() error {
+	if plugin.logger != nil {
+		return plugin.logger.Close()
+	}
 	return nil
 }
 
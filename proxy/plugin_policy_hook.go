@@ -0,0 +1,321 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+const (
+	DefaultPolicyHookTimeout  = 100
+	DefaultPolicyHookCacheTTL = 300
+	PolicyHookCacheSize       = 65536
+	PolicyHookAnswerTTL       = 60
+	PolicyHookMaxResponseSize = 4096
+	// A helper that exits is not started again before this delay
+	PolicyHelperRestartDelay = 5 * time.Second
+)
+
+type PolicyHookConfig struct {
+	URL      string `toml:"url"`
+	Command  string `toml:"command"`
+	Timeout  int    `toml:"timeout"`
+	CacheTTL int    `toml:"cache_ttl"`
+	OnError  string `toml:"on_error"`
+}
+
+type policyVerdict struct {
+	block      bool
+	ips        []net.IP
+	expiration time.Time
+}
+
+// parsePolicyVerdict parses the response of a policy hook: `allow`, `block`, or `rewrite`
+// followed by the IP addresses to answer with
+func parsePolicyVerdict(line string) (policyVerdict, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return policyVerdict{}, errors.New("Empty verdict")
+	}
+	switch strings.ToLower(fields[0]) {
+	case "allow":
+		return policyVerdict{}, nil
+	case "block":
+		return policyVerdict{block: true}, nil
+	case "rewrite":
+		verdict := policyVerdict{}
+		for _, field := range fields[1:] {
+			ip := net.ParseIP(field)
+			if ip == nil {
+				return policyVerdict{}, fmt.Errorf("Invalid IP address: [%s]", field)
+			}
+			verdict.ips = append(verdict.ips, ip)
+		}
+		if len(verdict.ips) == 0 {
+			return policyVerdict{}, errors.New("No IP addresses to rewrite to")
+		}
+		return verdict, nil
+	}
+	return policyVerdict{}, fmt.Errorf("Unexpected verdict: [%s]", line)
+}
+
+// policyHelper is a long-running process receiving one `<id> <name> <type> <client IP>` line
+// per query on its standard input, and writing `<id> <verdict>` lines to its standard output,
+// in any order. Names are percent-encoded, since they can contain spaces and any other byte.
+// It is started when the first verdict is needed, and again if it exits.
+type policyHelper struct {
+	sync.Mutex
+	command []string
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	started time.Time
+	nextID  uint64
+	pending map[uint64]chan string
+}
+
+func (helper *policyHelper) start() error {
+	if time.Since(helper.started) < PolicyHelperRestartDelay {
+		return errors.New("The policy helper is not running")
+	}
+	helper.started = time.Now()
+	cmd := exec.Command(helper.command[0], helper.command[1:]...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	dlog.Noticef("Policy helper [%s] started", helper.command[0])
+	helper.cmd, helper.stdin = cmd, stdin
+	go helper.read(cmd, stdout)
+	return nil
+}
+
+func (helper *policyHelper) read(cmd *exec.Cmd, stdout io.Reader) {
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		parts := strings.SplitN(strings.TrimSpace(scanner.Text()), " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		id, err := strconv.ParseUint(parts[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		helper.Lock()
+		if ch, ok := helper.pending[id]; ok {
+			delete(helper.pending, id)
+			ch <- parts[1]
+		}
+		helper.Unlock()
+	}
+	cmd.Wait()
+	helper.Lock()
+	if helper.cmd == cmd {
+		dlog.Warnf("Policy helper [%s] exited", helper.command[0])
+		helper.cmd, helper.stdin = nil, nil
+		for id, ch := range helper.pending {
+			close(ch)
+			delete(helper.pending, id)
+		}
+	}
+	helper.Unlock()
+}
+
+func (helper *policyHelper) query(name string, qType string, clientIP string, timeout time.Duration) (string, error) {
+	helper.Lock()
+	if helper.cmd == nil {
+		if err := helper.start(); err != nil {
+			helper.Unlock()
+			return "", err
+		}
+	}
+	helper.nextID++
+	id := helper.nextID
+	ch := make(chan string, 1)
+	helper.pending[id] = ch
+	_, err := fmt.Fprintf(helper.stdin, "%d %s %s %s\n", id, strings.Replace(url.QueryEscape(name), "+", "%20", -1), qType, clientIP)
+	if err != nil {
+		delete(helper.pending, id)
+	}
+	helper.Unlock()
+	if err != nil {
+		return "", err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case line, ok := <-ch:
+		if !ok {
+			return "", errors.New("The policy helper exited")
+		}
+		return line, nil
+	case <-timer.C:
+		helper.Lock()
+		delete(helper.pending, id)
+		helper.Unlock()
+		return "", errors.New("Timeout")
+	}
+}
+
+func (helper *policyHelper) stop() {
+	helper.Lock()
+	defer helper.Unlock()
+	if helper.cmd != nil {
+		helper.stdin.Close()
+		helper.cmd.Process.Kill()
+		helper.cmd, helper.stdin = nil, nil
+	}
+}
+
+// PluginPolicyHook asks an external service whether names that are not in the cache can be
+// resolved. Verdicts are cached for each name and type, independently of the client.
+type PluginPolicyHook struct {
+	url         string
+	helper      *policyHelper
+	httpClient  *http.Client
+	timeout     time.Duration
+	cacheTTL    time.Duration
+	blockOnFail bool
+	verdicts    *lru.Cache
+}
+
+func (plugin *PluginPolicyHook) Name() string {
+	return "policy_hook"
+}
+
+func (plugin *PluginPolicyHook) Description() string {
+	return "Ask an external service for a verdict on queries."
+}
+
+func (plugin *PluginPolicyHook) Init(proxy *Proxy) error {
+	config := proxy.policyHook
+	if (len(config.URL) > 0) == (len(config.Command) > 0) {
+		return errors.New("Either a URL or a command must be set")
+	}
+	switch strings.ToLower(config.OnError) {
+	case "", "allow":
+	case "block":
+		plugin.blockOnFail = true
+	default:
+		return fmt.Errorf("Unsupported on_error action: [%s]", config.OnError)
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultPolicyHookTimeout
+	}
+	if config.CacheTTL < 0 {
+		config.CacheTTL = 0
+	} else if config.CacheTTL == 0 {
+		config.CacheTTL = DefaultPolicyHookCacheTTL
+	}
+	plugin.timeout = time.Duration(config.Timeout) * time.Millisecond
+	plugin.cacheTTL = time.Duration(config.CacheTTL) * time.Second
+	if len(config.URL) > 0 {
+		if _, err := url.Parse(config.URL); err != nil {
+			return err
+		}
+		plugin.url = config.URL
+		plugin.httpClient = &http.Client{Timeout: plugin.timeout}
+	} else {
+		plugin.helper = &policyHelper{command: strings.Fields(config.Command), pending: make(map[uint64]chan string)}
+	}
+	verdicts, err := lru.New(PolicyHookCacheSize)
+	if err != nil {
+		return err
+	}
+	plugin.verdicts = verdicts
+	return nil
+}
+
+func (plugin *PluginPolicyHook) Drop() error {
+	if plugin.helper != nil {
+		plugin.helper.stop()
+	}
+	return nil
+}
+
+func (plugin *PluginPolicyHook) Reload() error {
+	return nil
+}
+
+func (plugin *PluginPolicyHook) ask(name string, qType string, clientIP string) (string, error) {
+	if plugin.helper != nil {
+		return plugin.helper.query(name, qType, clientIP, plugin.timeout)
+	}
+	query := url.Values{"name": {name}, "type": {qType}, "client": {clientIP}}
+	separator := "?"
+	if strings.Contains(plugin.url, "?") {
+		separator = "&"
+	}
+	resp, err := plugin.httpClient.Get(plugin.url + separator + query.Encode())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Status: %s", resp.Status)
+	}
+	bin, err := ioutil.ReadAll(io.LimitReader(resp.Body, PolicyHookMaxResponseSize))
+	if err != nil {
+		return "", err
+	}
+	return strings.SplitN(string(bin), "\n", 2)[0], nil
+}
+
+func (plugin *PluginPolicyHook) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if len(msg.Question) != 1 {
+		return nil
+	}
+	qType, ok := dns.TypeToString[pluginsState.qType]
+	if !ok {
+		qType = strconv.Itoa(int(pluginsState.qType))
+	}
+	key := pluginsState.qName + "/" + qType
+	var verdict policyVerdict
+	if cached, ok := plugin.verdicts.Get(key); ok && time.Now().Before(cached.(policyVerdict).expiration) {
+		verdict = cached.(policyVerdict)
+	} else {
+		line, err := plugin.ask(pluginsState.qName, qType, pluginsState.ClientIP().String())
+		if err == nil {
+			verdict, err = parsePolicyVerdict(line)
+		}
+		if err != nil {
+			dlog.Debugf("Policy hook failed for [%s]: %v", pluginsState.qName, err)
+			verdict = policyVerdict{block: plugin.blockOnFail}
+		} else if plugin.cacheTTL > 0 {
+			verdict.expiration = time.Now().Add(plugin.cacheTTL)
+			plugin.verdicts.Add(key, verdict)
+		}
+	}
+	if verdict.block {
+		pluginsState.action = PluginsActionReject
+		pluginsState.rejectReason = "policy_hook"
+		return nil
+	}
+	if len(verdict.ips) > 0 {
+		if err := synthAddressesResponse(pluginsState, msg, verdict.ips, PolicyHookAnswerTTL); err != nil {
+			return err
+		}
+		pluginsState.audit("rewritten", plugin.Name(), "", fmt.Sprint(verdict.ips))
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	crypto_rand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+	lumberjack "gopkg.in/natefinch/lumberjack.v2"
+)
+
+type PluginQueryLog struct {
+	sync.RWMutex
+	logger           *lumberjack.Logger
+	groupLoggers     map[string]*lumberjack.Logger
+	format           string
+	ignoredQtypes    []string
+	ignoredDomains   map[string]bool
+	ignoredClients   []*net.IPNet
+	anonymizeClients string
+	clientHashKey    [32]byte
+	hardwareAddrs    bool
+	retention        time.Duration
+	aggregateFile    string
+	stop             chan struct{}
+	window           *WeeklyRanges
+	shipper          *QueryLogShipper
+}
+
+func (plugin *PluginQueryLog) Name() string {
+	return "query_log"
+}
+
+func (plugin *PluginQueryLog) Description() string {
+	return "Log DNS queries."
+}
+
+func (plugin *PluginQueryLog) Init(proxy *Proxy) error {
+	if len(proxy.queryLogFile) > 0 {
+		plugin.logger = &lumberjack.Logger{LocalTime: true, MaxSize: proxy.logMaxSize, MaxAge: proxy.logMaxAge, MaxBackups: proxy.logMaxBackups, Filename: proxy.queryLogFile, Compress: true}
+	}
+	plugin.groupLoggers = make(map[string]*lumberjack.Logger)
+	for groupName, groupConfig := range proxy.clientGroupsConfig {
+		if len(groupConfig.QueryLogFile) > 0 {
+			plugin.groupLoggers[groupName] = &lumberjack.Logger{LocalTime: true, MaxSize: proxy.logMaxSize, MaxAge: proxy.logMaxAge, MaxBackups: proxy.logMaxBackups, Filename: groupConfig.QueryLogFile, Compress: true}
+		}
+	}
+	plugin.format = proxy.queryLogFormat
+	plugin.ignoredQtypes = proxy.queryLogIgnoredQtypes
+	plugin.ignoredDomains = make(map[string]bool)
+	for _, domain := range proxy.queryLogIgnoredDomains {
+		plugin.ignoredDomains[domain] = true
+	}
+	plugin.ignoredClients = proxy.queryLogIgnoredClients
+	plugin.anonymizeClients = proxy.queryLogAnonymizeClients
+	// MAC addresses are never logged if client addresses are anonymized
+	plugin.hardwareAddrs = (len(proxy.clientIdentification.EDNSFrom) > 0 || proxy.clientIdentification.Neighbors) && len(plugin.anonymizeClients) == 0
+	// Hashes can only be linked to each other until the proxy is restarted
+	if _, err := crypto_rand.Read(plugin.clientHashKey[:]); err != nil {
+		return err
+	}
+	plugin.retention = proxy.queryLogRetention
+	plugin.aggregateFile = proxy.queryLogAggregateFile
+	plugin.window = proxy.maintenanceWindow
+	if plugin.retention > 0 && plugin.logger != nil {
+		plugin.stop = make(chan struct{})
+		go plugin.monitorRetention()
+	}
+	if len(proxy.queryLogRemote.Type) > 0 {
+		shipper, err := NewQueryLogShipper(&proxy.queryLogRemote)
+		if err != nil {
+			return err
+		}
+		plugin.shipper = shipper
+	}
+	return nil
+}
+
+func (plugin *PluginQueryLog) Drop() error {
+	if plugin.stop != nil {
+		close(plugin.stop)
+	}
+	if plugin.shipper != nil {
+		plugin.shipper.close()
+	}
+	for _, groupLogger := range plugin.groupLoggers {
+		groupLogger.Close()
+	}
+	if plugin.logger != nil {
+		return plugin.logger.Close()
+	}
+	return nil
+}
+
+func (plugin *PluginQueryLog) Reload() error {
+	return nil
+}
+
+func (plugin *PluginQueryLog) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if pluginsState.backgroundRefresh {
+		return nil
+	}
+	questions := msg.Question
+	if len(questions) == 0 {
+		return nil
+	}
+	question := questions[0]
+	qType, ok := dns.TypeToString[question.Qtype]
+	if !ok {
+		qType = string(qType)
+	}
+	if len(plugin.ignoredQtypes) > 0 {
+		for _, ignoredQtype := range plugin.ignoredQtypes {
+			if strings.EqualFold(ignoredQtype, qType) {
+				return nil
+			}
+		}
+	}
+	clientIP := pluginsState.ClientIP()
+	for _, network := range plugin.ignoredClients {
+		if network.Contains(clientIP) {
+			return nil
+		}
+	}
+	qName := StripTrailingDot(question.Name)
+	if plugin.isIgnoredName(qName) {
+		return nil
+	}
+	clientIPStr := plugin.clientIPString(clientIP)
+	if plugin.shipper != nil {
+		event := QueryLogEvent{Time: time.Now(), Client: clientIPStr, Name: qName, Type: qType}
+		if plugin.hardwareAddrs {
+			event.MAC = pluginsState.clientMAC
+		}
+		plugin.shipper.enqueue(event)
+	}
+	// Queries received by a listener bound to a client group can have their own log
+	logger := plugin.logger
+	if groupLogger, ok := plugin.groupLoggers[pluginsState.listenerClientGroup]; ok {
+		logger = groupLogger
+	}
+	if logger == nil {
+		return nil
+	}
+
+	hardwareAddrStr := "-"
+	if len(pluginsState.clientMAC) > 0 {
+		hardwareAddrStr = pluginsState.clientMAC
+	}
+	var line string
+	if plugin.format == "tsv" {
+		now := time.Now()
+		year, month, day := now.Date()
+		hour, minute, second := now.Clock()
+		tsStr := fmt.Sprintf("[%d-%02d-%02d %02d:%02d:%02d]", year, int(month), day, hour, minute, second)
+		line = fmt.Sprintf("%s\t%s\t%s\t%s", tsStr, clientIPStr, StringQuote(qName), qType)
+		if plugin.hardwareAddrs {
+			line += "\t" + hardwareAddrStr
+		}
+		line += "\n"
+	} else if plugin.format == "ltsv" {
+		line = fmt.Sprintf("time:%d\thost:%s\tmessage:%s\ttype:%s",
+			time.Now().Unix(), clientIPStr, StringQuote(qName), qType)
+		if plugin.hardwareAddrs {
+			line += "\tmac:" + hardwareAddrStr
+		}
+		line += "\n"
+	} else {
+		dlog.Fatalf("Unexpected log format: [%s]", plugin.format)
+	}
+	plugin.RLock()
+	logger.Write([]byte(line))
+	plugin.RUnlock()
+	return nil
+}
+
+// isIgnoredName returns true if a name, or one of its parent domains, shouldn't be logged
+func (plugin *PluginQueryLog) isIgnoredName(qName string) bool {
+	if len(plugin.ignoredDomains) == 0 {
+		return false
+	}
+	name := strings.ToLower(qName)
+	for {
+		if plugin.ignoredDomains[name] {
+			return true
+		}
+		dot := strings.IndexByte(name, '.')
+		if dot < 0 {
+			return false
+		}
+		name = name[dot+1:]
+	}
+}
+
+// clientIPString returns the client address as it should be logged: as-is, without the host
+// part (/24 for IPv4, /48 for IPv6), or as a keyed hash
+func (plugin *PluginQueryLog) clientIPString(ip net.IP) string {
+	switch plugin.anonymizeClients {
+	case "truncate":
+		if ipv4 := ip.To4(); ipv4 != nil {
+			return ipv4.Mask(net.CIDRMask(24, 32)).String()
+		}
+		return ip.Mask(net.CIDRMask(48, 128)).String()
+	case "hash":
+		mac := hmac.New(sha256.New, plugin.clientHashKey[:])
+		mac.Write(ip.To16())
+		return hex.EncodeToString(mac.Sum(nil)[:8])
+	}
+	return ip.String()
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+const RateLimitMaxClients = 8192
+
+type TokenBucket struct {
+	tokens     float64
+	lastUpdate time.Time
+}
+
+type PluginRateLimit struct {
+	sync.Mutex
+	buckets         *lru.Cache
+	rate            float64
+	burst           float64
+	blockedResponse *BlockedResponse
+}
+
+func (plugin *PluginRateLimit) Name() string {
+	return "rate_limit"
+}
+
+func (plugin *PluginRateLimit) Description() string {
+	return "Limit the rate of queries accepted from each client."
+}
+
+func (plugin *PluginRateLimit) Init(proxy *Proxy) error {
+	plugin.rate = float64(proxy.clientRateLimit)
+	plugin.burst = float64(Max(proxy.clientRateLimitBurst, proxy.clientRateLimit))
+	plugin.blockedResponse = &BlockedResponse{responseType: BlockedResponseRefused, ede: proxy.blockedQueryResponse.ede}
+	var err error
+	plugin.buckets, err = lru.New(RateLimitMaxClients)
+	return err
+}
+
+func (plugin *PluginRateLimit) Drop() error {
+	return nil
+}
+
+func (plugin *PluginRateLimit) Reload() error {
+	return nil
+}
+
+func (plugin *PluginRateLimit) allow(key string, now time.Time) bool {
+	plugin.Lock()
+	defer plugin.Unlock()
+	var bucket *TokenBucket
+	if xbucket, ok := plugin.buckets.Get(key); ok {
+		bucket = xbucket.(*TokenBucket)
+		elapsed := now.Sub(bucket.lastUpdate).Seconds()
+		bucket.tokens = MinF(plugin.burst, bucket.tokens+elapsed*plugin.rate)
+		bucket.lastUpdate = now
+	} else {
+		bucket = &TokenBucket{tokens: plugin.burst, lastUpdate: now}
+		plugin.buckets.Add(key, bucket)
+	}
+	if bucket.tokens < 1.0 {
+		return false
+	}
+	bucket.tokens -= 1.0
+	return true
+}
+
+func (plugin *PluginRateLimit) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	clientIPStr := pluginsState.ClientIP().String()
+	if plugin.allow(clientIPStr, time.Now()) {
+		return nil
+	}
+	dlog.Debugf("Rate limit exceeded for client [%s]", clientIPStr)
+	pluginsState.action = PluginsActionReject
+	pluginsState.rejectReason = "rate limit"
+	pluginsState.blockedResponse = plugin.blockedResponse
+	return nil
+}
@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const SafeSearchCNAMETTL = 3600
+
+type SafeSearchRewrite struct {
+	originalName string
+	target       string
+}
+
+var safeSearchTargets = map[string]string{
+	"bing.com":                "strict.bing.com",
+	"duckduckgo.com":          "safe.duckduckgo.com",
+	"youtube.com":             "restrict.youtube.com",
+	"m.youtube.com":           "restrict.youtube.com",
+	"youtubei.googleapis.com": "restrict.youtube.com",
+	"youtube.googleapis.com":  "restrict.youtube.com",
+	"youtube-nocookie.com":    "restrict.youtube.com",
+}
+
+const googleSafeSearchTarget = "forcesafesearch.google.com"
+
+type PluginSafeSearch struct {
+	allClients bool
+}
+
+func (plugin *PluginSafeSearch) Name() string {
+	return "safe_search"
+}
+
+func (plugin *PluginSafeSearch) Description() string {
+	return "Enforce safe search results on popular search engines."
+}
+
+func (plugin *PluginSafeSearch) Init(proxy *Proxy) error {
+	plugin.allClients = proxy.safeSearch
+	return nil
+}
+
+func (plugin *PluginSafeSearch) Drop() error {
+	return nil
+}
+
+func (plugin *PluginSafeSearch) Reload() error {
+	return nil
+}
+
+func (plugin *PluginSafeSearch) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if !plugin.allClients && (pluginsState.clientGroup == nil || !pluginsState.clientGroup.safeSearch) {
+		return nil
+	}
+	questions := msg.Question
+	if len(questions) != 1 {
+		return nil
+	}
+	question := questions[0]
+	if question.Qclass != dns.ClassINET || (question.Qtype != dns.TypeA && question.Qtype != dns.TypeAAAA) {
+		return nil
+	}
+	target := safeSearchTarget(strings.ToLower(StripTrailingDot(question.Name)))
+	if len(target) == 0 {
+		return nil
+	}
+	pluginsState.safeSearchRewrite = &SafeSearchRewrite{originalName: question.Name, target: dns.Fqdn(target)}
+	pluginsState.audit("rewritten", plugin.Name(), "", target)
+	question.Name = dns.Fqdn(target)
+	msg.Question = []dns.Question{question}
+	return nil
+}
+
+func safeSearchTarget(qName string) string {
+	qName = strings.TrimPrefix(qName, "www.")
+	if target, ok := safeSearchTargets[qName]; ok {
+		return target
+	}
+	if strings.HasPrefix(qName, "google.") && len(qName) > len("google.") {
+		return googleSafeSearchTarget
+	}
+	return ""
+}
+
+func (rewrite *SafeSearchRewrite) restore(msg *dns.Msg) {
+	if len(msg.Question) != 1 {
+		return
+	}
+	question := msg.Question[0]
+	question.Name = rewrite.originalName
+	msg.Question = []dns.Question{question}
+	if msg.Rcode != dns.RcodeSuccess {
+		return
+	}
+	ttl := uint32(SafeSearchCNAMETTL)
+	for _, rr := range msg.Answer {
+		if rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	cname := new(dns.CNAME)
+	cname.Hdr = dns.RR_Header{Name: rewrite.originalName, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: ttl}
+	cname.Target = rewrite.target
+	msg.Answer = append([]dns.RR{cname}, msg.Answer...)
+}
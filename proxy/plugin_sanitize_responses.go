@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"strings"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+// PluginSanitizeResponses removes what stub clients don't need from responses, before they
+// are cached or returned, to reduce their size and what a poisoned response can inject:
+//   - answer records that are not part of the chain of names starting with the question
+//   - the authority section of positive responses, and everything but the SOA record (and
+//     DNSSEC proofs) in negative responses
+//   - additional records, except the addresses of the names the answer points to
+//   - DNSSEC records, for clients that didn't ask for them
+//
+// The ID and the question, with its original case, are also set back to the ones of the query.
+type PluginSanitizeResponses struct{}
+
+func (plugin *PluginSanitizeResponses) Name() string {
+	return "sanitize_responses"
+}
+
+func (plugin *PluginSanitizeResponses) Description() string {
+	return "Remove unneeded and unrelated records from responses."
+}
+
+func (plugin *PluginSanitizeResponses) Init(proxy *Proxy) error {
+	return nil
+}
+
+func (plugin *PluginSanitizeResponses) Drop() error {
+	return nil
+}
+
+func (plugin *PluginSanitizeResponses) Reload() error {
+	return nil
+}
+
+func isDNSSECRecord(rr dns.RR) bool {
+	switch rr.Header().Rrtype {
+	case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+		return true
+	}
+	return false
+}
+
+// isAncestor returns true if a name is one of the names of a set, or one of their parents
+func isAncestor(name string, names map[string]bool) bool {
+	for child := range names {
+		if dns.IsSubDomain(name, child) {
+			return true
+		}
+	}
+	return false
+}
+
+func (plugin *PluginSanitizeResponses) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if len(msg.Question) != 1 {
+		return nil
+	}
+	if queryName := pluginsState.queryName; len(queryName) > 0 && strings.EqualFold(msg.Question[0].Name, queryName) {
+		msg.Question[0].Name = queryName
+		msg.Id = pluginsState.queryID
+	}
+	dnssec := pluginsState.dnssec
+	removed := 0
+
+	// Names of the chain starting with the question, following CNAME records in any order;
+	// servers synthesize CNAME records for DNAME records
+	names := map[string]bool{strings.ToLower(msg.Question[0].Name): true}
+	for changed := true; changed; {
+		changed = false
+		for _, rr := range msg.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok && names[strings.ToLower(cname.Hdr.Name)] {
+				if target := strings.ToLower(cname.Target); !names[target] {
+					names[target], changed = true, true
+				}
+			}
+		}
+	}
+	answer := msg.Answer[:0]
+	targets := make(map[string]bool)
+	answered := false
+	for _, rr := range msg.Answer {
+		owner := strings.ToLower(rr.Header().Name)
+		keep := names[owner]
+		switch rr := rr.(type) {
+		case *dns.DNAME:
+			keep = isAncestor(owner, names)
+		case *dns.RRSIG:
+			keep = dnssec && (keep || (rr.TypeCovered == dns.TypeDNAME && isAncestor(owner, names)))
+		case *dns.NSEC, *dns.NSEC3:
+			keep = keep && dnssec
+		}
+		if !keep {
+			removed++
+			continue
+		}
+		switch rr := rr.(type) {
+		case *dns.MX:
+			targets[strings.ToLower(rr.Mx)] = true
+		case *dns.SRV:
+			targets[strings.ToLower(rr.Target)] = true
+		case *dns.NS:
+			targets[strings.ToLower(rr.Ns)] = true
+		}
+		if qType := msg.Question[0].Qtype; rr.Header().Rrtype == qType || qType == dns.TypeANY {
+			answered = true
+		}
+		answer = append(answer, rr)
+	}
+	msg.Answer = answer
+
+	// Negative responses, including CNAME chains ending with a name without records of the
+	// requested type, keep the SOA record, that tells for how long they can be cached
+	negative := msg.Rcode == dns.RcodeNameError || (msg.Rcode == dns.RcodeSuccess && !answered)
+	ns := msg.Ns[:0]
+	for _, rr := range msg.Ns {
+		keep := false
+		if isDNSSECRecord(rr) {
+			keep = dnssec
+		} else if rr.Header().Rrtype == dns.TypeSOA {
+			keep = negative && isAncestor(strings.ToLower(rr.Header().Name), names)
+		}
+		if !keep {
+			removed++
+			continue
+		}
+		ns = append(ns, rr)
+	}
+	msg.Ns = ns
+
+	extra := msg.Extra[:0]
+	for _, rr := range msg.Extra {
+		keep := false
+		switch rr.Header().Rrtype {
+		case dns.TypeOPT:
+			keep = true
+		case dns.TypeA, dns.TypeAAAA:
+			keep = targets[strings.ToLower(rr.Header().Name)]
+		case dns.TypeRRSIG:
+			keep = dnssec && targets[strings.ToLower(rr.Header().Name)]
+		}
+		if !keep {
+			removed++
+			continue
+		}
+		extra = append(extra, rr)
+	}
+	msg.Extra = extra
+	if removed > 0 {
+		dlog.Debugf("%d records removed from the response to [%s]", removed, pluginsState.qName)
+	}
+	return nil
+}
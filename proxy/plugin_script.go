@@ -0,0 +1,234 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	ScriptStatesCount = 4
+	ScriptTimeout     = time.Duration(100) * time.Millisecond
+	ScriptAnswerTTL   = 60
+)
+
+type ScriptEngine struct {
+	states chan *lua.LState
+}
+
+func NewScriptEngine(scriptFile string) (*ScriptEngine, error) {
+	dlog.Noticef("Loading the script from [%s]", scriptFile)
+	scriptEngine := ScriptEngine{states: make(chan *lua.LState, ScriptStatesCount)}
+	for i := 0; i < ScriptStatesCount; i++ {
+		L := lua.NewState(lua.Options{SkipOpenLibs: true})
+		for _, lib := range []struct {
+			name string
+			open lua.LGFunction
+		}{
+			{lua.BaseLibName, lua.OpenBase},
+			{lua.TabLibName, lua.OpenTable},
+			{lua.StringLibName, lua.OpenString},
+			{lua.MathLibName, lua.OpenMath},
+		} {
+			L.Push(L.NewFunction(lib.open))
+			L.Push(lua.LString(lib.name))
+			L.Call(1, 0)
+		}
+		for _, unsafeFunction := range []string{"dofile", "loadfile", "load", "loadstring", "require", "module"} {
+			L.SetGlobal(unsafeFunction, lua.LNil)
+		}
+		if err := L.DoFile(scriptFile); err != nil {
+			L.Close()
+			return nil, err
+		}
+		scriptEngine.states <- L
+	}
+	return &scriptEngine, nil
+}
+
+func (scriptEngine *ScriptEngine) call(hook string, arg func(L *lua.LState) *lua.LTable) (lua.LValue, error) {
+	L := <-scriptEngine.states
+	defer func() { scriptEngine.states <- L }()
+	fn := L.GetGlobal(hook)
+	if fn.Type() != lua.LTFunction {
+		return lua.LNil, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ScriptTimeout)
+	defer cancel()
+	L.SetContext(ctx)
+	defer L.RemoveContext()
+	if err := L.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}, arg(L)); err != nil {
+		return lua.LNil, err
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+	return ret, nil
+}
+
+func scriptQueryTable(L *lua.LState, pluginsState *PluginsState, msg *dns.Msg) *lua.LTable {
+	tbl := L.CreateTable(0, 4)
+	if len(msg.Question) == 1 {
+		question := msg.Question[0]
+		L.SetField(tbl, "name", lua.LString(strings.ToLower(StripTrailingDot(question.Name))))
+		L.SetField(tbl, "qtype", lua.LString(dns.TypeToString[question.Qtype]))
+	}
+	L.SetField(tbl, "client_ip", lua.LString(pluginsState.ClientIP().String()))
+	L.SetField(tbl, "proto", lua.LString(pluginsState.clientProto))
+	return tbl
+}
+
+func (scriptEngine *ScriptEngine) applyAction(pluginsState *PluginsState, msg *dns.Msg, ret lua.LValue, hook string) error {
+	switch ret.Type() {
+	case lua.LTNil:
+		return nil
+	case lua.LTString:
+		switch action := ret.String(); action {
+		case "pass":
+		case "block":
+			pluginsState.action = PluginsActionReject
+			pluginsState.rejectReason = "script"
+		case "drop":
+			pluginsState.action = PluginsActionDrop
+		default:
+			return fmt.Errorf("Unexpected action returned by the [%s] script hook: [%s]", hook, action)
+		}
+		return nil
+	case lua.LTTable:
+		return scriptSynthResponse(pluginsState, msg, ret.(*lua.LTable))
+	}
+	return fmt.Errorf("Unexpected value returned by the [%s] script hook", hook)
+}
+
+func scriptSynthResponse(pluginsState *PluginsState, msg *dns.Msg, ips *lua.LTable) error {
+	var parsedIPs []net.IP
+	ips.ForEach(func(_ lua.LValue, value lua.LValue) {
+		if ip := net.ParseIP(value.String()); ip != nil {
+			parsedIPs = append(parsedIPs, ip)
+		}
+	})
+	return synthAddressesResponse(pluginsState, msg, parsedIPs, ScriptAnswerTTL)
+}
+
+// synthAddressesResponse answers a query with the addresses of the requested family
+func synthAddressesResponse(pluginsState *PluginsState, msg *dns.Msg, ips []net.IP, ttl uint32) error {
+	if len(msg.Question) != 1 {
+		return errors.New("Unexpected number of questions")
+	}
+	question := msg.Question[0]
+	synth, err := EmptyResponseFromMessage(msg)
+	if err != nil {
+		return err
+	}
+	synth.Rcode = dns.RcodeSuccess
+	synth.Answer = []dns.RR{}
+	for _, ip := range ips {
+		if ipv4 := ip.To4(); ipv4 != nil && question.Qtype == dns.TypeA {
+			rr := new(dns.A)
+			rr.Hdr = dns.RR_Header{Name: question.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}
+			rr.A = ipv4
+			synth.Answer = append(synth.Answer, rr)
+		} else if ipv4 == nil && question.Qtype == dns.TypeAAAA {
+			rr := new(dns.AAAA)
+			rr.Hdr = dns.RR_Header{Name: question.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: ttl}
+			rr.AAAA = ip
+			synth.Answer = append(synth.Answer, rr)
+		}
+	}
+	pluginsState.synthResponse = synth
+	pluginsState.action = PluginsActionSynth
+	return nil
+}
+
+type PluginScript struct {
+	scriptEngine *ScriptEngine
+}
+
+func (plugin *PluginScript) Name() string {
+	return "script"
+}
+
+func (plugin *PluginScript) Description() string {
+	return "Run a user-supplied script on queries."
+}
+
+func (plugin *PluginScript) Init(proxy *Proxy) error {
+	scriptEngine, err := NewScriptEngine(proxy.scriptFile)
+	if err != nil {
+		return err
+	}
+	plugin.scriptEngine = scriptEngine
+	proxy.scriptEngine = scriptEngine
+	return nil
+}
+
+func (plugin *PluginScript) Drop() error {
+	return nil
+}
+
+func (plugin *PluginScript) Reload() error {
+	return nil
+}
+
+func (plugin *PluginScript) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	ret, err := plugin.scriptEngine.call("query", func(L *lua.LState) *lua.LTable {
+		return scriptQueryTable(L, pluginsState, msg)
+	})
+	if err != nil {
+		dlog.Warnf("Script error: %s", err)
+		return nil
+	}
+	return plugin.scriptEngine.applyAction(pluginsState, msg, ret, "query")
+}
+
+type PluginScriptResponse struct {
+	scriptEngine *ScriptEngine
+}
+
+func (plugin *PluginScriptResponse) Name() string {
+	return "script_response"
+}
+
+func (plugin *PluginScriptResponse) Description() string {
+	return "Run a user-supplied script on responses."
+}
+
+func (plugin *PluginScriptResponse) Init(proxy *Proxy) error {
+	if proxy.scriptEngine == nil {
+		return errors.New("Script engine not initialized")
+	}
+	plugin.scriptEngine = proxy.scriptEngine
+	return nil
+}
+
+func (plugin *PluginScriptResponse) Drop() error {
+	return nil
+}
+
+func (plugin *PluginScriptResponse) Reload() error {
+	return nil
+}
+
+func (plugin *PluginScriptResponse) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	ret, err := plugin.scriptEngine.call("response", func(L *lua.LState) *lua.LTable {
+		tbl := scriptQueryTable(L, pluginsState, msg)
+		L.SetField(tbl, "rcode", lua.LString(dns.RcodeToString[msg.Rcode]))
+		answers := L.CreateTable(len(msg.Answer), 0)
+		for _, answer := range msg.Answer {
+			answers.Append(lua.LString(answer.String()))
+		}
+		L.SetField(tbl, "answers", answers)
+		return tbl
+	})
+	if err != nil {
+		dlog.Warnf("Script error: %s", err)
+		return nil
+	}
+	return plugin.scriptEngine.applyAction(pluginsState, msg, ret, "response")
+}
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	SvcParamKeyMandatory uint16 = 0
+	SvcParamKeyECH       uint16 = 5
+)
+
+type PluginStripECH struct{}
+
+func (plugin *PluginStripECH) Name() string {
+	return "strip_ech"
+}
+
+func (plugin *PluginStripECH) Description() string {
+	return "Remove the Encrypted Client Hello configuration from HTTPS and SVCB records."
+}
+
+func (plugin *PluginStripECH) Init(proxy *Proxy) error {
+	return nil
+}
+
+func (plugin *PluginStripECH) Drop() error {
+	return nil
+}
+
+func (plugin *PluginStripECH) Reload() error {
+	return nil
+}
+
+func (plugin *PluginStripECH) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	for _, section := range [][]dns.RR{msg.Answer, msg.Extra} {
+		for i, rr := range section {
+			header := rr.Header()
+			if header.Rrtype != DNSTypeHTTPS && header.Rrtype != DNSTypeSVCB {
+				continue
+			}
+			// SVCB and HTTPS records are not known to the DNS library, and are kept as-is
+			unknown, ok := rr.(*dns.RFC3597)
+			if !ok {
+				continue
+			}
+			rdata, err := hex.DecodeString(unknown.Rdata)
+			if err != nil {
+				continue
+			}
+			stripped, found, err := removeSvcParam(rdata, SvcParamKeyECH)
+			if err != nil || !found {
+				continue
+			}
+			section[i] = &dns.RFC3597{Hdr: *header, Rdata: hex.EncodeToString(stripped)}
+		}
+	}
+	return nil
+}
+
+// removeSvcParam returns the data of a SVCB or HTTPS record without a parameter (RFC 9460).
+// The key is also removed from the mandatory keys, so that clients don't ignore the record.
+func removeSvcParam(rdata []byte, key uint16) ([]byte, bool, error) {
+	if len(rdata) < 3 {
+		return nil, false, errors.New("Short record")
+	}
+	offset := 2
+	for {
+		if offset >= len(rdata) {
+			return nil, false, errors.New("Short record")
+		}
+		labelLen := int(rdata[offset])
+		if labelLen > 63 {
+			return nil, false, errors.New("Invalid target name")
+		}
+		offset += 1 + labelLen
+		if labelLen == 0 {
+			break
+		}
+	}
+	if offset > len(rdata) {
+		return nil, false, errors.New("Short record")
+	}
+	stripped := append([]byte{}, rdata[:offset]...)
+	found := false
+	for offset < len(rdata) {
+		if offset+4 > len(rdata) {
+			return nil, false, errors.New("Truncated parameter")
+		}
+		paramKey := binary.BigEndian.Uint16(rdata[offset:])
+		end := offset + 4 + int(binary.BigEndian.Uint16(rdata[offset+2:]))
+		if end > len(rdata) {
+			return nil, false, errors.New("Truncated parameter")
+		}
+		value := rdata[offset+4 : end]
+		switch {
+		case paramKey == key:
+			found = true
+		case paramKey == SvcParamKeyMandatory:
+			var keys []byte
+			for i := 0; i+2 <= len(value); i += 2 {
+				if binary.BigEndian.Uint16(value[i:]) != key {
+					keys = append(keys, value[i:i+2]...)
+				}
+			}
+			if len(keys) > 0 {
+				stripped = append(stripped, rdata[offset:offset+2]...)
+				stripped = append(stripped, byte(len(keys)>>8), byte(len(keys)))
+				stripped = append(stripped, keys...)
+			}
+		default:
+			stripped = append(stripped, rdata[offset:end]...)
+		}
+		offset = end
+	}
+	return stripped, found, nil
+}
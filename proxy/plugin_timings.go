@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+const PluginTimingSamples = 256
+
+// PluginTimings keeps track of how long each plugin takes to evaluate a query or a response,
+// so that slow rule files can be found. A nil *PluginTimings is valid, and doesn't record
+// anything.
+type PluginTimings struct {
+	sync.RWMutex
+	plugins map[string]*pluginTiming
+}
+
+type pluginTiming struct {
+	sync.Mutex
+	evaluations uint64
+	samples     [PluginTimingSamples]uint32
+}
+
+type PluginTiming struct {
+	Name        string `json:"name"`
+	Evaluations uint64 `json:"evaluations"`
+	P50         int    `json:"p50_us"`
+	P99         int    `json:"p99_us"`
+	Max         int    `json:"max_us"`
+}
+
+func NewPluginTimings() *PluginTimings {
+	return &PluginTimings{plugins: make(map[string]*pluginTiming)}
+}
+
+func (pluginTimings *PluginTimings) record(name string, elapsed time.Duration) {
+	if pluginTimings == nil {
+		return
+	}
+	pluginTimings.RLock()
+	timing, ok := pluginTimings.plugins[name]
+	pluginTimings.RUnlock()
+	if !ok {
+		pluginTimings.Lock()
+		if timing, ok = pluginTimings.plugins[name]; !ok {
+			timing = &pluginTiming{}
+			pluginTimings.plugins[name] = timing
+		}
+		pluginTimings.Unlock()
+	}
+	timing.Lock()
+	timing.samples[timing.evaluations%PluginTimingSamples] = uint32(elapsed.Nanoseconds() / 1000)
+	timing.evaluations++
+	timing.Unlock()
+}
+
+// snapshot returns the percentiles of the most recent evaluations, slowest plugins first
+func (pluginTimings *PluginTimings) snapshot() []PluginTiming {
+	if pluginTimings == nil {
+		return nil
+	}
+	pluginTimings.RLock()
+	defer pluginTimings.RUnlock()
+	timings := make([]PluginTiming, 0, len(pluginTimings.plugins))
+	for name, timing := range pluginTimings.plugins {
+		timing.Lock()
+		count := timing.evaluations
+		if count > PluginTimingSamples {
+			count = PluginTimingSamples
+		}
+		samples := make([]int, count)
+		for i := range samples {
+			samples[i] = int(timing.samples[i])
+		}
+		pluginTiming := PluginTiming{Name: name, Evaluations: timing.evaluations}
+		timing.Unlock()
+		if len(samples) > 0 {
+			sort.Ints(samples)
+			pluginTiming.P50 = samples[(len(samples)-1)*50/100]
+			pluginTiming.P99 = samples[(len(samples)-1)*99/100]
+			pluginTiming.Max = samples[len(samples)-1]
+		}
+		timings = append(timings, pluginTiming)
+	}
+	sort.Slice(timings, func(i, j int) bool {
+		return timings[i].P99 > timings[j].P99
+	})
+	return timings
+}
+
+// evalPlugin runs a plugin, timing it if plugin statistics are kept or slow plugins are logged
+func (pluginsState *PluginsState) evalPlugin(plugin Plugin, msg *dns.Msg) error {
+	if pluginsState.pluginTimings == nil && pluginsState.slowPluginThreshold <= 0 {
+		return plugin.Eval(pluginsState, msg)
+	}
+	start := time.Now()
+	err := plugin.Eval(pluginsState, msg)
+	elapsed := time.Since(start)
+	pluginsState.pluginTimings.record(plugin.Name(), elapsed)
+	if pluginsState.slowPluginThreshold > 0 && elapsed >= pluginsState.slowPluginThreshold {
+		dlog.Debugf("Plugin [%s] took %v to process [%s]", plugin.Name(), elapsed, pluginsState.qName)
+	}
+	return err
+}
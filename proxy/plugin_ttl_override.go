@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+type PluginTTLOverride struct {
+	patternMatcher *PatternMatcher
+}
+
+func (plugin *PluginTTLOverride) Name() string {
+	return "ttl_override"
+}
+
+func (plugin *PluginTTLOverride) Description() string {
+	return "Overrides the TTL of responses for specific names"
+}
+
+func (plugin *PluginTTLOverride) Init(proxy *Proxy) error {
+	dlog.Noticef("Loading the set of TTL rules from [%s]", proxy.ttlRulesFile)
+	bin, err := ioutil.ReadFile(proxy.ttlRulesFile)
+	if err != nil {
+		return err
+	}
+	plugin.patternMatcher = NewPatternPatcher()
+	for lineNo, line := range strings.Split(string(bin), "\n") {
+		line = strings.TrimFunc(line, unicode.IsSpace)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ttl, pattern, err := parseTTLRule(line)
+		if err != nil {
+			dlog.Errorf("Syntax error in TTL rules at line %d -- %v", 1+lineNo, err)
+			continue
+		}
+		if _, err := plugin.patternMatcher.Add(pattern, ttl, lineNo+1); err != nil {
+			dlog.Error(err)
+			continue
+		}
+	}
+	return nil
+}
+
+func parseTTLRule(line string) (uint32, string, error) {
+	parts := strings.FieldsFunc(line, unicode.IsSpace)
+	if len(parts) != 2 {
+		return 0, "", errors.New("Expected a name and a TTL")
+	}
+	if !strings.HasPrefix(parts[1], "ttl=") {
+		return 0, "", fmt.Errorf("Unexpected parameter [%s]", parts[1])
+	}
+	ttl, err := strconv.ParseUint(strings.TrimPrefix(parts[1], "ttl="), 10, 32)
+	if err != nil {
+		return 0, "", fmt.Errorf("Invalid TTL [%s]", parts[1])
+	}
+	return uint32(ttl), strings.ToLower(parts[0]), nil
+}
+
+func (plugin *PluginTTLOverride) Drop() error {
+	return nil
+}
+
+func (plugin *PluginTTLOverride) Reload() error {
+	return nil
+}
+
+func (plugin *PluginTTLOverride) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	questions := msg.Question
+	if len(questions) != 1 {
+		return nil
+	}
+	qName := strings.ToLower(StripTrailingDot(questions[0].Name))
+	_, _, xttl := plugin.patternMatcher.Eval(qName)
+	if xttl == nil {
+		return nil
+	}
+	ttl := xttl.(uint32)
+	for _, rrs := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range rrs {
+			if header := rr.Header(); header.Rrtype != dns.TypeOPT {
+				header.Ttl = ttl
+			}
+		}
+	}
+	pluginsState.cacheMinTTL = ttl
+	pluginsState.cacheMaxTTL = ttl
+	pluginsState.cacheNegMinTTL = ttl
+	pluginsState.cacheNegMaxTTL = ttl
+	return nil
+}
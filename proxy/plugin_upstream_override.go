@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"strings"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+// Private EDNS option, from the range reserved for local and experimental use (RFC 6891)
+const EDNS0UpstreamOverride = 65430
+
+// PluginUpstreamOverride lets local software choose the upstream server a query is sent to, or
+// skip the cache, by adding a private EDNS option to the query. The option contains
+// space-separated directives: `server=<name>` and `nocache`. It is only honored for queries sent
+// from the local host, and is always removed before the query is forwarded.
+type PluginUpstreamOverride struct{}
+
+func (plugin *PluginUpstreamOverride) Name() string {
+	return "upstream_override"
+}
+
+func (plugin *PluginUpstreamOverride) Description() string {
+	return "Let local clients pick the upstream server or skip the cache using a private EDNS option."
+}
+
+func (plugin *PluginUpstreamOverride) Init(proxy *Proxy) error {
+	return nil
+}
+
+func (plugin *PluginUpstreamOverride) Drop() error {
+	return nil
+}
+
+func (plugin *PluginUpstreamOverride) Reload() error {
+	return nil
+}
+
+func (plugin *PluginUpstreamOverride) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	var directives []string
+	options := opt.Option[:0]
+	for _, option := range opt.Option {
+		if local, ok := option.(*dns.EDNS0_LOCAL); ok && local.Code == EDNS0UpstreamOverride {
+			directives = append(directives, strings.Fields(string(local.Data))...)
+			continue
+		}
+		options = append(options, option)
+	}
+	opt.Option = options
+	if len(directives) == 0 || !pluginsState.ClientIP().IsLoopback() {
+		return nil
+	}
+	for _, directive := range directives {
+		switch {
+		case directive == "nocache":
+			pluginsState.cacheBypass = true
+		case strings.HasPrefix(directive, "server="):
+			name := strings.TrimPrefix(directive, "server=")
+			pluginsState.serverNames = []string{name}
+			pluginsState.upstreamOverride = name
+			pluginsState.audit("override", plugin.Name(), directive, name)
+		default:
+			dlog.Debugf("Unsupported upstream override directive: [%s]", directive)
+		}
+	}
+	return nil
+}
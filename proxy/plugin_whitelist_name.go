@@ -1,9 +1,8 @@
-package main
+package proxy
 
 import (
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net"
 	"strings"
 	"time"
@@ -31,7 +30,7 @@ func (plugin *PluginWhitelistName) Description() string {
 
 func (plugin *PluginWhitelistName) Init(proxy *Proxy) error {
 	dlog.Noticef("Loading the set of whitelisting rules from [%s]", proxy.whitelistNameFile)
-	bin, err := ioutil.ReadFile(proxy.whitelistNameFile)
+	bin, err := ReadRuleFile(proxy.whitelistNameFile)
 	if err != nil {
 		return err
 	}
@@ -75,6 +74,9 @@ func (plugin *PluginWhitelistName) Init(proxy *Proxy) error {
 }
 
 func (plugin *PluginWhitelistName) Drop() error {
+	if plugin.logger != nil {
+		return plugin.logger.Close()
+	}
 	return nil
 }
 
@@ -87,7 +89,7 @@ func (plugin *PluginWhitelistName) Eval(pluginsState *PluginsState, msg *dns.Msg
 	if len(questions) != 1 {
 		return nil
 	}
-	qName := strings.ToLower(StripTrailingDot(questions[0].Name))
+	qName := pluginsState.qName
 	whitelist, reason, xweeklyRanges := plugin.patternMatcher.Eval(qName)
 	var weeklyRanges *WeeklyRanges
 	if xweeklyRanges != nil {
@@ -103,6 +105,7 @@ func (plugin *PluginWhitelistName) Eval(pluginsState *PluginsState, msg *dns.Msg
 			pluginsState.sessionData = make(map[string]interface{})
 		}
 		pluginsState.sessionData["whitelisted"] = true
+		pluginsState.audit("allowed", plugin.Name(), reason, "")
 		if plugin.logger != nil {
 			var clientIPStr string
 			if pluginsState.clientProto == "udp" {
@@ -0,0 +1,408 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+type PluginsAction int
+
+const (
+	PluginsActionNone    = 0
+	PluginsActionForward = 1
+	PluginsActionDrop    = 2
+	PluginsActionReject  = 3
+	PluginsActionSynth   = 4
+)
+
+// Plugins skipped while filtering is disabled through the control socket
+var filteringPlugins = map[string]bool{
+	"block_name":  true,
+	"block_ip":    true,
+	"safe_search": true,
+	"policy_hook": true,
+}
+
+type PluginsGlobals struct {
+	sync.RWMutex
+	queryPlugins    *[]Plugin
+	responsePlugins *[]Plugin
+	settings        *PluginsSettings
+}
+
+// PluginsSettings are the settings read while queries are being processed. A new set is built
+// along with the plugins, and swapped with them, so that a reload never modifies the settings
+// being used.
+type PluginsSettings struct {
+	cache                 bool
+	cacheSize             int
+	cacheMaxBytes         int
+	cacheNegMinTTL        uint32
+	cacheNegMaxTTL        uint32
+	cacheMinTTL           uint32
+	cacheMaxTTL           uint32
+	cacheOptimisticWindow time.Duration
+	blockedQueryResponse  *BlockedResponse
+	slowPluginThreshold   time.Duration
+}
+
+type PluginsState struct {
+	sessionData            map[string]interface{}
+	action                 PluginsAction
+	originalMaxPayloadSize int
+	maxPayloadSize         int
+	clientProto            string
+	clientAddr             *net.Addr
+	synthResponse          *dns.Msg
+	blockedResponse        *BlockedResponse
+	rejectReason           string
+	rejectInfoCode         uint16
+	clientGroup            *ClientGroup
+	clientMAC              string
+	listenerClientGroup    string
+	safeSearchRewrite      *SafeSearchRewrite
+	serverNames            []string
+	dnssec                 bool
+	cacheSize              int
+	cacheMaxBytes          int
+	cacheNegMinTTL         uint32
+	cacheNegMaxTTL         uint32
+	cacheMinTTL            uint32
+	cacheMaxTTL            uint32
+	cacheOptimisticWindow  time.Duration
+	cacheHit               bool
+	cacheRefreshKey        *[32]byte
+	backgroundRefresh      bool
+	cacheBypass            bool
+	peerCache              *PeerCache
+	pluginTimings          *PluginTimings
+	slowPluginThreshold    time.Duration
+	upstreamOverride       string
+	offline                bool
+	filteringDisabled      bool
+	deadline               time.Time
+	qName                  string
+	qType                  uint16
+	queryID                uint16
+	queryName              string
+	dnsCookie              string
+	auditEnabled           bool
+	auditEntries           []auditEntry
+	dryRun                 bool
+}
+
+func InitPluginsGlobals(pluginsGlobals *PluginsGlobals, proxy *Proxy) error {
+	queryPlugins := &[]Plugin{}
+	if proxy.chaosResponses {
+		*queryPlugins = append(*queryPlugins, Plugin(new(PluginChaos)))
+	}
+	if proxy.clientRateLimit > 0 {
+		*queryPlugins = append(*queryPlugins, Plugin(new(PluginRateLimit)))
+	}
+	if proxy.dnsCookies {
+		*queryPlugins = append(*queryPlugins, Plugin(new(PluginDNSCookies)))
+	}
+	if len(proxy.clientIdentification.EDNSFrom) != 0 || proxy.clientIdentification.Neighbors {
+		*queryPlugins = append(*queryPlugins, Plugin(new(PluginClientMAC)))
+	}
+	if len(proxy.queryLogFile) != 0 || len(proxy.queryLogRemote.Type) != 0 || proxy.clientGroupsQueryLogs() {
+		*queryPlugins = append(*queryPlugins, Plugin(new(PluginQueryLog)))
+	}
+	if proxy.blockDoHCanary {
+		*queryPlugins = append(*queryPlugins, Plugin(new(PluginDoHCanary)))
+	}
+	if len(proxy.whitelistNameFile) != 0 {
+		*queryPlugins = append(*queryPlugins, Plugin(new(PluginWhitelistName)))
+	}
+	if len(proxy.captivePortalFile) != 0 {
+		*queryPlugins = append(*queryPlugins, Plugin(new(PluginCaptivePortal)))
+	}
+	if len(proxy.clientGroupsConfig) != 0 {
+		*queryPlugins = append(*queryPlugins, Plugin(new(PluginClientGroups)))
+	}
+	if len(proxy.blockNameFile) != 0 || len(proxy.blockNameURLs) != 0 {
+		*queryPlugins = append(*queryPlugins, Plugin(new(PluginBlockName)))
+	}
+	if proxy.pluginBlockIPv6 || proxy.blockIPv6ForIPv4Clients {
+		*queryPlugins = append(*queryPlugins, Plugin(new(PluginBlockIPv6)))
+	}
+	if len(proxy.blockedQtypes) != 0 {
+		*queryPlugins = append(*queryPlugins, Plugin(new(PluginBlockQtype)))
+	}
+	if len(proxy.cloakFile) != 0 {
+		*queryPlugins = append(*queryPlugins, Plugin(new(PluginCloak)))
+	}
+	if len(proxy.localZones) != 0 {
+		*queryPlugins = append(*queryPlugins, Plugin(new(PluginLocalZones)))
+	}
+	if proxy.safeSearch || proxy.clientGroupsSafeSearch() {
+		*queryPlugins = append(*queryPlugins, Plugin(new(PluginSafeSearch)))
+	}
+	if len(proxy.scriptFile) != 0 {
+		*queryPlugins = append(*queryPlugins, Plugin(new(PluginScript)))
+	}
+	if proxy.upstreamOverride {
+		*queryPlugins = append(*queryPlugins, Plugin(new(PluginUpstreamOverride)))
+	}
+	*queryPlugins = append(*queryPlugins, Plugin(new(PluginGetSetPayloadSize)))
+	if proxy.cache {
+		*queryPlugins = append(*queryPlugins, Plugin(new(PluginCache)))
+	}
+	// Only names that are not in the cache are sent to the policy hook
+	if len(proxy.policyHook.URL) != 0 || len(proxy.policyHook.Command) != 0 {
+		*queryPlugins = append(*queryPlugins, Plugin(new(PluginPolicyHook)))
+	}
+	if len(proxy.forwardFile) != 0 || proxy.networkProfiles.hasForwardingRules() || proxy.forwardSearchDomains {
+		*queryPlugins = append(*queryPlugins, Plugin(new(PluginForward)))
+	}
+
+	responsePlugins := &[]Plugin{}
+	if proxy.dnssecValidation {
+		*responsePlugins = append(*responsePlugins, Plugin(new(PluginDNSSECValidation)))
+	}
+	// After the validation, that needs the authority and additional sections
+	if proxy.sanitizeResponses {
+		*responsePlugins = append(*responsePlugins, Plugin(new(PluginSanitizeResponses)))
+	}
+	if len(proxy.nxLogFile) != 0 {
+		*responsePlugins = append(*responsePlugins, Plugin(new(PluginNxLog)))
+	}
+	if len(proxy.scriptFile) != 0 {
+		*responsePlugins = append(*responsePlugins, Plugin(new(PluginScriptResponse)))
+	}
+	if len(proxy.blockIPFile) != 0 {
+		*responsePlugins = append(*responsePlugins, Plugin(new(PluginBlockIP)))
+	}
+	if len(proxy.ttlRulesFile) != 0 {
+		*responsePlugins = append(*responsePlugins, Plugin(new(PluginTTLOverride)))
+	}
+	if proxy.stripECH {
+		*responsePlugins = append(*responsePlugins, Plugin(new(PluginStripECH)))
+	}
+	if proxy.cache {
+		*responsePlugins = append(*responsePlugins, Plugin(new(PluginCacheResponse)))
+	}
+	if proxy.dnsCookies {
+		*responsePlugins = append(*responsePlugins, Plugin(new(PluginDNSCookiesResponse)))
+	}
+	var initialized []Plugin
+	for _, plugin := range append(append([]Plugin{}, *queryPlugins...), *responsePlugins...) {
+		if err := plugin.Init(proxy); err != nil {
+			dropPlugins(initialized)
+			return fmt.Errorf("Unable to initialize the [%s] plugin: %v", plugin.Name(), err)
+		}
+		initialized = append(initialized, plugin)
+	}
+
+	(*pluginsGlobals).queryPlugins = queryPlugins
+	(*pluginsGlobals).responsePlugins = responsePlugins
+	(*pluginsGlobals).settings = &PluginsSettings{
+		cache:                 proxy.cache,
+		cacheSize:             proxy.cacheSize,
+		cacheMaxBytes:         proxy.cacheMaxBytes,
+		cacheNegMinTTL:        proxy.cacheNegMinTTL,
+		cacheNegMaxTTL:        proxy.cacheNegMaxTTL,
+		cacheMinTTL:           proxy.cacheMinTTL,
+		cacheMaxTTL:           proxy.cacheMaxTTL,
+		cacheOptimisticWindow: proxy.cacheOptimisticWindow,
+		blockedQueryResponse:  proxy.blockedQueryResponse,
+		slowPluginThreshold:   proxy.slowPluginThreshold,
+	}
+	return nil
+}
+
+// pluginsSettings returns the settings matching the current plugins
+func (proxy *Proxy) pluginsSettings() *PluginsSettings {
+	proxy.pluginsGlobals.RLock()
+	settings := proxy.pluginsGlobals.settings
+	proxy.pluginsGlobals.RUnlock()
+	if settings == nil {
+		return &PluginsSettings{}
+	}
+	return settings
+}
+
+type Plugin interface {
+	Name() string
+	Description() string
+	Init(proxy *Proxy) error
+	Drop() error
+	Reload() error
+	Eval(pluginsState *PluginsState, msg *dns.Msg) error
+}
+
+func NewPluginsState(proxy *Proxy, clientProto string, clientAddr *net.Addr) PluginsState {
+	var serverNames []string
+	if profile := proxy.networkProfiles.Active(); profile != nil {
+		serverNames = profile.serverNames
+	}
+	settings := proxy.pluginsSettings()
+	return PluginsState{
+		serverNames:           serverNames,
+		action:                PluginsActionForward,
+		maxPayloadSize:        proxy.ednsBufferSize - ResponseOverhead,
+		clientProto:           clientProto,
+		clientAddr:            clientAddr,
+		blockedResponse:       settings.blockedQueryResponse,
+		rejectInfoCode:        ExtendedErrorCodeBlocked,
+		cacheSize:             settings.cacheSize,
+		cacheMaxBytes:         settings.cacheMaxBytes,
+		cacheNegMinTTL:        settings.cacheNegMinTTL,
+		cacheNegMaxTTL:        settings.cacheNegMaxTTL,
+		cacheMinTTL:           settings.cacheMinTTL,
+		cacheMaxTTL:           settings.cacheMaxTTL,
+		cacheOptimisticWindow: settings.cacheOptimisticWindow,
+		peerCache:             proxy.peerCache,
+		pluginTimings:         proxy.pluginTimings,
+		slowPluginThreshold:   settings.slowPluginThreshold,
+		auditEnabled:          proxy.auditLog != nil,
+		filteringDisabled:     atomic.LoadInt32(&proxy.filteringDisabled) != 0,
+		deadline:              time.Now().Add(proxy.timeout),
+	}
+}
+
+// ClientIP returns the address of the client. IPv4 clients of sockets accepting both IPv4 and
+// IPv6 are returned as IPv4 addresses, not as IPv4-mapped IPv6 addresses.
+func (pluginsState *PluginsState) ClientIP() net.IP {
+	var ip net.IP
+	if pluginsState.clientProto == "udp" {
+		ip = (*pluginsState.clientAddr).(*net.UDPAddr).IP
+	} else {
+		ip = (*pluginsState.clientAddr).(*net.TCPAddr).IP
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+func (pluginsState *PluginsState) ApplyQueryPlugins(pluginsGlobals *PluginsGlobals, packet []byte) ([]byte, error) {
+	if len(*pluginsGlobals.queryPlugins) == 0 {
+		return packet, nil
+	}
+	pluginsState.action = PluginsActionForward
+	msg := dns.Msg{}
+	if err := msg.Unpack(packet); err != nil {
+		return packet, err
+	}
+	if len(msg.Question) > 1 {
+		return packet, errors.New("Unexpected number of questions")
+	}
+	// Normalized once for all the plugins; only safe_search can rewrite the name, and the
+	// plugins using it run before
+	if len(msg.Question) == 1 {
+		pluginsState.qName = StripTrailingDot(strings.ToLower(msg.Question[0].Name))
+		pluginsState.qType = msg.Question[0].Qtype
+	}
+	pluginsGlobals.RLock()
+	for _, plugin := range *pluginsGlobals.queryPlugins {
+		if pluginsState.filteringDisabled && filteringPlugins[plugin.Name()] {
+			continue
+		}
+		if ret := pluginsState.evalPlugin(plugin, &msg); ret != nil {
+			pluginsGlobals.RUnlock()
+			pluginsState.action = PluginsActionDrop
+			return packet, ret
+		}
+		if pluginsState.action == PluginsActionReject {
+			pluginsState.audit("blocked", plugin.Name(), pluginsState.rejectReason, "")
+			synth, err := pluginsState.blockedResponse.ResponseFromMessage(&msg, pluginsState.rejectInfoCode, pluginsState.rejectReason)
+			if err != nil {
+				pluginsGlobals.RUnlock()
+				return nil, err
+			}
+			pluginsState.synthResponse = synth
+		}
+		if pluginsState.action != PluginsActionForward {
+			break
+		}
+	}
+	pluginsGlobals.RUnlock()
+	// The question, as it is forwarded, after safe_search has possibly rewritten it
+	if len(msg.Question) == 1 {
+		pluginsState.queryID, pluginsState.queryName = msg.Id, msg.Question[0].Name
+	}
+	if pluginsState.synthResponse != nil && pluginsState.safeSearchRewrite != nil {
+		pluginsState.safeSearchRewrite.restore(pluginsState.synthResponse)
+	}
+	if pluginsState.synthResponse != nil && len(pluginsState.dnsCookie) > 0 {
+		setDNSCookie(pluginsState.synthResponse, pluginsState.dnsCookie)
+	}
+	packet2, err := msg.PackBuffer(packet)
+	if err != nil {
+		return packet, err
+	}
+	return packet2, nil
+}
+
+func (pluginsState *PluginsState) ApplyResponsePlugins(pluginsGlobals *PluginsGlobals, packet []byte, ttl *uint32) ([]byte, error) {
+	if len(*pluginsGlobals.responsePlugins) == 0 && pluginsState.safeSearchRewrite == nil {
+		return packet, nil
+	}
+	pluginsState.action = PluginsActionForward
+	msg := dns.Msg{}
+	if err := msg.Unpack(packet); err != nil {
+		if len(packet) >= MinDNSPacketSize && HasTCFlag(packet) {
+			err = nil
+		}
+		return packet, err
+	}
+	pluginsGlobals.RLock()
+	for _, plugin := range *pluginsGlobals.responsePlugins {
+		if pluginsState.filteringDisabled && filteringPlugins[plugin.Name()] {
+			continue
+		}
+		if ret := pluginsState.evalPlugin(plugin, &msg); ret != nil {
+			pluginsGlobals.RUnlock()
+			pluginsState.action = PluginsActionDrop
+			return packet, ret
+		}
+		if pluginsState.action == PluginsActionReject {
+			pluginsState.audit("blocked", plugin.Name(), pluginsState.rejectReason, "")
+			synth, err := pluginsState.blockedResponse.ResponseFromMessage(&msg, pluginsState.rejectInfoCode, pluginsState.rejectReason)
+			if err != nil {
+				pluginsGlobals.RUnlock()
+				return nil, err
+			}
+			dlog.Infof("Blocking [%s]", synth.Question[0].Name)
+			pluginsState.synthResponse = synth
+		}
+		if pluginsState.action != PluginsActionForward {
+			break
+		}
+	}
+	pluginsGlobals.RUnlock()
+	// A blocked or synthesized response replaces the one from the server
+	if pluginsState.synthResponse != nil && (pluginsState.action == PluginsActionReject || pluginsState.action == PluginsActionSynth) {
+		if pluginsState.safeSearchRewrite != nil {
+			pluginsState.safeSearchRewrite.restore(pluginsState.synthResponse)
+		}
+		if len(pluginsState.dnsCookie) > 0 {
+			setDNSCookie(pluginsState.synthResponse, pluginsState.dnsCookie)
+		}
+		packet2, err := pluginsState.synthResponse.PackBuffer(packet)
+		if err != nil {
+			return packet, err
+		}
+		return packet2, nil
+	}
+	if pluginsState.safeSearchRewrite != nil {
+		pluginsState.safeSearchRewrite.restore(&msg)
+	}
+	if ttl != nil {
+		setMaxTTL(&msg, *ttl)
+	}
+	packet2, err := msg.PackBuffer(packet)
+	if err != nil {
+		return packet, err
+	}
+	return packet2, nil
+}
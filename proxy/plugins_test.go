@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func blockIPResponsePlugins(t *testing.T, blockedResponse string) *PluginsGlobals {
+	dir, err := ioutil.TempDir("", "block-ip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	proxy := Proxy{blockIPFile: filepath.Join(dir, "blocked-ips.txt")}
+	if err := ioutil.WriteFile(proxy.blockIPFile, []byte("192.0.2.1\n198.51.100.*\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if len(blockedResponse) > 0 {
+		if proxy.blockIPResponse, err = ParseBlockedResponse(blockedResponse); err != nil {
+			t.Fatal(err)
+		}
+	}
+	plugin := new(PluginBlockIP)
+	if err := plugin.Init(&proxy); err != nil {
+		t.Fatal(err)
+	}
+	queryPlugins, responsePlugins := []Plugin{}, []Plugin{plugin}
+	return &PluginsGlobals{queryPlugins: &queryPlugins, responsePlugins: &responsePlugins}
+}
+
+func upstreamResponse(t *testing.T, ip net.IP) []byte {
+	query := new(dns.Msg)
+	query.SetQuestion("www.example.com.", dns.TypeA)
+	response := new(dns.Msg)
+	response.SetReply(query)
+	response.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   ip,
+	}}
+	packet, err := response.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packet
+}
+
+func applyResponsePlugins(t *testing.T, pluginsGlobals *PluginsGlobals, packet []byte) (*PluginsState, *dns.Msg) {
+	defaultResponse, _ := ParseBlockedResponse("refused")
+	pluginsState := PluginsState{action: PluginsActionForward, blockedResponse: defaultResponse, rejectInfoCode: ExtendedErrorCodeBlocked}
+	packet, err := pluginsState.ApplyResponsePlugins(pluginsGlobals, packet, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(packet); err != nil {
+		t.Fatal(err)
+	}
+	return &pluginsState, msg
+}
+
+func TestBlockIPResponse(t *testing.T) {
+	pluginsGlobals := blockIPResponsePlugins(t, "")
+	pluginsState, msg := applyResponsePlugins(t, pluginsGlobals, upstreamResponse(t, net.IPv4(192, 0, 2, 1)))
+	if pluginsState.action != PluginsActionReject {
+		t.Fatalf("Action is %d, not reject", pluginsState.action)
+	}
+	if msg.Rcode != dns.RcodeRefused || len(msg.Answer) != 0 {
+		t.Errorf("Blocked response sent as %s with %d answers", dns.RcodeToString[msg.Rcode], len(msg.Answer))
+	}
+
+	_, msg = applyResponsePlugins(t, pluginsGlobals, upstreamResponse(t, net.IPv4(203, 0, 113, 1)))
+	if msg.Rcode != dns.RcodeSuccess || len(msg.Answer) != 1 || !msg.Answer[0].(*dns.A).A.Equal(net.IPv4(203, 0, 113, 1)) {
+		t.Errorf("Allowed response modified: %v", msg)
+	}
+}
+
+func TestBlockIPSinkholeResponse(t *testing.T) {
+	pluginsGlobals := blockIPResponsePlugins(t, "a:0.0.0.0")
+	_, msg := applyResponsePlugins(t, pluginsGlobals, upstreamResponse(t, net.IPv4(198, 51, 100, 7)))
+	if msg.Rcode != dns.RcodeSuccess || len(msg.Answer) != 1 {
+		t.Fatalf("Blocked response sent as %s with %d answers", dns.RcodeToString[msg.Rcode], len(msg.Answer))
+	}
+	if ip := msg.Answer[0].(*dns.A).A; !ip.Equal(net.IPv4zero) {
+		t.Errorf("Sinkhole address is %v", ip)
+	}
+}
@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+
+	"github.com/jedisct1/dlog"
+)
+
+// lookupUserIDs returns the user and group identifiers of a user name.
+// A numeric identifier is accepted for users that are not in the users database.
+func lookupUserIDs(userName string) (int, int, error) {
+	userInfo, err := user.Lookup(userName)
+	if err != nil {
+		uid, err2 := strconv.Atoi(userName)
+		if err2 != nil || uid <= 0 {
+			return 0, 0, err
+		}
+		dlog.Warnf("Unable to retrieve any information about user [%s]: [%s] - Switching to user id [%v] with the same group id", userName, err, uid)
+		return uid, uid, nil
+	}
+	uid, err := strconv.Atoi(userInfo.Uid)
+	if err != nil {
+		return 0, 0, err
+	}
+	gid, err := strconv.Atoi(userInfo.Gid)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uid, gid, nil
+}
+
+// chownLogFiles creates the log files, and gives them to the user the proxy is going to run as,
+// so that they can still be written to after privileges have been dropped
+func (proxy *Proxy) chownLogFiles(uid int, gid int) {
+	logFiles := []string{proxy.queryLogFile, proxy.nxLogFile, proxy.blockNameLogFile, proxy.whitelistNameLogFile, proxy.blockIPLogFile}
+	if proxy.config != nil && proxy.config.LogFile != nil {
+		logFiles = append(logFiles, *proxy.config.LogFile)
+	}
+	if proxy.auditLog != nil {
+		logFiles = append(logFiles, proxy.config.AuditLog.File)
+	}
+	for _, logFile := range logFiles {
+		if len(logFile) == 0 || logFile == "-" {
+			continue
+		}
+		fp, err := os.OpenFile(logFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			dlog.Warnf("Unable to create the log file [%s]: [%s]", logFile, err)
+			continue
+		}
+		fp.Close()
+		if err := os.Chown(logFile, uid, gid); err != nil {
+			dlog.Warnf("Unable to change the owner of the log file [%s]: [%s]", logFile, err)
+		}
+	}
+	// The DNSCrypt server keys are read again, and replaced, by the unprivileged process
+	if proxy.dnscryptServer != nil && proxy.config != nil {
+		for _, keyFile := range []string{proxy.config.DNSCryptServer.ProviderKeyFile, proxy.dnscryptServer.keysFile} {
+			if err := os.Chown(keyFile, uid, gid); err != nil {
+				dlog.Warnf("Unable to change the owner of the key file [%s]: [%s]", keyFile, err)
+			}
+		}
+	}
+	// So is the key of the audit log
+	if proxy.auditLog != nil && len(proxy.config.AuditLog.KeyFile) > 0 {
+		if err := os.Chown(proxy.config.AuditLog.KeyFile, uid, gid); err != nil {
+			dlog.Warnf("Unable to change the owner of the key file [%s]: [%s]", proxy.config.AuditLog.KeyFile, err)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"syscall"
+
+	"github.com/jedisct1/dlog"
+)
+
+// dropPrivilege switches to an unprivileged user, and executes the proxy again with the sockets that
+// have already been bound. On Linux, the identity of a process can't be changed while it is running
+// multiple threads, so the new credentials are only set on the current thread before the process is
+// replaced. The sockets are passed the same way as systemd does, so that the new process wires them
+// as listeners. It never returns.
+func (proxy *Proxy) dropPrivilege(userName string, files []*os.File) {
+	if os.Geteuid() != 0 {
+		dlog.Fatal("Root privileges are required in order to switch to a different user. Maybe try again with 'sudo'")
+	}
+	if len(os.Getenv("LISTEN_FDS")) > 0 {
+		dlog.Fatal("[user_name] can't be used with systemd socket activation -- Use the User directive of the unit instead")
+	}
+	uid, gid, err := lookupUserIDs(userName)
+	if err != nil {
+		dlog.Fatal(err)
+	}
+	execPath, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		dlog.Fatalf("Unable to get the path to the dnscrypt-proxy executable file: [%s]", err)
+	}
+	path, err := filepath.Abs(execPath)
+	if err != nil {
+		dlog.Fatal(err)
+	}
+	proxy.chownLogFiles(uid, gid)
+	args := append(append([]string{}, os.Args...), "-child")
+
+	dlog.Noticef("Dropping privileges, switching to user [%s]", userName)
+	runtime.LockOSThread()
+	if err := syscall.Setgroups([]int{}); err != nil {
+		dlog.Fatalf("Unable to drop additional groups: [%s]", err)
+	}
+	if _, _, rcode := syscall.RawSyscall(sysSetgid, uintptr(gid), 0, 0); rcode != 0 {
+		dlog.Fatalf("Unable to drop user privileges: [%s]", rcode.Error())
+	}
+	if _, _, rcode := syscall.RawSyscall(sysSetuid, uintptr(uid), 0, 0); rcode != 0 {
+		dlog.Fatalf("Unable to drop user privileges: [%s]", rcode.Error())
+	}
+
+	// Move the descriptors above all the existing ones first, so that they can't be overwritten
+	// when they are moved to their final positions, starting at 3
+	maxFd := uintptr(2)
+	for _, file := range files {
+		if file.Fd() > maxFd {
+			maxFd = file.Fd()
+		}
+	}
+	fdBase := maxFd + 1
+	for i, file := range files {
+		if err := syscall.Dup3(int(file.Fd()), int(fdBase)+i, syscall.O_CLOEXEC); err != nil {
+			dlog.Fatalf("Unable to clone a file descriptor: [%s]", err)
+		}
+	}
+	for i := range files {
+		if err := syscall.Dup3(int(fdBase)+i, i+3, 0); err != nil {
+			dlog.Fatalf("Unable to clone a file descriptor: [%s]", err)
+		}
+	}
+	env := append(os.Environ(), "LISTEN_PID="+strconv.Itoa(os.Getpid()), "LISTEN_FDS="+strconv.Itoa(len(files)))
+	err = syscall.Exec(path, args, env)
+	dlog.Fatalf("Unable to execute [%s] again: [%s]", path, err)
+}
@@ -0,0 +1,9 @@
+package proxy
+
+import "syscall"
+
+// The 16-bit versions of these system calls can't represent all the user and group identifiers
+const (
+	sysSetuid = syscall.SYS_SETUID32
+	sysSetgid = syscall.SYS_SETGID32
+)
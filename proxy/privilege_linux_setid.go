@@ -0,0 +1,10 @@
+// +build linux,!386,!arm
+
+package proxy
+
+import "syscall"
+
+const (
+	sysSetuid = syscall.SYS_SETUID
+	sysSetgid = syscall.SYS_SETGID
+)
@@ -0,0 +1,36 @@
+// +build !linux,!windows
+
+package proxy
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/jedisct1/dlog"
+)
+
+// dropPrivilege switches to an unprivileged user. Unlike on Linux, the identity applies to the
+// whole process, so the sockets that have already been bound can be used as they are.
+func (proxy *Proxy) dropPrivilege(userName string, files []*os.File) {
+	for _, file := range files {
+		file.Close()
+	}
+	if os.Geteuid() != 0 {
+		dlog.Fatal("Root privileges are required in order to switch to a different user. Maybe try again with 'sudo'")
+	}
+	uid, gid, err := lookupUserIDs(userName)
+	if err != nil {
+		dlog.Fatal(err)
+	}
+	proxy.chownLogFiles(uid, gid)
+	dlog.Noticef("Dropping privileges, switching to user [%s]", userName)
+	if err := syscall.Setgroups([]int{}); err != nil {
+		dlog.Fatalf("Unable to drop additional groups: [%s]", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		dlog.Fatalf("Unable to drop user privileges: [%s]", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		dlog.Fatalf("Unable to drop user privileges: [%s]", err)
+	}
+}
@@ -0,0 +1,11 @@
+package proxy
+
+import (
+	"os"
+
+	"github.com/jedisct1/dlog"
+)
+
+func (proxy *Proxy) dropPrivilege(userName string, files []*os.File) {
+	dlog.Fatal("[user_name] is not supported on Windows")
+}
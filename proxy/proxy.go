@@ -0,0 +1,1083 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	clocksmith "github.com/jedisct1/go-clocksmith"
+	stamps "github.com/jedisct1/go-dnsstamps"
+	"golang.org/x/crypto/curve25519"
+)
+
+// Listener is a local address to accept queries on
+type Listener struct {
+	address     string
+	udp         bool
+	tcp         bool
+	dnscrypt    bool
+	clientGroup string
+	ipv6Only    bool
+}
+
+func listenerKey(addr net.Addr) string {
+	return addr.Network() + "/" + addr.String()
+}
+
+// network returns the network to listen to for a protocol. Sockets bound to the IPv6 wildcard
+// address also accept IPv4 clients, with IPv4-mapped addresses, unless ipv6Only is set.
+func (listener *Listener) network(proto string, ip net.IP) string {
+	if listener.ipv6Only && ip != nil && ip.To4() == nil {
+		return proto + "6"
+	}
+	return proto
+}
+
+// listenerForAddr returns the configured listener for a local address, or nil if there is none
+func (proxy *Proxy) listenerForAddr(addr net.Addr) *Listener {
+	for i := range proxy.listeners {
+		listener := &proxy.listeners[i]
+		var listenAddr net.Addr
+		var err error
+		switch addr.Network() {
+		case "udp":
+			if !listener.udp {
+				continue
+			}
+			listenAddr, err = net.ResolveUDPAddr("udp", listener.address)
+		case "tcp":
+			if !listener.tcp {
+				continue
+			}
+			listenAddr, err = net.ResolveTCPAddr("tcp", listener.address)
+		default:
+			continue
+		}
+		if err == nil && listenerKey(listenAddr) == listenerKey(addr) {
+			return listener
+		}
+	}
+	return nil
+}
+
+type Proxy struct {
+	proxyPublicKey               [32]byte
+	proxySecretKey               [32]byte
+	sharedKeys                   SharedKeyCache
+	ephemeralKeys                bool
+	questionSizeEstimator        QuestionSizeEstimator
+	serversInfo                  ServersInfo
+	timeout                      time.Duration
+	udpTimeout                   time.Duration
+	tcpConnectTimeout            time.Duration
+	dohTimeout                   time.Duration
+	lastResort                   *LastResort
+	latencyBudget                time.Duration
+	ednsBufferSize               int
+	outgoing                     *Outgoing
+	netprobeAddress              string
+	offlineMode                  int32
+	nxRedirectProtection         int
+	filteringDisabled            int32
+	networkDown                  int32
+	certRefreshDelay             time.Duration
+	certRefreshDelayAfterFailure time.Duration
+	latencyProbeInterval         time.Duration
+	maintenanceWindow            *WeeklyRanges
+	queryRetries                 int
+	serverMaxErrorRate           float64
+	raceServers                  int
+	certIgnoreTimestamp          bool
+	certClock                    *CertClock
+	certLog                      *CertLog
+	storage                      Storage
+	stateDir                     string
+	malformed                    MalformedCounters
+	upstreamFailures             FailureCounters
+	logMalformedQueries          bool
+	mainProto                    string
+	listeners                    []Listener
+	daemonize                    bool
+	registeredServers            []RegisteredServer
+	pluginBlockIPv6              bool
+	blockIPv6ForIPv4Clients      bool
+	stripECH                     bool
+	sanitizeResponses            bool
+	blockDoHCanary               bool
+	chaosResponses               bool
+	chaosPolicy                  string
+	upstreamOverride             bool
+	blockedQtypes                []string
+	blockedQtypesResponse        *BlockedResponse
+	blockedQueryResponse         *BlockedResponse
+	cache                        bool
+	cacheSize                    int
+	cacheMaxBytes                int
+	cacheNegMinTTL               uint32
+	cacheNegMaxTTL               uint32
+	cacheMinTTL                  uint32
+	cacheMaxTTL                  uint32
+	cacheWarmNames               []cacheWarmName
+	cacheSnapshotFile            string
+	cacheOptimisticWindow        time.Duration
+	peerCache                    *PeerCache
+	pluginTimings                *PluginTimings
+	slowPluginThreshold          time.Duration
+	queryLogFile                 string
+	queryLogFormat               string
+	queryLogIgnoredQtypes        []string
+	queryLogIgnoredDomains       []string
+	queryLogIgnoredClients       []*net.IPNet
+	queryLogAnonymizeClients     string
+	queryLogRetention            time.Duration
+	queryLogAggregateFile        string
+	queryLogRemote               QueryLogRemoteConfig
+	nxLogFile                    string
+	nxLogFormat                  string
+	blockNameFile                string
+	whitelistNameFile            string
+	blockNameLogFile             string
+	whitelistNameLogFile         string
+	blockNameFormat              string
+	blockNameResponse            *BlockedResponse
+	blockNameURLs                []string
+	blockNameMinisignKey         string
+	blockNameCacheFile           string
+	blockNameRefreshDelay        time.Duration
+	whitelistNameFormat          string
+	blockIPFile                  string
+	blockIPLogFile               string
+	blockIPFormat                string
+	blockIPResponse              *BlockedResponse
+	forwardFile                  string
+	forwardSearchDomains         bool
+	searchDomainsResolvConf      string
+	cloakFile                    string
+	localZones                   map[string]string
+	ttlRulesFile                 string
+	captivePortalFile            string
+	scriptFile                   string
+	dnssecValidation             bool
+	dnssecTrustAnchorsFile       string
+	scriptEngine                 *ScriptEngine
+	policyHook                   PolicyHookConfig
+	captivePortalResolver        string
+	clientGroupsConfig           map[string]ClientGroupConfig
+	networkProfiles              *NetworkProfiles
+	clientHintsFile              string
+	clientIdentification         ClientIdentificationConfig
+	safeSearch                   bool
+	pluginsGlobals               PluginsGlobals
+	urlsToPrefetch               []URLToPrefetch
+	clientsCount                 uint32
+	maxClients                   uint32
+	clientRateLimit              int
+	clientRateLimitBurst         int
+	dnsCookies                   bool
+	dnsCookiesStrict             bool
+	xTransport                   *XTransport
+	allWeeklyRanges              *map[string]WeeklyRanges
+	logFile                      string
+	crashReportFile              string
+	logMaxSize                   int
+	logMaxAge                    int
+	logMaxBackups                int
+	configFile                   string
+	config                       *Config
+	userName                     string
+	child                        bool
+	sandbox                      bool
+	setSystemDNS                 bool
+	serverHeaders                map[string]map[string]string
+	dashboardAddress             string
+	controlSocket                string
+	watchRuleFilesEnabled        bool
+	responseRateLimiter          *ResponseRateLimiter
+	serverLocations              *ServerLocations
+	coalesceQueries              bool
+	pendingQueries               PendingQueries
+	healthCheckAddress           string
+	haKey                        *[32]byte
+	virtualIP                    *VirtualIP
+	standby                      *Standby
+	debugAddress                 string
+	udpWorkers                   int
+	udpBatchSize                 int
+	tcpIdleTimeout               time.Duration
+	tcpMaxQueries                int
+	tcpConnections               uint32
+	clientACL                    *ClientACL
+	queryWorkers                 int
+	udpQueries                   chan udpQuery
+	overloadRefuse               bool
+	overload                     overloadWarning
+	queryTail                    QueryTail
+	auditLog                     *AuditLog
+	dnscryptServer               *DNSCryptServer
+	dnscryptServerAddress        string
+	localDoHServer               *LocalDoHServer
+	reloadLock                   sync.Mutex
+	stats                        *Stats
+	previousSystemDNS            []SystemDNSSetting
+	systemDNSLock                sync.Mutex
+	systemDNSMonitor             int
+	stopping                     int32
+	stopped                      chan struct{}
+	activeListeners              []io.Closer
+	activeListenersLock          sync.Mutex
+}
+
+// initServers creates the key pair of the proxy, and registers the configured servers
+func (proxy *Proxy) initServers() {
+	proxy.questionSizeEstimator = NewQuestionSizeEstimator()
+	if _, err := rand.Read(proxy.proxySecretKey[:]); err != nil {
+		dlog.Fatal(err)
+	}
+	curve25519.ScalarBaseMult(&proxy.proxyPublicKey, &proxy.proxySecretKey)
+	for _, registeredServer := range proxy.registeredServers {
+		proxy.serversInfo.registerServer(proxy, registeredServer.name, registeredServer.stamp)
+	}
+}
+
+// StartProxy starts the proxy, and exits if it can't be started
+func (proxy *Proxy) StartProxy() {
+	if err := proxy.start(); err != nil {
+		dlog.Fatal(err)
+	}
+}
+
+func (proxy *Proxy) start() error {
+	proxy.initServers()
+	// Privileges are dropped after the sockets have been bound, but before any query is read
+	dropPrivilege := len(proxy.userName) > 0 && !proxy.child
+	if proxy.virtualIP != nil && proxy.standby == nil {
+		// The primary holds the virtual IP while it is running, so that its listeners can be bound to it
+		if err := proxy.virtualIP.acquire(); err != nil {
+			return err
+		}
+	}
+	var activated map[string]bool
+	var serve []func()
+	var err error
+	if !dropPrivilege {
+		if activated, serve, err = proxy.SystemDListeners(); err != nil {
+			return err
+		}
+	}
+	var listenerFiles []*os.File
+	if proxy.localDoHServer != nil {
+		bound, err := proxy.localDoHServer.bind(proxy)
+		if err != nil {
+			return fmt.Errorf("Unable to start the DoH server: %v", err)
+		}
+		for _, listener := range bound {
+			if dropPrivilege {
+				file, err := listener.File()
+				if err != nil {
+					return err
+				}
+				listenerFiles = append(listenerFiles, file)
+			}
+		}
+	}
+	for i := range proxy.listeners {
+		listener := &proxy.listeners[i]
+		if listener.udp {
+			listenUDPAddr, err := net.ResolveUDPAddr("udp", listener.address)
+			if err != nil {
+				return err
+			}
+			if !activated[listenerKey(listenUDPAddr)] {
+				clientPcs, err := proxy.udpListenersFromAddr(listenUDPAddr, listener)
+				if err != nil {
+					return err
+				}
+				for _, clientPc := range clientPcs {
+					if dropPrivilege {
+						file, err := clientPc.File()
+						if err != nil {
+							return err
+						}
+						listenerFiles = append(listenerFiles, file)
+					}
+					clientPc := clientPc
+					serve = append(serve, func() { go proxy.udpListener(clientPc, listener) })
+				}
+			}
+		}
+		if listener.tcp {
+			listenTCPAddr, err := net.ResolveTCPAddr("tcp", listener.address)
+			if err != nil {
+				return err
+			}
+			if !activated[listenerKey(listenTCPAddr)] {
+				acceptPc, err := proxy.tcpListenerFromAddr(listenTCPAddr, listener)
+				if err != nil {
+					return err
+				}
+				if dropPrivilege {
+					file, err := acceptPc.File()
+					if err != nil {
+						return err
+					}
+					listenerFiles = append(listenerFiles, file)
+				}
+				serve = append(serve, func() { go proxy.tcpListener(acceptPc, listener) })
+			}
+		}
+	}
+	if dropPrivilege {
+		proxy.dropPrivilege(proxy.userName, listenerFiles)
+	}
+	proxy.restoreSavedSystemDNS()
+	if proxy.setSystemDNS {
+		proxy.systemDNSLock.Lock()
+		if proxy.previousSystemDNS, err = proxy.SetSystemDNS(); err != nil {
+			dlog.Errorf("Unable to use the proxy as the system DNS resolver: %v", err)
+		}
+		proxy.saveSystemDNS()
+		proxy.systemDNSLock.Unlock()
+	}
+	if proxy.systemDNSMonitor != SystemDNSMonitorOff {
+		if err := proxy.monitorSystemDNS(); err != nil {
+			dlog.Errorf("Unable to monitor the system DNS settings: %v", err)
+		}
+	}
+	if proxy.sandbox {
+		if err := proxy.Sandbox(); err != nil {
+			return fmt.Errorf("Unable to enable the sandbox: %v", err)
+		}
+		dlog.Notice("Sandbox enabled")
+	}
+	if len(proxy.netprobeAddress) > 0 {
+		proxy.monitorConnectivity()
+	}
+	proxy.startQueryWorkers()
+	if proxy.standby != nil {
+		go proxy.standby.monitor(proxy, serve)
+	} else {
+		for _, start := range serve {
+			start()
+		}
+	}
+	if proxy.dnscryptServer != nil {
+		dlog.Noticef("DNSCrypt server stamp: %s", proxy.dnscryptServer.Stamp(proxy.dnscryptServerAddress))
+		go proxy.dnscryptServer.rotateKeys()
+	}
+	if proxy.peerCache != nil {
+		if err := proxy.peerCache.serve(proxy); err != nil {
+			return fmt.Errorf("Unable to share the cache with peers: %v", err)
+		}
+	}
+	if proxy.localDoHServer != nil {
+		proxy.startLocalDoH()
+	}
+	if len(proxy.dashboardAddress) > 0 {
+		if err := proxy.startDashboard(); err != nil {
+			return fmt.Errorf("Unable to start the dashboard: %v", err)
+		}
+	}
+	if len(proxy.controlSocket) > 0 {
+		if err := proxy.startControlSocket(); err != nil {
+			return fmt.Errorf("Unable to create the control socket: %v", err)
+		}
+	}
+	if len(proxy.healthCheckAddress) > 0 {
+		if err := proxy.startHealthCheckServer(); err != nil {
+			return fmt.Errorf("Unable to start the health check server: %v", err)
+		}
+	}
+	if len(proxy.debugAddress) > 0 {
+		if err := proxy.startDebugServer(); err != nil {
+			return fmt.Errorf("Unable to start the debug server: %v", err)
+		}
+	}
+	liveServers, err := proxy.serversInfo.refresh(proxy)
+	if liveServers > 0 {
+		dlog.Noticef("dnscrypt-proxy is ready - live servers: %d", liveServers)
+		SystemDNotify()
+	} else if err != nil {
+		dlog.Error(err)
+		dlog.Notice("dnscrypt-proxy is waiting for at least one server to be reachable")
+	}
+	if proxy.nxRedirectProtection != NXRedirectOff {
+		go proxy.serversInfo.detectNXRedirects(proxy)
+	}
+	proxy.prefetcher(&proxy.urlsToPrefetch)
+	if len(proxy.cacheSnapshotFile) > 0 {
+		if loaded, err := cachedResponses.load(proxy, proxy.cacheSnapshotFile); err == nil {
+			dlog.Noticef("Cache snapshot loaded from [%s] (%d entries)", proxy.cacheSnapshotFile, loaded)
+		} else if !os.IsNotExist(err) {
+			dlog.Warnf("Unable to load the cache snapshot: %v", err)
+		}
+	}
+	if len(proxy.cacheWarmNames) > 0 {
+		proxy.cacheWarmer(proxy.cacheWarmNames)
+	}
+	go func() {
+		defer proxy.ReportPanic()
+		for {
+			delay := proxy.certRefreshDelay
+			if proxy.serversInfo.liveServers() == 0 {
+				delay = proxy.certRefreshDelayAfterFailure
+			} else if nextExpiry, ok := proxy.serversInfo.nextCertExpiry(); ok {
+				if untilRefresh := time.Until(nextExpiry.Add(-CertRefreshBeforeExpiry)); untilRefresh < delay {
+					// Don't keep hammering servers that haven't published a new certificate yet
+					delay = untilRefresh
+					if minDelay := CertRefreshBeforeExpiry / 12; delay < minDelay {
+						delay = minDelay
+					}
+					dlog.Debugf("A certificate expires at %s, refreshing certificates in %v", nextExpiry.Format(time.RFC3339), delay)
+				}
+			}
+			clocksmith.Sleep(delay)
+			if atomic.LoadInt32(&proxy.stopping) != 0 {
+				return
+			}
+			proxy.serversInfo.refresh(proxy)
+			if proxy.nxRedirectProtection != NXRedirectOff {
+				proxy.serversInfo.detectNXRedirects(proxy)
+			}
+		}
+	}()
+	if proxy.networkProfiles != nil {
+		proxy.networkProfiles.Monitor()
+	}
+	if proxy.watchRuleFilesEnabled {
+		proxy.watchRuleFiles()
+	}
+	if proxy.latencyProbeInterval > 0 {
+		go func() {
+			for {
+				clocksmith.Sleep(proxy.latencyProbeInterval)
+				if atomic.LoadInt32(&proxy.stopping) != 0 {
+					return
+				}
+				if !proxy.inMaintenanceWindow() {
+					continue
+				}
+				proxy.serversInfo.probe(proxy)
+			}
+		}()
+	}
+	return nil
+}
+
+func (proxy *Proxy) prefetcher(urlsToPrefetch *[]URLToPrefetch) {
+	go func() {
+		for {
+			now := time.Now()
+			for i := range *urlsToPrefetch {
+				urlToPrefetch := &(*urlsToPrefetch)[i]
+				if now.After(urlToPrefetch.when) && proxy.inMaintenanceWindow() {
+					dlog.Debugf("Prefetching [%s]", urlToPrefetch.url)
+					if err := PrefetchSourceURL(proxy.xTransport, urlToPrefetch); err != nil {
+						dlog.Debugf("Prefetching [%s] failed: %s", urlToPrefetch.url, err)
+					} else {
+						dlog.Debugf("Prefetching [%s] succeeded. Next refresh scheduled for %v", urlToPrefetch.url, urlToPrefetch.when)
+					}
+				}
+			}
+			clocksmith.Sleep(60 * time.Second)
+			if atomic.LoadInt32(&proxy.stopping) != 0 {
+				return
+			}
+		}
+	}()
+}
+
+func (proxy *Proxy) udpListener(clientPc *net.UDPConn, listener *Listener) {
+	dnscrypt := listener != nil && listener.dnscrypt
+	if proxy.udpBatchSize > 1 && udpBatchSupported && !dnscrypt {
+		proxy.udpBatchListener(clientPc, listener)
+		return
+	}
+	defer clientPc.Close()
+	proxy.trackListener(clientPc)
+	for {
+		buffer := packetBuffers.Get().(*[]byte)
+		length, clientAddr, err := clientPc.ReadFrom((*buffer)[:MaxDNSPacketSize-1])
+		if err != nil {
+			packetBuffers.Put(buffer)
+			return
+		}
+		packet, queryPc := (*buffer)[:length], net.Conn(clientPc)
+		if dnscrypt {
+			if packet, queryPc = proxy.unwrapDNSCryptUDPQuery(packet, clientPc, clientAddr); packet == nil {
+				packetBuffers.Put(buffer)
+				continue
+			}
+		}
+		proxy.enqueueUDPQuery(udpQuery{buffer: buffer, packet: packet, clientAddr: clientAddr, clientPc: queryPc, listener: listener})
+	}
+}
+
+// udpListenersFromAddr binds proxy.udpWorkers sockets to the same address if the platform can
+// spread the incoming queries among them, or a single socket otherwise
+func (proxy *Proxy) udpListenersFromAddr(listenAddr *net.UDPAddr, listener *Listener) ([]*net.UDPConn, error) {
+	if proxy.udpWorkers <= 1 || !reusePortSupported {
+		clientPc, err := proxy.udpListenerFromAddr(listenAddr, listener)
+		if err != nil {
+			return nil, err
+		}
+		return []*net.UDPConn{clientPc}, nil
+	}
+	var clientPcs []*net.UDPConn
+	for i := 0; i < proxy.udpWorkers; i++ {
+		clientPc, err := listenUDPReusePort(listenAddr, listener.ipv6Only, proxy.freebind(listenAddr.IP))
+		if err != nil {
+			for _, clientPc := range clientPcs {
+				clientPc.Close()
+			}
+			return nil, err
+		}
+		clientPcs = append(clientPcs, clientPc)
+	}
+	dlog.Noticef("Now listening to %v [UDP] (%d sockets)", listenAddr, len(clientPcs))
+	return clientPcs, nil
+}
+
+func (proxy *Proxy) udpListenerFromAddr(listenAddr *net.UDPAddr, listener *Listener) (*net.UDPConn, error) {
+	var clientPc *net.UDPConn
+	var err error
+	if proxy.freebind(listenAddr.IP) {
+		clientPc, err = listenUDPFreebind(listenAddr, listener.ipv6Only)
+	} else {
+		clientPc, err = net.ListenUDP(listener.network("udp", listenAddr.IP), listenAddr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	dlog.Noticef("Now listening to %v [UDP]", listenAddr)
+	return clientPc, nil
+}
+
+func (proxy *Proxy) tcpListener(acceptPc *net.TCPListener, listener *Listener) {
+	defer acceptPc.Close()
+	proxy.trackListener(acceptPc)
+	for {
+		clientPc, err := acceptPc.Accept()
+		if err != nil {
+			if atomic.LoadInt32(&proxy.stopping) != 0 {
+				return
+			}
+			continue
+		}
+		go proxy.tcpClient(clientPc, listener)
+	}
+}
+
+func (proxy *Proxy) tcpListenerFromAddr(listenAddr *net.TCPAddr, listener *Listener) (*net.TCPListener, error) {
+	var acceptPc *net.TCPListener
+	var err error
+	if proxy.freebind(listenAddr.IP) {
+		acceptPc, err = listenTCPFreebind(listenAddr, listener.ipv6Only)
+	} else {
+		acceptPc, err = net.ListenTCP(listener.network("tcp", listenAddr.IP), listenAddr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	dlog.Noticef("Now listening to %v [TCP]", listenAddr)
+	return acceptPc, nil
+}
+
+func (proxy *Proxy) exchangeWithUDPServer(serverInfo *ServerInfo, sharedKey *[32]byte, encryptedQuery []byte, clientNonce []byte, timeout time.Duration) ([]byte, error) {
+	pc, err := proxy.outgoing.Dial("udp", serverInfo.UDPAddr.String(), 0)
+	if err != nil {
+		return nil, err
+	}
+	pc.SetDeadline(time.Now().Add(MinTimeout(timeout, proxy.udpTimeout)))
+	pc.Write(encryptedQuery)
+	buffer := packetBuffers.Get().(*[]byte)
+	defer packetBuffers.Put(buffer)
+	length, err := pc.Read(*buffer)
+	pc.Close()
+	if err != nil {
+		return nil, err
+	}
+	// The decrypted response is a new slice, so that the buffer can be recycled
+	response, err := proxy.Decrypt(serverInfo, sharedKey, (*buffer)[:length], clientNonce)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (proxy *Proxy) exchangeWithTCPServer(serverInfo *ServerInfo, sharedKey *[32]byte, encryptedQuery []byte, clientNonce []byte, timeout time.Duration) ([]byte, error) {
+	deadline := time.Now().Add(timeout)
+	conn, err := proxy.outgoing.Dial("tcp", serverInfo.TCPAddr.String(), MinTimeout(timeout, proxy.tcpConnectTimeout))
+	if err != nil {
+		return nil, err
+	}
+	pc := conn.(*net.TCPConn)
+	pc.SetDeadline(deadline)
+	encryptedQuery, err = PrefixWithSize(encryptedQuery)
+	if err != nil {
+		return nil, err
+	}
+	pc.Write(encryptedQuery)
+
+	encryptedResponse, err := ReadPrefixed(pc)
+	pc.Close()
+	if err != nil {
+		return nil, err
+	}
+	return proxy.Decrypt(serverInfo, sharedKey, encryptedResponse, clientNonce)
+}
+
+func (proxy *Proxy) exchangeWithServer(serverInfo *ServerInfo, serverProto string, query []byte, timeout time.Duration) ([]byte, error) {
+	start := time.Now()
+	response, err := proxy.exchangeWithServerOnce(serverInfo, serverProto, query, timeout)
+	serverInfo.stats.record(time.Since(start), err)
+	return response, err
+}
+
+func (proxy *Proxy) exchangeWithServerOnce(serverInfo *ServerInfo, serverProto string, query []byte, timeout time.Duration) ([]byte, error) {
+	var response []byte
+	if serverInfo.Proto == stamps.StampProtoTypeDNSCrypt {
+		if limit := serverInfo.ednsSize.limit(); limit > 0 && serverProto == "udp" {
+			query = withEDNSPayloadSize(query, Max(MinEDNSBufferSize, limit-ResponseOverhead))
+		}
+		sharedKey, encryptedQuery, clientNonce, err := proxy.Encrypt(serverInfo, query, serverProto)
+		if err != nil {
+			return nil, err
+		}
+		serverInfo.noticeBegin(proxy)
+		if serverProto == "udp" {
+			response, err = proxy.exchangeWithUDPServer(serverInfo, sharedKey, encryptedQuery, clientNonce, timeout)
+			serverInfo.ednsSize.observe(serverInfo.Name, proxy.ednsBufferSize, err)
+		} else {
+			response, err = proxy.exchangeWithTCPServer(serverInfo, sharedKey, encryptedQuery, clientNonce, timeout)
+		}
+		if err != nil {
+			serverInfo.noticeFailure(proxy)
+			return nil, err
+		}
+	} else if serverInfo.Proto == stamps.StampProtoTypeDoH {
+		tid := TransactionID(query)
+		SetTransactionID(query, 0)
+		serverInfo.noticeBegin(proxy)
+		resp, _, err := proxy.xTransport.DoHQuery(serverInfo.useGet, serverInfo.URL, query, MinTimeout(timeout, proxy.dohTimeout), serverInfo.headers)
+		SetTransactionID(query, tid)
+		if err != nil {
+			serverInfo.noticeFailure(proxy)
+			return nil, err
+		}
+		response, err = ioutil.ReadAll(io.LimitReader(resp.Body, int64(MaxDNSPacketSize)))
+		if err != nil {
+			serverInfo.noticeFailure(proxy)
+			return nil, err
+		}
+		// Responses are expected to have the same ID as the query, that is always 0
+		if len(response) >= MinDNSPacketSize && TransactionID(response) == 0 {
+			SetTransactionID(response, tid)
+		}
+	} else {
+		dlog.Fatal("Unsupported protocol")
+	}
+	if len(response) < MinDNSPacketSize || len(response) > MaxDNSPacketSize {
+		serverInfo.noticeFailure(proxy)
+		return nil, errors.New("Invalid response size")
+	}
+	if !responseMatchesQuery(query, response) {
+		serverInfo.noticeFailure(proxy)
+		return nil, errResponseMismatch
+	}
+	return response, nil
+}
+
+type raceResult struct {
+	serverInfo *ServerInfo
+	response   []byte
+	err        error
+}
+
+// raceExchange sends the same query to several servers at once, and returns the first usable response
+func (proxy *Proxy) raceExchange(servers []*ServerInfo, serverProto string, query []byte, timeout time.Duration) (*ServerInfo, []byte, error) {
+	results := make(chan raceResult, len(servers))
+	for _, serverInfo := range servers {
+		go func(serverInfo *ServerInfo, query []byte) {
+			response, err := proxy.exchangeWithServer(serverInfo, serverProto, query, timeout)
+			results <- raceResult{serverInfo: serverInfo, response: response, err: err}
+		}(serverInfo, append([]byte{}, query...))
+	}
+	var result raceResult
+	for i := range servers {
+		result = <-results
+		if failure := classifyFailure(result.response, result.err); failure < 0 || failure == FailureTruncated {
+			go func(remaining int) {
+				for ; remaining > 0; remaining-- {
+					if loser := <-results; loser.err == nil {
+						loser.serverInfo.noticeSuccess(proxy)
+					}
+				}
+			}(len(servers) - i - 1)
+			break
+		}
+	}
+	return result.serverInfo, result.response, result.err
+}
+
+func (proxy *Proxy) trackListener(listener io.Closer) {
+	proxy.activeListenersLock.Lock()
+	proxy.activeListeners = append(proxy.activeListeners, listener)
+	proxy.activeListenersLock.Unlock()
+}
+
+// Shutdown stops accepting new queries, waits for up to timeout for the queries being processed
+// to be answered, writes a snapshot of the cache if cache_snapshot_file is set, and then drops
+// the plugins, so that logs are flushed
+func (proxy *Proxy) Shutdown(timeout time.Duration) {
+	// Restore the system DNS settings first, so that the system doesn't send queries to closed sockets
+	proxy.systemDNSLock.Lock()
+	RestoreSystemDNS(proxy.previousSystemDNS)
+	proxy.previousSystemDNS = nil
+	proxy.saveSystemDNS()
+	proxy.systemDNSLock.Unlock()
+	atomic.StoreInt32(&proxy.stopping, 1)
+	if err := proxy.virtualIP.release(); err != nil {
+		dlog.Warn(err)
+	}
+	proxy.activeListenersLock.Lock()
+	for _, listener := range proxy.activeListeners {
+		listener.Close()
+	}
+	proxy.activeListeners = nil
+	proxy.activeListenersLock.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadUint32(&proxy.clientsCount) > 0 {
+		if time.Now().After(deadline) {
+			dlog.Warnf("%d queries were still being processed", atomic.LoadUint32(&proxy.clientsCount))
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if len(proxy.cacheSnapshotFile) > 0 {
+		if exported, err := cachedResponses.export(proxy.storage, proxy.cacheSnapshotFile); err != nil {
+			dlog.Warnf("Unable to write the cache snapshot: %v", err)
+		} else {
+			dlog.Noticef("Cache snapshot written to [%s] (%d entries)", proxy.cacheSnapshotFile, exported)
+		}
+	}
+
+	proxy.pluginsGlobals.Lock()
+	queryPlugins, responsePlugins := proxy.pluginsGlobals.queryPlugins, proxy.pluginsGlobals.responsePlugins
+	proxy.pluginsGlobals.queryPlugins, proxy.pluginsGlobals.responsePlugins = &[]Plugin{}, &[]Plugin{}
+	proxy.pluginsGlobals.Unlock()
+	if queryPlugins != nil {
+		dropPlugins(*queryPlugins)
+	}
+	if responsePlugins != nil {
+		dropPlugins(*responsePlugins)
+	}
+}
+
+func (proxy *Proxy) clientsCountInc() bool {
+	for {
+		count := atomic.LoadUint32(&proxy.clientsCount)
+		if count >= proxy.maxClients {
+			return false
+		}
+		if atomic.CompareAndSwapUint32(&proxy.clientsCount, count, count+1) {
+			dlog.Debugf("clients count: %d", count+1)
+			return true
+		}
+	}
+}
+
+func (proxy *Proxy) clientsCountDec() {
+	for {
+		if count := atomic.LoadUint32(&proxy.clientsCount); count == 0 || atomic.CompareAndSwapUint32(&proxy.clientsCount, count, count-1) {
+			break
+		}
+	}
+}
+
+func (proxy *Proxy) processIncomingQuery(serverInfo *ServerInfo, clientProto string, serverProto string, query []byte, clientAddr *net.Addr, clientPc net.Conn, listener *Listener) {
+	defer proxy.ReportPanic()
+	response := proxy.resolveQuery(serverInfo, clientProto, serverProto, query, clientAddr, listener)
+	if response == nil {
+		return
+	}
+	var err error
+	if clientProto == "udp" {
+		if proxy.responseRateLimiter != nil {
+			if response = proxy.responseRateLimiter.limit(response, *clientAddr); response == nil {
+				return
+			}
+		}
+		if len(response) > MaxDNSUDPPacketSize {
+			response, err = TruncatedResponse(response)
+			if err != nil {
+				return
+			}
+		}
+		clientPc.(net.PacketConn).WriteTo(response, *clientAddr)
+		if HasTCFlag(response) {
+			proxy.questionSizeEstimator.blindAdjust()
+		} else {
+			proxy.questionSizeEstimator.adjust(ResponseOverhead + len(response))
+		}
+	} else {
+		response, err = PrefixWithSize(response)
+		if err != nil {
+			return
+		}
+		clientPc.Write(response)
+	}
+}
+
+// resolveQuery applies the plugins to a query, and returns the response to send to the
+// client, from the plugins, the cache or an upstream server. nil means that the query has to
+// be dropped.
+func (proxy *Proxy) resolveQuery(serverInfo *ServerInfo, clientProto string, serverProto string, query []byte, clientAddr *net.Addr, listener *Listener) []byte {
+	return proxy.resolve(serverInfo, clientProto, serverProto, query, clientAddr, listener, false)
+}
+
+// refreshCachedResponse resolves a query again, after a stale response has been sent from the
+// cache, so that the cache gets the new response
+func (proxy *Proxy) refreshCachedResponse(cacheKey [32]byte, clientProto string, serverProto string, query []byte, clientAddr *net.Addr, listener *Listener) {
+	defer cachedResponses.refreshing.Delete(cacheKey)
+	proxy.resolve(proxy.serversInfo.getOne(), clientProto, serverProto, query, clientAddr, listener, true)
+}
+
+// resolve implements resolveQuery; background refreshes skip the cache, and are not accounted
+// for as client queries
+func (proxy *Proxy) resolve(serverInfo *ServerInfo, clientProto string, serverProto string, query []byte, clientAddr *net.Addr, listener *Listener, refresh bool) (response []byte) {
+	received := time.Now()
+	offline := proxy.isOffline()
+	if !refresh && proxy.rejectMalformedQuery(query, clientAddr) {
+		return nil
+	}
+	if len(query) < MinDNSPacketSize || (serverInfo == nil && !offline && proxy.lastResort == nil) {
+		return nil
+	}
+	pluginsState := NewPluginsState(proxy, clientProto, clientAddr)
+	pluginsState.offline = offline
+	pluginsState.backgroundRefresh = refresh
+	if listener != nil {
+		pluginsState.listenerClientGroup = listener.clientGroup
+	}
+	var originalQuery []byte
+	if pluginsState.cacheOptimisticWindow > 0 && !refresh {
+		originalQuery = append([]byte{}, query...)
+	}
+	query, _ = pluginsState.ApplyQueryPlugins(&proxy.pluginsGlobals, query)
+	if cacheKey := pluginsState.cacheRefreshKey; cacheKey != nil && originalQuery != nil {
+		go proxy.refreshCachedResponse(*cacheKey, clientProto, serverProto, originalQuery, clientAddr, listener)
+	}
+	if proxy.auditLog != nil && !refresh {
+		defer proxy.auditLog.write(&pluginsState)
+	}
+	if !refresh {
+		proxy.stats.recordQuery(&pluginsState)
+	}
+	if proxy.queryTail.active() && !refresh {
+		start, queryAction := time.Now(), pluginsState.action
+		defer func() {
+			proxy.queryTail.publish(&pluginsState, queryAction, serverInfo, response, time.Since(start))
+		}()
+	}
+	var err error
+	if offline && pluginsState.action == PluginsActionForward {
+		if response, err = ServerFailureResponse(query); err != nil {
+			return nil
+		}
+	} else if len(pluginsState.serverNames) > 0 && pluginsState.action == PluginsActionForward {
+		if serverInfo = proxy.serversInfo.getOneOf(pluginsState.serverNames); serverInfo == nil {
+			if len(pluginsState.upstreamOverride) > 0 {
+				dlog.Warnf("No live server named [%s]", pluginsState.upstreamOverride)
+			} else if pluginsState.clientGroup != nil {
+				dlog.Warnf("No live servers available for client group [%s]", pluginsState.clientGroup.name)
+			} else {
+				dlog.Warnf("No live servers available for the current network profile")
+			}
+			// The last-resort resolver is used below, if there is one
+			if proxy.lastResort == nil {
+				if response, err = ServerFailureResponse(query); err != nil {
+					return nil
+				}
+			}
+		}
+	}
+	if pluginsState.action != PluginsActionForward {
+		if pluginsState.synthResponse != nil {
+			response, err = pluginsState.synthResponse.PackBuffer(response)
+			if err != nil {
+				return nil
+			}
+		}
+		if pluginsState.action == PluginsActionDrop {
+			return nil
+		}
+	}
+	if len(response) == 0 {
+		var ttl *uint32
+		shared := false
+		deadline := time.Now().Add(proxy.timeout)
+		budgetLimited := false
+		if proxy.latencyBudget > 0 && !refresh {
+			if budgetDeadline := received.Add(proxy.latencyBudget); budgetDeadline.Before(deadline) {
+				deadline, budgetLimited = budgetDeadline, true
+			}
+		}
+		if serverInfo == nil {
+			err = errors.New("No live servers")
+		} else if proxy.coalesceQueries {
+			serverInfo, response, err, shared = proxy.pendingQueries.do(query, serverProto, pluginsState.serverNames, func() (*ServerInfo, []byte, error) {
+				return proxy.forwardQuery(serverInfo, serverProto, query, pluginsState.serverNames, deadline)
+			})
+		} else {
+			serverInfo, response, err = proxy.forwardQuery(serverInfo, serverProto, query, pluginsState.serverNames, deadline)
+		}
+		if err == nil && proxy.nxRedirectProtection == NXRedirectStrip {
+			response = serverInfo.nxRedirect.strip(response)
+		}
+		if shared {
+			proxy.stats.recordCoalesced()
+		} else {
+			proxy.stats.recordUpstream(err)
+		}
+		if err != nil && budgetLimited && !time.Now().Before(deadline) {
+			if !shared && serverInfo != nil {
+				serverInfo.stats.recordOverBudget()
+			}
+			response, _ = proxy.overBudgetResponse(&pluginsState, query)
+			return response
+		}
+		lastResort := false
+		if proxy.lastResort != nil && (err != nil || Rcode(response) == 2) { // SERVFAIL
+			if lastResortResponse, lastResortErr := proxy.lastResort.exchange(query); lastResortErr == nil {
+				if err == nil && !shared {
+					serverInfo.noticeFailure(proxy)
+				}
+				response, err, lastResort = lastResortResponse, nil, true
+			}
+		}
+		if err != nil {
+			return nil
+		}
+		// The response may be replaced with a blocked response, that doesn't tell anything about the server
+		rcode := Rcode(response)
+		response, err = pluginsState.ApplyResponsePlugins(&proxy.pluginsGlobals, response, ttl)
+		if err != nil {
+			if !shared && !lastResort {
+				serverInfo.noticeFailure(proxy)
+			}
+			return nil
+		}
+		if pluginsState.action == PluginsActionReject {
+			proxy.stats.recordBlockedResponse(&pluginsState)
+		}
+		// The server has already been accounted for by the query that was forwarded, or
+		// when the last-resort resolver was used
+		if shared || lastResort {
+			return response
+		}
+		if rcode == 2 || rcode == 5 { // SERVFAIL / REFUSED
+			dlog.Infof("Server [%v] returned temporary error code [%v] -- Upstream server may be experiencing connectivity issues", serverInfo.Name, rcode)
+			serverInfo.noticeFailure(proxy)
+		} else {
+			serverInfo.noticeSuccess(proxy)
+		}
+	}
+	return response
+}
+
+// forwardQuery sends a query to a server, and retries with other servers after an error, a
+// SERVFAIL or a REFUSED response, as long as the deadline allows it. Truncated responses are
+// requested again from the same server over TCP.
+func (proxy *Proxy) forwardQuery(serverInfo *ServerInfo, serverProto string, query []byte, serverNames []string, deadline time.Time) (*ServerInfo, []byte, error) {
+	var response []byte
+	var err error
+	var tried []*ServerInfo
+	for attempt := 0; ; attempt++ {
+		attemptsLeft := 1 + proxy.queryRetries - attempt
+		// The first attempt can use the whole time budget, retries share what is left of it
+		timeout := time.Until(deadline)
+		if attempt > 0 {
+			timeout /= time.Duration(attemptsLeft)
+		}
+		if attempt == 0 && proxy.raceServers > 1 {
+			var racers []*ServerInfo
+			for len(racers) < proxy.raceServers {
+				racer := proxy.serversInfo.getNext(serverNames, racers)
+				if racer == nil {
+					break
+				}
+				racers = append(racers, racer)
+			}
+			if len(racers) == 0 {
+				racers = []*ServerInfo{serverInfo}
+			}
+			serverInfo, response, err = proxy.raceExchange(racers, serverProto, query, timeout)
+			tried = append(tried, racers...)
+		} else {
+			response, err = proxy.exchangeWithServer(serverInfo, serverProto, query, timeout)
+			tried = append(tried, serverInfo)
+		}
+		failure := classifyFailure(response, err)
+		if failure >= 0 {
+			proxy.upstreamFailures.count(failure)
+		}
+		switch failure {
+		case FailureTruncated:
+			if serverProto == "udp" && serverInfo.Proto == stamps.StampProtoTypeDNSCrypt {
+				dlog.Debugf("Truncated response from [%s], retrying over TCP", serverInfo.Name)
+				if tcpResponse, tcpErr := proxy.exchangeWithServer(serverInfo, "tcp", query, time.Until(deadline)); tcpErr == nil {
+					response = tcpResponse
+				}
+			}
+		case FailureTimeout:
+			serverInfo.noticeTimeout()
+		}
+		if attemptsLeft <= 1 || failure < 0 || failure == FailureTruncated || time.Until(deadline) <= 0 {
+			break
+		}
+		nextServerInfo := proxy.serversInfo.getNext(serverNames, tried)
+		if nextServerInfo == nil {
+			break
+		}
+		if err == nil {
+			serverInfo.noticeFailure(proxy)
+		}
+		dlog.Debugf("No usable response from [%s], retrying with [%s]", serverInfo.Name, nextServerInfo.Name)
+		serverInfo = nextServerInfo
+	}
+	return serverInfo, response, err
+}
+
+func (proxy *Proxy) clientGroupsQueryLogs() bool {
+	for _, groupConfig := range proxy.clientGroupsConfig {
+		if len(groupConfig.QueryLogFile) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (proxy *Proxy) clientGroupsSafeSearch() bool {
+	for _, groupConfig := range proxy.clientGroupsConfig {
+		if groupConfig.SafeSearch {
+			return true
+		}
+	}
+	return false
+}
+
+func NewProxy() Proxy {
+	return Proxy{
+		serversInfo: ServersInfo{lbStrategy: DefaultLBStrategy, lbJitter: DefaultLBJitter},
+	}
+}
@@ -0,0 +1,328 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	kafkaAPIProduce  = 0
+	kafkaAPIMetadata = 3
+	// Produce v3 is the oldest version still accepted by current brokers, and the first one using
+	// record batches
+	kafkaProduceVersion  = 3
+	kafkaMetadataVersion = 1
+	kafkaClientID        = "dnscrypt-proxy"
+	// Largest response accepted from a broker
+	kafkaMaxResponseSize = 16 * 1024 * 1024
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// kafkaProducer sends events to a Kafka topic, spreading batches over its partitions. It only
+// implements what is needed to produce records without compression, with acks = 1, and is only
+// used by the goroutine of the shipper.
+type kafkaProducer struct {
+	brokers       []string
+	topic         string
+	conns         map[string]net.Conn
+	leaders       map[int32]string
+	partitions    []int32
+	next          int
+	correlationID int32
+}
+
+// newKafkaProducer parses an address such as kafka://broker1:9092,broker2:9092/topic
+func newKafkaProducer(address string) (*kafkaProducer, error) {
+	remote, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	topic := strings.Trim(remote.Path, "/")
+	if remote.Scheme != "kafka" || len(remote.Host) == 0 || len(topic) == 0 {
+		return nil, errors.New("The Kafka address must look like kafka://broker1:9092,broker2:9092/topic")
+	}
+	return &kafkaProducer{
+		brokers: strings.Split(remote.Host, ","),
+		topic:   topic,
+		conns:   make(map[string]net.Conn),
+	}, nil
+}
+
+func (producer *kafkaProducer) send(lines [][]byte) error {
+	if len(producer.partitions) == 0 {
+		if err := producer.refreshMetadata(); err != nil {
+			return err
+		}
+	}
+	partition := producer.partitions[producer.next%len(producer.partitions)]
+	producer.next++
+	if err := producer.produce(partition, lines); err != nil {
+		// Leaders may have moved
+		producer.partitions = nil
+		return err
+	}
+	return nil
+}
+
+func (producer *kafkaProducer) close() {
+	for address, conn := range producer.conns {
+		conn.Close()
+		delete(producer.conns, address)
+	}
+}
+
+// roundTrip sends a request to a broker, and returns the body of its response
+func (producer *kafkaProducer) roundTrip(address string, apiKey int16, apiVersion int16, body []byte) ([]byte, error) {
+	conn, ok := producer.conns[address]
+	if !ok {
+		var err error
+		if conn, err = net.DialTimeout("tcp", address, QueryLogShipTimeout); err != nil {
+			return nil, err
+		}
+		producer.conns[address] = conn
+	}
+	producer.correlationID++
+	request := make([]byte, 4, 4+14+len(kafkaClientID)+len(body))
+	request = appendKafkaInt16(request, apiKey)
+	request = appendKafkaInt16(request, apiVersion)
+	request = appendKafkaInt32(request, producer.correlationID)
+	request = appendKafkaString(request, kafkaClientID)
+	request = append(request, body...)
+	binary.BigEndian.PutUint32(request[0:4], uint32(len(request)-4))
+	conn.SetDeadline(time.Now().Add(QueryLogShipTimeout))
+	response, err := func() ([]byte, error) {
+		if _, err := conn.Write(request); err != nil {
+			return nil, err
+		}
+		var size [4]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return nil, err
+		}
+		length := binary.BigEndian.Uint32(size[:])
+		if length < 4 || length > kafkaMaxResponseSize {
+			return nil, fmt.Errorf("Unexpected response size: %d", length)
+		}
+		response := make([]byte, length)
+		if _, err := io.ReadFull(conn, response); err != nil {
+			return nil, err
+		}
+		if int32(binary.BigEndian.Uint32(response[0:4])) != producer.correlationID {
+			return nil, errors.New("Unexpected correlation identifier")
+		}
+		return response[4:], nil
+	}()
+	if err != nil {
+		conn.Close()
+		delete(producer.conns, address)
+	}
+	return response, err
+}
+
+// refreshMetadata retrieves the partitions of the topic, and their leaders, from the first
+// broker that answers
+func (producer *kafkaProducer) refreshMetadata() error {
+	request := appendKafkaInt32(nil, 1)
+	request = appendKafkaString(request, producer.topic)
+	var err error
+	for _, broker := range producer.brokers {
+		var response []byte
+		if response, err = producer.roundTrip(broker, kafkaAPIMetadata, kafkaMetadataVersion, request); err != nil {
+			continue
+		}
+		if err = producer.parseMetadata(response); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (producer *kafkaProducer) parseMetadata(response []byte) error {
+	decoder := kafkaDecoder{buf: response}
+	brokers := make(map[int32]string)
+	for i := decoder.int32(); i > 0 && decoder.err == nil; i-- {
+		nodeID, host, port := decoder.int32(), decoder.string(), decoder.int32()
+		decoder.string() // Rack
+		brokers[nodeID] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	decoder.int32() // Controller
+	leaders := make(map[int32]string)
+	var partitions []int32
+	for i := decoder.int32(); i > 0 && decoder.err == nil; i-- {
+		errorCode, name := decoder.int16(), decoder.string()
+		decoder.int8() // Internal
+		for j := decoder.int32(); j > 0 && decoder.err == nil; j-- {
+			partitionErrorCode, partition, leader := decoder.int16(), decoder.int32(), decoder.int32()
+			for k := 0; k < 2; k++ { // Replicas and in-sync replicas
+				for l := decoder.int32(); l > 0 && decoder.err == nil; l-- {
+					decoder.int32()
+				}
+			}
+			if address, ok := brokers[leader]; ok && name == producer.topic && partitionErrorCode == 0 {
+				leaders[partition] = address
+				partitions = append(partitions, partition)
+			}
+		}
+		if name == producer.topic && errorCode != 0 {
+			return fmt.Errorf("Kafka error %d for topic [%s]", errorCode, name)
+		}
+	}
+	if decoder.err != nil {
+		return decoder.err
+	}
+	if len(partitions) == 0 {
+		return fmt.Errorf("No available partitions for topic [%s]", producer.topic)
+	}
+	producer.leaders, producer.partitions = leaders, partitions
+	return nil
+}
+
+func (producer *kafkaProducer) produce(partition int32, lines [][]byte) error {
+	batch := kafkaRecordBatch(lines, time.Now())
+	request := appendKafkaInt16(nil, -1) // No transactional identifier
+	request = appendKafkaInt16(request, 1)
+	request = appendKafkaInt32(request, int32(QueryLogShipTimeout/time.Millisecond))
+	request = appendKafkaInt32(request, 1)
+	request = appendKafkaString(request, producer.topic)
+	request = appendKafkaInt32(request, 1)
+	request = appendKafkaInt32(request, partition)
+	request = appendKafkaInt32(request, int32(len(batch)))
+	request = append(request, batch...)
+	response, err := producer.roundTrip(producer.leaders[partition], kafkaAPIProduce, kafkaProduceVersion, request)
+	if err != nil {
+		return err
+	}
+	decoder := kafkaDecoder{buf: response}
+	for i := decoder.int32(); i > 0 && decoder.err == nil; i-- {
+		decoder.string()
+		for j := decoder.int32(); j > 0 && decoder.err == nil; j-- {
+			decoder.int32()
+			errorCode := decoder.int16()
+			decoder.int64() // Base offset
+			decoder.int64() // Log append time
+			if decoder.err == nil && errorCode != 0 {
+				return fmt.Errorf("Kafka error %d for partition %d of topic [%s]", errorCode, partition, producer.topic)
+			}
+		}
+	}
+	return decoder.err
+}
+
+// kafkaRecordBatch encodes values as a batch of records without keys (message format v2)
+func kafkaRecordBatch(values [][]byte, now time.Time) []byte {
+	var records []byte
+	for i, value := range values {
+		record := []byte{0} // Attributes
+		record = appendKafkaVarint(record, 0)
+		record = appendKafkaVarint(record, int64(i))
+		record = appendKafkaVarint(record, -1)
+		record = appendKafkaVarint(record, int64(len(value)))
+		record = append(record, value...)
+		record = appendKafkaVarint(record, 0) // Headers
+		records = appendKafkaVarint(records, int64(len(record)))
+		records = append(records, record...)
+	}
+	ts := now.UnixNano() / int64(time.Millisecond)
+	// Everything after the checksum
+	checked := appendKafkaInt16(nil, 0) // Attributes: no compression, creation time
+	checked = appendKafkaInt32(checked, int32(len(values)-1))
+	checked = appendKafkaInt64(checked, ts)
+	checked = appendKafkaInt64(checked, ts)
+	checked = appendKafkaInt64(checked, -1) // Producer identifier
+	checked = appendKafkaInt16(checked, -1) // Producer epoch
+	checked = appendKafkaInt32(checked, -1) // Base sequence
+	checked = appendKafkaInt32(checked, int32(len(values)))
+	checked = append(checked, records...)
+	batch := appendKafkaInt64(nil, 0)                          // Base offset
+	batch = appendKafkaInt32(batch, int32(4+1+4+len(checked))) // Length, after this field
+	batch = appendKafkaInt32(batch, -1)                        // Partition leader epoch
+	batch = append(batch, 2)                                   // Magic
+	batch = appendKafkaInt32(batch, int32(crc32.Checksum(checked, crc32c)))
+	return append(batch, checked...)
+}
+
+func appendKafkaInt16(b []byte, v int16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendKafkaInt32(b []byte, v int32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendKafkaInt64(b []byte, v int64) []byte {
+	return appendKafkaInt32(appendKafkaInt32(b, int32(v>>32)), int32(v))
+}
+
+func appendKafkaString(b []byte, s string) []byte {
+	return append(appendKafkaInt16(b, int16(len(s))), s...)
+}
+
+// appendKafkaVarint appends a zigzag-encoded variable-length integer
+func appendKafkaVarint(b []byte, v int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutVarint(buf[:], v)]...)
+}
+
+// kafkaDecoder reads the fields of a response, remembering the first error
+type kafkaDecoder struct {
+	buf []byte
+	err error
+}
+
+func (decoder *kafkaDecoder) next(n int) []byte {
+	if decoder.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(decoder.buf) {
+		decoder.err = errors.New("Short Kafka response")
+		return nil
+	}
+	field := decoder.buf[:n]
+	decoder.buf = decoder.buf[n:]
+	return field
+}
+
+func (decoder *kafkaDecoder) int8() int8 {
+	if field := decoder.next(1); field != nil {
+		return int8(field[0])
+	}
+	return 0
+}
+
+func (decoder *kafkaDecoder) int16() int16 {
+	if field := decoder.next(2); field != nil {
+		return int16(binary.BigEndian.Uint16(field))
+	}
+	return 0
+}
+
+func (decoder *kafkaDecoder) int32() int32 {
+	if field := decoder.next(4); field != nil {
+		return int32(binary.BigEndian.Uint32(field))
+	}
+	return 0
+}
+
+func (decoder *kafkaDecoder) int64() int64 {
+	if field := decoder.next(8); field != nil {
+		return int64(binary.BigEndian.Uint64(field))
+	}
+	return 0
+}
+
+// string reads a nullable string; null strings are returned as empty strings
+func (decoder *kafkaDecoder) string() string {
+	length := decoder.int16()
+	if length < 0 {
+		return ""
+	}
+	return string(decoder.next(int(length)))
+}
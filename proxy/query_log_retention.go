@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	// Interval between two passes over the query log, when a retention period is set
+	QueryLogCompactInterval = time.Hour
+	// Rotated files that have just been written may still be being compressed
+	QueryLogRotatedMinAge = time.Minute
+)
+
+type queryLogCount struct {
+	hour  int64
+	qName string
+}
+
+// monitorRetention removes the entries older than the retention period from the query log,
+// optionally keeping how many times each name was queried every hour, without the clients
+func (plugin *PluginQueryLog) monitorRetention() {
+	ticker := time.NewTicker(QueryLogCompactInterval)
+	defer ticker.Stop()
+	for {
+		if !waitForMaintenanceWindow(plugin.window, plugin.stop) {
+			return
+		}
+		if err := plugin.compact(); err != nil {
+			dlog.Warnf("Unable to remove old entries from the query log: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-plugin.stop:
+			return
+		}
+	}
+}
+
+// compact rewrites the log files without the entries recorded before the last full hour that
+// is older than the retention period; counting whole hours only means that an hour is never
+// aggregated twice
+func (plugin *PluginQueryLog) compact() error {
+	cutoff := time.Now().Add(-plugin.retention).Truncate(time.Hour)
+	counts := make(map[queryLogCount]int)
+	plugin.Lock()
+	removed, err := plugin.compactFile(plugin.logger.Filename, cutoff, counts)
+	if removed > 0 {
+		// The logger opens the file again on the next write
+		plugin.logger.Close()
+	}
+	plugin.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, file := range plugin.rotatedFiles() {
+		fi, err := os.Stat(file)
+		if err != nil || time.Since(fi.ModTime()) < QueryLogRotatedMinAge {
+			continue
+		}
+		n, fileErr := plugin.compactFile(file, cutoff, counts)
+		if fileErr != nil {
+			// The entries removed from the other files are still counted
+			err = fileErr
+			break
+		}
+		removed += n
+	}
+	if removed == 0 {
+		return err
+	}
+	dlog.Infof("%d query log entries older than %v removed", removed, plugin.retention)
+	if len(plugin.aggregateFile) > 0 {
+		if countsErr := plugin.writeCounts(counts); countsErr != nil {
+			return countsErr
+		}
+	}
+	return err
+}
+
+// rotatedFiles returns the previous log files, as named by the logger
+func (plugin *PluginQueryLog) rotatedFiles() []string {
+	file := plugin.logger.Filename
+	ext := filepath.Ext(file)
+	prefix := strings.TrimSuffix(file, ext) + "-"
+	var files []string
+	for _, pattern := range []string{prefix + "*" + ext, prefix + "*" + ext + ".gz"} {
+		matches, _ := filepath.Glob(pattern)
+		files = append(files, matches...)
+	}
+	return files
+}
+
+// compactFile removes the entries recorded before the cutoff from a log file, that can be
+// gzip-compressed, counts them, and returns how many were removed
+func (plugin *PluginQueryLog) compactFile(file string, cutoff time.Time, counts map[queryLogCount]int) (int, error) {
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		return 0, nil
+	}
+	compressed := strings.HasSuffix(file, ".gz")
+	bin, err := ReadRuleFile(file)
+	if err != nil {
+		return 0, err
+	}
+	var kept bytes.Buffer
+	removed := 0
+	for _, line := range strings.SplitAfter(string(bin), "\n") {
+		if len(line) == 0 {
+			continue
+		}
+		ts, qName, ok := parseQueryLogLine(plugin.format, line)
+		if !ok || !ts.Before(cutoff) {
+			kept.WriteString(line)
+			continue
+		}
+		counts[queryLogCount{hour: ts.Truncate(time.Hour).Unix(), qName: qName}]++
+		removed++
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	if kept.Len() == 0 {
+		return removed, os.Remove(file)
+	}
+	content := kept.Bytes()
+	if compressed {
+		var gz bytes.Buffer
+		gzipWriter := gzip.NewWriter(&gz)
+		gzipWriter.Write(content)
+		gzipWriter.Close()
+		content = gz.Bytes()
+	}
+	return removed, AtomicFileWrite(file, content)
+}
+
+// parseQueryLogLine returns the time and the name of a query log entry
+func parseQueryLogLine(format string, line string) (time.Time, string, bool) {
+	fields := strings.Split(strings.TrimRight(line, "\r\n"), "\t")
+	if format == "tsv" {
+		if len(fields) < 3 {
+			return time.Time{}, "", false
+		}
+		ts, err := time.ParseInLocation("[2006-01-02 15:04:05]", fields[0], time.Local)
+		if err != nil {
+			return time.Time{}, "", false
+		}
+		return ts, fields[2], true
+	}
+	var ts time.Time
+	var qName string
+	for _, field := range fields {
+		if strings.HasPrefix(field, "time:") {
+			unix, err := strconv.ParseInt(strings.TrimPrefix(field, "time:"), 10, 64)
+			if err != nil {
+				return time.Time{}, "", false
+			}
+			ts = time.Unix(unix, 0)
+		} else if strings.HasPrefix(field, "message:") {
+			qName = strings.TrimPrefix(field, "message:")
+		}
+	}
+	return ts, qName, !ts.IsZero() && len(qName) > 0
+}
+
+// writeCounts appends the number of queries per hour and per name to the aggregate file
+func (plugin *PluginQueryLog) writeCounts(counts map[queryLogCount]int) error {
+	keys := make([]queryLogCount, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].hour != keys[j].hour {
+			return keys[i].hour < keys[j].hour
+		}
+		return keys[i].qName < keys[j].qName
+	})
+	var lines bytes.Buffer
+	for _, key := range keys {
+		if plugin.format == "tsv" {
+			hour := time.Unix(key.hour, 0).Format("[2006-01-02 15:04]")
+			fmt.Fprintf(&lines, "%s\t%s\t%d\n", hour, key.qName, counts[key])
+		} else {
+			fmt.Fprintf(&lines, "time:%d\tmessage:%s\tcount:%d\n", key.hour, key.qName, counts[key])
+		}
+	}
+	fp, err := os.OpenFile(plugin.aggregateFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := fp.Write(lines.Bytes()); err != nil {
+		fp.Close()
+		return err
+	}
+	return fp.Close()
+}
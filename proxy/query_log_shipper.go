@@ -0,0 +1,317 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	DefaultQueryLogShipBatchSize     = 500
+	DefaultQueryLogShipFlushInterval = 5
+	DefaultQueryLogShipQueueSize     = 10000
+	DefaultQueryLogShipSpoolMaxSize  = 100
+	QueryLogShipTimeout              = 10 * time.Second
+	QueryLogShipMaxRetryDelay        = time.Minute
+)
+
+type QueryLogRemoteConfig struct {
+	Type          string `toml:"type"`
+	Address       string `toml:"address"`
+	BatchSize     int    `toml:"batch_size"`
+	FlushInterval int    `toml:"flush_interval"`
+	QueueSize     int    `toml:"queue_size"`
+	SpoolFile     string `toml:"spool_file"`
+	SpoolMaxSize  int    `toml:"spool_max_size"`
+}
+
+type QueryLogEvent struct {
+	Time   time.Time `json:"time"`
+	Client string    `json:"client"`
+	Name   string    `json:"name"`
+	Type   string    `json:"type"`
+	MAC    string    `json:"mac,omitempty"`
+}
+
+// QueryLogShipper sends query log events to a remote collector, in batches. Events are queued
+// in memory, and never slow down queries: they are dropped if the queue is full. Batches that
+// can't be sent are appended to a spool file, if there is one, and sent again once the collector
+// is back.
+type QueryLogShipper struct {
+	send          func(lines [][]byte) error
+	batchSize     int
+	flushInterval time.Duration
+	spoolFile     string
+	spoolMaxSize  int64
+	events        chan QueryLogEvent
+	stop          chan struct{}
+	done          chan struct{}
+	dropped       uint64
+	hostname      string
+	syslogConn    net.Conn
+	kafka         *kafkaProducer
+}
+
+func NewQueryLogShipper(config *QueryLogRemoteConfig) (*QueryLogShipper, error) {
+	shipper := QueryLogShipper{
+		batchSize:     config.BatchSize,
+		flushInterval: time.Duration(config.FlushInterval) * time.Second,
+		spoolFile:     config.SpoolFile,
+		spoolMaxSize:  int64(config.SpoolMaxSize) * 1024 * 1024,
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	if shipper.batchSize <= 0 {
+		shipper.batchSize = DefaultQueryLogShipBatchSize
+	}
+	if shipper.flushInterval <= 0 {
+		shipper.flushInterval = DefaultQueryLogShipFlushInterval * time.Second
+	}
+	if shipper.spoolMaxSize <= 0 {
+		shipper.spoolMaxSize = DefaultQueryLogShipSpoolMaxSize * 1024 * 1024
+	}
+	queueSize := config.QueueSize
+	if queueSize <= 0 {
+		queueSize = DefaultQueryLogShipQueueSize
+	}
+	shipper.events = make(chan QueryLogEvent, queueSize)
+	switch config.Type {
+	case "http":
+		if _, err := url.Parse(config.Address); err != nil {
+			return nil, err
+		}
+		client := &http.Client{Timeout: QueryLogShipTimeout}
+		shipper.send = func(lines [][]byte) error {
+			return shipHTTP(client, config.Address, lines)
+		}
+	case "syslog":
+		remote, err := url.Parse(config.Address)
+		if err != nil {
+			return nil, err
+		}
+		if remote.Scheme != "udp" && remote.Scheme != "tcp" {
+			return nil, errors.New("The syslog address must start with udp:// or tcp://")
+		}
+		if shipper.hostname, err = os.Hostname(); err != nil {
+			shipper.hostname = "-"
+		}
+		shipper.send = func(lines [][]byte) error {
+			return shipper.shipSyslog(remote.Scheme, remote.Host, lines)
+		}
+	case "kafka":
+		kafka, err := newKafkaProducer(config.Address)
+		if err != nil {
+			return nil, err
+		}
+		shipper.kafka = kafka
+		shipper.send = kafka.send
+	default:
+		return nil, fmt.Errorf("Unsupported remote query log type: [%s] -- Use http, syslog or kafka", config.Type)
+	}
+	go shipper.run()
+	return &shipper, nil
+}
+
+// enqueue adds an event to the queue, without blocking
+func (shipper *QueryLogShipper) enqueue(event QueryLogEvent) {
+	select {
+	case shipper.events <- event:
+	default:
+		if atomic.AddUint64(&shipper.dropped, 1)%1000 == 1 {
+			dlog.Warnf("The remote query log queue is full - %d events dropped so far", atomic.LoadUint64(&shipper.dropped))
+		}
+	}
+}
+
+// close sends or spools the pending events, and stops the shipper
+func (shipper *QueryLogShipper) close() {
+	close(shipper.stop)
+	<-shipper.done
+}
+
+func (shipper *QueryLogShipper) run() {
+	defer close(shipper.done)
+	ticker := time.NewTicker(shipper.flushInterval)
+	defer ticker.Stop()
+	var batch [][]byte
+	var retryAt time.Time
+	retryDelay := time.Second
+	flush := func() {
+		if len(batch) == 0 && !shipper.hasSpool() {
+			return
+		}
+		if !retryAt.IsZero() && time.Now().Before(retryAt) {
+			shipper.spool(batch)
+			batch = nil
+			return
+		}
+		err := shipper.sendSpool()
+		if err == nil && len(batch) > 0 {
+			err = shipper.send(batch)
+		}
+		if err != nil {
+			dlog.Warnf("Unable to send the query log: %v", err)
+			shipper.spool(batch)
+			retryAt = time.Now().Add(retryDelay)
+			retryDelay *= 2
+			if retryDelay > QueryLogShipMaxRetryDelay {
+				retryDelay = QueryLogShipMaxRetryDelay
+			}
+		} else {
+			retryAt, retryDelay = time.Time{}, time.Second
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case event := <-shipper.events:
+			line, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			batch = append(batch, line)
+			if len(batch) >= shipper.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-shipper.stop:
+			for len(shipper.events) > 0 {
+				if line, err := json.Marshal(<-shipper.events); err == nil {
+					batch = append(batch, line)
+				}
+			}
+			retryAt = time.Time{}
+			flush()
+			if shipper.syslogConn != nil {
+				shipper.syslogConn.Close()
+			}
+			if shipper.kafka != nil {
+				shipper.kafka.close()
+			}
+			return
+		}
+	}
+}
+
+func (shipper *QueryLogShipper) hasSpool() bool {
+	if len(shipper.spoolFile) == 0 {
+		return false
+	}
+	fi, err := os.Stat(shipper.spoolFile)
+	return err == nil && fi.Size() > 0
+}
+
+// spool appends events to the spool file, unless it has reached its maximum size
+func (shipper *QueryLogShipper) spool(lines [][]byte) {
+	if len(lines) == 0 {
+		return
+	}
+	if len(shipper.spoolFile) == 0 {
+		atomic.AddUint64(&shipper.dropped, uint64(len(lines)))
+		return
+	}
+	if fi, err := os.Stat(shipper.spoolFile); err == nil && fi.Size() >= shipper.spoolMaxSize {
+		atomic.AddUint64(&shipper.dropped, uint64(len(lines)))
+		return
+	}
+	fp, err := os.OpenFile(shipper.spoolFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		dlog.Warnf("Unable to spool the query log: %v", err)
+		atomic.AddUint64(&shipper.dropped, uint64(len(lines)))
+		return
+	}
+	defer fp.Close()
+	writer := bufio.NewWriter(fp)
+	for _, line := range lines {
+		writer.Write(line)
+		writer.WriteByte('\n')
+	}
+	writer.Flush()
+}
+
+// sendSpool sends the spooled events, and removes the ones that have been sent
+func (shipper *QueryLogShipper) sendSpool() error {
+	if !shipper.hasSpool() {
+		return nil
+	}
+	fp, err := os.Open(shipper.spoolFile)
+	if err != nil {
+		return err
+	}
+	var lines [][]byte
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		if line := scanner.Bytes(); len(line) > 0 {
+			lines = append(lines, append([]byte{}, line...))
+		}
+	}
+	fp.Close()
+	for len(lines) > 0 {
+		count := shipper.batchSize
+		if count > len(lines) {
+			count = len(lines)
+		}
+		if err := shipper.send(lines[:count]); err != nil {
+			var remaining bytes.Buffer
+			for _, line := range lines {
+				remaining.Write(line)
+				remaining.WriteByte('\n')
+			}
+			AtomicFileWrite(shipper.spoolFile, remaining.Bytes())
+			return err
+		}
+		lines = lines[count:]
+	}
+	dlog.Notice("Spooled query log events sent")
+	return os.Remove(shipper.spoolFile)
+}
+
+// shipHTTP posts events as newline-delimited JSON
+func shipHTTP(client *http.Client, address string, lines [][]byte) error {
+	body := append(bytes.Join(lines, []byte{'\n'}), '\n')
+	resp, err := client.Post(address, "application/x-ndjson", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Status: %s", resp.Status)
+	}
+	return nil
+}
+
+// shipSyslog sends every event as an RFC 5424 message, with the local0 facility. TCP messages
+// are framed with their length (RFC 6587).
+func (shipper *QueryLogShipper) shipSyslog(network string, address string, lines [][]byte) error {
+	if shipper.syslogConn == nil {
+		conn, err := net.DialTimeout(network, address, QueryLogShipTimeout)
+		if err != nil {
+			return err
+		}
+		shipper.syslogConn = conn
+	}
+	shipper.syslogConn.SetWriteDeadline(time.Now().Add(QueryLogShipTimeout))
+	for _, line := range lines {
+		msg := fmt.Sprintf("<134>1 %s %s dnscrypt-proxy - query - %s", time.Now().UTC().Format(time.RFC3339), shipper.hostname, line)
+		if network == "tcp" {
+			msg = fmt.Sprintf("%d %s", len(msg), msg)
+		}
+		if _, err := shipper.syslogConn.Write([]byte(msg)); err != nil {
+			shipper.syslogConn.Close()
+			shipper.syslogConn = nil
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const QueryTailBufferSize = 256
+
+// TailEvent describes a query once it has been answered, or not
+type TailEvent struct {
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client"`
+	Name     string    `json:"name"`
+	Type     string    `json:"type"`
+	Action   string    `json:"action"`
+	Server   string    `json:"server,omitempty"`
+	Rcode    string    `json:"rcode,omitempty"`
+	Duration int64     `json:"duration_ms"`
+}
+
+// QueryTail broadcasts processed queries to the clients watching them.
+// Slow clients miss events instead of slowing down the proxy.
+type QueryTail struct {
+	sync.RWMutex
+	subscribers map[chan TailEvent]string
+	count       int32
+}
+
+func (queryTail *QueryTail) active() bool {
+	return atomic.LoadInt32(&queryTail.count) > 0
+}
+
+// subscribe returns a channel receiving the queries for names under filter, or all the
+// queries if filter is empty
+func (queryTail *QueryTail) subscribe(filter string) chan TailEvent {
+	events := make(chan TailEvent, QueryTailBufferSize)
+	queryTail.Lock()
+	if queryTail.subscribers == nil {
+		queryTail.subscribers = make(map[chan TailEvent]string)
+	}
+	queryTail.subscribers[events] = strings.ToLower(StripTrailingDot(filter))
+	atomic.AddInt32(&queryTail.count, 1)
+	queryTail.Unlock()
+	return events
+}
+
+func (queryTail *QueryTail) unsubscribe(events chan TailEvent) {
+	queryTail.Lock()
+	if _, found := queryTail.subscribers[events]; found {
+		delete(queryTail.subscribers, events)
+		atomic.AddInt32(&queryTail.count, -1)
+	}
+	queryTail.Unlock()
+}
+
+func (queryTail *QueryTail) publish(pluginsState *PluginsState, queryAction PluginsAction, serverInfo *ServerInfo, response []byte, elapsed time.Duration) {
+	event := TailEvent{
+		Time:     time.Now(),
+		Client:   pluginsState.ClientIP().String(),
+		Name:     pluginsState.qName,
+		Type:     dns.TypeToString[pluginsState.qType],
+		Duration: elapsed.Nanoseconds() / 1000000,
+	}
+	switch {
+	case queryAction == PluginsActionDrop:
+		event.Action = "dropped"
+	case queryAction == PluginsActionReject || pluginsState.action == PluginsActionReject:
+		event.Action = "blocked"
+	case pluginsState.cacheHit:
+		event.Action = "cached"
+	case queryAction == PluginsActionSynth:
+		event.Action = "synthesized"
+	default:
+		event.Action = "forwarded"
+		if serverInfo != nil {
+			event.Server = serverInfo.Name
+		}
+	}
+	if len(response) >= MinDNSPacketSize {
+		event.Rcode = dns.RcodeToString[int(Rcode(response))]
+	} else if event.Action == "forwarded" {
+		event.Rcode = "NO RESPONSE"
+	}
+	queryTail.RLock()
+	for events, filter := range queryTail.subscribers {
+		if len(filter) > 0 && event.Name != filter && !strings.HasSuffix(event.Name, "."+filter) {
+			continue
+		}
+		select {
+		case events <- event:
+		default:
+		}
+	}
+	queryTail.RUnlock()
+}
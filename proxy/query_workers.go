@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const OverloadWarningInterval = time.Duration(10) * time.Second
+
+type udpQuery struct {
+	buffer     *[]byte
+	packet     []byte
+	clientAddr net.Addr
+	clientPc   net.Conn
+	listener   *Listener
+}
+
+// startQueryWorkers starts a fixed number of goroutines processing the UDP queries.
+// The queue can hold max_clients queries, which is also the maximum number of queries in
+// flight, so that queueing a query that has been accepted never blocks.
+func (proxy *Proxy) startQueryWorkers() {
+	proxy.udpQueries = make(chan udpQuery, proxy.maxClients)
+	for i := 0; i < proxy.queryWorkers; i++ {
+		go func() {
+			for query := range proxy.udpQueries {
+				clientAddr := query.clientAddr
+				proxy.processIncomingQuery(proxy.serversInfo.getOne(), "udp", proxy.mainProto, query.packet, &clientAddr, query.clientPc, query.listener)
+				proxy.clientsCountDec()
+				packetBuffers.Put(query.buffer)
+			}
+		}()
+	}
+}
+
+// enqueueUDPQuery hands a query over to the workers, or rejects it if too many queries are
+// already being processed
+func (proxy *Proxy) enqueueUDPQuery(query udpQuery) {
+	if !proxy.clientAllowed(query.clientAddr) {
+		packetBuffers.Put(query.buffer)
+		return
+	}
+	if !proxy.clientsCountInc() {
+		proxy.warnOverload()
+		if proxy.overloadRefuse {
+			if response, err := RefusedResponse(query.packet); err == nil {
+				query.clientPc.(net.PacketConn).WriteTo(response, query.clientAddr)
+			}
+		}
+		packetBuffers.Put(query.buffer)
+		return
+	}
+	proxy.udpQueries <- query
+}
+
+type overloadWarning struct {
+	sync.Mutex
+	rejected    uint64
+	lastWarning time.Time
+}
+
+// warnOverload logs rejected queries, without flooding the logs during a flood of queries
+func (proxy *Proxy) warnOverload() {
+	now := time.Now()
+	proxy.overload.Lock()
+	proxy.overload.rejected++
+	rejected := proxy.overload.rejected
+	warn := now.Sub(proxy.overload.lastWarning) >= OverloadWarningInterval
+	if warn {
+		proxy.overload.lastWarning = now
+	}
+	proxy.overload.Unlock()
+	if warn {
+		dlog.Warnf("Too many queries in flight (max=%d) - %d queries rejected so far", proxy.maxClients, rejected)
+	}
+}
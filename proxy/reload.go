@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+
+	"github.com/jedisct1/dlog"
+)
+
+// Settings that are applied by a reload; other changes require a restart
+var reloadableSettings = map[string]bool{
+	"block_ipv6":                   true,
+	"block_ipv6_for_ipv4_clients":  true,
+	"block_doh_canary":             true,
+	"chaos_responses":              true,
+	"chaos_policy":                 true,
+	"upstream_override":            true,
+	"strip_ech":                    true,
+	"sanitize_responses":           true,
+	"blocked_query_types":          true,
+	"blocked_query_types_response": true,
+	"blocked_query_response":       true,
+	"cache":                        true,
+	"cache_size":                   true,
+	"cache_neg_ttl":                true,
+	"cache_neg_min_ttl":            true,
+	"cache_neg_max_ttl":            true,
+	"cache_min_ttl":                true,
+	"cache_max_ttl":                true,
+	"cache_optimistic_window":      true,
+	"slow_plugin_threshold":        true,
+	"query_log":                    true,
+	"nx_log":                       true,
+	"blacklist":                    true,
+	"whitelist":                    true,
+	"ip_blacklist":                 true,
+	"forwarding_rules":             true,
+	"forward_search_domains":       true,
+	"search_domains_resolv_conf":   true,
+	"cloaking_rules":               true,
+	"ttl_rules":                    true,
+	"script_file":                  true,
+	"policy_hook":                  true,
+	"captive_portals":              true,
+	"local_zones":                  true,
+	"client_groups":                true,
+	"client_hints_file":            true,
+	"client_identification":        true,
+	"safe_search":                  true,
+	"dnssec_validation":            true,
+	"dnssec_trust_anchors_file":    true,
+	"client_rate_limit":            true,
+	"client_rate_limit_burst":      true,
+	"dns_cookies":                  true,
+	"dns_cookies_strict":           true,
+	"schedules":                    true,
+}
+
+// ReloadOnSignal reloads the configuration every time a SIGHUP signal is received
+func (proxy *Proxy) ReloadOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			dlog.Notice("SIGHUP received, reloading the configuration")
+			if err := proxy.Reload(); err != nil {
+				dlog.Errorf("Configuration not reloaded: %v", err)
+				continue
+			}
+			dlog.Notice("Configuration reloaded")
+		}
+	}()
+}
+
+// Reload reads the configuration file again, and replaces the plugins with new ones.
+// Queries being processed keep using the previous plugins and settings, and the cache is
+// preserved, unless it has to be shrunk or disabled.
+// If the new configuration or one of the rule files is invalid, nothing is changed.
+func (proxy *Proxy) Reload() error {
+	proxy.reloadLock.Lock()
+	defer proxy.reloadLock.Unlock()
+	if len(proxy.configFile) == 0 {
+		return errors.New("The configuration was not loaded from a file")
+	}
+	config := newConfig()
+	if err := decodeConfigFile(proxy.configFile, &config, 0); err != nil {
+		return err
+	}
+	if err := config.loadPluginSettings(proxy); err != nil {
+		proxy.config.loadPluginSettings(proxy)
+		return err
+	}
+	if err := proxy.replacePlugins(); err != nil {
+		proxy.config.loadPluginSettings(proxy)
+		return err
+	}
+
+	for _, key := range changedSettings(proxy.config, &config) {
+		if reloadableSettings[key] {
+			dlog.Noticef("Setting [%s] changed", key)
+		} else {
+			dlog.Warnf("Setting [%s] changed, but requires a restart to be applied", key)
+		}
+	}
+	proxy.config = &config
+	return nil
+}
+
+// ReloadRules loads the rule files again, with the current configuration
+func (proxy *Proxy) ReloadRules() error {
+	proxy.reloadLock.Lock()
+	defer proxy.reloadLock.Unlock()
+	return proxy.replacePlugins()
+}
+
+// replacePlugins initializes new plugins, and only swaps them with the current ones if they all loaded
+func (proxy *Proxy) replacePlugins() error {
+	pluginsGlobals := PluginsGlobals{}
+	if err := InitPluginsGlobals(&pluginsGlobals, proxy); err != nil {
+		return err
+	}
+	proxy.pluginsGlobals.Lock()
+	previousQueryPlugins, previousResponsePlugins := proxy.pluginsGlobals.queryPlugins, proxy.pluginsGlobals.responsePlugins
+	proxy.pluginsGlobals.queryPlugins, proxy.pluginsGlobals.responsePlugins = pluginsGlobals.queryPlugins, pluginsGlobals.responsePlugins
+	proxy.pluginsGlobals.settings = pluginsGlobals.settings
+	proxy.pluginsGlobals.Unlock()
+	dropPlugins(*previousQueryPlugins)
+	dropPlugins(*previousResponsePlugins)
+	settings := pluginsGlobals.settings
+	if !settings.cache {
+		cachedResponses.purge()
+	} else if evicted := cachedResponses.resize(settings.cacheSize, settings.cacheMaxBytes); evicted > 0 {
+		dlog.Noticef("Cache resized, %d entries evicted", evicted)
+	}
+	return nil
+}
+
+func dropPlugins(plugins []Plugin) {
+	for _, plugin := range plugins {
+		if err := plugin.Drop(); err != nil {
+			dlog.Warnf("Unable to drop the [%s] plugin: %v", plugin.Name(), err)
+		}
+	}
+}
+
+// changedSettings returns the names of the top-level settings that differ between two configurations
+func changedSettings(previous *Config, current *Config) []string {
+	var changed []string
+	previousValue, currentValue := reflect.ValueOf(*previous), reflect.ValueOf(*current)
+	configType := previousValue.Type()
+	for i := 0; i < configType.NumField(); i++ {
+		field := configType.Field(i)
+		if reflect.DeepEqual(previousValue.Field(i).Interface(), currentValue.Field(i).Interface()) {
+			continue
+		}
+		name := field.Tag.Get("toml")
+		if len(name) == 0 {
+			name = strings.ToLower(field.Name)
+		}
+		changed = append(changed, name)
+	}
+	return changed
+}
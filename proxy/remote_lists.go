@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/jedisct1/dlog"
+	clocksmith "github.com/jedisct1/go-clocksmith"
+	"github.com/jedisct1/go-minisign"
+)
+
+const (
+	RemoteListDefaultRefreshDelay = time.Duration(24) * time.Hour
+	RemoteListRetryDelay          = time.Duration(1) * time.Hour
+)
+
+type RemoteList struct {
+	name         string
+	storage      Storage
+	urls         []string
+	minisignKey  *minisign.PublicKey
+	cacheFile    string
+	refreshDelay time.Duration
+	transform    func(in string) string
+	window       *WeeklyRanges
+	stop         chan struct{}
+}
+
+func NewRemoteList(name string, storage Storage, urls []string, minisignKeyStr string, cacheFile string, refreshDelay time.Duration) (*RemoteList, error) {
+	remoteList := RemoteList{name: name, storage: storage, urls: urls, cacheFile: cacheFile, refreshDelay: refreshDelay, stop: make(chan struct{})}
+	if refreshDelay <= 0 {
+		remoteList.refreshDelay = RemoteListDefaultRefreshDelay
+	}
+	if len(cacheFile) == 0 {
+		return nil, fmt.Errorf("Missing cache file for the remote %s", name)
+	}
+	if len(minisignKeyStr) > 0 {
+		minisignKey, err := minisign.NewPublicKey(minisignKeyStr)
+		if err != nil {
+			return nil, err
+		}
+		remoteList.minisignKey = &minisignKey
+	}
+	return &remoteList, nil
+}
+
+func (remoteList *RemoteList) LoadCache() (in string, delayTillNextUpdate time.Duration, err error) {
+	modTime, err := remoteList.storage.ModTime(remoteList.cacheFile)
+	if err != nil {
+		return "", time.Duration(0), err
+	}
+	bin, err := remoteList.storage.Read(remoteList.cacheFile)
+	if err != nil {
+		return "", time.Duration(0), err
+	}
+	if elapsed := time.Since(modTime); elapsed < remoteList.refreshDelay {
+		delayTillNextUpdate = remoteList.refreshDelay - elapsed
+	}
+	return string(bin), delayTillNextUpdate, nil
+}
+
+func fetchURL(xTransport *XTransport, urlStr string) ([]byte, error) {
+	url, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, err
+	}
+	return xTransport.Download(url)
+}
+
+func (remoteList *RemoteList) fetchOne(xTransport *XTransport, urlStr string) (string, error) {
+	dlog.Infof("Loading %s from URL [%s]", remoteList.name, urlStr)
+	bin, err := fetchURL(xTransport, urlStr)
+	if err != nil {
+		return "", err
+	}
+	if remoteList.minisignKey != nil {
+		sigBin, err := fetchURL(xTransport, urlStr+".minisig")
+		if err != nil {
+			return "", err
+		}
+		signature, err := minisign.DecodeSignature(string(sigBin))
+		if err != nil {
+			return "", err
+		}
+		if res, err := remoteList.minisignKey.Verify(bin, signature); err != nil || !res {
+			return "", fmt.Errorf("Invalid signature for [%s]", urlStr)
+		}
+	}
+	if bin, err = DecompressRules(bin); err != nil {
+		return "", err
+	}
+	return string(bin), nil
+}
+
+func (remoteList *RemoteList) Fetch(xTransport *XTransport) (string, error) {
+	seen := make(map[string]bool)
+	var merged []string
+	for _, urlStr := range remoteList.urls {
+		in, err := remoteList.fetchOne(xTransport, urlStr)
+		if err != nil {
+			return "", fmt.Errorf("Unable to load [%s]: %s", urlStr, err)
+		}
+		if remoteList.transform != nil {
+			in = remoteList.transform(in)
+		}
+		for _, line := range strings.Split(in, "\n") {
+			line = strings.TrimFunc(line, unicode.IsSpace)
+			if len(line) == 0 || strings.HasPrefix(line, "#") || seen[line] {
+				continue
+			}
+			seen[line] = true
+			merged = append(merged, line)
+		}
+	}
+	in := strings.Join(merged, "\n")
+	if err := remoteList.storage.Write(remoteList.cacheFile, []byte(in)); err != nil {
+		dlog.Warnf("%s: %s", remoteList.cacheFile, err)
+	}
+	return in, nil
+}
+
+func (remoteList *RemoteList) Refresher(xTransport *XTransport, delay time.Duration, update func(in string)) {
+	go func() {
+		for {
+			clocksmith.Sleep(delay)
+			select {
+			case <-remoteList.stop:
+				return
+			default:
+			}
+			if !waitForMaintenanceWindow(remoteList.window, remoteList.stop) {
+				return
+			}
+			in, err := remoteList.Fetch(xTransport)
+			if err != nil {
+				dlog.Warnf("Unable to refresh the remote %s: %s", remoteList.name, err)
+				delay = RemoteListRetryDelay
+				continue
+			}
+			update(in)
+			dlog.Noticef("Remote %s refreshed", remoteList.name)
+			delay = remoteList.refreshDelay
+		}
+	}()
+}
+
+// Stop prevents the list from being refreshed any more
+func (remoteList *RemoteList) Stop() {
+	close(remoteList.stop)
+}
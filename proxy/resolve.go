@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	stamps "github.com/jedisct1/go-dnsstamps"
+	"github.com/miekg/dns"
+)
+
+// ResolveAndPrint sends a query for a name through the plugins and servers of the configuration, and
+// prints the response. If serverName is not empty, the query is sent to that server only; it
+// can be the name of a registered server, or a stamp.
+func ResolveAndPrint(proxy *Proxy, name string, serverName string) error {
+	if err := InitPluginsGlobals(&proxy.pluginsGlobals, proxy); err != nil {
+		return err
+	}
+	proxy.initServers()
+	msg := dns.Msg{}
+	msg.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	msg.RecursionDesired = true
+	msg.SetEdns0(uint16(MaxDNSUDPPacketSize), true)
+	query, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Resolving [%s]\n\n", name)
+
+	var clientAddr net.Addr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	pluginsState := NewPluginsState(proxy, "udp", &clientAddr)
+	start := time.Now()
+	query, _ = pluginsState.ApplyQueryPlugins(&proxy.pluginsGlobals, query)
+	if pluginsState.action == PluginsActionDrop {
+		fmt.Println("Result:         the query was dropped by the configuration")
+		return nil
+	}
+
+	var response []byte
+	if pluginsState.action != PluginsActionForward {
+		if pluginsState.synthResponse == nil {
+			return errors.New("The query was rejected by the configuration")
+		}
+		if response, err = pluginsState.synthResponse.Pack(); err != nil {
+			return err
+		}
+		fmt.Println("Server:         - (answered by the local rules)")
+	} else {
+		serverInfo, err := resolveServer(proxy, serverName, pluginsState.serverNames)
+		if err != nil {
+			return err
+		}
+		serverProto := "udp"
+		start = time.Now()
+		response, err = proxy.exchangeWithServer(serverInfo, serverProto, query, proxy.timeout)
+		if err == nil && HasTCFlag(response) {
+			serverProto = "tcp"
+			response, err = proxy.exchangeWithServer(serverInfo, serverProto, query, proxy.timeout)
+		}
+		if err != nil {
+			return fmt.Errorf("No response from [%s]: %v", serverInfo.Name, err)
+		}
+		fmt.Printf("Server:         %s\n", serverInfo.Name)
+		fmt.Printf("Protocol:       %s over %s\n", serverInfo.Proto.String(), strings.ToUpper(serverProto))
+	}
+	rtt := time.Since(start)
+	if response, err = pluginsState.ApplyResponsePlugins(&proxy.pluginsGlobals, response, nil); err != nil {
+		return err
+	}
+	fmt.Printf("RTT:            %dms\n", rtt.Nanoseconds()/1000000)
+
+	responseMsg := dns.Msg{}
+	if err := responseMsg.Unpack(response); err != nil {
+		return err
+	}
+	fmt.Printf("Response code:  %s\n", dns.RcodeToString[responseMsg.Rcode])
+	fmt.Printf("DNSSEC:         %v\n", responseMsg.AuthenticatedData)
+	fmt.Println("")
+	if len(responseMsg.Answer) == 0 {
+		fmt.Println("No records in the answer section")
+	}
+	for _, rr := range responseMsg.Answer {
+		fmt.Println(rr.String())
+	}
+	fmt.Println("")
+	return nil
+}
+
+// resolveServer returns the server to send a diagnostic query to; if no server name is given,
+// it is chosen the same way as for regular queries
+func resolveServer(proxy *Proxy, serverName string, candidates []string) (*ServerInfo, error) {
+	if len(serverName) == 0 {
+		if _, err := proxy.serversInfo.refresh(proxy); err != nil && proxy.serversInfo.liveServers() == 0 {
+			return nil, err
+		}
+		var serverInfo *ServerInfo
+		if len(candidates) > 0 {
+			serverInfo = proxy.serversInfo.getOneOf(candidates)
+		} else {
+			serverInfo = proxy.serversInfo.getOne()
+		}
+		if serverInfo == nil {
+			return nil, errors.New("No live servers available")
+		}
+		return serverInfo, nil
+	}
+	var stamp *stamps.ServerStamp
+	if strings.HasPrefix(serverName, "sdns:") {
+		serverStamp, err := stamps.NewServerStampFromString(serverName)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid stamp [%s]: %v", serverName, err)
+		}
+		stamp, serverName = &serverStamp, "command-line"
+	} else {
+		for _, registeredServer := range proxy.registeredServers {
+			if registeredServer.name == serverName {
+				stamp = &registeredServer.stamp
+				break
+			}
+		}
+		if stamp == nil {
+			return nil, fmt.Errorf("Server [%s] not found -- Use -list-all to print the names of the available servers", serverName)
+		}
+	}
+	if err := proxy.serversInfo.refreshServer(proxy, serverName, *stamp); err != nil {
+		return nil, fmt.Errorf("Unable to use [%s]: %v", serverName, err)
+	}
+	serverInfo := proxy.serversInfo.getOneOf([]string{serverName})
+	if serverInfo == nil {
+		return nil, fmt.Errorf("Server [%s] is not available", serverName)
+	}
+	return serverInfo, nil
+}
@@ -0,0 +1,3 @@
+package proxy
+
+const soReusePort = 0x200
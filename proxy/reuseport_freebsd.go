@@ -0,0 +1,4 @@
+package proxy
+
+// SO_REUSEPORT_LB (FreeBSD 12+) balances datagrams among the sockets, unlike SO_REUSEPORT
+const soReusePort = 0x00010000
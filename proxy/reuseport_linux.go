@@ -0,0 +1,6 @@
+// +build linux,!mips,!mipsle,!mips64,!mips64le
+
+package proxy
+
+// SO_REUSEPORT is not defined by the syscall package on Linux
+const soReusePort = 0xf
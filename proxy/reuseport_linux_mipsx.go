@@ -0,0 +1,5 @@
+// +build linux,mips linux,mipsle linux,mips64 linux,mips64le
+
+package proxy
+
+const soReusePort = 0x200
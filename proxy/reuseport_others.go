@@ -0,0 +1,14 @@
+// +build !linux,!freebsd,!dragonfly
+
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+const reusePortSupported = false
+
+func listenUDPReusePort(listenAddr *net.UDPAddr, ipv6Only bool, freebind bool) (*net.UDPConn, error) {
+	return nil, errors.New("Load balancing with SO_REUSEPORT is not supported on this platform")
+}
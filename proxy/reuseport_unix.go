@@ -0,0 +1,70 @@
+// +build linux freebsd dragonfly
+
+package proxy
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+const reusePortSupported = true
+
+// socketAddress returns the family and the address of a socket to bind to an IP address
+func socketAddress(ip net.IP, port int, zone string) (int, syscall.Sockaddr) {
+	if ip4 := ip.To4(); ip == nil || ip4 != nil {
+		sockaddr4 := &syscall.SockaddrInet4{Port: port}
+		copy(sockaddr4.Addr[:], ip4)
+		return syscall.AF_INET, sockaddr4
+	}
+	sockaddr6 := &syscall.SockaddrInet6{Port: port}
+	copy(sockaddr6.Addr[:], ip.To16())
+	if len(zone) > 0 {
+		if iface, err := net.InterfaceByName(zone); err == nil {
+			sockaddr6.ZoneId = uint32(iface.Index)
+		}
+	}
+	return syscall.AF_INET6, sockaddr6
+}
+
+// listenUDPReusePort creates a UDP socket that can be bound to the same address as other
+// sockets of the same user, so that the kernel spreads the incoming datagrams among them.
+// Other BSDs and macOS support SO_REUSEPORT, but deliver all the datagrams to a single socket.
+// IPv6 sockets also accept IPv4 datagrams, unless ipv6Only is set. With freebind, the address
+// doesn't have to be assigned to an interface yet.
+func listenUDPReusePort(listenAddr *net.UDPAddr, ipv6Only bool, freebind bool) (*net.UDPConn, error) {
+	family, sockaddr := socketAddress(listenAddr.IP, listenAddr.Port, listenAddr.Zone)
+	fd, err := syscall.Socket(family, syscall.SOCK_DGRAM, syscall.IPPROTO_UDP)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	syscall.CloseOnExec(fd)
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, soReusePort, 1); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+	if freebind {
+		if err := setFreebind(fd, family); err != nil {
+			syscall.Close(fd)
+			return nil, os.NewSyscallError("setsockopt", err)
+		}
+	}
+	if family == syscall.AF_INET6 {
+		v6Only := 0
+		if ipv6Only {
+			v6Only = 1
+		}
+		syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, v6Only)
+	}
+	if err := syscall.Bind(fd, sockaddr); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	file := os.NewFile(uintptr(fd), listenAddr.String())
+	defer file.Close()
+	pc, err := net.FilePacketConn(file)
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
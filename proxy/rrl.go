@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+const (
+	RRLMaxEntries              = 16384
+	DefaultRRLSlip             = 2
+	DefaultRRLIPv4PrefixLength = 24
+	DefaultRRLIPv6PrefixLength = 56
+	RRLLogInterval             = time.Minute
+)
+
+// ResponseRateLimiter limits the rate of identical UDP responses sent to a network, so that the
+// proxy can't be used to flood a victim whose address was spoofed, if it is reachable from the
+// Internet. Legitimate clients sharing that network still get a truncated response every `slip`
+// dropped responses, and retry over TCP, that can't be spoofed.
+type ResponseRateLimiter struct {
+	sync.Mutex
+	buckets  *lru.Cache
+	rate     float64
+	burst    float64
+	slip     int
+	leak     int
+	ipv4Mask net.IPMask
+	ipv6Mask net.IPMask
+	lastLog  time.Time
+	limited  uint64
+}
+
+type rrlBucket struct {
+	tokens     float64
+	lastUpdate time.Time
+	limited    int
+}
+
+func NewResponseRateLimiter(config ResponseRateLimitConfig) (*ResponseRateLimiter, error) {
+	buckets, err := lru.New(RRLMaxEntries)
+	if err != nil {
+		return nil, err
+	}
+	rrl := ResponseRateLimiter{
+		buckets:  buckets,
+		rate:     float64(config.ResponsesPerSecond),
+		burst:    float64(Max(config.ResponsesPerSecond, config.Burst)),
+		slip:     DefaultRRLSlip,
+		leak:     config.Leak,
+		ipv4Mask: net.CIDRMask(DefaultRRLIPv4PrefixLength, 32),
+		ipv6Mask: net.CIDRMask(DefaultRRLIPv6PrefixLength, 128),
+	}
+	if config.Slip != nil {
+		rrl.slip = *config.Slip
+	}
+	if config.IPv4PrefixLength > 0 {
+		rrl.ipv4Mask = net.CIDRMask(Min(config.IPv4PrefixLength, 32), 32)
+	}
+	if config.IPv6PrefixLength > 0 {
+		rrl.ipv6Mask = net.CIDRMask(Min(config.IPv6PrefixLength, 128), 128)
+	}
+	return &rrl, nil
+}
+
+// key identifies the responses that are counted together: same client network, and same
+// question for positive responses. Errors and NXDOMAIN responses are counted together whatever
+// the name is, so that queries for random names don't bypass the limit.
+func (rrl *ResponseRateLimiter) key(response []byte, clientAddr net.Addr) (string, string, bool) {
+	var ip net.IP
+	switch addr := clientAddr.(type) {
+	case *net.UDPAddr:
+		ip = addr.IP
+	default:
+		return "", "", false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4.Mask(rrl.ipv4Mask)
+	} else {
+		ip = ip.Mask(rrl.ipv6Mask)
+	}
+	end, err := questionEnd(response)
+	if err != nil {
+		return "", "", false
+	}
+	network := ip.String()
+	rcode := int(response[3] & 0x0f)
+	key := network + "/" + strconv.Itoa(rcode)
+	if rcode == dns.RcodeSuccess {
+		key += "/" + string(bytes.ToLower(response[12:end]))
+	}
+	return key, network, true
+}
+
+// limit returns the response to send, a truncated response, or nil if nothing has to be sent
+func (rrl *ResponseRateLimiter) limit(response []byte, clientAddr net.Addr) []byte {
+	key, network, ok := rrl.key(response, clientAddr)
+	if !ok {
+		return response
+	}
+	now := time.Now()
+	rrl.Lock()
+	defer rrl.Unlock()
+	var bucket *rrlBucket
+	if xbucket, ok := rrl.buckets.Get(key); ok {
+		bucket = xbucket.(*rrlBucket)
+		elapsed := now.Sub(bucket.lastUpdate).Seconds()
+		bucket.tokens = MinF(rrl.burst, bucket.tokens+elapsed*rrl.rate)
+		bucket.lastUpdate = now
+	} else {
+		bucket = &rrlBucket{tokens: rrl.burst, lastUpdate: now}
+		rrl.buckets.Add(key, bucket)
+	}
+	if bucket.tokens >= 1.0 {
+		bucket.tokens -= 1.0
+		bucket.limited = 0
+		return response
+	}
+	bucket.limited++
+	rrl.limited++
+	if now.Sub(rrl.lastLog) >= RRLLogInterval {
+		dlog.Warnf("Response rate limit exceeded for network [%s] -- %d responses dropped or truncated so far", network, rrl.limited)
+		rrl.lastLog = now
+	}
+	if rrl.leak > 0 && bucket.limited%rrl.leak == 0 {
+		return response
+	}
+	if rrl.slip > 0 && bucket.limited%rrl.slip == 0 {
+		truncated, err := TruncatedResponse(response)
+		if err != nil {
+			return nil
+		}
+		return truncated
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/jedisct1/dnscrypt-proxy/internal/zstd"
+)
+
+const (
+	// Upper bound for the decompressed size of a rule file, as a defense against decompression bombs
+	MaxRuleFileSize = 1 << 30
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// ReadRuleFile reads a file containing rules, that can be gzip or zstd-compressed
+func ReadRuleFile(file string) ([]byte, error) {
+	fp, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	bin, err := readRules(bufio.NewReader(fp))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return bin, nil
+}
+
+// DecompressRules returns the content of rules that may have been downloaded compressed
+func DecompressRules(bin []byte) ([]byte, error) {
+	return readRules(bufio.NewReader(bytes.NewReader(bin)))
+}
+
+func readRules(reader *bufio.Reader) ([]byte, error) {
+	magic, _ := reader.Peek(len(zstdMagic))
+	var in io.Reader = reader
+	if bytes.HasPrefix(magic, gzipMagic) {
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		defer gzipReader.Close()
+		in = gzipReader
+	} else if bytes.HasPrefix(magic, zstdMagic) {
+		in = zstd.NewReader(reader)
+	}
+	bin, err := ioutil.ReadAll(io.LimitReader(in, MaxRuleFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(bin) > MaxRuleFileSize {
+		return nil, errors.New("Rules are too large")
+	}
+	return bin, nil
+}
@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	// Interval between checks of the rule files, when they can't be watched
+	RuleFilesPollInterval = 2 * time.Second
+	// Rules are reloaded once the files haven't changed for that long
+	RuleFilesSettleDelay = 500 * time.Millisecond
+)
+
+// ruleFiles returns the files the plugins load rules from
+func (proxy *Proxy) ruleFiles() []string {
+	proxy.reloadLock.Lock()
+	defer proxy.reloadLock.Unlock()
+	files := []string{
+		proxy.blockNameFile, proxy.whitelistNameFile, proxy.blockIPFile, proxy.forwardFile,
+		proxy.cloakFile, proxy.ttlRulesFile, proxy.captivePortalFile, proxy.clientHintsFile,
+	}
+	for _, file := range proxy.localZones {
+		files = append(files, file)
+	}
+	for _, groupConfig := range proxy.clientGroupsConfig {
+		files = append(files, groupConfig.BlacklistFile)
+	}
+	return absPaths(files)
+}
+
+// watchRuleFiles reloads the rules as soon as one of the rule files changes, without reading the
+// configuration file again
+func (proxy *Proxy) watchRuleFiles() {
+	current := &currentRuleFilesWatcher{}
+	proxy.trackListener(current)
+	go func() {
+		for {
+			files := proxy.ruleFiles()
+			if len(files) == 0 {
+				return
+			}
+			watcher, err := newRuleFilesWatcher(files)
+			if err != nil {
+				dlog.Debugf("Unable to watch the rule files, checking them every %v instead: %v", RuleFilesPollInterval, err)
+				watcher = newRuleFilesPoller(files)
+			}
+			if !current.set(watcher) {
+				return
+			}
+			changed := watcher.Wait()
+			watcher.Close()
+			if atomic.LoadInt32(&proxy.stopping) != 0 {
+				return
+			}
+			if len(changed) == 0 {
+				continue
+			}
+			dlog.Debugf("[%s] changed", changed)
+			waitForSettledFiles(files)
+			dlog.Noticef("Rule files changed, reloading the rules")
+			if err := proxy.ReloadRules(); err != nil {
+				dlog.Errorf("Rules not reloaded: %v", err)
+				continue
+			}
+			dlog.Notice("Rules reloaded")
+		}
+	}()
+}
+
+// RuleFilesWatcher waits for a change to one of the rule files
+type RuleFilesWatcher interface {
+	// Wait blocks until a file changes, and returns its name, or returns an empty string once
+	// the watcher has been closed
+	Wait() string
+	Close() error
+}
+
+// currentRuleFilesWatcher closes the watcher in use when the proxy shuts down
+type currentRuleFilesWatcher struct {
+	sync.Mutex
+	watcher RuleFilesWatcher
+	closed  bool
+}
+
+func (current *currentRuleFilesWatcher) set(watcher RuleFilesWatcher) bool {
+	current.Lock()
+	defer current.Unlock()
+	if current.closed {
+		watcher.Close()
+		return false
+	}
+	current.watcher = watcher
+	return true
+}
+
+func (current *currentRuleFilesWatcher) Close() error {
+	current.Lock()
+	defer current.Unlock()
+	current.closed = true
+	if current.watcher != nil {
+		return current.watcher.Close()
+	}
+	return nil
+}
+
+type fileState struct {
+	size    int64
+	modTime time.Time
+	exists  bool
+}
+
+func statFiles(files []string) map[string]fileState {
+	states := make(map[string]fileState, len(files))
+	for _, file := range files {
+		if fi, err := os.Stat(file); err == nil {
+			states[file] = fileState{size: fi.Size(), modTime: fi.ModTime(), exists: true}
+		} else {
+			states[file] = fileState{}
+		}
+	}
+	return states
+}
+
+// changedFile returns the name of a file whose state differs between two snapshots
+func changedFile(files []string, previous map[string]fileState, current map[string]fileState) string {
+	for _, file := range files {
+		if previous[file] != current[file] {
+			return file
+		}
+	}
+	return ""
+}
+
+// waitForSettledFiles returns once the files haven't changed for RuleFilesSettleDelay, as they
+// are often written in several steps
+func waitForSettledFiles(files []string) {
+	states := statFiles(files)
+	for {
+		time.Sleep(RuleFilesSettleDelay)
+		current := statFiles(files)
+		if len(changedFile(files, states, current)) == 0 {
+			return
+		}
+		states = current
+	}
+}
+
+// RuleFilesPoller checks the size and modification time of the rule files at regular intervals
+type RuleFilesPoller struct {
+	files     []string
+	states    map[string]fileState
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+func newRuleFilesPoller(files []string) *RuleFilesPoller {
+	return &RuleFilesPoller{files: files, states: statFiles(files), stop: make(chan struct{})}
+}
+
+func (poller *RuleFilesPoller) Wait() string {
+	for {
+		select {
+		case <-poller.stop:
+			return ""
+		case <-time.After(RuleFilesPollInterval):
+		}
+		current := statFiles(poller.files)
+		if changed := changedFile(poller.files, poller.states, current); len(changed) > 0 {
+			poller.states = current
+			return changed
+		}
+	}
+}
+
+func (poller *RuleFilesPoller) Close() error {
+	poller.closeOnce.Do(func() { close(poller.stop) })
+	return nil
+}
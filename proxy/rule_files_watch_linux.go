@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+const ruleFilesWatchMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_CREATE | syscall.IN_DELETE
+
+// RuleFilesInotify watches the directories of the rule files with inotify, so that files
+// replaced by renaming a new version over them are noticed as well
+type RuleFilesInotify struct {
+	fp    *os.File
+	names map[int32]map[string]bool
+}
+
+func newRuleFilesWatcher(files []string) (RuleFilesWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	watcher := RuleFilesInotify{names: make(map[int32]map[string]bool)}
+	wds := make(map[string]int32)
+	for _, file := range files {
+		dir := filepath.Dir(file)
+		wd, ok := wds[dir]
+		if !ok {
+			wdInt, err := syscall.InotifyAddWatch(fd, dir, ruleFilesWatchMask)
+			if err != nil {
+				syscall.Close(fd)
+				return nil, err
+			}
+			wd = int32(wdInt)
+			wds[dir] = wd
+			watcher.names[wd] = make(map[string]bool)
+		}
+		watcher.names[wd][filepath.Base(file)] = true
+	}
+	// The file is non-blocking, so that reads go through the runtime poller and are
+	// interrupted when the file is closed
+	watcher.fp = os.NewFile(uintptr(fd), "inotify")
+	return &watcher, nil
+}
+
+func (watcher *RuleFilesInotify) Wait() string {
+	var buf [syscall.SizeofInotifyEvent * 64]byte
+	for {
+		n, err := watcher.fp.Read(buf[:])
+		if err != nil {
+			return ""
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBin := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+			name := string(nameBin)
+			for len(name) > 0 && name[len(name)-1] == 0 {
+				name = name[:len(name)-1]
+			}
+			if watcher.names[event.Wd][name] {
+				return name
+			}
+		}
+	}
+}
+
+func (watcher *RuleFilesInotify) Close() error {
+	return watcher.fp.Close()
+}
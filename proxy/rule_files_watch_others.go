@@ -0,0 +1,9 @@
+// +build !linux
+
+package proxy
+
+import "errors"
+
+func newRuleFilesWatcher(files []string) (RuleFilesWatcher, error) {
+	return nil, errors.New("Not supported on this platform")
+}
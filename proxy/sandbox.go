@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"path/filepath"
+)
+
+// sandboxPaths returns the paths the proxy may have to read or write once it is running.
+// Rule files can be loaded again on reload; log and cache files are written to.
+func (proxy *Proxy) sandboxPaths() (readPaths []string, writePaths []string) {
+	readPaths = []string{
+		proxy.blockNameFile, proxy.whitelistNameFile, proxy.blockIPFile, proxy.forwardFile,
+		proxy.cloakFile, proxy.ttlRulesFile, proxy.captivePortalFile, proxy.scriptFile,
+		proxy.dnssecTrustAnchorsFile, proxy.clientHintsFile,
+	}
+	if proxy.forwardSearchDomains {
+		readPaths = append(readPaths, proxy.searchDomainsResolvConf)
+	}
+	for _, file := range proxy.localZones {
+		readPaths = append(readPaths, file)
+	}
+	writePaths = []string{
+		proxy.queryLogFile, proxy.nxLogFile, proxy.blockNameLogFile, proxy.whitelistNameLogFile,
+		proxy.blockIPLogFile, proxy.blockNameCacheFile, proxy.controlSocket, proxy.stateDir,
+	}
+	for _, groupConfig := range proxy.clientGroupsConfig {
+		writePaths = append(writePaths, groupConfig.QueryLogFile)
+	}
+	if proxy.certLog != nil && (len(proxy.stateDir) == 0 || filepath.IsAbs(proxy.certLog.file)) {
+		// Relative paths are otherwise covered by the state directory
+		writePaths = append(writePaths, proxy.certLog.file)
+	}
+	if proxy.certClock != nil {
+		writePaths = append(writePaths, proxy.certClock.cacheFile)
+	}
+	if spoolFile := proxy.queryLogRemote.SpoolFile; len(spoolFile) > 0 {
+		// The spool file is replaced and removed, not only written to
+		writePaths = append(writePaths, filepath.Dir(spoolFile))
+	}
+	if len(proxy.queryLogFile) > 0 && proxy.queryLogFile != "-" && proxy.queryLogRetention > 0 {
+		// Rotated query log files are rewritten and removed by the retention job, and
+		// counts are appended to the aggregate file
+		writePaths = append(writePaths, filepath.Dir(proxy.queryLogFile), proxy.queryLogAggregateFile)
+	}
+	if proxy.dnscryptServer != nil {
+		writePaths = append(writePaths, proxy.dnscryptServer.keysFile)
+	}
+	if len(proxy.cacheSnapshotFile) > 0 {
+		// The snapshot is replaced atomically, through a temporary file
+		writePaths = append(writePaths, filepath.Dir(proxy.cacheSnapshotFile))
+	}
+	if len(proxy.crashReportFile) > 0 {
+		// The report is written atomically, through a temporary file
+		writePaths = append(writePaths, filepath.Dir(proxy.crashReportFile))
+	}
+	if proxy.auditLog != nil {
+		// Rotated files are created next to the audit log
+		writePaths = append(writePaths, filepath.Dir(proxy.config.AuditLog.File))
+	}
+	if len(proxy.configFile) > 0 {
+		// Sources are cached in the directory of the configuration file by default
+		writePaths = append(writePaths, filepath.Dir(proxy.configFile))
+	}
+	if config := proxy.config; config != nil {
+		readPaths = append(readPaths, config.Include...)
+		readPaths = append(readPaths, config.ServerLocation.Database, config.CacheWarmFile)
+		if config.LogFile != nil {
+			writePaths = append(writePaths, *config.LogFile)
+		}
+		writePaths = append(writePaths, config.SourcesCacheDir)
+		for _, cfgSource := range config.SourcesConfig {
+			writePaths = append(writePaths, cfgSource.CacheFile)
+		}
+	}
+	return absPaths(readPaths), absPaths(writePaths)
+}
+
+func absPaths(paths []string) []string {
+	var abs []string
+	for _, path := range paths {
+		if len(path) == 0 || path == "-" {
+			continue
+		}
+		if absPath, err := filepath.Abs(path); err == nil {
+			abs = append(abs, absPath)
+		}
+	}
+	return abs
+}
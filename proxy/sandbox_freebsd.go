@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	sysCapRightsLimit = 533
+
+	capRead        = 0x200000000000001
+	capWrite       = 0x200000000000002
+	capFcntl       = 0x200000000008000
+	capFstat       = 0x200000000080000
+	capAccept      = 0x200000020000000
+	capGetpeername = 0x200000100000000
+	capGetsockname = 0x200000200000000
+	capGetsockopt  = 0x200000400000000
+	capSetsockopt  = 0x200002000000000
+	capShutdown    = 0x200004000000000
+	capEvent       = 0x400000000000020
+)
+
+// The process doesn't enter capability mode, so commands can still be executed
+const sandboxForbidsExec = false
+
+// Sandbox limits what can be done with the listening sockets to what is needed to serve queries
+// with Capsicum: they can't be connected, bound again or used to send data to arbitrary
+// addresses other than the clients. Sockets accepted from a TCP or Unix listener inherit its
+// rights.
+// The process doesn't enter capability mode, as it forbids connecting to addresses that are not
+// known in advance, which the proxy needs for every new connection to a server, and opening
+// files by path, which reloading rule files needs.
+func (proxy *Proxy) Sandbox() error {
+	proxy.activeListenersLock.Lock()
+	defer proxy.activeListenersLock.Unlock()
+	for _, listener := range proxy.activeListeners {
+		rights := []uint64{capRead, capWrite, capEvent, capFcntl, capFstat, capGetsockname, capGetsockopt, capSetsockopt}
+		switch listener.(type) {
+		case *net.TCPListener, *net.UnixListener:
+			rights = append(rights, capAccept, capShutdown, capGetpeername)
+		}
+		conn, ok := listener.(syscall.Conn)
+		if !ok {
+			continue
+		}
+		rawConn, err := conn.SyscallConn()
+		if err != nil {
+			return err
+		}
+		var limitErr error
+		if err := rawConn.Control(func(fd uintptr) {
+			limitErr = capRightsLimit(fd, rights)
+		}); err != nil {
+			return err
+		}
+		if limitErr != nil {
+			return limitErr
+		}
+	}
+	return nil
+}
+
+func capRightsLimit(fd uintptr, rights []uint64) error {
+	capRights := [2]uint64{1 << 57, 1 << 58}
+	for _, right := range rights {
+		index := ((right >> 57) & 0x1f) >> 1
+		capRights[index] |= right
+	}
+	if _, _, rcode := syscall.Syscall(sysCapRightsLimit, fd, uintptr(unsafe.Pointer(&capRights)), 0); rcode != 0 {
+		return rcode
+	}
+	return nil
+}
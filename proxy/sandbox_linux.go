@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"errors"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	prSetNoNewPrivs        = 38
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTsync = 1
+	seccompRetAllow        = 0x7fff0000
+	seccompRetErrno        = 0x00050000
+	seccompDataNrOffset    = 0
+	seccompDataArchOffset  = 4
+)
+
+// Commands can't be executed once the sandbox is enabled
+const sandboxForbidsExec = true
+
+// System calls the proxy and the Go runtime need once the proxy is running, on every
+// architecture. Anything else, including execve, ptrace, mount, bpf, unshare, setns and module
+// loading, fails with EPERM.
+var sandboxAllowedSyscalls = []uintptr{
+	// Memory, threads and signals
+	syscall.SYS_BRK,
+	syscall.SYS_MMAP,
+	syscall.SYS_MUNMAP,
+	syscall.SYS_MPROTECT,
+	syscall.SYS_MREMAP,
+	syscall.SYS_MADVISE,
+	syscall.SYS_MINCORE,
+	syscall.SYS_CLONE,
+	syscall.SYS_EXIT,
+	syscall.SYS_EXIT_GROUP,
+	syscall.SYS_FUTEX,
+	syscall.SYS_SET_ROBUST_LIST,
+	syscall.SYS_SET_TID_ADDRESS,
+	syscall.SYS_SCHED_YIELD,
+	syscall.SYS_SCHED_GETAFFINITY,
+	syscall.SYS_GETTID,
+	syscall.SYS_GETPID,
+	syscall.SYS_GETPPID,
+	syscall.SYS_KILL,
+	syscall.SYS_TKILL,
+	syscall.SYS_TGKILL,
+	syscall.SYS_RT_SIGACTION,
+	syscall.SYS_RT_SIGPROCMASK,
+	syscall.SYS_RT_SIGRETURN,
+	syscall.SYS_RT_SIGTIMEDWAIT,
+	syscall.SYS_SIGALTSTACK,
+	syscall.SYS_RESTART_SYSCALL,
+	syscall.SYS_WAIT4,
+	syscall.SYS_WAITID,
+
+	// Time
+	syscall.SYS_NANOSLEEP,
+	syscall.SYS_CLOCK_GETTIME,
+	syscall.SYS_CLOCK_GETRES,
+	syscall.SYS_CLOCK_NANOSLEEP,
+	syscall.SYS_GETTIMEOFDAY,
+	syscall.SYS_SETITIMER,
+	syscall.SYS_GETITIMER,
+	syscall.SYS_TIMER_CREATE,
+	syscall.SYS_TIMER_SETTIME,
+	syscall.SYS_TIMER_DELETE,
+
+	// Polling
+	syscall.SYS_EPOLL_CREATE1,
+	syscall.SYS_EPOLL_CTL,
+	syscall.SYS_EPOLL_PWAIT,
+	syscall.SYS_EVENTFD2,
+	syscall.SYS_PIPE2,
+	syscall.SYS_PPOLL,
+	syscall.SYS_PSELECT6,
+
+	// Descriptors and files
+	syscall.SYS_READ,
+	syscall.SYS_WRITE,
+	syscall.SYS_READV,
+	syscall.SYS_WRITEV,
+	syscall.SYS_PREAD64,
+	syscall.SYS_PWRITE64,
+	syscall.SYS_CLOSE,
+	syscall.SYS_DUP,
+	syscall.SYS_DUP3,
+	syscall.SYS_FCNTL,
+	syscall.SYS_IOCTL,
+	syscall.SYS_FLOCK,
+	syscall.SYS_LSEEK,
+	syscall.SYS_OPENAT,
+	syscall.SYS_FSTAT,
+	syscall.SYS_FSTATFS,
+	syscall.SYS_STATFS,
+	syscall.SYS_FSYNC,
+	syscall.SYS_FDATASYNC,
+	syscall.SYS_FTRUNCATE,
+	syscall.SYS_GETDENTS64,
+	syscall.SYS_READLINKAT,
+	syscall.SYS_FACCESSAT,
+	syscall.SYS_RENAMEAT,
+	syscall.SYS_UNLINKAT,
+	syscall.SYS_MKDIRAT,
+	syscall.SYS_FCHMOD,
+	syscall.SYS_FCHMODAT,
+	syscall.SYS_FCHOWN,
+	syscall.SYS_FCHOWNAT,
+	syscall.SYS_UTIMENSAT,
+	syscall.SYS_SENDFILE,
+	syscall.SYS_SPLICE,
+	syscall.SYS_GETCWD,
+	syscall.SYS_UMASK,
+	syscall.SYS_INOTIFY_INIT1,
+	syscall.SYS_INOTIFY_ADD_WATCH,
+	syscall.SYS_INOTIFY_RM_WATCH,
+	syscall.SYS_RECVMMSG,
+
+	// Process information
+	syscall.SYS_UNAME,
+	syscall.SYS_SYSINFO,
+	syscall.SYS_GETRUSAGE,
+	syscall.SYS_GETRLIMIT,
+	syscall.SYS_PRLIMIT64,
+	syscall.SYS_GETUID,
+	syscall.SYS_GETEUID,
+	syscall.SYS_GETGID,
+	syscall.SYS_GETEGID,
+
+	// Numbers shared by all architectures, missing from the syscall package
+	sysPidfdSendSignal,
+	sysFaccessat2,
+}
+
+const (
+	sysPidfdSendSignal = 424
+	sysFaccessat2      = 439
+)
+
+// Sandbox installs a seccomp-bpf filter on all the threads of the process, that only allows the
+// system calls listed in sandboxAllowedSyscalls and seccompArchAllowedSyscalls. Other system
+// calls fail with EPERM rather than killing the process, so that a call made by a new version of
+// the Go runtime and missing from the list is reported as an error.
+func (proxy *Proxy) Sandbox() error {
+	if seccompAuditArch == 0 {
+		return errors.New("Sandboxing is not supported on this architecture")
+	}
+	var filter []syscall.SockFilter
+	// Only filter system calls of the native architecture; their numbers would be different otherwise
+	filter = append(filter,
+		syscall.SockFilter{Code: syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS, K: seccompDataArchOffset},
+		syscall.SockFilter{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, Jt: 1, Jf: 0, K: seccompAuditArch},
+		syscall.SockFilter{Code: syscall.BPF_RET | syscall.BPF_K, K: seccompRetErrno | uint32(syscall.EPERM)},
+		syscall.SockFilter{Code: syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS, K: seccompDataNrOffset},
+	)
+	for _, nr := range append(sandboxAllowedSyscalls, seccompArchAllowedSyscalls...) {
+		filter = append(filter,
+			syscall.SockFilter{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, Jt: 0, Jf: 1, K: uint32(nr)},
+			syscall.SockFilter{Code: syscall.BPF_RET | syscall.BPF_K, K: seccompRetAllow},
+		)
+	}
+	filter = append(filter, syscall.SockFilter{Code: syscall.BPF_RET | syscall.BPF_K, K: seccompRetErrno | uint32(syscall.EPERM)})
+	prog := syscall.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+
+	if _, _, rcode := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); rcode != 0 {
+		return rcode
+	}
+	if _, _, rcode := syscall.RawSyscall(seccompSyscall, seccompSetModeFilter, seccompFilterFlagTsync, uintptr(unsafe.Pointer(&prog))); rcode != 0 {
+		return rcode
+	}
+	return nil
+}
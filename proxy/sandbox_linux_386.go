@@ -0,0 +1,57 @@
+package proxy
+
+import "syscall"
+
+const (
+	seccompAuditArch = 0x40000003
+	seccompSyscall   = 354
+)
+
+var seccompArchAllowedSyscalls = []uintptr{
+	syscall.SYS_SET_THREAD_AREA,
+	syscall.SYS_SIGRETURN,
+	syscall.SYS_MMAP2,
+	syscall.SYS_TIME,
+	syscall.SYS_EPOLL_CREATE,
+	syscall.SYS_EPOLL_WAIT,
+	syscall.SYS_POLL,
+	syscall.SYS_SELECT,
+	syscall.SYS__NEWSELECT,
+	syscall.SYS_PIPE,
+	syscall.SYS_DUP2,
+	syscall.SYS_FCNTL64,
+	syscall.SYS__LLSEEK,
+	syscall.SYS_OPEN,
+	syscall.SYS_STAT,
+	syscall.SYS_LSTAT,
+	syscall.SYS_STAT64,
+	syscall.SYS_LSTAT64,
+	syscall.SYS_FSTAT64,
+	syscall.SYS_FSTATAT64,
+	syscall.SYS_STATFS64,
+	syscall.SYS_FSTATFS64,
+	syscall.SYS_FTRUNCATE64,
+	syscall.SYS_FCHOWN32,
+	syscall.SYS_SENDFILE64,
+	syscall.SYS_ACCESS,
+	syscall.SYS_GETDENTS,
+	syscall.SYS_READLINK,
+	syscall.SYS_RENAME,
+	syscall.SYS_UNLINK,
+	syscall.SYS_MKDIR,
+	syscall.SYS_CHMOD,
+	syscall.SYS_UGETRLIMIT,
+	syscall.SYS_GETUID32,
+	syscall.SYS_GETEUID32,
+	syscall.SYS_GETGID32,
+	syscall.SYS_GETEGID32,
+	// All the socket operations go through socketcall(2)
+	syscall.SYS_SOCKETCALL,
+	345, // sendmmsg
+	355, // getrandom
+	377, // copy_file_range
+	383, // statx
+	403, // clock_gettime64
+	407, // clock_nanosleep_time64
+	422, // futex_time64
+}
@@ -0,0 +1,51 @@
+package proxy
+
+import "syscall"
+
+const (
+	seccompAuditArch = 0xc000003e
+	seccompSyscall   = 317
+)
+
+var seccompArchAllowedSyscalls = []uintptr{
+	syscall.SYS_ARCH_PRCTL,
+	syscall.SYS_SET_THREAD_AREA,
+	syscall.SYS_TIME,
+	syscall.SYS_EPOLL_CREATE,
+	syscall.SYS_EPOLL_WAIT,
+	syscall.SYS_POLL,
+	syscall.SYS_SELECT,
+	syscall.SYS_PIPE,
+	syscall.SYS_DUP2,
+	syscall.SYS_OPEN,
+	syscall.SYS_STAT,
+	syscall.SYS_LSTAT,
+	syscall.SYS_NEWFSTATAT,
+	syscall.SYS_ACCESS,
+	syscall.SYS_GETDENTS,
+	syscall.SYS_READLINK,
+	syscall.SYS_RENAME,
+	syscall.SYS_UNLINK,
+	syscall.SYS_MKDIR,
+	syscall.SYS_CHMOD,
+	syscall.SYS_SOCKET,
+	syscall.SYS_SOCKETPAIR,
+	syscall.SYS_CONNECT,
+	syscall.SYS_BIND,
+	syscall.SYS_LISTEN,
+	syscall.SYS_ACCEPT,
+	syscall.SYS_ACCEPT4,
+	syscall.SYS_GETSOCKNAME,
+	syscall.SYS_GETPEERNAME,
+	syscall.SYS_SETSOCKOPT,
+	syscall.SYS_GETSOCKOPT,
+	syscall.SYS_SENDTO,
+	syscall.SYS_RECVFROM,
+	syscall.SYS_SENDMSG,
+	syscall.SYS_RECVMSG,
+	syscall.SYS_SHUTDOWN,
+	307, // sendmmsg
+	318, // getrandom
+	326, // copy_file_range
+	332, // statx
+}
@@ -0,0 +1,33 @@
+package proxy
+
+import "syscall"
+
+const (
+	seccompAuditArch = 0xc00000b7
+	seccompSyscall   = 277
+)
+
+var seccompArchAllowedSyscalls = []uintptr{
+	syscall.SYS_FSTATAT,
+	syscall.SYS_RENAMEAT2,
+	syscall.SYS_GETRANDOM,
+	syscall.SYS_SOCKET,
+	syscall.SYS_SOCKETPAIR,
+	syscall.SYS_CONNECT,
+	syscall.SYS_BIND,
+	syscall.SYS_LISTEN,
+	syscall.SYS_ACCEPT,
+	syscall.SYS_ACCEPT4,
+	syscall.SYS_GETSOCKNAME,
+	syscall.SYS_GETPEERNAME,
+	syscall.SYS_SETSOCKOPT,
+	syscall.SYS_GETSOCKOPT,
+	syscall.SYS_SENDTO,
+	syscall.SYS_SENDMSG,
+	syscall.SYS_SENDMMSG,
+	syscall.SYS_RECVFROM,
+	syscall.SYS_RECVMSG,
+	syscall.SYS_SHUTDOWN,
+	285, // copy_file_range
+	291, // statx
+}
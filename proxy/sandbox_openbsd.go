@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"syscall"
+	"unsafe"
+
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	sysPledge = 108
+	sysUnveil = 114
+)
+
+// Commands can't be executed once the sandbox is enabled
+const sandboxForbidsExec = true
+
+// Sandbox restricts the filesystem view of the process to the paths it needs with unveil(2),
+// and the system calls it can make with pledge(2)
+func (proxy *Proxy) Sandbox() error {
+	readPaths, writePaths := proxy.sandboxPaths()
+	readPaths = append(readPaths, "/etc/resolv.conf", "/etc/hosts", "/etc/ssl", "/usr/share/zoneinfo")
+	for _, path := range readPaths {
+		if err := unveil(path, "r"); err != nil {
+			dlog.Debugf("Unable to unveil [%s]: %v", path, err)
+		}
+	}
+	for _, path := range writePaths {
+		if err := unveil(path, "rwc"); err != nil {
+			dlog.Debugf("Unable to unveil [%s]: %v", path, err)
+		}
+	}
+	if err := unveil("", ""); err != nil {
+		return err
+	}
+	return pledge("stdio rpath wpath cpath flock inet dns unix")
+}
+
+func unveil(path string, permissions string) error {
+	var pathPtr, permissionsPtr *byte
+	var err error
+	if len(path) > 0 {
+		if pathPtr, err = syscall.BytePtrFromString(path); err != nil {
+			return err
+		}
+		if permissionsPtr, err = syscall.BytePtrFromString(permissions); err != nil {
+			return err
+		}
+	}
+	if _, _, rcode := syscall.Syscall(sysUnveil, uintptr(unsafe.Pointer(pathPtr)), uintptr(unsafe.Pointer(permissionsPtr)), 0); rcode != 0 {
+		return rcode
+	}
+	return nil
+}
+
+func pledge(promises string) error {
+	promisesPtr, err := syscall.BytePtrFromString(promises)
+	if err != nil {
+		return err
+	}
+	if _, _, rcode := syscall.Syscall(sysPledge, uintptr(unsafe.Pointer(promisesPtr)), 0, 0); rcode != 0 {
+		return rcode
+	}
+	return nil
+}
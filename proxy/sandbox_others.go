@@ -0,0 +1,11 @@
+// +build !linux,!openbsd,!freebsd
+
+package proxy
+
+import "errors"
+
+const sandboxForbidsExec = false
+
+func (proxy *Proxy) Sandbox() error {
+	return errors.New("Sandboxing is not supported on this platform")
+}
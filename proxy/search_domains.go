@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultSearchDomainsResolvConf = "/etc/resolv.conf"
+	SearchDomainsRefreshInterval   = time.Minute
+)
+
+// searchDomainsFromResolvConf maps the search domains of a resolv.conf file to its name servers
+func searchDomainsFromResolvConf(file string) []PluginForwardEntry {
+	bin, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+	var domains, servers []string
+	for _, line := range strings.Split(string(bin), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "domain", "search":
+			domains = append(domains, fields[1:]...)
+		case "nameserver":
+			servers = append(servers, fields[1])
+		}
+	}
+	return searchDomainEntries(domains, servers)
+}
+
+// searchDomainEntries builds forwarding rules from search domains and the resolvers they were
+// received with. Loopback resolvers are ignored, as they are likely to be the proxy itself.
+func searchDomainEntries(domains []string, servers []string) []PluginForwardEntry {
+	var resolvers []string
+	for _, server := range servers {
+		// Link-local IPv6 addresses come with a zone, that is kept
+		ip := net.ParseIP(strings.SplitN(server, "%", 2)[0])
+		if ip == nil || ip.IsLoopback() || ip.IsUnspecified() {
+			continue
+		}
+		resolvers = append(resolvers, net.JoinHostPort(server, "53"))
+	}
+	if len(resolvers) == 0 {
+		return nil
+	}
+	var entries []PluginForwardEntry
+	seen := make(map[string]bool)
+	for _, domain := range domains {
+		domain = strings.ToLower(StripTrailingDot(domain))
+		if len(domain) == 0 || seen[domain] {
+			continue
+		}
+		seen[domain] = true
+		entries = append(entries, PluginForwardEntry{domain: domain, servers: resolvers})
+	}
+	return entries
+}
@@ -0,0 +1,9 @@
+// +build !windows
+
+package proxy
+
+// systemSearchDomains returns the search domains received from DHCP, with the resolvers to
+// forward them to
+func systemSearchDomains(resolvConf string) []PluginForwardEntry {
+	return searchDomainsFromResolvConf(resolvConf)
+}
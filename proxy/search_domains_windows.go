@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"strings"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+// systemSearchDomains returns the domain of every network adapter, with the resolvers of the
+// same adapter. The resolvers received from DHCP are preferred, as the static ones may have
+// been replaced by the proxy itself.
+func systemSearchDomains(resolvConf string) []PluginForwardEntry {
+	var entries []PluginForwardEntry
+	for _, interfacesKey := range []string{tcpip4InterfacesKey, tcpip6InterfacesKey} {
+		key, err := registry.OpenKey(registry.LOCAL_MACHINE, interfacesKey, registry.ENUMERATE_SUB_KEYS)
+		if err != nil {
+			continue
+		}
+		guids, err := key.ReadSubKeyNames(-1)
+		key.Close()
+		if err != nil {
+			continue
+		}
+		for _, guid := range guids {
+			domain := firstRegistryValue(interfacesKey+`\`+guid, "DhcpDomain", "Domain")
+			if len(domain) == 0 {
+				continue
+			}
+			servers := strings.FieldsFunc(firstRegistryValue(interfacesKey+`\`+guid, "DhcpNameServer", "NameServer"), func(c rune) bool { return c == ',' || c == ' ' })
+			entries = append(entries, searchDomainEntries([]string{domain}, servers)...)
+		}
+	}
+	return entries
+}
+
+func firstRegistryValue(path string, names ...string) string {
+	key, err := registry.OpenKey(registry.LOCAL_MACHINE, path, registry.QUERY_VALUE)
+	if err != nil {
+		return ""
+	}
+	defer key.Close()
+	for _, name := range names {
+		if value, _, err := key.GetStringValue(name); err == nil && len(strings.TrimSpace(value)) > 0 {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
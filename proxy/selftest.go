@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	stamps "github.com/jedisct1/go-dnsstamps"
+	"github.com/miekg/dns"
+)
+
+// Default number of servers whose certificates are fetched by -self-test
+const DefaultSelfTestServers = 5
+
+type SelfTestCheck struct {
+	Name     string `json:"name"`
+	OK       bool   `json:"ok"`
+	Details  string `json:"details,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Duration int64  `json:"duration_ms"`
+}
+
+// SelfTestReport is the result of -self-test, meant to be displayed by graphical front-ends
+type SelfTestReport struct {
+	Version    string          `json:"version"`
+	ConfigFile string          `json:"config_file"`
+	OK         bool            `json:"ok"`
+	Checks     []SelfTestCheck `json:"checks"`
+}
+
+func (report *SelfTestReport) add(name string, start time.Time, details string, err error) bool {
+	check := SelfTestCheck{Name: name, OK: err == nil, Details: details, Duration: time.Since(start).Nanoseconds() / 1000000}
+	if err != nil {
+		check.Error = err.Error()
+		report.OK = false
+	}
+	report.Checks = append(report.Checks, check)
+	return err == nil
+}
+
+// print writes the report, and exits with a non-zero status if a check failed
+func (report *SelfTestReport) print(jsonOutput bool) {
+	if jsonOutput {
+		jsonStr, err := json.MarshalIndent(report, "", " ")
+		if err != nil {
+			os.Exit(1)
+		}
+		fmt.Println(string(jsonStr))
+	} else {
+		for _, check := range report.Checks {
+			status := "OK  "
+			if !check.OK {
+				status = "FAIL"
+			}
+			line := fmt.Sprintf("[%s] %-32s %5dms", status, check.Name, check.Duration)
+			if len(check.Details) > 0 {
+				line += "  " + check.Details
+			}
+			if len(check.Error) > 0 {
+				line += "  " + check.Error
+			}
+			fmt.Println(line)
+		}
+	}
+	if !report.OK {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// SelfTest checks the configuration without binding any sockets: the rules are compiled, the
+// sources are verified, the certificates of the first servers are fetched, and a name is
+// resolved using every transport these servers support
+func SelfTest(proxy *Proxy, config *Config, configFile string, serversCount int, jsonOutput bool) {
+	report := SelfTestReport{Version: AppVersion, ConfigFile: configFile, OK: true}
+	start := time.Now()
+	configLoaded := report.add("config", start, "", config.load(proxy, configFile))
+
+	// Sources are verified while the configuration is loaded
+	sourceNames := make([]string, 0, len(config.SourcesConfig))
+	for sourceName := range config.SourcesConfig {
+		sourceNames = append(sourceNames, sourceName)
+	}
+	sort.Strings(sourceNames)
+	for _, sourceName := range sourceNames {
+		report.add("source:"+sourceName, time.Now(), config.SourcesConfig[sourceName].CacheFile, config.sourceErrors[sourceName])
+	}
+	if !configLoaded {
+		report.print(jsonOutput)
+	}
+	report.add("servers", time.Now(), fmt.Sprintf("%d servers match the configuration", len(proxy.registeredServers)), nil)
+	start = time.Now()
+	report.add("rules", start, "", InitPluginsGlobals(&proxy.pluginsGlobals, proxy))
+
+	proxy.initServers()
+	if serversCount <= 0 {
+		serversCount = DefaultSelfTestServers
+	}
+	tested := 0
+	for _, registeredServer := range proxy.registeredServers {
+		if tested >= serversCount {
+			break
+		}
+		if registeredServer.stamp.Proto != stamps.StampProtoTypeDNSCrypt && registeredServer.stamp.Proto != stamps.StampProtoTypeDoH {
+			continue
+		}
+		start = time.Now()
+		err := proxy.serversInfo.refreshServer(proxy, registeredServer.name, registeredServer.stamp)
+		report.add("certificate:"+registeredServer.name, start, registeredServer.stamp.Proto.String(), err)
+		tested++
+	}
+
+	transports := []struct {
+		proto       stamps.StampProtoType
+		serverProto string
+	}{
+		{stamps.StampProtoTypeDNSCrypt, "udp"},
+		{stamps.StampProtoTypeDNSCrypt, "tcp"},
+		{stamps.StampProtoTypeDoH, "tcp"},
+	}
+	for _, transport := range transports {
+		var serverInfo *ServerInfo
+		proxy.serversInfo.RLock()
+		for _, candidate := range proxy.serversInfo.inner {
+			if candidate.Proto == transport.proto {
+				serverInfo = candidate
+				break
+			}
+		}
+		proxy.serversInfo.RUnlock()
+		if serverInfo == nil {
+			continue
+		}
+		name := "resolve:" + transport.proto.String()
+		if transport.proto == stamps.StampProtoTypeDNSCrypt {
+			name += "/" + strings.ToUpper(transport.serverProto)
+		}
+		start = time.Now()
+		err := selfTestResolve(proxy, serverInfo, transport.serverProto)
+		report.add(name, start, serverInfo.Name, err)
+	}
+	report.print(jsonOutput)
+}
+
+func selfTestResolve(proxy *Proxy, serverInfo *ServerInfo, serverProto string) error {
+	msg := dns.Msg{}
+	msg.SetQuestion(".", dns.TypeNS)
+	msg.RecursionDesired = true
+	msg.SetEdns0(uint16(MaxDNSUDPPacketSize), false)
+	query, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+	response, err := proxy.exchangeWithServer(serverInfo, serverProto, query, proxy.timeout)
+	if err != nil {
+		return err
+	}
+	if rcode := Rcode(response); rcode != dns.RcodeSuccess {
+		return fmt.Errorf("Unexpected response code: %s", dns.RcodeToString[int(rcode)])
+	}
+	return nil
+}
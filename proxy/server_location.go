@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jedisct1/dlog"
+	stamps "github.com/jedisct1/go-dnsstamps"
+)
+
+type ServerLocationConfig struct {
+	Database          string   `toml:"database"`
+	Countries         []string `toml:"countries"`
+	ExcludedCountries []string `toml:"excluded_countries"`
+	ExcludedASNs      []int    `toml:"excluded_asns"`
+}
+
+type ipLocationRange struct {
+	start   net.IP
+	end     net.IP
+	country string
+	asn     uint32
+}
+
+// ServerLocations maps server addresses to a country and an autonomous system, using a CSV
+// database such as the free ipinfo.io "IP to Country + ASN" one, and tells whether a server is
+// located in an allowed jurisdiction
+type ServerLocations struct {
+	ranges            []ipLocationRange
+	countries         map[string]bool
+	excludedCountries map[string]bool
+	excludedASNs      map[uint32]bool
+}
+
+func NewServerLocations(config ServerLocationConfig) (*ServerLocations, error) {
+	bin, err := ReadRuleFile(config.Database)
+	if err != nil {
+		return nil, err
+	}
+	ranges, err := parseIPLocations(bin)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", config.Database, err)
+	}
+	serverLocations := ServerLocations{
+		ranges:            ranges,
+		countries:         make(map[string]bool),
+		excludedCountries: make(map[string]bool),
+		excludedASNs:      make(map[uint32]bool),
+	}
+	for _, country := range config.Countries {
+		serverLocations.countries[strings.ToUpper(country)] = true
+	}
+	for _, country := range config.ExcludedCountries {
+		serverLocations.excludedCountries[strings.ToUpper(country)] = true
+	}
+	for _, asn := range config.ExcludedASNs {
+		serverLocations.excludedASNs[uint32(asn)] = true
+	}
+	dlog.Noticef("Server locations loaded from [%s] (%d networks)", config.Database, len(ranges))
+	return &serverLocations, nil
+}
+
+// parseIPLocations reads a CSV file whose header names the columns: the networks are either
+// given as `network` (CIDR) or as `start_ip` and `end_ip`, and `country` (or `country_code`) and
+// `asn` (or `autonomous_system_number`) are both optional
+func parseIPLocations(bin []byte) ([]ipLocationRange, error) {
+	reader := csv.NewReader(bytes.NewReader(bin))
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	column := func(record []string, names ...string) string {
+		for _, name := range names {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+		}
+		return ""
+	}
+	_, hasNetwork := columns["network"]
+	_, hasStart := columns["start_ip"]
+	_, hasEnd := columns["end_ip"]
+	if !hasNetwork && !(hasStart && hasEnd) {
+		return nil, errors.New("Missing [network] or [start_ip] and [end_ip] columns")
+	}
+	var ranges []ipLocationRange
+	for lineNo := 2; ; lineNo++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		var ipRange ipLocationRange
+		if hasNetwork {
+			_, ipnet, err := net.ParseCIDR(column(record, "network"))
+			if err != nil {
+				return nil, fmt.Errorf("Invalid network at line %d", lineNo)
+			}
+			ipRange.start = ipnet.IP.To16()
+			ipRange.end = make(net.IP, net.IPv6len)
+			mask := ipnet.Mask
+			if len(mask) == net.IPv4len {
+				mask = append(net.CIDRMask(96, 128)[:12], mask...)
+			}
+			for i := range ipRange.end {
+				ipRange.end[i] = ipRange.start[i] | ^mask[i]
+			}
+		} else {
+			ipRange.start = net.ParseIP(column(record, "start_ip")).To16()
+			ipRange.end = net.ParseIP(column(record, "end_ip")).To16()
+			if ipRange.start == nil || ipRange.end == nil {
+				return nil, fmt.Errorf("Invalid IP range at line %d", lineNo)
+			}
+		}
+		ipRange.country = strings.ToUpper(column(record, "country", "country_code"))
+		if asnStr := strings.TrimPrefix(strings.ToUpper(column(record, "asn", "autonomous_system_number")), "AS"); len(asnStr) > 0 {
+			asn, err := strconv.ParseUint(asnStr, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid ASN at line %d", lineNo)
+			}
+			ipRange.asn = uint32(asn)
+		}
+		ranges = append(ranges, ipRange)
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].start, ranges[j].start) < 0
+	})
+	return ranges, nil
+}
+
+// lookup returns the country and the ASN of an IP address, if it is in the database
+func (serverLocations *ServerLocations) lookup(ip net.IP) (string, uint32, bool) {
+	ip = ip.To16()
+	if ip == nil {
+		return "", 0, false
+	}
+	i := sort.Search(len(serverLocations.ranges), func(i int) bool {
+		return bytes.Compare(serverLocations.ranges[i].start, ip) > 0
+	})
+	if i == 0 {
+		return "", 0, false
+	}
+	ipRange := &serverLocations.ranges[i-1]
+	if bytes.Compare(ip, ipRange.end) > 0 {
+		return "", 0, false
+	}
+	return ipRange.country, ipRange.asn, true
+}
+
+// locate returns the country and the ASN of a server; servers whose stamp doesn't include an IP
+// address can't be located
+func (serverLocations *ServerLocations) locate(stamp *stamps.ServerStamp) (string, uint32, bool) {
+	if serverLocations == nil || len(stamp.ServerAddrStr) == 0 {
+		return "", 0, false
+	}
+	ip := net.ParseIP(strings.Trim(ExtractHost(stamp.ServerAddrStr), "[]"))
+	if ip == nil {
+		return "", 0, false
+	}
+	return serverLocations.lookup(ip)
+}
+
+// allowed tells whether a server can be used; servers that can't be located are only excluded
+// if a list of allowed countries is set
+func (serverLocations *ServerLocations) allowed(registeredServer *RegisteredServer) bool {
+	if serverLocations == nil {
+		return true
+	}
+	country, asn, found := serverLocations.locate(&registeredServer.stamp)
+	if !found {
+		if len(serverLocations.countries) > 0 {
+			dlog.Debugf("[%s] can't be located, and is not used", registeredServer.name)
+			return false
+		}
+		return true
+	}
+	if len(serverLocations.countries) > 0 && !serverLocations.countries[country] {
+		dlog.Debugf("[%s] is located in [%s], that is not an allowed country", registeredServer.name, country)
+		return false
+	}
+	if serverLocations.excludedCountries[country] {
+		dlog.Debugf("[%s] is located in [%s], that is an excluded country", registeredServer.name, country)
+		return false
+	}
+	if serverLocations.excludedASNs[asn] {
+		dlog.Debugf("[%s] is in AS%d, that is excluded", registeredServer.name, asn)
+		return false
+	}
+	return true
+}
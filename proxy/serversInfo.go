@@ -0,0 +1,792 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VividCortex/ewma"
+	"github.com/jedisct1/dlog"
+	clocksmith "github.com/jedisct1/go-clocksmith"
+	stamps "github.com/jedisct1/go-dnsstamps"
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/ed25519"
+)
+
+const (
+	RTTEwmaDecay                = 10.0
+	DefaultLatencyProbeInterval = time.Duration(120) * time.Second
+	ServerFailuresBeforeDown    = 3
+	ServerDownMinDelay          = time.Duration(10) * time.Second
+	ServerDownMaxDelay          = time.Duration(10) * time.Minute
+	ServerErrorRateDecay        = 20.0
+	ServerTimeoutMinBackoff     = time.Duration(1) * time.Second
+	ServerTimeoutMaxBackoff     = time.Duration(1) * time.Minute
+	DefaultServerMaxErrorRate   = 0.5
+)
+
+type RegisteredServer struct {
+	name        string
+	stamp       stamps.ServerStamp
+	description string
+}
+
+type ServerInfo struct {
+	sync.RWMutex
+	Proto              stamps.StampProtoType
+	MagicQuery         [8]byte
+	ServerPk           [32]byte
+	SharedKey          [32]byte
+	CryptoConstruction CryptoConstruction
+	Name               string
+	Timeout            time.Duration
+	URL                *url.URL
+	HostName           string
+	UDPAddr            *net.UDPAddr
+	TCPAddr            *net.TCPAddr
+	lastActionTS       time.Time
+	rtt                ewma.MovingAverage
+	initialRtt         int
+	useGet             bool
+	failures           int
+	errorRate          ewma.MovingAverage
+	down               bool
+	downUntil          time.Time
+	trips              int
+	upSince            time.Time
+	timeouts           int
+	backoffUntil       time.Time
+	certSerial         uint32
+	certNotAfter       time.Time
+	headers            map[string]string
+	stats              *ServerStats
+	nxRedirect         *NXRedirect
+	ednsSize           *EDNSSize
+}
+
+type LBStrategy int
+
+const (
+	LBStrategyNone = LBStrategy(iota)
+	LBStrategyP2
+	LBStrategyPH
+	LBStrategyFastest
+	LBStrategyRandom
+)
+
+const (
+	DefaultLBStrategy = LBStrategyP2
+	DefaultLBJitter   = 0.1
+)
+
+type ServersInfo struct {
+	sync.RWMutex
+	inner             []*ServerInfo
+	registeredServers []RegisteredServer
+	lbStrategy        LBStrategy
+	lbJitter          float64
+	maxActiveServers  int
+	weights           map[string]int
+}
+
+func (serversInfo *ServersInfo) registerServer(proxy *Proxy, name string, stamp stamps.ServerStamp) error {
+	newRegisteredServer := RegisteredServer{name: name, stamp: stamp}
+	serversInfo.Lock()
+	defer serversInfo.Unlock()
+	for i, oldRegisteredServer := range serversInfo.registeredServers {
+		if oldRegisteredServer.name == name {
+			serversInfo.registeredServers[i] = newRegisteredServer
+			return nil
+		}
+	}
+	serversInfo.registeredServers = append(serversInfo.registeredServers, newRegisteredServer)
+	return nil
+}
+
+func (serversInfo *ServersInfo) refreshServer(proxy *Proxy, name string, stamp stamps.ServerStamp) error {
+	serversInfo.Lock()
+	defer serversInfo.Unlock()
+	previousIndex := -1
+	for i, oldServer := range serversInfo.inner {
+		if oldServer.Name == name {
+			previousIndex = i
+			break
+		}
+	}
+	newServer, err := serversInfo.fetchServerInfo(proxy, name, stamp, previousIndex < 0)
+	if err != nil {
+		return err
+	}
+	if name != newServer.Name {
+		dlog.Fatalf("[%s] != [%s]", name, newServer.Name)
+	}
+	newServer.rtt = ewma.NewMovingAverage(RTTEwmaDecay)
+	newServer.errorRate = ewma.NewMovingAverage(ServerErrorRateDecay)
+	if previousIndex >= 0 {
+		newServer.stats = serversInfo.inner[previousIndex].stats
+		newServer.nxRedirect = serversInfo.inner[previousIndex].nxRedirect
+		newServer.ednsSize = serversInfo.inner[previousIndex].ednsSize
+		checkCertRotation(serversInfo.inner[previousIndex], &newServer)
+		serversInfo.inner[previousIndex] = &newServer
+		return nil
+	}
+	newServer.stats = NewServerStats()
+	newServer.nxRedirect = &NXRedirect{}
+	newServer.ednsSize = &EDNSSize{}
+	serversInfo.inner = append(serversInfo.inner, &newServer)
+	return nil
+}
+
+func (serversInfo *ServersInfo) refresh(proxy *Proxy) (int, error) {
+	dlog.Debug("Refreshing certificates")
+	serversInfo.RLock()
+	registeredServers := serversInfo.registeredServers
+	maxActiveServers := serversInfo.maxActiveServers
+	serversInfo.RUnlock()
+	liveServers := 0
+	var err error
+	if maxActiveServers > 0 && len(registeredServers) > maxActiveServers {
+		liveServers, err = serversInfo.refreshActive(proxy, registeredServers, maxActiveServers)
+	} else {
+		for _, registeredServer := range registeredServers {
+			if err = serversInfo.refreshServer(proxy, registeredServer.name, registeredServer.stamp); err == nil {
+				liveServers++
+			}
+		}
+	}
+	serversInfo.Lock()
+	inner := serversInfo.inner
+	innerLen := len(inner)
+	for i := 0; i < innerLen; i++ {
+		for j := i + 1; j < innerLen; j++ {
+			if inner[j].initialRtt < inner[i].initialRtt {
+				inner[j], inner[i] = inner[i], inner[j]
+			}
+		}
+	}
+	serversInfo.inner = inner
+	if innerLen > 0 {
+		dlog.Noticef("Server with the lowest initial latency: %s (rtt: %dms)", inner[0].Name, inner[0].initialRtt)
+		proxy.certIgnoreTimestamp = false
+	}
+	serversInfo.Unlock()
+	return liveServers, err
+}
+
+// refreshActive only refreshes the certificates of the active servers, and fetches new certificates
+// from the remaining candidates in small batches until maxActiveServers servers are live.
+// Within a batch, the servers with the lowest latency are kept.
+func (serversInfo *ServersInfo) refreshActive(proxy *Proxy, registeredServers []RegisteredServer, maxActiveServers int) (int, error) {
+	serversInfo.RLock()
+	active := make(map[string]bool)
+	for _, serverInfo := range serversInfo.inner {
+		active[serverInfo.Name] = true
+	}
+	serversInfo.RUnlock()
+	liveServers := 0
+	failed := make(map[string]bool)
+	var candidates []RegisteredServer
+	var err error
+	for _, registeredServer := range registeredServers {
+		if !active[registeredServer.name] {
+			candidates = append(candidates, registeredServer)
+			continue
+		}
+		if err = serversInfo.refreshServer(proxy, registeredServer.name, registeredServer.stamp); err != nil {
+			failed[registeredServer.name] = true
+			continue
+		}
+		liveServers++
+	}
+	for liveServers < maxActiveServers && len(candidates) > 0 {
+		batchSize := Min(len(candidates), 2*(maxActiveServers-liveServers))
+		batch := candidates[:batchSize]
+		candidates = candidates[batchSize:]
+		newServers := make([]*ServerInfo, len(batch))
+		errs := make([]error, len(batch))
+		var wg sync.WaitGroup
+		for i, registeredServer := range batch {
+			wg.Add(1)
+			go func(i int, registeredServer RegisteredServer) {
+				defer wg.Done()
+				newServer, err := serversInfo.fetchServerInfo(proxy, registeredServer.name, registeredServer.stamp, true)
+				if err != nil {
+					errs[i] = err
+					return
+				}
+				newServer.rtt = ewma.NewMovingAverage(RTTEwmaDecay)
+				newServer.errorRate = ewma.NewMovingAverage(ServerErrorRateDecay)
+				newServers[i] = &newServer
+			}(i, registeredServer)
+		}
+		wg.Wait()
+		var fetched []*ServerInfo
+		for i, newServer := range newServers {
+			if newServer == nil {
+				err = errs[i]
+				continue
+			}
+			fetched = append(fetched, newServer)
+		}
+		sort.SliceStable(fetched, func(i, j int) bool {
+			return fetched[i].initialRtt < fetched[j].initialRtt
+		})
+		if len(fetched) > maxActiveServers-liveServers {
+			fetched = fetched[:maxActiveServers-liveServers]
+		}
+		serversInfo.Lock()
+		serversInfo.inner = append(serversInfo.inner, fetched...)
+		serversInfo.Unlock()
+		liveServers += len(fetched)
+	}
+	if liveServers > 0 && len(failed) > 0 {
+		serversInfo.Lock()
+		inner := []*ServerInfo{}
+		for _, serverInfo := range serversInfo.inner {
+			if failed[serverInfo.Name] {
+				dlog.Infof("Server [%s] is not reachable any more, removing it from the active servers", serverInfo.Name)
+				continue
+			}
+			inner = append(inner, serverInfo)
+		}
+		serversInfo.inner = inner
+		serversInfo.Unlock()
+	}
+	return liveServers, err
+}
+
+// checkCertRotation logs certificate changes, and warns about changes that may indicate an attack
+func checkCertRotation(previous *ServerInfo, current *ServerInfo) {
+	if current.Proto != stamps.StampProtoTypeDNSCrypt || previous.Proto != stamps.StampProtoTypeDNSCrypt {
+		return
+	}
+	if current.certSerial < previous.certSerial {
+		dlog.Warnf("[%s] certificate serial went backwards (%d -> %d) -- the server may be replaying an old certificate", current.Name, previous.certSerial, current.certSerial)
+	} else if current.certSerial > previous.certSerial {
+		dlog.Infof("[%s] certificate rotated (serial %d -> %d), valid until %s", current.Name, previous.certSerial, current.certSerial, current.certNotAfter.Format(time.RFC3339))
+	}
+	if current.CryptoConstruction < previous.CryptoConstruction {
+		dlog.Warnf("[%s] crypto construction was downgraded from v%d to v%d", current.Name, previous.CryptoConstruction, current.CryptoConstruction)
+	}
+}
+
+// nextCertExpiry returns the earliest expiration date of the DNSCrypt certificates currently in use
+func (serversInfo *ServersInfo) nextCertExpiry() (time.Time, bool) {
+	serversInfo.RLock()
+	defer serversInfo.RUnlock()
+	var next time.Time
+	found := false
+	for _, serverInfo := range serversInfo.inner {
+		if serverInfo.Proto != stamps.StampProtoTypeDNSCrypt || serverInfo.certNotAfter.IsZero() {
+			continue
+		}
+		if !found || serverInfo.certNotAfter.Before(next) {
+			next, found = serverInfo.certNotAfter, true
+		}
+	}
+	return next, found
+}
+
+func (serversInfo *ServersInfo) liveServers() int {
+	serversInfo.RLock()
+	liveServers := len(serversInfo.inner)
+	serversInfo.RUnlock()
+	return liveServers
+}
+
+// probe sends a lightweight query to every live server, so that latency estimates
+// keep being updated for the servers that are not currently being picked
+func (serversInfo *ServersInfo) probe(proxy *Proxy) {
+	serversInfo.RLock()
+	inner := append([]*ServerInfo{}, serversInfo.inner...)
+	serversInfo.RUnlock()
+	msg := new(dns.Msg)
+	msg.SetQuestion(".", dns.TypeNS)
+	query, err := msg.Pack()
+	if err != nil {
+		return
+	}
+	for _, serverInfo := range inner {
+		if serverInfo.isDown() {
+			continue
+		}
+		if _, err := proxy.exchangeWithServer(serverInfo, proxy.mainProto, append([]byte{}, query...), proxy.timeout); err != nil {
+			dlog.Debugf("Latency probe for [%s] failed: %v", serverInfo.Name, err)
+			continue
+		}
+		serverInfo.noticeSuccess(proxy)
+	}
+	serversInfo.sortByRtt()
+}
+
+func (serversInfo *ServersInfo) sortByRtt() {
+	serversInfo.Lock()
+	inner := serversInfo.inner
+	rtts := make(map[*ServerInfo]float64, len(inner))
+	for _, serverInfo := range inner {
+		rtts[serverInfo] = serverInfo.rttValue()
+	}
+	sort.SliceStable(inner, func(i, j int) bool {
+		return rtts[inner[i]] < rtts[inner[j]]
+	})
+	if len(inner) > 0 {
+		dlog.Debugf("Server with the lowest estimated latency: %s (rtt: %.0fms)", inner[0].Name, rtts[inner[0]])
+	}
+	serversInfo.Unlock()
+}
+
+func (serversInfo *ServersInfo) getOne() *ServerInfo {
+	serversInfo.Lock()
+	defer serversInfo.Unlock()
+	serversCount := len(serversInfo.inner)
+	if serversCount <= 0 {
+		return nil
+	}
+	candidate := rand.Intn(serversCount)
+	if candidate == 0 {
+		return serversInfo.inner[candidate]
+	}
+	candidateRtt, currentBestRtt := serversInfo.inner[candidate].rtt.Value(), serversInfo.inner[0].rtt.Value()
+	if currentBestRtt < 0 {
+		currentBestRtt = candidateRtt
+		serversInfo.inner[0].rtt.Set(currentBestRtt)
+	}
+	partialSort := false
+	if candidateRtt < currentBestRtt {
+		serversInfo.inner[candidate], serversInfo.inner[0] = serversInfo.inner[0], serversInfo.inner[candidate]
+		partialSort = true
+		dlog.Debugf("New preferred candidate: %v (rtt: %v vs previous: %v)", serversInfo.inner[0].Name, candidateRtt, currentBestRtt)
+	} else if candidateRtt >= currentBestRtt*4.0 {
+		if time.Since(serversInfo.inner[candidate].lastActionTS) > time.Duration(1*time.Minute) {
+			serversInfo.inner[candidate].rtt.Add(MinF(MaxF(candidateRtt/2.0, currentBestRtt*2.0), candidateRtt))
+			partialSort = true
+		}
+	}
+	if partialSort {
+		for i := 1; i < serversCount; i++ {
+			if serversInfo.inner[i-1].rtt.Value() > serversInfo.inner[i].rtt.Value() {
+				serversInfo.inner[i-1], serversInfo.inner[i] = serversInfo.inner[i], serversInfo.inner[i-1]
+			}
+		}
+	}
+	servers := upServers(serversInfo.inner)
+	if serverInfo := serversInfo.weightedCandidate(servers); serverInfo != nil {
+		dlog.Debugf("Using weighted candidate: [%v]", serverInfo.Name)
+		return serverInfo
+	}
+	candidate = serversInfo.lbCandidate(servers)
+	serverInfo := servers[candidate]
+	dlog.Debugf("Using candidate %v: [%v]", candidate, (*serverInfo).Name)
+
+	return serverInfo
+}
+
+// weightedCandidate picks one of the servers given a weight, with a probability of its weight
+// in percent, or returns nil so that the remaining queries are load-balanced among all the
+// servers. If the weights add up to 100 or more, weighted servers are always used while any
+// of them is up.
+func (serversInfo *ServersInfo) weightedCandidate(servers []*ServerInfo) *ServerInfo {
+	if len(serversInfo.weights) == 0 {
+		return nil
+	}
+	var weighted []*ServerInfo
+	totalWeight := 0
+	for _, serverInfo := range servers {
+		if weight := serversInfo.weights[serverInfo.Name]; weight > 0 && !serverInfo.isDown() {
+			weighted = append(weighted, serverInfo)
+			totalWeight += weight
+		}
+	}
+	if totalWeight == 0 {
+		return nil
+	}
+	draw := rand.Intn(Max(totalWeight, 100))
+	for _, serverInfo := range weighted {
+		if draw -= serversInfo.weights[serverInfo.Name]; draw < 0 {
+			return serverInfo
+		}
+	}
+	return nil
+}
+
+// lbCandidate picks the index of a server according to the load-balancing strategy.
+// Servers are expected to be sorted by latency; the ones within lbJitter of the
+// fastest one are considered equivalent, so that clients don't all pick the same server.
+func (serversInfo *ServersInfo) lbCandidate(servers []*ServerInfo) int {
+	serversCount := len(servers)
+	equivalents := 1
+	if bestRtt := servers[0].rttValue(); bestRtt > 0 {
+		for equivalents < serversCount && servers[equivalents].rttValue() <= bestRtt*(1.0+serversInfo.lbJitter) {
+			equivalents++
+		}
+	}
+	switch serversInfo.lbStrategy {
+	case LBStrategyFastest:
+		return rand.Intn(equivalents)
+	case LBStrategyPH:
+		return rand.Intn(Max(equivalents, Max(Min(serversCount, 2), serversCount/2)))
+	case LBStrategyRandom:
+		return rand.Intn(serversCount)
+	default:
+		return rand.Intn(Max(equivalents, Min(serversCount, 2)))
+	}
+}
+
+func (serversInfo *ServersInfo) getOneOf(names []string) *ServerInfo {
+	serversInfo.RLock()
+	defer serversInfo.RUnlock()
+	var candidates []*ServerInfo
+	for _, serverInfo := range serversInfo.inner {
+		if includesName(names, serverInfo.Name) {
+			candidates = append(candidates, serverInfo)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	candidates = upServers(candidates)
+	serverInfo := serversInfo.weightedCandidate(candidates)
+	if serverInfo == nil {
+		serverInfo = candidates[serversInfo.lbCandidate(candidates)]
+	}
+	dlog.Debugf("Using restricted candidate: [%v]", serverInfo.Name)
+
+	return serverInfo
+}
+
+// getNext returns the fastest server that hasn't been tried yet, preferring servers that are not down
+func (serversInfo *ServersInfo) getNext(names []string, tried []*ServerInfo) *ServerInfo {
+	serversInfo.RLock()
+	defer serversInfo.RUnlock()
+	var candidates []*ServerInfo
+	for _, serverInfo := range serversInfo.inner {
+		if len(names) > 0 && !includesName(names, serverInfo.Name) {
+			continue
+		}
+		alreadyTried := false
+		for _, triedServerInfo := range tried {
+			if triedServerInfo == serverInfo {
+				alreadyTried = true
+				break
+			}
+		}
+		if !alreadyTried {
+			candidates = append(candidates, serverInfo)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	return upServers(candidates)[0]
+}
+
+// upServers returns the servers that are not considered down, preferring the ones that are not
+// backing off after a timeout, or all of them if they are all down
+func upServers(servers []*ServerInfo) []*ServerInfo {
+	var up, backingOff []*ServerInfo
+	for _, serverInfo := range servers {
+		if serverInfo.isDown() {
+			continue
+		}
+		if serverInfo.isBackingOff() {
+			backingOff = append(backingOff, serverInfo)
+		} else {
+			up = append(up, serverInfo)
+		}
+	}
+	if len(up) > 0 {
+		return up
+	}
+	if len(backingOff) > 0 {
+		return backingOff
+	}
+	return servers
+}
+
+func (serversInfo *ServersInfo) fetchServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, isNew bool) (ServerInfo, error) {
+	if stamp.Proto == stamps.StampProtoTypeDNSCrypt {
+		return serversInfo.fetchDNSCryptServerInfo(proxy, name, stamp, isNew)
+	} else if stamp.Proto == stamps.StampProtoTypeDoH {
+		return serversInfo.fetchDoHServerInfo(proxy, name, stamp, isNew)
+	}
+	return ServerInfo{}, errors.New("Unsupported protocol")
+}
+
+func (serversInfo *ServersInfo) fetchDNSCryptServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, isNew bool) (ServerInfo, error) {
+	if len(stamp.ServerPk) != ed25519.PublicKeySize {
+		serverPk, err := hex.DecodeString(strings.Replace(string(stamp.ServerPk), ":", "", -1))
+		if err != nil || len(serverPk) != ed25519.PublicKeySize {
+			dlog.Fatalf("Unsupported public key for [%s]: [%s]", name, stamp.ServerPk)
+		}
+		dlog.Warnf("Public key [%s] shouldn't be hex-encoded any more", string(stamp.ServerPk))
+		stamp.ServerPk = serverPk
+	}
+	certInfo, rtt, err := FetchCurrentDNSCryptCert(proxy, &name, proxy.mainProto, stamp.ServerPk, stamp.ServerAddrStr, stamp.ProviderName, isNew)
+	if err != nil {
+		return ServerInfo{}, err
+	}
+	proxy.certLog.record(dnscryptCertLogEntry(name, &certInfo))
+	remoteUDPAddr, err := net.ResolveUDPAddr("udp", stamp.ServerAddrStr)
+	if err != nil {
+		return ServerInfo{}, err
+	}
+	remoteTCPAddr, err := net.ResolveTCPAddr("tcp", stamp.ServerAddrStr)
+	if err != nil {
+		return ServerInfo{}, err
+	}
+	return ServerInfo{
+		Proto:              stamps.StampProtoTypeDNSCrypt,
+		MagicQuery:         certInfo.MagicQuery,
+		ServerPk:           certInfo.ServerPk,
+		SharedKey:          certInfo.SharedKey,
+		CryptoConstruction: certInfo.CryptoConstruction,
+		Name:               name,
+		Timeout:            proxy.timeout,
+		UDPAddr:            remoteUDPAddr,
+		TCPAddr:            remoteTCPAddr,
+		initialRtt:         rtt,
+		certSerial:         certInfo.Serial,
+		certNotAfter:       certInfo.NotAfter,
+	}, nil
+}
+
+func (serversInfo *ServersInfo) fetchDoHServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, isNew bool) (ServerInfo, error) {
+	if len(stamp.ServerAddrStr) > 0 {
+		addrStr := stamp.ServerAddrStr
+		ipOnly := addrStr[:strings.LastIndex(addrStr, ":")]
+		proxy.xTransport.cachedIPs.Lock()
+		proxy.xTransport.cachedIPs.cache[stamp.ProviderName] = ipOnly
+		proxy.xTransport.cachedIPs.Unlock()
+	}
+	url := &url.URL{
+		Scheme: "https",
+		Host:   stamp.ProviderName,
+		Path:   stamp.Path,
+	}
+	body := []byte{
+		0xca, 0xfe, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x02, 0x00, 0x01, 0x00, 0x00, 0x29, 0x10, 0x00, 0x00, 0x00, 0x80, 0x00, 0x00, 0x00,
+	}
+	headers := proxy.serverHeaders[name]
+	useGet := false
+	if _, _, err := proxy.xTransport.DoHQuery(useGet, url, body, proxy.timeout, headers); err != nil {
+		useGet = true
+		if _, _, err := proxy.xTransport.DoHQuery(useGet, url, body, proxy.timeout, headers); err != nil {
+			return ServerInfo{}, err
+		}
+		dlog.Debugf("Server [%s] doesn't appear to support POST; falling back to GET requests", name)
+	}
+	resp, rtt, err := proxy.xTransport.DoHQuery(useGet, url, body, proxy.timeout, headers)
+	if err != nil {
+		return ServerInfo{}, err
+	}
+	tls := resp.TLS
+	if tls == nil || !tls.HandshakeComplete {
+		return ServerInfo{}, errors.New("TLS handshake failed")
+	}
+	dlog.Infof("[%s] TLS version: %x - Protocol: %v - Cipher suite: %v", name, tls.Version, tls.NegotiatedProtocol, tls.CipherSuite)
+	showCerts := len(os.Getenv("SHOW_CERTS")) > 0
+	found := false
+	var wantedHash [32]byte
+	for _, cert := range tls.PeerCertificates {
+		h := sha256.Sum256(cert.RawTBSCertificate)
+		if showCerts {
+			dlog.Infof("Advertised cert: [%s] [%x]", cert.Subject, h)
+		} else {
+			dlog.Debugf("Advertised cert: [%s] [%x]", cert.Subject, h)
+		}
+		for _, hash := range stamp.Hashes {
+			if len(hash) == len(wantedHash) {
+				copy(wantedHash[:], hash)
+				if h == wantedHash {
+					found = true
+					break
+				}
+			}
+		}
+		if found {
+			break
+		}
+	}
+	if !found && len(stamp.Hashes) > 0 {
+		return ServerInfo{}, fmt.Errorf("Certificate hash [%x] not found for [%s]", wantedHash, name)
+	}
+	if len(tls.PeerCertificates) > 0 {
+		proxy.certLog.record(tlsCertLogEntry(name, tls.PeerCertificates[0]))
+	}
+	respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, MaxHTTPBodyLength))
+	if err != nil {
+		return ServerInfo{}, err
+	}
+	if len(respBody) < MinDNSPacketSize || len(respBody) > MaxDNSPacketSize ||
+		respBody[0] != 0xca || respBody[1] != 0xfe || respBody[4] != 0x00 || respBody[5] != 0x01 {
+		return ServerInfo{}, errors.New("Webserver returned an unexpected response")
+	}
+	if isNew {
+		dlog.Noticef("[%s] OK (DoH) - rtt: %dms", name, rtt.Nanoseconds()/1000000)
+	} else {
+		dlog.Infof("[%s] OK (DoH) - rtt: %dms", name, rtt.Nanoseconds()/1000000)
+	}
+	return ServerInfo{
+		Proto:      stamps.StampProtoTypeDoH,
+		Name:       name,
+		Timeout:    proxy.timeout,
+		URL:        url,
+		HostName:   stamp.ProviderName,
+		initialRtt: int(rtt.Nanoseconds() / 1000000),
+		useGet:     useGet,
+		headers:    headers,
+	}, nil
+}
+
+// noticeFailure accounts for a failed exchange. A server that fails several times in a row, or
+// too often, is not used any more until it answers a probe query; the delay before the first
+// probe doubles every time the server goes down again shortly after having been readmitted.
+func (serverInfo *ServerInfo) noticeFailure(proxy *Proxy) {
+	serverInfo.Lock()
+	serverInfo.rtt.Add(float64(proxy.timeout.Nanoseconds() / 1000000))
+	serverInfo.failures++
+	serverInfo.errorRate.Add(1.0)
+	if serverInfo.down {
+		serverInfo.Unlock()
+		return
+	}
+	if serverInfo.failures >= ServerFailuresBeforeDown {
+		dlog.Infof("Server [%s] has failed %d times in a row", serverInfo.Name, serverInfo.failures)
+	} else if errorRate := serverInfo.errorRate.Value(); proxy.serverMaxErrorRate > 0 && errorRate > proxy.serverMaxErrorRate {
+		dlog.Infof("Server [%s] has an error rate of %.0f%%", serverInfo.Name, errorRate*100.0)
+	} else {
+		serverInfo.Unlock()
+		return
+	}
+	delay := serverInfo.trip()
+	serverInfo.Unlock()
+	dlog.Infof("Not using [%s] for at least %v", serverInfo.Name, delay)
+	go proxy.serversInfo.probeUntilUp(proxy, serverInfo, delay)
+}
+
+// trip marks the server as down, and returns the delay before it can be probed
+func (serverInfo *ServerInfo) trip() time.Duration {
+	if !serverInfo.down && time.Since(serverInfo.upSince) > ServerDownMaxDelay {
+		serverInfo.trips = 0
+	}
+	delay := ServerDownMinDelay << uint(Min(serverInfo.trips, 16))
+	if delay > ServerDownMaxDelay {
+		delay = ServerDownMaxDelay
+	}
+	serverInfo.trips++
+	serverInfo.down = true
+	serverInfo.downUntil = time.Now().Add(delay)
+	return delay
+}
+
+// probeUntilUp sends a query to a server that is down every time its delay has elapsed, and
+// readmits it once it answers. It stops if the server is used again in the meantime, or if it
+// has been replaced after its certificate was refreshed.
+func (serversInfo *ServersInfo) probeUntilUp(proxy *Proxy, serverInfo *ServerInfo, delay time.Duration) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(".", dns.TypeNS)
+	query, err := msg.Pack()
+	if err != nil {
+		return
+	}
+	for {
+		clocksmith.Sleep(delay)
+		if !serverInfo.isDown() || !serversInfo.isLive(serverInfo) {
+			return
+		}
+		response, err := proxy.exchangeWithServer(serverInfo, proxy.mainProto, append([]byte{}, query...), proxy.timeout)
+		if err == nil && Rcode(response) != dns.RcodeServerFailure && Rcode(response) != dns.RcodeRefused {
+			serverInfo.noticeSuccess(proxy)
+			dlog.Infof("Server [%s] answered a probe query, using it again", serverInfo.Name)
+			return
+		}
+		serverInfo.Lock()
+		delay = serverInfo.trip()
+		serverInfo.Unlock()
+		dlog.Debugf("Probe for [%s] failed, trying again in %v", serverInfo.Name, delay)
+	}
+}
+
+func (serversInfo *ServersInfo) isLive(serverInfo *ServerInfo) bool {
+	serversInfo.RLock()
+	defer serversInfo.RUnlock()
+	for _, liveServerInfo := range serversInfo.inner {
+		if liveServerInfo == serverInfo {
+			return true
+		}
+	}
+	return false
+}
+
+func (serverInfo *ServerInfo) isDown() bool {
+	serverInfo.RLock()
+	down := serverInfo.down
+	serverInfo.RUnlock()
+	return down
+}
+
+// noticeTimeout makes a server that didn't respond in time only used when no other servers
+// are available, for a delay that doubles after every consecutive timeout
+func (serverInfo *ServerInfo) noticeTimeout() {
+	serverInfo.Lock()
+	delay := ServerTimeoutMinBackoff << uint(Min(serverInfo.timeouts, 16))
+	if delay > ServerTimeoutMaxBackoff {
+		delay = ServerTimeoutMaxBackoff
+	}
+	serverInfo.timeouts++
+	serverInfo.backoffUntil = time.Now().Add(delay)
+	serverInfo.Unlock()
+	dlog.Debugf("Server [%s] timed out, backing off for %v", serverInfo.Name, delay)
+}
+
+func (serverInfo *ServerInfo) isBackingOff() bool {
+	serverInfo.RLock()
+	backingOff := time.Now().Before(serverInfo.backoffUntil)
+	serverInfo.RUnlock()
+	return backingOff
+}
+
+func (serverInfo *ServerInfo) rttValue() float64 {
+	serverInfo.RLock()
+	rtt := serverInfo.rtt.Value()
+	serverInfo.RUnlock()
+	return rtt
+}
+
+func (serverInfo *ServerInfo) noticeBegin(proxy *Proxy) {
+	serverInfo.Lock()
+	serverInfo.lastActionTS = time.Now()
+	serverInfo.Unlock()
+}
+
+func (serverInfo *ServerInfo) noticeSuccess(proxy *Proxy) {
+	now := time.Now()
+	serverInfo.Lock()
+	elapsed := now.Sub(serverInfo.lastActionTS)
+	elapsedMs := elapsed.Nanoseconds() / 1000000
+	if elapsedMs > 0 && elapsed < proxy.timeout {
+		serverInfo.rtt.Add(float64(elapsedMs))
+	}
+	serverInfo.failures = 0
+	serverInfo.timeouts = 0
+	serverInfo.backoffUntil = time.Time{}
+	serverInfo.errorRate.Add(0.0)
+	if serverInfo.down {
+		serverInfo.down = false
+		serverInfo.downUntil = time.Time{}
+		serverInfo.errorRate = ewma.NewMovingAverage(ServerErrorRateDecay)
+		serverInfo.upSince = now
+	}
+	serverInfo.Unlock()
+}
@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"container/list"
+)
+
+// Share of the capacity reserved to entries that have been looked up at least once after
+// having been added
+const SegmentedLRUProtectedRatio = 0.8
+
+// SegmentedLRU is a cache split into a probationary and a protected segment. New entries are
+// added to the probationary segment, and only move to the protected segment once they are
+// looked up again. Names that are only queried once, such as the ones looked up by antivirus
+// software, thus only evict each other, not the working set of frequently used names.
+//
+// The capacity is either a number of entries, or a number of bytes when every entry is
+// given its size. A SegmentedLRU is not safe for concurrent use.
+type SegmentedLRU struct {
+	capacity          int
+	protectedCapacity int
+	bySize            bool
+	entries           map[[32]byte]*list.Element
+	probation         *list.List
+	protected         *list.List
+	probationCost     int
+	protectedCost     int
+	size              int
+}
+
+type segmentedLRUEntry struct {
+	key       [32]byte
+	value     CachedResponse
+	size      int
+	protected bool
+}
+
+// NewSegmentedLRU creates a cache holding up to capacity entries, or entries whose sizes sum
+// up to capacity bytes if bySize is set
+func NewSegmentedLRU(capacity int, bySize bool) *SegmentedLRU {
+	return &SegmentedLRU{
+		capacity:          Max(1, capacity),
+		protectedCapacity: int(float64(capacity) * SegmentedLRUProtectedRatio),
+		bySize:            bySize,
+		entries:           make(map[[32]byte]*list.Element),
+		probation:         list.New(),
+		protected:         list.New(),
+	}
+}
+
+func (slru *SegmentedLRU) cost(entry *segmentedLRUEntry) int {
+	if slru.bySize {
+		return entry.size
+	}
+	return 1
+}
+
+// Get returns the value of an entry, and promotes it to the protected segment
+func (slru *SegmentedLRU) Get(key [32]byte) (CachedResponse, bool) {
+	element, found := slru.entries[key]
+	if !found {
+		return CachedResponse{}, false
+	}
+	entry := element.Value.(*segmentedLRUEntry)
+	if entry.protected {
+		slru.protected.MoveToFront(element)
+		return entry.value, true
+	}
+	slru.probation.Remove(element)
+	slru.probationCost -= slru.cost(entry)
+	entry.protected = true
+	slru.entries[key] = slru.protected.PushFront(entry)
+	slru.protectedCost += slru.cost(entry)
+	for slru.protectedCost > slru.protectedCapacity && slru.protected.Len() > 1 {
+		slru.demote(slru.protected.Back())
+	}
+	return entry.value, true
+}
+
+// Add adds or replaces an entry, and returns the number of entries that had to be evicted
+func (slru *SegmentedLRU) Add(key [32]byte, value CachedResponse, size int) int {
+	if element, found := slru.entries[key]; found {
+		slru.remove(element)
+	}
+	entry := &segmentedLRUEntry{key: key, value: value, size: size}
+	slru.entries[key] = slru.probation.PushFront(entry)
+	slru.probationCost += slru.cost(entry)
+	slru.size += size
+	evicted := 0
+	for slru.probationCost+slru.protectedCost > slru.capacity {
+		victim := slru.probation.Back()
+		if victim == nil {
+			victim = slru.protected.Back()
+		}
+		slru.remove(victim)
+		evicted++
+	}
+	return evicted
+}
+
+// demote moves an entry from the protected segment back to the probationary segment, where
+// it gets a last chance to be looked up before being evicted
+func (slru *SegmentedLRU) demote(element *list.Element) {
+	entry := element.Value.(*segmentedLRUEntry)
+	slru.protected.Remove(element)
+	slru.protectedCost -= slru.cost(entry)
+	entry.protected = false
+	slru.entries[entry.key] = slru.probation.PushFront(entry)
+	slru.probationCost += slru.cost(entry)
+}
+
+func (slru *SegmentedLRU) remove(element *list.Element) {
+	entry := element.Value.(*segmentedLRUEntry)
+	if entry.protected {
+		slru.protected.Remove(element)
+		slru.protectedCost -= slru.cost(entry)
+	} else {
+		slru.probation.Remove(element)
+		slru.probationCost -= slru.cost(entry)
+	}
+	slru.size -= entry.size
+	delete(slru.entries, entry.key)
+}
+
+// Resize changes the capacity, and returns the number of entries that had to be evicted
+func (slru *SegmentedLRU) Resize(capacity int, bySize bool) int {
+	slru.capacity = Max(1, capacity)
+	slru.protectedCapacity = int(float64(capacity) * SegmentedLRUProtectedRatio)
+	if bySize != slru.bySize {
+		slru.bySize = bySize
+		slru.probationCost, slru.protectedCost = 0, 0
+		for _, element := range slru.entries {
+			entry := element.Value.(*segmentedLRUEntry)
+			if entry.protected {
+				slru.protectedCost += slru.cost(entry)
+			} else {
+				slru.probationCost += slru.cost(entry)
+			}
+		}
+	}
+	for slru.protectedCost > slru.protectedCapacity && slru.protected.Len() > 1 {
+		slru.demote(slru.protected.Back())
+	}
+	evicted := 0
+	for slru.probationCost+slru.protectedCost > slru.capacity {
+		victim := slru.probation.Back()
+		if victim == nil {
+			victim = slru.protected.Back()
+		}
+		slru.remove(victim)
+		evicted++
+	}
+	return evicted
+}
+
+func (slru *SegmentedLRU) Len() int {
+	return len(slru.entries)
+}
+
+// Size returns the sum of the sizes of the entries
+func (slru *SegmentedLRU) Size() int {
+	return slru.size
+}
+
+func (slru *SegmentedLRU) Purge() {
+	slru.entries = make(map[[32]byte]*list.Element)
+	slru.probation.Init()
+	slru.protected.Init()
+	slru.probationCost, slru.protectedCost, slru.size = 0, 0, 0
+}
+
+// Walk calls fn for every entry, from the least to the most recently used one of each segment,
+// probationary entries first, so that adding them again in that order preserves the order
+func (slru *SegmentedLRU) Walk(fn func(key [32]byte, value CachedResponse, protected bool)) {
+	for _, segment := range []*list.List{slru.probation, slru.protected} {
+		for element := segment.Back(); element != nil; element = element.Prev() {
+			entry := element.Value.(*segmentedLRUEntry)
+			fn(entry.key, entry.value, entry.protected)
+		}
+	}
+}
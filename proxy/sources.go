@@ -0,0 +1,342 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/dchest/safefile"
+
+	"github.com/jedisct1/dlog"
+	stamps "github.com/jedisct1/go-dnsstamps"
+	"github.com/jedisct1/go-minisign"
+)
+
+type SourceFormat int
+
+const (
+	SourceFormatV2 = iota
+)
+
+const (
+	SourcesRetryDelay = time.Duration(1) * time.Hour
+)
+
+type Source struct {
+	urls   []string
+	format SourceFormat
+	in     string
+}
+
+func fetchFromCache(storage Storage, cacheFile string, refreshDelay time.Duration) (in string, expired bool, delayTillNextUpdate time.Duration, err error) {
+	expired = false
+	modTime, err := storage.ModTime(cacheFile)
+	if err != nil {
+		dlog.Debugf("Cache file [%s] not present", cacheFile)
+		delayTillNextUpdate = time.Duration(0)
+		return
+	}
+	elapsed := time.Since(modTime)
+	if elapsed < refreshDelay {
+		dlog.Debugf("Cache file [%s] is still fresh", cacheFile)
+		delayTillNextUpdate = refreshDelay - elapsed
+	} else {
+		dlog.Debugf("Cache file [%s] needs to be refreshed", cacheFile)
+		delayTillNextUpdate = time.Duration(0)
+	}
+	var bin []byte
+	bin, err = storage.Read(cacheFile)
+	if err != nil {
+		delayTillNextUpdate = time.Duration(0)
+		return
+	}
+	in = string(bin)
+	if delayTillNextUpdate <= time.Duration(0) {
+		expired = true
+	}
+	return
+}
+
+// localSourcePath returns the path of a source given as a file:// URL or as a plain path
+func localSourcePath(urlStr string) (string, bool) {
+	if strings.HasPrefix(strings.ToLower(urlStr), "file://") {
+		path := urlStr[len("file://"):]
+		if len(path) >= 3 && path[0] == '/' && path[2] == ':' {
+			path = path[1:] // file:///C:/...
+		}
+		return filepath.FromSlash(path), true
+	}
+	if len(urlStr) > 0 && !strings.Contains(urlStr, "://") {
+		return urlStr, true
+	}
+	return "", false
+}
+
+func fetchWithCache(xTransport *XTransport, storage Storage, urlStr string, cacheFile string, refreshDelay time.Duration) (in string, cached bool, delayTillNextUpdate time.Duration, err error) {
+	cached = false
+	expired := false
+	// Local files are cheap to read, and may have been updated since they were cached
+	if path, isLocal := localSourcePath(urlStr); isLocal {
+		dlog.Infof("Loading source information from file [%s]", path)
+		var bin []byte
+		if bin, err = ioutil.ReadFile(path); err != nil {
+			return
+		}
+		in = string(bin)
+		delayTillNextUpdate = refreshDelay
+		return
+	}
+	in, expired, delayTillNextUpdate, err = fetchFromCache(storage, cacheFile, refreshDelay)
+	if err == nil && !expired {
+		dlog.Debugf("Delay till next update: %v", delayTillNextUpdate)
+		cached = true
+		return
+	}
+	if expired {
+		cached = true
+	}
+	if len(urlStr) == 0 {
+		if !expired {
+			err = fmt.Errorf("Cache file [%s] not present and no URL given to retrieve it", cacheFile)
+		}
+		return
+	}
+
+	dlog.Infof("Loading source information from URL [%s]", urlStr)
+
+	url, err := url.Parse(urlStr)
+	if err != nil {
+		return
+	}
+	var bin []byte
+	bin, err = xTransport.Download(url)
+	if err != nil {
+		return
+	}
+	cached = false
+	in = string(bin)
+	delayTillNextUpdate = refreshDelay
+	return
+}
+
+func AtomicFileWrite(file string, data []byte) error {
+	return safefile.WriteFile(file, data, 0644)
+}
+
+type URLToPrefetch struct {
+	url           string
+	storage       Storage
+	cacheFile     string
+	when          time.Time
+	refreshDelay  time.Duration
+	refreshJitter time.Duration
+}
+
+// withJitter adds a random delay, so that instances started at the same time don't fetch sources simultaneously
+func withJitter(delay time.Duration, jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return delay
+	}
+	return delay + time.Duration(rand.Int63n(int64(jitter)))
+}
+
+// checkStaleness returns an error if a cache file is older than maxStaleness; 0 means no limit
+func checkStaleness(storage Storage, cacheFile string, maxStaleness time.Duration) error {
+	if maxStaleness <= 0 {
+		return nil
+	}
+	modTime, err := storage.ModTime(cacheFile)
+	if err != nil {
+		return err
+	}
+	if age := time.Since(modTime); age > maxStaleness {
+		return fmt.Errorf("Cached copy of [%s] is too old (%v, maximum: %v)", cacheFile, age.Round(time.Minute), maxStaleness)
+	}
+	return nil
+}
+
+func NewSource(xTransport *XTransport, storage Storage, urls []string, minisignKeyStrs []string, cacheFile string, formatStr string, refreshDelay time.Duration, refreshJitter time.Duration, maxStaleness time.Duration) (Source, []URLToPrefetch, error) {
+	source := Source{urls: urls}
+	if formatStr == "v2" {
+		source.format = SourceFormatV2
+	} else {
+		return source, []URLToPrefetch{}, fmt.Errorf("Unsupported source format: [%s]", formatStr)
+	}
+	if len(minisignKeyStrs) == 0 {
+		return source, []URLToPrefetch{}, fmt.Errorf("Missing public key for source [%s]", cacheFile)
+	}
+	var minisignKeys []minisign.PublicKey
+	for _, minisignKeyStr := range minisignKeyStrs {
+		minisignKey, err := minisign.NewPublicKey(minisignKeyStr)
+		if err != nil {
+			return source, []URLToPrefetch{}, err
+		}
+		minisignKeys = append(minisignKeys, minisignKey)
+	}
+	now := time.Now()
+	urlsToPrefetch := []URLToPrefetch{}
+	sigCacheFile := cacheFile + ".minisig"
+
+	var sigStr, in string
+	var cached, sigCached bool
+	var delayTillNextUpdate, sigDelayTillNextUpdate time.Duration
+	var err, sigErr error
+	var preloadURL string
+	if len(urls) <= 0 {
+		in, cached, delayTillNextUpdate, err = fetchWithCache(xTransport, storage, "", cacheFile, refreshDelay)
+		sigStr, sigCached, sigDelayTillNextUpdate, sigErr = fetchWithCache(xTransport, storage, "", sigCacheFile, refreshDelay)
+	} else {
+		preloadURL = urls[0]
+		for _, url := range urls {
+			sigURL := url + ".minisig"
+			in, cached, delayTillNextUpdate, err = fetchWithCache(xTransport, storage, url, cacheFile, refreshDelay)
+			sigStr, sigCached, sigDelayTillNextUpdate, sigErr = fetchWithCache(xTransport, storage, sigURL, sigCacheFile, refreshDelay)
+			if err == nil && sigErr == nil {
+				if err = verifySource(minisignKeys, in, sigStr); err == nil {
+					preloadURL = url
+					break
+				}
+				if cached && sigCached {
+					storage.Remove(cacheFile)
+					storage.Remove(sigCacheFile)
+				}
+			}
+			dlog.Infof("Loading from [%s] failed", url)
+		}
+	}
+	if len(preloadURL) > 0 {
+		url := preloadURL
+		sigURL := url + ".minisig"
+		urlsToPrefetch = append(urlsToPrefetch, URLToPrefetch{url: url, storage: storage, cacheFile: cacheFile, when: now.Add(withJitter(delayTillNextUpdate, refreshJitter)), refreshDelay: refreshDelay, refreshJitter: refreshJitter})
+		urlsToPrefetch = append(urlsToPrefetch, URLToPrefetch{url: sigURL, storage: storage, cacheFile: sigCacheFile, when: now.Add(withJitter(sigDelayTillNextUpdate, refreshJitter)), refreshDelay: refreshDelay, refreshJitter: refreshJitter})
+	}
+	if sigErr != nil && err == nil {
+		err = sigErr
+	}
+	if err == nil && len(urls) <= 0 {
+		err = verifySource(minisignKeys, in, sigStr)
+		if err == nil && cached {
+			err = checkStaleness(storage, cacheFile, maxStaleness)
+		}
+	}
+	if err != nil {
+		// Fall back to the cached copy, even if it has expired, as long as it is properly signed
+		cachedIn, cacheErr := storage.Read(cacheFile)
+		cachedSig, sigCacheErr := storage.Read(sigCacheFile)
+		if cacheErr != nil || sigCacheErr != nil || verifySource(minisignKeys, string(cachedIn), string(cachedSig)) != nil {
+			return source, urlsToPrefetch, err
+		}
+		if staleErr := checkStaleness(storage, cacheFile, maxStaleness); staleErr != nil {
+			return source, urlsToPrefetch, fmt.Errorf("%v - %v", err, staleErr)
+		}
+		dlog.Warnf("Unable to update source [%s] (%v) - using the cached copy", cacheFile, err)
+		source.in = string(cachedIn)
+		for i := range urlsToPrefetch {
+			urlsToPrefetch[i].when = now.Add(withJitter(SourcesRetryDelay, refreshJitter))
+		}
+		return source, urlsToPrefetch, nil
+	}
+	if !cached {
+		if err = storage.Write(cacheFile, []byte(in)); err != nil {
+			dlog.Warnf("%s: %s", cacheFile, err)
+		}
+	}
+	if !sigCached {
+		if err = storage.Write(sigCacheFile, []byte(sigStr)); err != nil {
+			dlog.Warnf("%s: %s", sigCacheFile, err)
+		}
+	}
+	dlog.Noticef("Source [%s] loaded", cacheFile)
+	source.in = in
+	return source, urlsToPrefetch, nil
+}
+
+// verifySource checks that a source has been signed with one of the trusted keys
+func verifySource(minisignKeys []minisign.PublicKey, in string, sigStr string) error {
+	signature, err := minisign.DecodeSignature(sigStr)
+	if err != nil {
+		return err
+	}
+	for _, minisignKey := range minisignKeys {
+		if res, err := minisignKey.Verify([]byte(in), signature); err == nil && res {
+			return nil
+		}
+	}
+	return errors.New("Invalid signature")
+}
+
+func (source *Source) Parse(prefix string) ([]RegisteredServer, error) {
+	if source.format == SourceFormatV2 {
+		return source.parseV2(prefix)
+	}
+	dlog.Fatal("Unexpected source format")
+	return []RegisteredServer{}, nil
+}
+
+func (source *Source) parseV2(prefix string) ([]RegisteredServer, error) {
+	var registeredServers []RegisteredServer
+	in := string(source.in)
+	parts := strings.Split(in, "## ")
+	if len(parts) < 2 {
+		return registeredServers, fmt.Errorf("Invalid format for source at [%v]", source.urls)
+	}
+	parts = parts[1:]
+	for _, part := range parts {
+		part = strings.TrimFunc(part, unicode.IsSpace)
+		subparts := strings.Split(part, "\n")
+		if len(subparts) < 2 {
+			return registeredServers, fmt.Errorf("Invalid format for source at [%v]", source.urls)
+		}
+		name := strings.TrimFunc(subparts[0], unicode.IsSpace)
+		if len(name) == 0 {
+			return registeredServers, fmt.Errorf("Invalid format for source at [%v]", source.urls)
+		}
+		subparts = subparts[1:]
+		name = prefix + name
+		var stampStr, description string
+		for _, subpart := range subparts {
+			subpart = strings.TrimFunc(subpart, unicode.IsSpace)
+			if strings.HasPrefix(subpart, "sdns://") {
+				if len(stampStr) > 0 {
+					return registeredServers, fmt.Errorf("Multiple stamps for server [%s] in source from [%v]", name, source.urls)
+				}
+				stampStr = subpart
+				continue
+			} else if len(subpart) == 0 || strings.HasPrefix(subpart, "//") {
+				continue
+			}
+			if len(description) > 0 {
+				description += "\n"
+			}
+			description += subpart
+		}
+		if len(stampStr) < 8 {
+			return registeredServers, fmt.Errorf("Missing stamp for server [%s] in source from [%v]", name, source.urls)
+		}
+		stamp, err := stamps.NewServerStampFromString(stampStr)
+		if err != nil {
+			return registeredServers, err
+		}
+		registeredServer := RegisteredServer{
+			name: name, stamp: stamp, description: description,
+		}
+		dlog.Debugf("Registered [%s] with stamp [%s]", name, stamp.String())
+		registeredServers = append(registeredServers, registeredServer)
+	}
+	return registeredServers, nil
+}
+
+func PrefetchSourceURL(xTransport *XTransport, urlToPrefetch *URLToPrefetch) error {
+	in, cached, delayTillNextUpdate, err := fetchWithCache(xTransport, urlToPrefetch.storage, urlToPrefetch.url, urlToPrefetch.cacheFile, urlToPrefetch.refreshDelay)
+	if err == nil && !cached {
+		urlToPrefetch.storage.Write(urlToPrefetch.cacheFile, []byte(in))
+	}
+	urlToPrefetch.when = time.Now().Add(withJitter(delayTillNextUpdate, urlToPrefetch.refreshJitter))
+	return err
+}
@@ -0,0 +1,302 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	crypto_rand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const (
+	// Largest state accepted from a primary proxy
+	HAStateMaxSize = 256 * 1024 * 1024
+	// State requests whose timestamp differs more than this from the local clock are refused
+	HAMaxClockSkew = 30 * time.Second
+)
+
+type HighAvailabilityConfig struct {
+	Role          string `toml:"role"`
+	Primary       string `toml:"primary"`
+	Secret        string `toml:"secret"`
+	CheckInterval int    `toml:"check_interval"`
+	MaxFailures   int    `toml:"max_failures"`
+	StateInterval int    `toml:"state_interval"`
+	VirtualIP     string `toml:"virtual_ip"`
+	Interface     string `toml:"interface"`
+}
+
+// HAState is what a standby proxy copies from the primary, so that it doesn't start cold
+type HAState struct {
+	Latencies map[string]float64 `json:"latencies"`
+	Cache     string             `json:"cache"`
+}
+
+// Standby keeps a proxy idle while its primary is healthy. The sockets are bound on startup, so
+// that privileges can be dropped, but queries are only read once the primary has failed a number
+// of consecutive health checks. The standby then takes the virtual IP over, if there is one, and
+// gives it back once the primary has passed the same number of consecutive health checks.
+//
+// The state of the primary is requested with a random challenge, authenticated with a key derived
+// from the shared secret. The primary returns it encrypted and authenticated with that key:
+//
+//	request:  ts (8) || challenge (16) || HMAC-SHA256(key, ts || challenge), hex-encoded
+//	response: nonce (24) || secretbox(challenge (16) || state)
+//
+// so that the secret is never sent, and the state can't be read, modified or replayed.
+type Standby struct {
+	primary       string
+	key           *[32]byte
+	checkInterval time.Duration
+	maxFailures   int
+	stateInterval time.Duration
+	client        *http.Client
+	active        int32
+}
+
+func NewStandby(config *HighAvailabilityConfig) (*Standby, error) {
+	if len(config.Primary) == 0 {
+		return nil, errors.New("A standby proxy requires the address of the primary")
+	}
+	if config.CheckInterval <= 0 || config.MaxFailures <= 0 || config.StateInterval <= 0 {
+		return nil, errors.New("check_interval, max_failures and state_interval must be positive")
+	}
+	primary := strings.TrimSuffix(config.Primary, "/")
+	if !strings.Contains(primary, "://") {
+		primary = "http://" + primary
+	}
+	checkInterval := time.Duration(config.CheckInterval) * time.Second
+	return &Standby{
+		primary:       primary,
+		key:           haKey(config.Secret),
+		checkInterval: checkInterval,
+		maxFailures:   config.MaxFailures,
+		stateInterval: time.Duration(config.StateInterval) * time.Second,
+		client:        &http.Client{Timeout: checkInterval},
+	}, nil
+}
+
+// haKey derives the key shared by a primary and a standby proxy, if there is a secret
+func haKey(secret string) *[32]byte {
+	if len(secret) == 0 {
+		return nil
+	}
+	key := deriveKey([]byte(secret), "dnscrypt-proxy high availability")
+	return &key
+}
+
+func (standby *Standby) isActive() bool {
+	return standby != nil && atomic.LoadInt32(&standby.active) != 0
+}
+
+// monitor checks the health of the primary. The standby starts serving queries once the primary has
+// failed, and stands by again once it has recovered. Listeners are not stopped at that point: the
+// queries that still reach this proxy while the virtual IP moves back keep being answered.
+func (standby *Standby) monitor(proxy *Proxy, serve []func()) {
+	dlog.Noticef("Standing by while [%s] is healthy", standby.primary)
+	failures, successes := 0, 0
+	var lastState time.Time
+	for atomic.LoadInt32(&proxy.stopping) == 0 {
+		err := standby.checkPrimary()
+		if standby.isActive() {
+			if err != nil {
+				successes = 0
+			} else if successes++; successes >= standby.maxFailures {
+				if err := standby.standBy(proxy); err != nil {
+					// Still serving queries; tried again after the next successful check
+					dlog.Errorf("Unable to stand by: %v", err)
+					successes--
+				} else {
+					successes = 0
+				}
+			}
+		} else if err != nil {
+			failures++
+			dlog.Warnf("Primary health check failed (%d/%d): %v", failures, standby.maxFailures, err)
+			if failures >= standby.maxFailures {
+				if err := standby.takeOver(proxy, serve); err != nil {
+					// Not serving queries; tried again after the next failed check
+					dlog.Errorf("Unable to take over: %v", err)
+					failures--
+				} else {
+					failures = 0
+					serve = nil
+				}
+			}
+		} else {
+			failures = 0
+			if standby.key != nil && time.Since(lastState) >= standby.stateInterval {
+				if err := standby.copyState(proxy); err != nil {
+					dlog.Warnf("Unable to copy the state of the primary: %v", err)
+				} else {
+					lastState = time.Now()
+				}
+			}
+		}
+		time.Sleep(standby.checkInterval)
+	}
+}
+
+// takeOver acquires the virtual IP, if there is one, and starts serving queries. Nothing is served
+// if the address can't be acquired.
+func (standby *Standby) takeOver(proxy *Proxy, serve []func()) error {
+	dlog.Notice("The primary is down - taking over")
+	if proxy.virtualIP != nil {
+		if err := proxy.virtualIP.acquire(); err != nil {
+			return err
+		}
+	}
+	atomic.StoreInt32(&standby.active, 1)
+	for _, start := range serve {
+		start()
+	}
+	return nil
+}
+
+// standBy gives the virtual IP back to the primary. The listeners bound to it were bound with
+// IP_FREEBIND, so they remain valid once it is removed, and receive queries again after the next
+// takeover. If the address can't be removed, the proxy keeps serving queries, so that it isn't
+// held by a proxy that doesn't answer.
+func (standby *Standby) standBy(proxy *Proxy) error {
+	if err := proxy.virtualIP.release(); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&standby.active, 0)
+	dlog.Noticef("The primary is back - standing by while [%s] is healthy", standby.primary)
+	return nil
+}
+
+func (standby *Standby) checkPrimary() error {
+	resp, err := standby.client.Get(standby.primary + "/healthz")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Status: %s", resp.Status)
+	}
+	return nil
+}
+
+func haRequestMAC(key *[32]byte, ts []byte, challenge []byte) []byte {
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write(ts)
+	mac.Write(challenge)
+	return mac.Sum(nil)
+}
+
+// copyState imports the cache and the server latencies of the primary
+func (standby *Standby) copyState(proxy *Proxy) error {
+	request := make([]byte, 24, 24+sha256.Size)
+	binary.BigEndian.PutUint64(request[0:8], uint64(time.Now().UnixNano()))
+	if _, err := crypto_rand.Read(request[8:24]); err != nil {
+		return err
+	}
+	request = append(request, haRequestMAC(standby.key, request[0:8], request[8:24])...)
+	req, err := http.NewRequest("GET", standby.primary+"/ha/state", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-HA-Request", hex.EncodeToString(request))
+	// The cache can take a while to be transferred
+	client := http.Client{Timeout: standby.stateInterval}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Status: %s", resp.Status)
+	}
+	sealed, err := ioutil.ReadAll(io.LimitReader(resp.Body, HAStateMaxSize))
+	if err != nil {
+		return err
+	}
+	if len(sealed) < 24+secretbox.Overhead+16 {
+		return errors.New("Short state")
+	}
+	var nonce [24]byte
+	copy(nonce[:], sealed[:24])
+	bin, ok := secretbox.Open(nil, sealed[24:], &nonce, standby.key)
+	if !ok || !bytes.Equal(bin[:16], request[8:24]) {
+		return errors.New("Unauthenticated state -- Check that both proxies use the same secret")
+	}
+	var state HAState
+	if err := json.Unmarshal(bin[16:], &state); err != nil {
+		return err
+	}
+	imported := 0
+	if proxy.pluginsSettings().cache {
+		if imported, err = cachedResponses.loadDump(proxy, strings.NewReader(state.Cache), "state"); err != nil {
+			return err
+		}
+	}
+	proxy.serversInfo.setLatencies(state.Latencies)
+	dlog.Infof("State copied from the primary: %d cache entries, %d server latencies", imported, len(state.Latencies))
+	return nil
+}
+
+// haState returns the state a standby proxy copies
+func (proxy *Proxy) haState() HAState {
+	state := HAState{Latencies: make(map[string]float64)}
+	proxy.serversInfo.RLock()
+	for _, serverInfo := range proxy.serversInfo.inner {
+		state.Latencies[serverInfo.Name] = serverInfo.rttValue()
+	}
+	proxy.serversInfo.RUnlock()
+	state.Cache, _ = cachedResponses.dump()
+	return state
+}
+
+func (proxy *Proxy) serveHAState(w http.ResponseWriter, r *http.Request) {
+	request, err := hex.DecodeString(r.Header.Get("X-HA-Request"))
+	if err != nil || len(request) != 24+sha256.Size ||
+		!hmac.Equal(request[24:], haRequestMAC(proxy.haKey, request[0:8], request[8:24])) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if skew := time.Since(time.Unix(0, int64(binary.BigEndian.Uint64(request[0:8])))); skew > HAMaxClockSkew || skew < -HAMaxClockSkew {
+		http.Error(w, "Clock skew", http.StatusUnauthorized)
+		return
+	}
+	bin, err := json.Marshal(proxy.haState())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var nonce [24]byte
+	if _, err := crypto_rand.Read(nonce[:]); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(secretbox.Seal(nonce[:], append(request[8:24:24], bin...), &nonce, proxy.haKey))
+}
+
+// setLatencies replaces the estimated latencies of the servers by the ones of another proxy
+func (serversInfo *ServersInfo) setLatencies(latencies map[string]float64) {
+	serversInfo.Lock()
+	for _, serverInfo := range serversInfo.inner {
+		if rtt, ok := latencies[serverInfo.Name]; ok && rtt > 0 {
+			serverInfo.Lock()
+			serverInfo.rtt.Set(rtt)
+			serverInfo.Unlock()
+		}
+	}
+	serversInfo.Unlock()
+	serversInfo.sortByRtt()
+}
@@ -0,0 +1,315 @@
+package proxy
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	StatsQPSWindow       = 60
+	StatsTopNames        = 10
+	StatsMaxTrackedNames = 10000
+	ServerLatencySamples = 256
+)
+
+// Stats keeps counters about the queries processed by the proxy. It is shared by all the
+// consumers of statistics, so that they report consistent numbers.
+// A nil *Stats is valid, and doesn't record anything.
+type Stats struct {
+	sync.Mutex
+	startTime  time.Time
+	queries    uint64
+	blocked    uint64
+	failures   uint64
+	coalesced  uint64
+	perSecond  [StatsQPSWindow]uint64
+	lastSecond int64
+	topQueried *TopNames
+	topBlocked *TopNames
+}
+
+type NameCount struct {
+	Name  string `json:"name"`
+	Count uint64 `json:"count"`
+}
+
+type ServerHealth struct {
+	Name                string  `json:"name"`
+	Proto               string  `json:"proto"`
+	RTT                 int     `json:"rtt_ms"`
+	ConsecutiveFailures int     `json:"consecutive_failures"`
+	Down                bool    `json:"down"`
+	Successes           uint64  `json:"successes"`
+	Errors              uint64  `json:"errors"`
+	Timeouts            uint64  `json:"timeouts"`
+	ErrorRate           float64 `json:"error_rate"`
+	TimeoutRate         float64 `json:"timeout_rate"`
+	LatencyP50          int     `json:"latency_p50_ms"`
+	LatencyP90          int     `json:"latency_p90_ms"`
+	LatencyP99          int     `json:"latency_p99_ms"`
+	OverBudget          uint64  `json:"over_budget,omitempty"`
+	EDNSBufferSize      int     `json:"edns_buffer_size,omitempty"`
+	NXDomainRedirect    bool    `json:"nxdomain_redirect,omitempty"`
+}
+
+type CacheStats struct {
+	Enabled        bool    `json:"enabled"`
+	Entries        int     `json:"entries"`
+	Capacity       int     `json:"capacity,omitempty"`
+	CapacityBytes  uint64  `json:"capacity_bytes,omitempty"`
+	Hits           uint64  `json:"hits"`
+	Misses         uint64  `json:"misses"`
+	HitRatio       float64 `json:"hit_ratio"`
+	Expired        uint64  `json:"expired"`
+	Evictions      uint64  `json:"evictions"`
+	PeerHits       uint64  `json:"peer_hits,omitempty"`
+	PeerServed     uint64  `json:"peer_served,omitempty"`
+	MemoryEstimate uint64  `json:"memory_estimate_bytes"`
+}
+
+// StatsSnapshot is a consistent copy of the statistics, suitable for serialization
+type StatsSnapshot struct {
+	Uptime      int64          `json:"uptime_s"`
+	Queries     uint64         `json:"queries"`
+	Blocked     uint64         `json:"blocked"`
+	Failures    uint64         `json:"failures"`
+	Coalesced   uint64         `json:"coalesced"`
+	QPS         float64        `json:"qps"`
+	QPSHistory  []uint64       `json:"qps_history"`
+	TopQueried  []NameCount    `json:"top_queried"`
+	TopBlocked  []NameCount    `json:"top_blocked"`
+	Cache       CacheStats     `json:"cache"`
+	Servers     []ServerHealth `json:"servers"`
+	Plugins     []PluginTiming `json:"plugins"`
+	Malformed   MalformedStats `json:"malformed_queries"`
+	Upstream    FailureStats   `json:"upstream_failures"`
+	ActiveConns uint32         `json:"active_clients"`
+}
+
+func NewStats() *Stats {
+	return &Stats{
+		startTime:  time.Now(),
+		lastSecond: time.Now().Unix(),
+		topQueried: NewTopNames(),
+		topBlocked: NewTopNames(),
+	}
+}
+
+// recordQuery accounts for a query, once it has been processed by the query plugins
+func (stats *Stats) recordQuery(pluginsState *PluginsState) {
+	if stats == nil {
+		return
+	}
+	stats.Lock()
+	defer stats.Unlock()
+	stats.advance(time.Now().Unix())
+	stats.queries++
+	stats.perSecond[stats.lastSecond%StatsQPSWindow]++
+	if len(pluginsState.qName) > 0 {
+		stats.topQueried.add(pluginsState.qName, time.Now())
+	}
+	if pluginsState.action == PluginsActionReject || len(pluginsState.rejectReason) > 0 {
+		stats.addBlocked(pluginsState.qName)
+	}
+}
+
+// TopNames returns the most queried or the most blocked names over a window
+func (stats *Stats) TopNames(blocked bool, window time.Duration, n int) []NameCount {
+	stats.Lock()
+	defer stats.Unlock()
+	if blocked {
+		return stats.topBlocked.top(window, n, time.Now())
+	}
+	return stats.topQueried.top(window, n, time.Now())
+}
+
+// recordBlockedResponse accounts for a query whose response was blocked by the response plugins
+func (stats *Stats) recordBlockedResponse(pluginsState *PluginsState) {
+	if stats == nil {
+		return
+	}
+	stats.Lock()
+	stats.addBlocked(pluginsState.qName)
+	stats.Unlock()
+}
+
+func (stats *Stats) addBlocked(qName string) {
+	stats.blocked++
+	if len(qName) > 0 {
+		stats.topBlocked.add(qName, time.Now())
+	}
+}
+
+// recordUpstream accounts for a query that had to be forwarded to a server
+func (stats *Stats) recordUpstream(err error) {
+	if stats == nil {
+		return
+	}
+	stats.Lock()
+	if err != nil {
+		stats.failures++
+	}
+	stats.Unlock()
+}
+
+// recordCoalesced accounts for a query that got the response of an identical query
+func (stats *Stats) recordCoalesced() {
+	if stats == nil {
+		return
+	}
+	stats.Lock()
+	stats.coalesced++
+	stats.Unlock()
+}
+
+// advance clears the per-second counters of the seconds that elapsed without any queries
+func (stats *Stats) advance(now int64) {
+	elapsed := now - stats.lastSecond
+	if elapsed <= 0 {
+		return
+	}
+	if elapsed > StatsQPSWindow {
+		elapsed = StatsQPSWindow
+	}
+	for i := int64(1); i <= elapsed; i++ {
+		stats.perSecond[(stats.lastSecond+i)%StatsQPSWindow] = 0
+	}
+	stats.lastSecond = now
+}
+
+func (stats *Stats) Snapshot(proxy *Proxy) StatsSnapshot {
+	stats.Lock()
+	now := time.Now()
+	stats.advance(now.Unix())
+	snapshot := StatsSnapshot{
+		Uptime:     int64(now.Sub(stats.startTime).Seconds()),
+		Queries:    stats.queries,
+		Blocked:    stats.blocked,
+		Failures:   stats.failures,
+		Coalesced:  stats.coalesced,
+		QPSHistory: make([]uint64, 0, StatsQPSWindow),
+		TopQueried: stats.topQueried.top(time.Hour, StatsTopNames, now),
+		TopBlocked: stats.topBlocked.top(time.Hour, StatsTopNames, now),
+	}
+	// Oldest first; the current second is incomplete and is not part of the history
+	var total uint64
+	for i := int64(StatsQPSWindow - 1); i >= 1; i-- {
+		count := stats.perSecond[(stats.lastSecond-i)%StatsQPSWindow]
+		snapshot.QPSHistory = append(snapshot.QPSHistory, count)
+		total += count
+	}
+	stats.Unlock()
+	snapshot.QPS = float64(total) / float64(StatsQPSWindow-1)
+
+	snapshot.Cache = cachedResponses.stats(proxy)
+	snapshot.Servers = proxy.serversInfo.health()
+	snapshot.Plugins = proxy.pluginTimings.snapshot()
+	snapshot.Malformed = proxy.malformed.snapshot()
+	snapshot.Upstream = proxy.upstreamFailures.snapshot()
+	snapshot.ActiveConns = atomic.LoadUint32(&proxy.clientsCount)
+	return snapshot
+}
+
+// health returns the state of the live servers, fastest first
+func (serversInfo *ServersInfo) health() []ServerHealth {
+	serversInfo.RLock()
+	defer serversInfo.RUnlock()
+	servers := make([]ServerHealth, 0, len(serversInfo.inner))
+	for _, serverInfo := range serversInfo.inner {
+		serverInfo.RLock()
+		health := ServerHealth{
+			Name:                serverInfo.Name,
+			Proto:               serverInfo.Proto.String(),
+			RTT:                 int(serverInfo.rtt.Value()),
+			ConsecutiveFailures: serverInfo.failures,
+			Down:                serverInfo.down,
+		}
+		serverStats, nxRedirect, ednsSize := serverInfo.stats, serverInfo.nxRedirect, serverInfo.ednsSize
+		serverInfo.RUnlock()
+		serverStats.fill(&health)
+		health.NXDomainRedirect = nxRedirect.detected()
+		health.EDNSBufferSize = ednsSize.limit()
+		servers = append(servers, health)
+	}
+	return servers
+}
+
+// ServerStats keeps track of the exchanges with a server. It is kept when the server
+// information is refreshed, so that it covers the whole lifetime of the proxy.
+type ServerStats struct {
+	sync.Mutex
+	successes    uint64
+	errors       uint64
+	timeouts     uint64
+	overBudget   uint64
+	latencies    [ServerLatencySamples]uint32
+	latencyCount uint64
+}
+
+func NewServerStats() *ServerStats {
+	return &ServerStats{}
+}
+
+// record accounts for an exchange; errors include timeouts
+func (serverStats *ServerStats) record(elapsed time.Duration, err error) {
+	if serverStats == nil {
+		return
+	}
+	serverStats.Lock()
+	defer serverStats.Unlock()
+	if err != nil {
+		serverStats.errors++
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			serverStats.timeouts++
+		}
+		return
+	}
+	serverStats.successes++
+	serverStats.latencies[serverStats.latencyCount%ServerLatencySamples] = uint32(elapsed.Nanoseconds() / 1000000)
+	serverStats.latencyCount++
+}
+
+// recordOverBudget accounts for a query that couldn't be answered within the latency budget
+func (serverStats *ServerStats) recordOverBudget() {
+	if serverStats == nil {
+		return
+	}
+	serverStats.Lock()
+	serverStats.overBudget++
+	serverStats.Unlock()
+}
+
+// fill computes the rates, and the latency percentiles of the most recent successful exchanges
+func (serverStats *ServerStats) fill(health *ServerHealth) {
+	if serverStats == nil {
+		return
+	}
+	serverStats.Lock()
+	health.Successes, health.Errors, health.Timeouts = serverStats.successes, serverStats.errors, serverStats.timeouts
+	health.OverBudget = serverStats.overBudget
+	count := serverStats.latencyCount
+	if count > ServerLatencySamples {
+		count = ServerLatencySamples
+	}
+	latencies := make([]int, count)
+	for i := range latencies {
+		latencies[i] = int(serverStats.latencies[i])
+	}
+	serverStats.Unlock()
+
+	if total := health.Successes + health.Errors; total > 0 {
+		health.ErrorRate = float64(health.Errors) / float64(total)
+		health.TimeoutRate = float64(health.Timeouts) / float64(total)
+	}
+	if len(latencies) == 0 {
+		return
+	}
+	sort.Ints(latencies)
+	percentile := func(p int) int {
+		return latencies[(len(latencies)-1)*p/100]
+	}
+	health.LatencyP50, health.LatencyP90, health.LatencyP99 = percentile(50), percentile(90), percentile(99)
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Storage keeps the state that has to survive restarts: cached copies of the sources and of the
+// remote lists, the certificate log, the certificate bootstrap cache and cache snapshots.
+// Items are identified by a name. Reading or stating an item that doesn't exist returns an
+// error for which os.IsNotExist() is true.
+type Storage interface {
+	Read(name string) ([]byte, error)
+	// Write replaces the content of an item atomically
+	Write(name string, data []byte) error
+	Append(name string, data []byte) error
+	Remove(name string) error
+	ModTime(name string) (time.Time, error)
+}
+
+// FileStorage stores every item in a file. Names that are not absolute paths are relative to a
+// state directory, if there is one, or to the current directory.
+type FileStorage struct {
+	dir string
+}
+
+func NewFileStorage(dir string) (*FileStorage, error) {
+	if len(dir) > 0 {
+		var err error
+		if dir, err = filepath.Abs(dir); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("Unable to create the state directory [%s]: %v", dir, err)
+		}
+	}
+	return &FileStorage{dir: dir}, nil
+}
+
+func (storage *FileStorage) path(name string) string {
+	if len(storage.dir) == 0 || filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(storage.dir, name)
+}
+
+func (storage *FileStorage) Read(name string) ([]byte, error) {
+	return ioutil.ReadFile(storage.path(name))
+}
+
+func (storage *FileStorage) Write(name string, data []byte) error {
+	return AtomicFileWrite(storage.path(name), data)
+}
+
+func (storage *FileStorage) Append(name string, data []byte) error {
+	fp, err := os.OpenFile(storage.path(name), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = fp.Write(data); err != nil {
+		fp.Close()
+		return err
+	}
+	return fp.Close()
+}
+
+func (storage *FileStorage) Remove(name string) error {
+	return os.Remove(storage.path(name))
+}
+
+func (storage *FileStorage) ModTime(name string) (time.Time, error) {
+	fi, err := os.Stat(storage.path(name))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
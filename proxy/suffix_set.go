@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// Number of keys per front-coded block
+const suffixSetBlockSize = 16
+
+type suffixSetEntry struct {
+	key string
+	val interface{}
+}
+
+// SuffixSet is a compact, read-mostly set of strings. Keys are kept sorted in a
+// single byte slice, in blocks of 16 keys. The first key of a block is stored as
+// is, the following ones only store what differs from the previous key, so that
+// millions of reversed names, that share long prefixes, only require a few bytes
+// each. Values are only stored for keys that have one.
+type SuffixSet struct {
+	pending []suffixSetEntry
+	blob    []byte
+	blocks  []uint32
+	count   int
+	vals    map[uint32]interface{}
+}
+
+func NewSuffixSet() *SuffixSet {
+	return &SuffixSet{vals: make(map[uint32]interface{})}
+}
+
+func (suffixSet *SuffixSet) Insert(key string, val interface{}) {
+	suffixSet.pending = append(suffixSet.pending, suffixSetEntry{key: key, val: val})
+}
+
+func (suffixSet *SuffixSet) Len() int {
+	return suffixSet.count
+}
+
+// blockHead returns the first key of a block
+func (suffixSet *SuffixSet) blockHead(block int) []byte {
+	offset := int(suffixSet.blocks[block])
+	length, n := binary.Uvarint(suffixSet.blob[offset:])
+	offset += n
+	return suffixSet.blob[offset : offset+int(length)]
+}
+
+// walkBlock calls fn with every key of a block, and its index, until fn returns false. The
+// key is only valid until fn returns.
+func (suffixSet *SuffixSet) walkBlock(block int, buf []byte, fn func(i int, key []byte) bool) {
+	offset := int(suffixSet.blocks[block])
+	end := len(suffixSet.blob)
+	if block+1 < len(suffixSet.blocks) {
+		end = int(suffixSet.blocks[block+1])
+	}
+	key := buf[:0]
+	for i := block * suffixSetBlockSize; offset < end; i++ {
+		shared := uint64(0)
+		if i%suffixSetBlockSize != 0 {
+			var n int
+			shared, n = binary.Uvarint(suffixSet.blob[offset:])
+			offset += n
+		}
+		length, n := binary.Uvarint(suffixSet.blob[offset:])
+		offset += n
+		key = append(key[:shared], suffixSet.blob[offset:offset+int(length)]...)
+		offset += int(length)
+		if !fn(i, key) {
+			return
+		}
+	}
+}
+
+func (suffixSet *SuffixSet) Compile() {
+	if len(suffixSet.pending) == 0 {
+		return
+	}
+	entries := suffixSet.pending
+	suffixSet.pending = nil
+	for block := range suffixSet.blocks {
+		suffixSet.walkBlock(block, nil, func(i int, key []byte) bool {
+			entries = append(entries, suffixSetEntry{key: string(key), val: suffixSet.vals[uint32(i)]})
+			return true
+		})
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+	var blob []byte
+	var blocks []uint32
+	vals := make(map[uint32]interface{})
+	var varint [binary.MaxVarintLen64]byte
+	count, previous := 0, ""
+	for i, entry := range entries {
+		if i > 0 && entry.key == entries[i-1].key {
+			continue
+		}
+		if entry.val != nil {
+			vals[uint32(count)] = entry.val
+		}
+		suffix := entry.key
+		if count%suffixSetBlockSize == 0 {
+			blocks = append(blocks, uint32(len(blob)))
+		} else {
+			shared := 0
+			for shared < len(previous) && shared < len(suffix) && previous[shared] == suffix[shared] {
+				shared++
+			}
+			blob = append(blob, varint[:binary.PutUvarint(varint[:], uint64(shared))]...)
+			suffix = suffix[shared:]
+		}
+		blob = append(blob, varint[:binary.PutUvarint(varint[:], uint64(len(suffix)))]...)
+		blob = append(blob, suffix...)
+		previous = entry.key
+		count++
+	}
+	suffixSet.blob = append([]byte{}, blob...)
+	suffixSet.blocks, suffixSet.count, suffixSet.vals = blocks, count, vals
+}
+
+func (suffixSet *SuffixSet) Get(key string) (interface{}, bool) {
+	// The key can only be in the last block whose first key is not greater than it.
+	// Comparing converted byte slices doesn't allocate.
+	block := sort.Search(len(suffixSet.blocks), func(block int) bool {
+		return string(suffixSet.blockHead(block)) > key
+	}) - 1
+	if block < 0 {
+		return nil, false
+	}
+	var buf [256]byte
+	found := -1
+	suffixSet.walkBlock(block, buf[:], func(i int, candidate []byte) bool {
+		if string(candidate) == key {
+			found = i
+		}
+		return found < 0 && string(candidate) < key
+	})
+	if found < 0 {
+		return nil, false
+	}
+	return suffixSet.vals[uint32(found)], true
+}
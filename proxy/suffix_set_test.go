@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+const benchmarkBlocklistSize = 3000000
+
+var (
+	benchmarkMatcher     *PatternMatcher
+	benchmarkMatcherOnce sync.Once
+)
+
+func syntheticBlockedName(i int) string {
+	return fmt.Sprintf("ads%d.tracker%d.example%d.com", i, i%9973, i%97)
+}
+
+// blocklistMatcher builds a matcher with a few million suffix rules, once, and logs how much
+// memory it uses
+func blocklistMatcher(b *testing.B) *PatternMatcher {
+	benchmarkMatcherOnce.Do(func() {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		matcher := NewPatternPatcher()
+		for i := 0; i < benchmarkBlocklistSize; i++ {
+			if _, err := matcher.Add(syntheticBlockedName(i), nil, i+1); err != nil {
+				b.Fatal(err)
+			}
+		}
+		matcher.Eval("warm.up")
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		b.Logf("%d rules: %.1f MB", benchmarkBlocklistSize, float64(after.HeapAlloc-before.HeapAlloc)/(1024*1024))
+		benchmarkMatcher = matcher
+	})
+	return benchmarkMatcher
+}
+
+func TestSuffixSet(t *testing.T) {
+	suffixSet := NewSuffixSet()
+	for i := 0; i < 1000; i += 2 {
+		suffixSet.Insert(fmt.Sprintf("moc.%04d", i), i)
+	}
+	suffixSet.Insert("moc.0002", nil)
+	suffixSet.Compile()
+	suffixSet.Insert("ten.elpmaxe", "net")
+	suffixSet.Compile()
+	if suffixSet.Len() != 501 {
+		t.Fatalf("Expected 501 keys, got %d", suffixSet.Len())
+	}
+	for i := 0; i < 1000; i++ {
+		val, found := suffixSet.Get(fmt.Sprintf("moc.%04d", i))
+		if found != (i%2 == 0) || (found && val != i) {
+			t.Fatalf("Unexpected result for %d: %v %v", i, val, found)
+		}
+	}
+	if val, found := suffixSet.Get("ten.elpmaxe"); !found || val != "net" {
+		t.Fatal("Key inserted after the first compilation not found")
+	}
+	for _, key := range []string{"", "a", "moc.", "moc.00000", "zzz"} {
+		if _, found := suffixSet.Get(key); found {
+			t.Fatalf("[%s] should not be found", key)
+		}
+	}
+}
+
+func BenchmarkSuffixSetLookup(b *testing.B) {
+	matcher := blocklistMatcher(b)
+	hits := make([]string, 1024)
+	misses := make([]string, 1024)
+	for i := range hits {
+		hits[i] = "www.cdn." + syntheticBlockedName(i*2927%benchmarkBlocklistSize)
+		misses[i] = fmt.Sprintf("www.cdn.site%d.example%d.org", i, i%97)
+	}
+	if reject, _, _ := matcher.Eval(hits[0]); !reject {
+		b.Fatalf("[%s] should be blocked", hits[0])
+	}
+	if reject, _, _ := matcher.Eval(misses[0]); reject {
+		b.Fatalf("[%s] should not be blocked", misses[0])
+	}
+	b.Run("hit", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			matcher.Eval(hits[i%len(hits)])
+		}
+	})
+	b.Run("miss", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			matcher.Eval(misses[i%len(misses)])
+		}
+	})
+}
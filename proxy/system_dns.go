@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	SystemDNSMonitorOff = iota
+	SystemDNSMonitorLog
+	SystemDNSMonitorRepair
+)
+
+const (
+	SystemDNSMonitorInterval = 30 * time.Second
+	// Interfaces changed back this many times within SystemDNSRepairWindow are left alone,
+	// rather than fighting with the software changing them
+	SystemDNSMaxRepairs   = 5
+	SystemDNSRepairWindow = 10 * time.Minute
+	// Name of the item in the state directory keeping the settings to restore, if the proxy
+	// doesn't exit cleanly
+	SystemDNSBackupFile = "system-dns-backup.json"
+)
+
+// SystemDNSChange describes a network interface that doesn't use the proxy for DNS resolution
+type SystemDNSChange struct {
+	interfaceName string
+	id            string
+	servers       []string
+	source        string
+	repairable    bool
+}
+
+func parseSystemDNSMonitor(mode string) (int, error) {
+	switch strings.ToLower(mode) {
+	case "", "off":
+		return SystemDNSMonitorOff, nil
+	case "log":
+		return SystemDNSMonitorLog, nil
+	case "repair":
+		return SystemDNSMonitorRepair, nil
+	}
+	return SystemDNSMonitorOff, fmt.Errorf("Unsupported system DNS monitoring mode [%s] -- Use off, log or repair", mode)
+}
+
+// systemDNSAddresses returns the loopback addresses the proxy listens to on port 53, as the system
+// resolver can't use a different port
+func (proxy *Proxy) systemDNSAddresses() (ipv4Address string, ipv6Address string) {
+	for _, listener := range proxy.listeners {
+		if !listener.udp || listener.dnscrypt {
+			continue
+		}
+		host, port, err := net.SplitHostPort(listener.address)
+		if err != nil || port != "53" {
+			continue
+		}
+		ip := net.ParseIP(host)
+		if ip == nil || !ip.IsLoopback() {
+			continue
+		}
+		if ip.To4() != nil {
+			if len(ipv4Address) == 0 {
+				ipv4Address = ip.String()
+			}
+		} else if len(ipv6Address) == 0 {
+			ipv6Address = ip.String()
+		}
+	}
+	return
+}
+
+// rememberSystemDNS records the previous settings of an interface that has been changed after
+// startup, so that they are restored on exit, unless they have already been recorded
+func (proxy *Proxy) rememberSystemDNS(previous SystemDNSSetting, same func(SystemDNSSetting) bool) {
+	if !proxy.setSystemDNS {
+		return
+	}
+	proxy.systemDNSLock.Lock()
+	defer proxy.systemDNSLock.Unlock()
+	for _, setting := range proxy.previousSystemDNS {
+		if same(setting) {
+			return
+		}
+	}
+	proxy.previousSystemDNS = append(proxy.previousSystemDNS, previous)
+	proxy.saveSystemDNS()
+}
+
+// saveSystemDNS keeps a copy of the settings to restore in the state directory, or removes it if
+// there are none. systemDNSLock must be held.
+func (proxy *Proxy) saveSystemDNS() {
+	if len(proxy.previousSystemDNS) == 0 {
+		proxy.storage.Remove(SystemDNSBackupFile)
+		return
+	}
+	bin, err := json.Marshal(proxy.previousSystemDNS)
+	if err == nil {
+		err = proxy.storage.Write(SystemDNSBackupFile, bin)
+	}
+	if err != nil {
+		dlog.Warnf("Unable to save the previous DNS settings: %v", err)
+	}
+}
+
+// restoreSavedSystemDNS restores the settings saved by a previous instance that didn't exit
+// cleanly, as the system would otherwise keep using a resolver that may not be running
+func (proxy *Proxy) restoreSavedSystemDNS() {
+	bin, err := proxy.storage.Read(SystemDNSBackupFile)
+	if err != nil {
+		return
+	}
+	var previousSettings []SystemDNSSetting
+	if err := json.Unmarshal(bin, &previousSettings); err != nil {
+		dlog.Warnf("Unable to parse the saved DNS settings: %v", err)
+	} else {
+		dlog.Warn("The DNS settings were not restored when the proxy last stopped -- Restoring them")
+		RestoreSystemDNS(previousSettings)
+	}
+	proxy.storage.Remove(SystemDNSBackupFile)
+}
+
+// monitorSystemDNS periodically checks that the system still uses the proxy, as VPN and DHCP
+// clients can silently change the DNS settings
+func (proxy *Proxy) monitorSystemDNS() error {
+	if !systemDNSMonitorSupported {
+		return errors.New("Monitoring the system DNS settings is only supported on Windows and macOS")
+	}
+	if ipv4Address, ipv6Address := proxy.systemDNSAddresses(); len(ipv4Address) == 0 && len(ipv6Address) == 0 {
+		return errors.New("The proxy must listen to port 53 of a loopback address to be used as the system DNS")
+	}
+	go func() {
+		reported := make(map[string]string)
+		repairs := make(map[string][]time.Time)
+		for {
+			time.Sleep(SystemDNSMonitorInterval)
+			if atomic.LoadInt32(&proxy.stopping) != 0 {
+				return
+			}
+			current := make(map[string]string)
+			for _, change := range proxy.systemDNSChanges() {
+				servers := "no servers"
+				if len(change.servers) > 0 {
+					servers = strings.Join(change.servers, ", ")
+				}
+				current[change.interfaceName] = servers
+				if reported[change.interfaceName] != servers {
+					dlog.Warnf("Interface [%s] no longer uses the proxy for DNS resolution -- Now using %s (%s)", change.interfaceName, servers, change.source)
+				}
+				if proxy.systemDNSMonitor != SystemDNSMonitorRepair || !change.repairable {
+					continue
+				}
+				var recent []time.Time
+				for _, ts := range repairs[change.interfaceName] {
+					if time.Since(ts) < SystemDNSRepairWindow {
+						recent = append(recent, ts)
+					}
+				}
+				if len(recent) >= SystemDNSMaxRepairs {
+					if len(recent) == SystemDNSMaxRepairs {
+						dlog.Warnf("The DNS settings of [%s] keep being changed by another program -- Not changing them back for now", change.interfaceName)
+						repairs[change.interfaceName] = append(recent, time.Now())
+					}
+					continue
+				}
+				repairs[change.interfaceName] = append(recent, time.Now())
+				if err := proxy.repairSystemDNS(change); err != nil {
+					dlog.Errorf("Unable to make [%s] use the proxy again: %v", change.interfaceName, err)
+					continue
+				}
+				dlog.Noticef("Interface [%s] uses the proxy for DNS resolution again", change.interfaceName)
+				delete(current, change.interfaceName)
+			}
+			reported = current
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,219 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/jedisct1/dlog"
+)
+
+const systemDNSMonitorSupported = true
+
+// SystemDNSSetting is the DNS configuration of a network service before it was changed
+type SystemDNSSetting struct {
+	Service string   `json:"service"`
+	Servers []string `json:"servers"`
+}
+
+// SetSystemDNS configures all the enabled network services to use the proxy, and returns their
+// previous settings, so that they can be restored with RestoreSystemDNS
+func (proxy *Proxy) SetSystemDNS() ([]SystemDNSSetting, error) {
+	addresses := proxySystemDNSAddresses(proxy)
+	if len(addresses) == 0 {
+		return nil, errors.New("The proxy must listen to port 53 of a loopback address to be used as the system DNS")
+	}
+	services, err := networkServices()
+	if err != nil {
+		return nil, err
+	}
+	var previousSettings []SystemDNSSetting
+	for _, service := range services {
+		previous, err := useProxyForService(service, addresses)
+		if err != nil {
+			dlog.Warnf("Unable to change the DNS settings of [%s]: %v", service, err)
+			continue
+		}
+		dlog.Noticef("Network service [%s] now uses the proxy for DNS resolution", service)
+		previousSettings = append(previousSettings, previous)
+	}
+	if len(previousSettings) == 0 {
+		return nil, errors.New("No enabled network services found")
+	}
+	return previousSettings, nil
+}
+
+// RestoreSystemDNS restores the DNS settings of network services, as returned by SetSystemDNS
+func RestoreSystemDNS(previousSettings []SystemDNSSetting) {
+	for _, previous := range previousSettings {
+		servers := previous.Servers
+		if len(servers) == 0 {
+			servers = []string{"Empty"}
+		}
+		if _, err := networksetup(append([]string{"-setdnsservers", previous.Service}, servers...)...); err != nil {
+			dlog.Warnf("Unable to restore the DNS settings of [%s]: %v", previous.Service, err)
+			continue
+		}
+		dlog.Noticef("DNS settings of network service [%s] restored", previous.Service)
+	}
+}
+
+func proxySystemDNSAddresses(proxy *Proxy) []string {
+	var addresses []string
+	ipv4Address, ipv6Address := proxy.systemDNSAddresses()
+	for _, address := range []string{ipv4Address, ipv6Address} {
+		if len(address) > 0 {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+// useProxyForService changes the DNS servers of a network service to the proxy, and returns
+// its previous settings
+func useProxyForService(service string, addresses []string) (SystemDNSSetting, error) {
+	servers, err := serviceDNSServers(service)
+	if err != nil {
+		return SystemDNSSetting{}, err
+	}
+	// Don't restore the proxy itself, if the settings were not restored after a crash
+	previous := SystemDNSSetting{Service: service}
+	for _, server := range servers {
+		if !containsString(server, addresses) {
+			previous.Servers = append(previous.Servers, server)
+		}
+	}
+	if _, err := networksetup(append([]string{"-setdnsservers", service}, addresses...)...); err != nil {
+		return previous, err
+	}
+	return previous, nil
+}
+
+// systemDNSChanges returns the enabled network services whose first DNS server is not the
+// proxy, and the resolver actually used, if it was changed by software bypassing the network
+// services, such as VPN clients
+func (proxy *Proxy) systemDNSChanges() []SystemDNSChange {
+	addresses := proxySystemDNSAddresses(proxy)
+	services, err := networkServices()
+	if err != nil {
+		return nil
+	}
+	var changes []SystemDNSChange
+	for _, service := range services {
+		servers, err := serviceDNSServers(service)
+		if err != nil {
+			continue
+		}
+		source := "static"
+		if len(servers) == 0 {
+			source = "DHCP"
+		} else if containsString(servers[0], addresses) {
+			continue
+		}
+		changes = append(changes, SystemDNSChange{
+			interfaceName: service,
+			id:            service,
+			servers:       servers,
+			source:        source,
+			repairable:    true,
+		})
+	}
+	if len(changes) == 0 {
+		if servers := defaultResolverServers(); len(servers) > 0 && !containsString(servers[0], addresses) {
+			changes = append(changes, SystemDNSChange{
+				interfaceName: "default resolver",
+				servers:       servers,
+				source:        "dynamic configuration, usually set by a VPN client",
+			})
+		}
+	}
+	return changes
+}
+
+func (proxy *Proxy) repairSystemDNS(change SystemDNSChange) error {
+	previous, err := useProxyForService(change.id, proxySystemDNSAddresses(proxy))
+	if err != nil {
+		return err
+	}
+	proxy.rememberSystemDNS(previous, func(setting SystemDNSSetting) bool {
+		return setting.Service == change.id
+	})
+	return nil
+}
+
+// networkServices returns the names of the enabled network services
+func networkServices() ([]string, error) {
+	output, err := networksetup("-listallnetworkservices")
+	if err != nil {
+		return nil, err
+	}
+	var services []string
+	lines := strings.Split(output, "\n")
+	// The first line is a note about disabled services, that start with an asterisk
+	for _, line := range lines[1:] {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "*") {
+			continue
+		}
+		services = append(services, line)
+	}
+	return services, nil
+}
+
+// serviceDNSServers returns the DNS servers statically configured for a network service; an
+// empty list means that they are assigned by DHCP
+func serviceDNSServers(service string) ([]string, error) {
+	output, err := networksetup("-getdnsservers", service)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(output, "There aren't any DNS Servers") {
+		return nil, nil
+	}
+	return strings.Fields(output), nil
+}
+
+// defaultResolverServers returns the servers of the first resolver listed by scutil
+func defaultResolverServers() []string {
+	output, err := exec.Command("scutil", "--dns").Output()
+	if err != nil {
+		return nil
+	}
+	var servers []string
+	inResolver := false
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "resolver #") {
+			if inResolver {
+				break
+			}
+			inResolver = line == "resolver #1"
+			continue
+		}
+		if !inResolver || !strings.HasPrefix(line, "nameserver[") {
+			continue
+		}
+		if parts := strings.SplitN(line, ":", 2); len(parts) == 2 {
+			servers = append(servers, strings.TrimSpace(parts[1]))
+		}
+	}
+	return servers
+}
+
+func networksetup(args ...string) (string, error) {
+	output, err := exec.Command("networksetup", args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+func containsString(s string, list []string) bool {
+	for _, candidate := range list {
+		if candidate == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,23 @@
+// +build !windows,!darwin
+
+package proxy
+
+import "errors"
+
+const systemDNSMonitorSupported = false
+
+type SystemDNSSetting struct{}
+
+func (proxy *Proxy) SetSystemDNS() ([]SystemDNSSetting, error) {
+	return nil, errors.New("Changing the system DNS settings is only supported on Windows and macOS")
+}
+
+func RestoreSystemDNS(previousSettings []SystemDNSSetting) {}
+
+func (proxy *Proxy) systemDNSChanges() []SystemDNSChange {
+	return nil
+}
+
+func (proxy *Proxy) repairSystemDNS(change SystemDNSChange) error {
+	return errors.New("Changing the system DNS settings is only supported on Windows and macOS")
+}
@@ -0,0 +1,329 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/jedisct1/dlog"
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+)
+
+const (
+	networkConnectionsKey = `SYSTEM\CurrentControlSet\Control\Network\{4D36E972-E325-11CE-BFC1-08002BE10318}`
+	tcpip4InterfacesKey   = `SYSTEM\CurrentControlSet\Services\Tcpip\Parameters\Interfaces`
+	tcpip6InterfacesKey   = `SYSTEM\CurrentControlSet\Services\Tcpip6\Parameters\Interfaces`
+
+	dnsInterfaceSettingsVersion1 = 1
+	dnsSettingIPv6               = 0x0001
+	dnsSettingNameServer         = 0x0002
+)
+
+var procSetInterfaceDNSSettings = windows.NewLazySystemDLL("iphlpapi.dll").NewProc("SetInterfaceDnsSettings")
+
+// dnsInterfaceSettings is DNS_INTERFACE_SETTINGS; the padding after the version is explicit, as
+// 64-bit integers are only aligned to 4 bytes by Go on 32-bit platforms
+type dnsInterfaceSettings struct {
+	Version             uint32
+	_                   uint32
+	Flags               uint64
+	Domain              *uint16
+	NameServer          *uint16
+	SearchList          *uint16
+	RegistrationEnabled uint32
+	RegisterAdapterName uint32
+	EnableLLMNR         uint32
+	QueryAdapterName    uint32
+	ProfileNameServer   *uint16
+}
+
+// SystemDNSSetting is the DNS configuration of an interface before it was changed
+type SystemDNSSetting struct {
+	InterfaceName string   `json:"interface_name"`
+	GUID          string   `json:"guid"`
+	IPv4Servers   []string `json:"ipv4_servers"`
+	IPv6Servers   []string `json:"ipv6_servers"`
+}
+
+const systemDNSMonitorSupported = true
+
+// SetSystemDNS configures all the active network interfaces to use the proxy, and returns their
+// previous settings, so that they can be restored with RestoreSystemDNS
+func (proxy *Proxy) SetSystemDNS() ([]SystemDNSSetting, error) {
+	ipv4Address, ipv6Address := proxy.systemDNSAddresses()
+	if len(ipv4Address) == 0 && len(ipv6Address) == 0 {
+		return nil, errors.New("The proxy must listen to port 53 of a loopback address to be used as the system DNS")
+	}
+	guids := interfaceGUIDs()
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var previousSettings []SystemDNSSetting
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		guid, ok := guids[iface.Name]
+		if !ok {
+			dlog.Debugf("Interface [%s] not found in the registry", iface.Name)
+			continue
+		}
+		previous, err := useProxyForInterface(iface.Name, guid, ipv4Address, ipv6Address)
+		if err != nil {
+			dlog.Warnf("Unable to change the DNS settings of [%s]: %v", iface.Name, err)
+			continue
+		}
+		dlog.Noticef("Interface [%s] now uses the proxy for DNS resolution", iface.Name)
+		previousSettings = append(previousSettings, previous)
+	}
+	if len(previousSettings) == 0 {
+		return nil, errors.New("No active network interfaces found")
+	}
+	return previousSettings, nil
+}
+
+// useProxyForInterface changes the DNS servers of an interface to the proxy, and returns its
+// previous settings
+func useProxyForInterface(interfaceName string, guid string, ipv4Address string, ipv6Address string) (SystemDNSSetting, error) {
+	// Don't restore the proxy itself, if the settings were not restored after a crash
+	previous := SystemDNSSetting{
+		InterfaceName: interfaceName,
+		GUID:          guid,
+		IPv4Servers:   withoutAddress(staticNameServers(tcpip4InterfacesKey, guid), ipv4Address),
+		IPv6Servers:   withoutAddress(staticNameServers(tcpip6InterfacesKey, guid), ipv6Address),
+	}
+	if len(ipv4Address) > 0 {
+		if err := setInterfaceDNS(interfaceName, guid, false, []string{ipv4Address}); err != nil {
+			return previous, err
+		}
+	}
+	if len(ipv6Address) > 0 {
+		if err := setInterfaceDNS(interfaceName, guid, true, []string{ipv6Address}); err != nil {
+			dlog.Debugf("Unable to change the IPv6 DNS settings of [%s]: %v", interfaceName, err)
+		}
+	}
+	return previous, nil
+}
+
+// systemDNSChanges returns the active interfaces whose first DNS server is not the proxy
+func (proxy *Proxy) systemDNSChanges() []SystemDNSChange {
+	ipv4Address, ipv6Address := proxy.systemDNSAddresses()
+	guids := interfaceGUIDs()
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var changes []SystemDNSChange
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		guid, ok := guids[iface.Name]
+		if !ok {
+			continue
+		}
+		interfacesKey, address := tcpip4InterfacesKey, ipv4Address
+		if len(address) == 0 {
+			interfacesKey, address = tcpip6InterfacesKey, ipv6Address
+		}
+		servers, source := staticNameServers(interfacesKey, guid), "static"
+		if len(servers) == 0 {
+			servers, source = dhcpNameServers(interfacesKey, guid), "DHCP"
+		}
+		if len(servers) > 0 && servers[0] == address {
+			continue
+		}
+		changes = append(changes, SystemDNSChange{
+			interfaceName: iface.Name,
+			servers:       servers,
+			source:        source,
+			repairable:    true,
+			id:            guid,
+		})
+	}
+	return changes
+}
+
+// repairSystemDNS makes an interface use the proxy again. With -set-system-dns, interfaces that
+// were not configured at startup, such as VPN adapters, are restored on exit as well.
+func (proxy *Proxy) repairSystemDNS(change SystemDNSChange) error {
+	ipv4Address, ipv6Address := proxy.systemDNSAddresses()
+	previous, err := useProxyForInterface(change.interfaceName, change.id, ipv4Address, ipv6Address)
+	if err != nil {
+		return err
+	}
+	proxy.rememberSystemDNS(previous, func(setting SystemDNSSetting) bool {
+		return setting.InterfaceName == change.interfaceName
+	})
+	return nil
+}
+
+// RestoreSystemDNS restores the DNS settings of interfaces, as returned by SetSystemDNS
+func RestoreSystemDNS(previousSettings []SystemDNSSetting) {
+	for _, previous := range previousSettings {
+		for _, family := range []struct {
+			name    string
+			ipv6    bool
+			servers []string
+		}{{"IPv4", false, previous.IPv4Servers}, {"IPv6", true, previous.IPv6Servers}} {
+			if err := setInterfaceDNS(previous.InterfaceName, previous.GUID, family.ipv6, family.servers); err != nil {
+				dlog.Warnf("Unable to restore the %s DNS settings of [%s]: %v", family.name, previous.InterfaceName, err)
+			}
+		}
+		dlog.Noticef("DNS settings of interface [%s] restored", previous.InterfaceName)
+	}
+}
+
+// interfaceGUIDs maps the names of the network connections to their identifiers
+func interfaceGUIDs() map[string]string {
+	guids := make(map[string]string)
+	key, err := registry.OpenKey(registry.LOCAL_MACHINE, networkConnectionsKey, registry.ENUMERATE_SUB_KEYS)
+	if err != nil {
+		return guids
+	}
+	defer key.Close()
+	subKeys, err := key.ReadSubKeyNames(-1)
+	if err != nil {
+		return guids
+	}
+	for _, guid := range subKeys {
+		connectionKey, err := registry.OpenKey(key, guid+`\Connection`, registry.QUERY_VALUE)
+		if err != nil {
+			continue
+		}
+		if name, _, err := connectionKey.GetStringValue("Name"); err == nil {
+			guids[name] = guid
+		}
+		connectionKey.Close()
+	}
+	return guids
+}
+
+// staticNameServers returns the DNS servers statically configured for an interface; an empty
+// list means that they are assigned by DHCP
+func staticNameServers(interfacesKey string, guid string) []string {
+	key, err := registry.OpenKey(registry.LOCAL_MACHINE, interfacesKey+`\`+guid, registry.QUERY_VALUE)
+	if err != nil {
+		return nil
+	}
+	defer key.Close()
+	nameServers, _, err := key.GetStringValue("NameServer")
+	if err != nil {
+		return nil
+	}
+	return strings.FieldsFunc(nameServers, func(c rune) bool { return c == ',' || c == ' ' })
+}
+
+// dhcpNameServers returns the DNS servers assigned by DHCP to an interface
+func dhcpNameServers(interfacesKey string, guid string) []string {
+	key, err := registry.OpenKey(registry.LOCAL_MACHINE, interfacesKey+`\`+guid, registry.QUERY_VALUE)
+	if err != nil {
+		return nil
+	}
+	defer key.Close()
+	nameServers, _, err := key.GetStringValue("DhcpNameServer")
+	if err != nil {
+		return nil
+	}
+	return strings.FieldsFunc(nameServers, func(c rune) bool { return c == ',' || c == ' ' })
+}
+
+func withoutAddress(addresses []string, address string) []string {
+	var filtered []string
+	for _, candidate := range addresses {
+		if candidate != address {
+			filtered = append(filtered, candidate)
+		}
+	}
+	return filtered
+}
+
+// setInterfaceDNS sets the DNS servers of an interface, or makes it use the ones assigned by DHCP
+// if servers is empty. SetInterfaceDnsSettings() is only available since Windows 10 2004; netsh is
+// used on previous versions.
+func setInterfaceDNS(interfaceName string, guid string, ipv6 bool, servers []string) error {
+	if procSetInterfaceDNSSettings.Find() != nil {
+		return setInterfaceDNSWithNetsh(interfaceName, ipv6, servers)
+	}
+	interfaceGUID, err := parseGUID(guid)
+	if err != nil {
+		return err
+	}
+	nameServer, err := syscall.UTF16PtrFromString(strings.Join(servers, ","))
+	if err != nil {
+		return err
+	}
+	settings := dnsInterfaceSettings{
+		Version:    dnsInterfaceSettingsVersion1,
+		Flags:      dnsSettingNameServer,
+		NameServer: nameServer,
+	}
+	if ipv6 {
+		settings.Flags |= dnsSettingIPv6
+	}
+	// The GUID is passed by value: by reference on amd64, in two registers on arm64, and as
+	// 32-bit words on 32-bit platforms
+	var rcode uintptr
+	switch runtime.GOARCH {
+	case "amd64":
+		rcode, _, _ = procSetInterfaceDNSSettings.Call(uintptr(unsafe.Pointer(&interfaceGUID)), uintptr(unsafe.Pointer(&settings)))
+	case "arm64":
+		words := *(*[2]uint64)(unsafe.Pointer(&interfaceGUID))
+		rcode, _, _ = procSetInterfaceDNSSettings.Call(uintptr(words[0]), uintptr(words[1]), uintptr(unsafe.Pointer(&settings)))
+	default:
+		words := *(*[4]uint32)(unsafe.Pointer(&interfaceGUID))
+		rcode, _, _ = procSetInterfaceDNSSettings.Call(uintptr(words[0]), uintptr(words[1]), uintptr(words[2]), uintptr(words[3]), uintptr(unsafe.Pointer(&settings)))
+	}
+	if rcode != 0 {
+		return syscall.Errno(rcode)
+	}
+	return nil
+}
+
+// parseGUID parses a GUID in the {XXXXXXXX-XXXX-XXXX-XXXX-XXXXXXXXXXXX} form used by the registry
+func parseGUID(guid string) (windows.GUID, error) {
+	var parsed windows.GUID
+	bin, err := hex.DecodeString(strings.Replace(strings.Trim(guid, "{}"), "-", "", -1))
+	if err != nil || len(bin) != 16 {
+		return parsed, fmt.Errorf("Invalid interface identifier [%s]", guid)
+	}
+	parsed.Data1 = binary.BigEndian.Uint32(bin[0:4])
+	parsed.Data2 = binary.BigEndian.Uint16(bin[4:6])
+	parsed.Data3 = binary.BigEndian.Uint16(bin[6:8])
+	copy(parsed.Data4[:], bin[8:16])
+	return parsed, nil
+}
+
+func setInterfaceDNSWithNetsh(interfaceName string, ipv6 bool, servers []string) error {
+	family := "ipv4"
+	if ipv6 {
+		family = "ipv6"
+	}
+	if len(servers) == 0 {
+		return netsh(family, "set", "dnsservers", "name="+interfaceName, "dhcp")
+	}
+	err := netsh(family, "set", "dnsservers", "name="+interfaceName, "static", servers[0], "primary", "validate=no")
+	for i, server := range servers[1:] {
+		if err == nil {
+			err = netsh(family, "add", "dnsservers", "name="+interfaceName, server, fmt.Sprintf("index=%d", i+2), "validate=no")
+		}
+	}
+	return err
+}
+
+func netsh(family string, args ...string) error {
+	output, err := exec.Command("netsh", append([]string{"interface", family}, args...)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+// +build !linux
+
+package proxy
+
+func (proxy *Proxy) SystemDListeners() (map[string]bool, []func(), error) {
+	return nil, nil, nil
+}
+
+func SystemDNotify() {}
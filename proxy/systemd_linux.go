@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"net"
+
+	"github.com/coreos/go-systemd/activation"
+	"github.com/coreos/go-systemd/daemon"
+	"github.com/jedisct1/dlog"
+)
+
+// SystemDListeners wires the sockets passed by systemd (socket activation), and returns their
+// addresses, so that they are not bound a second time, along with the functions that start
+// serving them.
+// A socket whose address is also configured as a listener uses the settings of that listener.
+func (proxy *Proxy) SystemDListeners() (map[string]bool, []func(), error) {
+	activated := make(map[string]bool)
+	var serve []func()
+	// The descriptors must be retrieved only once: every call creates new files for the same descriptors
+	for i, file := range activation.Files(true) {
+		if acceptPc, err := net.FileListener(file); err == nil {
+			if tcpListener, ok := acceptPc.(*net.TCPListener); ok {
+				if proxy.localDoHServer != nil && proxy.localDoHServer.adopt(tcpListener) {
+					dlog.Noticef("Wiring systemd TCP socket #%d, %v [DoH]", i, tcpListener.Addr())
+					file.Close()
+					continue
+				}
+				dlog.Noticef("Wiring systemd TCP socket #%d, %v", i, tcpListener.Addr())
+				activated[listenerKey(tcpListener.Addr())] = true
+				listener := proxy.listenerForAddr(tcpListener.Addr())
+				serve = append(serve, func() { go proxy.tcpListener(tcpListener, listener) })
+			} else {
+				dlog.Warnf("Ignoring systemd socket #%d: not a TCP socket", i)
+				acceptPc.Close()
+			}
+		} else if clientPc, err := net.FilePacketConn(file); err == nil {
+			if udpConn, ok := clientPc.(*net.UDPConn); ok {
+				dlog.Noticef("Wiring systemd UDP socket #%d, %v", i, udpConn.LocalAddr())
+				activated[listenerKey(udpConn.LocalAddr())] = true
+				listener := proxy.listenerForAddr(udpConn.LocalAddr())
+				serve = append(serve, func() { go proxy.udpListener(udpConn, listener) })
+			} else {
+				dlog.Warnf("Ignoring systemd socket #%d: not a UDP socket", i)
+				clientPc.Close()
+			}
+		} else {
+			dlog.Warnf("Ignoring systemd socket #%d: unsupported socket type", i)
+		}
+		file.Close()
+	}
+	return activated, serve, nil
+}
+
+func SystemDNotify() {
+	daemon.SdNotify(false, "READY=1")
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+// tcpClientConn sets a deadline before every response, as the connection stays open for
+// longer than a single query
+type tcpClientConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (clientPc *tcpClientConn) Write(packet []byte) (int, error) {
+	clientPc.SetWriteDeadline(time.Now().Add(clientPc.timeout))
+	return clientPc.Conn.Write(packet)
+}
+
+// tcpClient handles a connection from a local client. As recommended by RFC 7766, the
+// connection is kept open for more queries, which are processed concurrently; responses are
+// sent as soon as they are ready, possibly out of order. The connection is closed once it
+// has been idle for tcp_idle_timeout, or after tcp_max_queries queries.
+func (proxy *Proxy) tcpClient(conn net.Conn, listener *Listener) {
+	defer conn.Close()
+	if !proxy.clientAllowed(conn.RemoteAddr()) {
+		return
+	}
+	if !proxy.tcpConnectionsInc() {
+		dlog.Debugf("Too many TCP connections (max=%d)", proxy.maxClients)
+		return
+	}
+	defer proxy.tcpConnectionsDec()
+	clientPc := &tcpClientConn{Conn: conn, timeout: proxy.timeout}
+	reader := bufio.NewReaderSize(conn, 2+MaxDNSPacketSize)
+	var inFlight sync.WaitGroup
+	defer inFlight.Wait()
+	for queries := 0; queries < proxy.tcpMaxQueries; queries++ {
+		conn.SetReadDeadline(time.Now().Add(proxy.tcpIdleTimeout))
+		packet, err := ReadPrefixedFrom(reader)
+		if err != nil {
+			return
+		}
+		queryPc := net.Conn(clientPc)
+		if listener != nil && listener.dnscrypt {
+			if packet, queryPc = proxy.unwrapDNSCryptTCPQuery(packet, clientPc); packet == nil {
+				continue
+			}
+		}
+		if !proxy.clientsCountInc() {
+			proxy.warnOverload()
+			if proxy.overloadRefuse {
+				if response, err := RefusedResponse(packet); err == nil {
+					if response, err = PrefixWithSize(response); err == nil {
+						queryPc.Write(response)
+					}
+				}
+			}
+			continue
+		}
+		inFlight.Add(1)
+		go func() {
+			defer inFlight.Done()
+			defer proxy.clientsCountDec()
+			clientAddr := conn.RemoteAddr()
+			proxy.processIncomingQuery(proxy.serversInfo.getOne(), "tcp", "tcp", packet, &clientAddr, queryPc, listener)
+		}()
+	}
+}
+
+func (proxy *Proxy) tcpConnectionsInc() bool {
+	if atomic.AddUint32(&proxy.tcpConnections, 1) > proxy.maxClients {
+		proxy.tcpConnectionsDec()
+		return false
+	}
+	return true
+}
+
+func (proxy *Proxy) tcpConnectionsDec() {
+	atomic.AddUint32(&proxy.tcpConnections, ^uint32(0))
+}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	TopNamesPerBucket = 512
+	TopNamesMinutes   = 60
+	TopNamesHours     = 24
+)
+
+// TopNames tallies the most frequent names over sliding windows, using a bounded amount of
+// memory: counts are kept per minute for the last hour, and per hour for the last day.
+// Every bucket is a space-saving counter: only the most frequent names are tracked, and a
+// new name replaces the least frequent one, inheriting its count. Counts can thus be
+// overestimated for infrequent names, but the most frequent names are always reported.
+type TopNames struct {
+	minutes [TopNamesMinutes]topNamesBucket
+	hours   [TopNamesHours]topNamesBucket
+}
+
+type topNamesBucket struct {
+	period   int64
+	counters *spaceSaving
+}
+
+func NewTopNames() *TopNames {
+	return &TopNames{}
+}
+
+// ParseTopNamesWindow parses the windows that TopNames can report on
+func ParseTopNamesWindow(window string) (time.Duration, error) {
+	duration, err := time.ParseDuration(window)
+	if err != nil || duration <= 0 || duration > TopNamesHours*time.Hour {
+		return 0, fmt.Errorf("Invalid window [%s] -- Use a duration up to 24h, such as 5m or 1h", window)
+	}
+	return duration, nil
+}
+
+func (topNames *TopNames) add(name string, now time.Time) {
+	minute, hour := now.Unix()/60, now.Unix()/3600
+	topNames.minutes[minute%TopNamesMinutes].add(minute, name)
+	topNames.hours[hour%TopNamesHours].add(hour, name)
+}
+
+// top returns the n most frequent names over the window ending now. Windows up to an hour
+// have a one-minute granularity; longer windows have a one-hour granularity.
+func (topNames *TopNames) top(window time.Duration, n int, now time.Time) []NameCount {
+	merged := make(map[string]uint64)
+	if window <= time.Hour {
+		current := now.Unix() / 60
+		for i := int64(0); i < int64((window+time.Minute-1)/time.Minute); i++ {
+			topNames.minutes[(current-i)%TopNamesMinutes].mergeInto(current-i, merged)
+		}
+	} else {
+		current := now.Unix() / 3600
+		for i := int64(0); i < int64((window+time.Hour-1)/time.Hour); i++ {
+			topNames.hours[(current-i)%TopNamesHours].mergeInto(current-i, merged)
+		}
+	}
+	all := make([]NameCount, 0, len(merged))
+	for name, count := range merged {
+		all = append(all, NameCount{Name: name, Count: count})
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Count != all[j].Count {
+			return all[i].Count > all[j].Count
+		}
+		return all[i].Name < all[j].Name
+	})
+	if len(all) > n {
+		all = all[:n]
+	}
+	return all
+}
+
+func (bucket *topNamesBucket) add(period int64, name string) {
+	if bucket.counters == nil || bucket.period != period {
+		bucket.period, bucket.counters = period, newSpaceSaving(TopNamesPerBucket)
+	}
+	bucket.counters.add(name)
+}
+
+func (bucket *topNamesBucket) mergeInto(period int64, merged map[string]uint64) {
+	if bucket.counters == nil || bucket.period != period {
+		return
+	}
+	for name, count := range bucket.counters.counts {
+		merged[name] += count
+	}
+}
+
+type spaceSaving struct {
+	capacity int
+	counts   map[string]uint64
+}
+
+func newSpaceSaving(capacity int) *spaceSaving {
+	return &spaceSaving{capacity: capacity, counts: make(map[string]uint64, capacity)}
+}
+
+func (counters *spaceSaving) add(name string) {
+	if _, found := counters.counts[name]; found || len(counters.counts) < counters.capacity {
+		counters.counts[name]++
+		return
+	}
+	var minName string
+	var minCount uint64
+	for candidate, count := range counters.counts {
+		if len(minName) == 0 || count < minCount {
+			minName, minCount = candidate, count
+		}
+	}
+	delete(counters.counts, minName)
+	counters.counts[name] = minCount + 1
+}
@@ -0,0 +1,258 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+const (
+	TrustAnchorAddHoldDown = 30 * 24 * time.Hour
+	DNSKEYFlagSEP          = 0x0001
+	DNSKEYFlagRevoke       = 0x0080
+)
+
+// Root zone KSKs (KSK-2017 and KSK-2024), used when no trust anchors file exists yet
+var defaultRootTrustAnchors = []string{
+	". 172800 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". 172800 IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+type TrustAnchorState int
+
+const (
+	TrustAnchorStateValid TrustAnchorState = iota
+	TrustAnchorStatePending
+)
+
+type TrustAnchor struct {
+	ds        *dns.DS
+	state     TrustAnchorState
+	firstSeen time.Time
+}
+
+type TrustAnchors struct {
+	sync.Mutex
+	file    string
+	anchors []TrustAnchor
+}
+
+func NewTrustAnchors(file string) (*TrustAnchors, error) {
+	trustAnchors := TrustAnchors{file: file}
+	if len(file) == 0 {
+		return &trustAnchors, trustAnchors.loadDefaults()
+	}
+	bin, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		dlog.Noticef("Trust anchors file [%s] not found, using the built-in root trust anchors", file)
+		if err := trustAnchors.loadDefaults(); err != nil {
+			return nil, err
+		}
+		return &trustAnchors, trustAnchors.save()
+	} else if err != nil {
+		return nil, err
+	}
+	dlog.Noticef("Loading trust anchors from [%s]", file)
+	for lineNo, line := range strings.Split(string(bin), "\n") {
+		line = strings.TrimFunc(line, unicode.IsSpace)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, " ", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("Syntax error in trust anchors at line %d", 1+lineNo)
+		}
+		var state TrustAnchorState
+		switch parts[0] {
+		case "valid":
+			state = TrustAnchorStateValid
+		case "pending":
+			state = TrustAnchorStatePending
+		default:
+			return nil, fmt.Errorf("Unknown trust anchor state [%s] at line %d", parts[0], 1+lineNo)
+		}
+		firstSeen, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid timestamp in trust anchors at line %d", 1+lineNo)
+		}
+		ds, err := parseDS(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid DS record in trust anchors at line %d: %v", 1+lineNo, err)
+		}
+		trustAnchors.anchors = append(trustAnchors.anchors, TrustAnchor{ds: ds, state: state, firstSeen: time.Unix(firstSeen, 0)})
+	}
+	if len(trustAnchors.validDS()) == 0 {
+		return nil, fmt.Errorf("No valid trust anchors found in [%s]", file)
+	}
+	return &trustAnchors, nil
+}
+
+func parseDS(str string) (*dns.DS, error) {
+	rr, err := dns.NewRR(str)
+	if err != nil {
+		return nil, err
+	}
+	ds, ok := rr.(*dns.DS)
+	if !ok {
+		return nil, errors.New("Not a DS record")
+	}
+	return ds, nil
+}
+
+func (trustAnchors *TrustAnchors) loadDefaults() error {
+	for _, str := range defaultRootTrustAnchors {
+		ds, err := parseDS(str)
+		if err != nil {
+			return err
+		}
+		trustAnchors.anchors = append(trustAnchors.anchors, TrustAnchor{ds: ds, state: TrustAnchorStateValid})
+	}
+	return nil
+}
+
+func (trustAnchors *TrustAnchors) save() error {
+	if len(trustAnchors.file) == 0 {
+		return nil
+	}
+	var out bytes.Buffer
+	out.WriteString("# Root trust anchors -- automatically updated according to RFC 5011\n")
+	for _, anchor := range trustAnchors.anchors {
+		state := "valid"
+		if anchor.state == TrustAnchorStatePending {
+			state = "pending"
+		}
+		out.WriteString(fmt.Sprintf("%s %d %s\n", state, anchor.firstSeen.Unix(), strings.Replace(anchor.ds.String(), "\t", " ", -1)))
+	}
+	return AtomicFileWrite(trustAnchors.file, out.Bytes())
+}
+
+func (trustAnchors *TrustAnchors) validDS() []*dns.DS {
+	dsSet := []*dns.DS{}
+	for _, anchor := range trustAnchors.anchors {
+		if anchor.state == TrustAnchorStateValid {
+			dsSet = append(dsSet, anchor.ds)
+		}
+	}
+	return dsSet
+}
+
+func (trustAnchors *TrustAnchors) ValidDS() []*dns.DS {
+	trustAnchors.Lock()
+	dsSet := trustAnchors.validDS()
+	trustAnchors.Unlock()
+	return dsSet
+}
+
+func dsMatchesKey(ds *dns.DS, key *dns.DNSKEY) bool {
+	if ds.KeyTag != key.KeyTag() || ds.Algorithm != key.Algorithm {
+		return false
+	}
+	keyDS := key.ToDS(ds.DigestType)
+	return keyDS != nil && strings.EqualFold(keyDS.Digest, ds.Digest)
+}
+
+// Observe updates the trust anchors given a DNSKEY set for the root zone that has already been validated
+func (trustAnchors *TrustAnchors) Observe(keys []*dns.DNSKEY, keysRRs []dns.RR, sigs []*dns.RRSIG) {
+	trustAnchors.Lock()
+	defer trustAnchors.Unlock()
+	now := time.Now()
+	changed := false
+	anchors := []TrustAnchor{}
+	for _, anchor := range trustAnchors.anchors {
+		present, revoked := false, false
+		for _, key := range keys {
+			if key.Flags&DNSKEYFlagRevoke != 0 {
+				unrevoked := *key
+				unrevoked.Flags &^= DNSKEYFlagRevoke
+				if dsMatchesKey(anchor.ds, &unrevoked) && keySignsSet(key, keysRRs, sigs, now) {
+					revoked = true
+				}
+			} else if dsMatchesKey(anchor.ds, key) {
+				present = true
+			}
+		}
+		if revoked {
+			dlog.Noticef("Root trust anchor [%d] has been revoked", anchor.ds.KeyTag)
+			changed = true
+			continue
+		}
+		if anchor.state == TrustAnchorStatePending {
+			if !present {
+				changed = true
+				continue
+			}
+			if now.Sub(anchor.firstSeen) >= TrustAnchorAddHoldDown {
+				dlog.Noticef("Root trust anchor [%d] is now trusted", anchor.ds.KeyTag)
+				anchor.state = TrustAnchorStateValid
+				changed = true
+			}
+		}
+		anchors = append(anchors, anchor)
+	}
+	for _, key := range keys {
+		if key.Flags&DNSKEYFlagSEP == 0 || key.Flags&DNSKEYFlagRevoke != 0 {
+			continue
+		}
+		known := false
+		for _, anchor := range anchors {
+			if dsMatchesKey(anchor.ds, key) {
+				known = true
+				break
+			}
+		}
+		if known || !keySignsSet(key, keysRRs, sigs, now) {
+			continue
+		}
+		ds := key.ToDS(dns.SHA256)
+		if ds == nil {
+			continue
+		}
+		dlog.Noticef("New root key [%d] observed, waiting for the hold-down period before trusting it", ds.KeyTag)
+		anchors = append(anchors, TrustAnchor{ds: ds, state: TrustAnchorStatePending, firstSeen: now})
+		changed = true
+	}
+	if !changed {
+		return
+	}
+	if len(validTrustAnchors(anchors)) == 0 {
+		dlog.Warn("Refusing to remove the last valid root trust anchor")
+		return
+	}
+	trustAnchors.anchors = anchors
+	if err := trustAnchors.save(); err != nil {
+		dlog.Warnf("Unable to save the trust anchors: %v", err)
+	}
+}
+
+func validTrustAnchors(anchors []TrustAnchor) []TrustAnchor {
+	valid := []TrustAnchor{}
+	for _, anchor := range anchors {
+		if anchor.state == TrustAnchorStateValid {
+			valid = append(valid, anchor)
+		}
+	}
+	return valid
+}
+
+func keySignsSet(key *dns.DNSKEY, rrset []dns.RR, sigs []*dns.RRSIG, now time.Time) bool {
+	keyTag := key.KeyTag()
+	for _, sig := range sigs {
+		if sig.KeyTag != keyTag || sig.Algorithm != key.Algorithm || !sig.ValidityPeriod(now) {
+			continue
+		}
+		if err := sig.Verify(key, rrset); err == nil {
+			return true
+		}
+	}
+	return false
+}
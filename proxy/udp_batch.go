@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const DefaultUDPBatchSize = 32
+
+// batchConn reads and writes several datagrams per system call (recvmmsg/sendmmsg).
+// ipv4.Message and ipv6.Message are the same type, so both packet connections qualify.
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+func newBatchConn(clientPc *net.UDPConn) batchConn {
+	if addr, ok := clientPc.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() != nil {
+		return ipv4.NewPacketConn(clientPc)
+	}
+	return ipv6.NewPacketConn(clientPc)
+}
+
+type udpResponse struct {
+	packet     []byte
+	clientAddr net.Addr
+}
+
+// batchedUDPConn queues the responses, so that a single goroutine can send them in batches.
+// If the queue is full, responses are sent right away instead.
+type batchedUDPConn struct {
+	*net.UDPConn
+	responses chan udpResponse
+}
+
+func (clientPc *batchedUDPConn) WriteTo(packet []byte, clientAddr net.Addr) (int, error) {
+	select {
+	case clientPc.responses <- udpResponse{packet: packet, clientAddr: clientAddr}:
+		return len(packet), nil
+	default:
+		return clientPc.UDPConn.WriteTo(packet, clientAddr)
+	}
+}
+
+// udpBatchListener is the same as udpListener, receiving up to proxy.udpBatchSize queries
+// per system call
+func (proxy *Proxy) udpBatchListener(udpConn *net.UDPConn, listener *Listener) {
+	defer udpConn.Close()
+	proxy.trackListener(udpConn)
+	conn := newBatchConn(udpConn)
+	clientPc := &batchedUDPConn{UDPConn: udpConn, responses: make(chan udpResponse, proxy.maxClients)}
+	go proxy.udpBatchWriter(conn, clientPc.responses)
+	buffers := make([]*[]byte, proxy.udpBatchSize)
+	messages := make([]ipv4.Message, proxy.udpBatchSize)
+	for i := range messages {
+		buffers[i] = packetBuffers.Get().(*[]byte)
+		messages[i].Buffers = [][]byte{(*buffers[i])[:MaxDNSPacketSize-1]}
+	}
+	for {
+		count, err := conn.ReadBatch(messages, 0)
+		if err != nil {
+			for _, buffer := range buffers {
+				packetBuffers.Put(buffer)
+			}
+			return
+		}
+		for i := 0; i < count; i++ {
+			proxy.enqueueUDPQuery(udpQuery{buffer: buffers[i], packet: (*buffers[i])[:messages[i].N], clientAddr: messages[i].Addr, clientPc: clientPc, listener: listener})
+			// The buffer now belongs to the query
+			buffers[i] = packetBuffers.Get().(*[]byte)
+			messages[i].Buffers[0] = (*buffers[i])[:MaxDNSPacketSize-1]
+		}
+	}
+}
+
+// udpBatchWriter sends the responses that are ready at the same time together
+func (proxy *Proxy) udpBatchWriter(conn batchConn, responses chan udpResponse) {
+	messages := make([]ipv4.Message, proxy.udpBatchSize)
+	for i := range messages {
+		messages[i].Buffers = make([][]byte, 1)
+	}
+	for response := range responses {
+		messages[0].Buffers[0], messages[0].Addr = response.packet, response.clientAddr
+		count := 1
+	collect:
+		for count < len(messages) {
+			select {
+			case response = <-responses:
+				messages[count].Buffers[0], messages[count].Addr = response.packet, response.clientAddr
+				count++
+			default:
+				break collect
+			}
+		}
+		for sent := 0; sent < count; {
+			written, err := conn.WriteBatch(messages[sent:count], 0)
+			if err != nil {
+				// Skip the response that couldn't be sent
+				written = 1
+			}
+			sent += written
+		}
+		for i := 0; i < count; i++ {
+			messages[i].Buffers[0], messages[i].Addr = nil, nil
+		}
+	}
+}
@@ -0,0 +1,3 @@
+package proxy
+
+const udpBatchSupported = true
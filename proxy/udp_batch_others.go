@@ -0,0 +1,5 @@
+// +build !linux
+
+package proxy
+
+const udpBatchSupported = false
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// Classes of failed exchanges with upstream servers, that are not handled the same way: a
+// truncated response is requested again from the same server over TCP, another server is
+// tried after a REFUSED response, and a server that timed out is avoided for a while
+const (
+	FailureTimeout = iota
+	FailureRefused
+	FailureTruncated
+	FailureServFail
+	FailureError
+	failureClasses
+)
+
+var failureNames = [failureClasses]string{
+	FailureTimeout:   "timeout",
+	FailureRefused:   "refused",
+	FailureTruncated: "truncated",
+	FailureServFail:  "servfail",
+	FailureError:     "error",
+}
+
+// FailureCounters counts the failed exchanges with upstream servers, per class
+type FailureCounters struct {
+	counts [failureClasses]uint64
+}
+
+// FailureStats maps the classes of failed exchanges to their number
+type FailureStats map[string]uint64
+
+func (counters *FailureCounters) count(class int) {
+	atomic.AddUint64(&counters.counts[class], 1)
+}
+
+func (counters *FailureCounters) snapshot() FailureStats {
+	snapshot := make(FailureStats)
+	for class, name := range failureNames {
+		if count := atomic.LoadUint64(&counters.counts[class]); count > 0 {
+			snapshot[name] = count
+		}
+	}
+	return snapshot
+}
+
+// classifyFailure returns the class of a failed exchange with a server, or -1 if the response
+// is usable
+func classifyFailure(response []byte, err error) int {
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return FailureTimeout
+		}
+		return FailureError
+	}
+	switch Rcode(response) {
+	case dns.RcodeServerFailure:
+		return FailureServFail
+	case dns.RcodeRefused:
+		return FailureRefused
+	}
+	if HasTCFlag(response) {
+		return FailureTruncated
+	}
+	return -1
+}
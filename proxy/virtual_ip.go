@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/jedisct1/dlog"
+)
+
+// VirtualIP is an address shared by an active/standby pair, that is added to a network interface
+// by the proxy that serves queries, and removed from it when it stops doing so
+type VirtualIP struct {
+	sync.Mutex
+	iface *net.Interface
+	ipNet *net.IPNet
+	held  bool
+}
+
+func NewVirtualIP(address string, ifName string) (*VirtualIP, error) {
+	ip, ipNet, err := net.ParseCIDR(address)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid virtual IP [%s] -- Use an address followed by a prefix length, such as 192.168.1.53/24", address)
+	}
+	ipNet.IP = ip
+	iface, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return nil, fmt.Errorf("Interface [%s] for the virtual IP: %v", ifName, err)
+	}
+	if !virtualIPSupported {
+		return nil, fmt.Errorf("Virtual IP addresses are not supported on this platform")
+	}
+	return &VirtualIP{iface: iface, ipNet: ipNet}, nil
+}
+
+// acquire adds the address to the interface, and announces it to the neighbors, so that they stop
+// sending packets to the previous holder
+func (virtualIP *VirtualIP) acquire() error {
+	virtualIP.Lock()
+	defer virtualIP.Unlock()
+	if virtualIP.held {
+		return nil
+	}
+	if err := addInterfaceAddress(virtualIP.iface, virtualIP.ipNet); err != nil {
+		return fmt.Errorf("Unable to add [%v] to [%s]: %v", virtualIP.ipNet, virtualIP.iface.Name, err)
+	}
+	virtualIP.held = true
+	dlog.Noticef("Virtual IP [%v] added to [%s]", virtualIP.ipNet, virtualIP.iface.Name)
+	if err := announceInterfaceAddress(virtualIP.iface, virtualIP.ipNet.IP); err != nil {
+		dlog.Warnf("Unable to announce [%v]: %v", virtualIP.ipNet.IP, err)
+	}
+	return nil
+}
+
+func (virtualIP *VirtualIP) release() error {
+	if virtualIP == nil {
+		return nil
+	}
+	virtualIP.Lock()
+	defer virtualIP.Unlock()
+	if !virtualIP.held {
+		return nil
+	}
+	if err := removeInterfaceAddress(virtualIP.iface, virtualIP.ipNet); err != nil {
+		return fmt.Errorf("Unable to remove [%v] from [%s]: %v", virtualIP.ipNet, virtualIP.iface.Name, err)
+	}
+	virtualIP.held = false
+	dlog.Noticef("Virtual IP [%v] removed from [%s]", virtualIP.ipNet, virtualIP.iface.Name)
+	return nil
+}
+
+// freebind tells if a listener has to be bound with IP_FREEBIND. A standby proxy binds its listeners
+// before it holds the virtual IP, and they stay bound to it once it has been released.
+func (proxy *Proxy) freebind(ip net.IP) bool {
+	return proxy.virtualIP != nil && len(ip) > 0 && !ip.IsUnspecified()
+}
@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+const virtualIPSupported = true
+
+// IPV6_FREEBIND is not defined by the syscall package
+const ipv6Freebind = 0x4e
+
+// setFreebind lets a socket be bound to an address that is not assigned to an interface yet
+func setFreebind(fd int, family int) error {
+	if family == syscall.AF_INET6 {
+		return syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, ipv6Freebind, 1)
+	}
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_FREEBIND, 1)
+}
+
+// listenFreebind binds a UDP or TCP socket with IP_FREEBIND, so that a standby proxy can bind its
+// listeners to the virtual IP while the primary holds it
+func listenFreebind(sotype int, ip net.IP, port int, zone string, ipv6Only bool) (*os.File, error) {
+	family, sockaddr := socketAddress(ip, port, zone)
+	fd, err := syscall.Socket(family, sotype|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if sotype == syscall.SOCK_STREAM {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+			syscall.Close(fd)
+			return nil, os.NewSyscallError("setsockopt", err)
+		}
+	}
+	if err := setFreebind(fd, family); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+	if family == syscall.AF_INET6 {
+		v6Only := 0
+		if ipv6Only {
+			v6Only = 1
+		}
+		syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, v6Only)
+	}
+	if err := syscall.Bind(fd, sockaddr); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	if sotype == syscall.SOCK_STREAM {
+		if err := syscall.Listen(fd, syscall.SOMAXCONN); err != nil {
+			syscall.Close(fd)
+			return nil, os.NewSyscallError("listen", err)
+		}
+	}
+	return os.NewFile(uintptr(fd), net.JoinHostPort(ip.String(), strconv.Itoa(port))), nil
+}
+
+func listenUDPFreebind(listenAddr *net.UDPAddr, ipv6Only bool) (*net.UDPConn, error) {
+	file, err := listenFreebind(syscall.SOCK_DGRAM, listenAddr.IP, listenAddr.Port, listenAddr.Zone, ipv6Only)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	pc, err := net.FilePacketConn(file)
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
+
+func listenTCPFreebind(listenAddr *net.TCPAddr, ipv6Only bool) (*net.TCPListener, error) {
+	file, err := listenFreebind(syscall.SOCK_STREAM, listenAddr.IP, listenAddr.Port, listenAddr.Zone, ipv6Only)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	acceptPc, err := net.FileListener(file)
+	if err != nil {
+		return nil, err
+	}
+	return acceptPc.(*net.TCPListener), nil
+}
+
+func addInterfaceAddress(iface *net.Interface, ipNet *net.IPNet) error {
+	err := changeInterfaceAddress(syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, iface, ipNet)
+	if err == syscall.EEXIST {
+		return nil
+	}
+	return err
+}
+
+func removeInterfaceAddress(iface *net.Interface, ipNet *net.IPNet) error {
+	err := changeInterfaceAddress(syscall.RTM_DELADDR, 0, iface, ipNet)
+	if err == syscall.EADDRNOTAVAIL {
+		return nil
+	}
+	return err
+}
+
+// changeInterfaceAddress sends a RTM_NEWADDR or RTM_DELADDR request over a netlink socket, and
+// waits for the kernel to acknowledge it. This requires the CAP_NET_ADMIN capability.
+func changeInterfaceAddress(msgType uint16, flags uint16, iface *net.Interface, ipNet *net.IPNet) error {
+	family, ip := syscall.AF_INET, ipNet.IP.To4()
+	if ip == nil {
+		family, ip = syscall.AF_INET6, ipNet.IP.To16()
+	}
+	prefixLen, _ := ipNet.Mask.Size()
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return os.NewSyscallError("socket", err)
+	}
+	defer syscall.Close(fd)
+	timeout := syscall.Timeval{Sec: 5}
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &timeout); err != nil {
+		return os.NewSyscallError("setsockopt", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return os.NewSyscallError("bind", err)
+	}
+
+	// Header, address message, and the IFA_LOCAL and IFA_ADDRESS attributes, all 4-byte aligned
+	attrLen := syscall.SizeofRtAttr + len(ip)
+	msg := make([]byte, syscall.SizeofNlMsghdr+syscall.SizeofIfAddrmsg+2*attrLen)
+	*(*syscall.NlMsghdr)(unsafe.Pointer(&msg[0])) = syscall.NlMsghdr{
+		Len:   uint32(len(msg)),
+		Type:  msgType,
+		Flags: syscall.NLM_F_REQUEST | syscall.NLM_F_ACK | flags,
+		Seq:   1,
+	}
+	*(*syscall.IfAddrmsg)(unsafe.Pointer(&msg[syscall.SizeofNlMsghdr])) = syscall.IfAddrmsg{
+		Family:    uint8(family),
+		Prefixlen: uint8(prefixLen),
+		Scope:     syscall.RT_SCOPE_UNIVERSE,
+		Index:     uint32(iface.Index),
+	}
+	offset := syscall.SizeofNlMsghdr + syscall.SizeofIfAddrmsg
+	for _, attrType := range []uint16{syscall.IFA_LOCAL, syscall.IFA_ADDRESS} {
+		*(*syscall.RtAttr)(unsafe.Pointer(&msg[offset])) = syscall.RtAttr{Len: uint16(attrLen), Type: attrType}
+		copy(msg[offset+syscall.SizeofRtAttr:], ip)
+		offset += attrLen
+	}
+	if err := syscall.Sendto(fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return os.NewSyscallError("sendto", err)
+	}
+
+	buf := make([]byte, os.Getpagesize())
+	n, _, err := syscall.Recvfrom(fd, buf, 0)
+	if err != nil {
+		return os.NewSyscallError("recvfrom", err)
+	}
+	replies, err := syscall.ParseNetlinkMessage(buf[:n])
+	if err != nil {
+		return err
+	}
+	for _, reply := range replies {
+		if reply.Header.Type != syscall.NLMSG_ERROR || reply.Header.Seq != 1 {
+			continue
+		}
+		if len(reply.Data) < 4 {
+			return errors.New("Short netlink acknowledgement")
+		}
+		if errno := *(*int32)(unsafe.Pointer(&reply.Data[0])); errno != 0 {
+			return syscall.Errno(-errno)
+		}
+		return nil
+	}
+	return errors.New("No acknowledgement from the kernel")
+}
+
+// announceInterfaceAddress broadcasts a gratuitous ARP request for an IPv4 address, so that the
+// neighbors update their caches right away. IPv6 neighbors find the new holder by themselves,
+// once their cached entries become unreachable. This requires the CAP_NET_RAW capability.
+func announceInterfaceAddress(iface *net.Interface, ip net.IP) error {
+	ip4 := ip.To4()
+	if ip4 == nil || len(iface.HardwareAddr) != 6 {
+		return nil
+	}
+	protocol := networkOrder16(syscall.ETH_P_ARP)
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, int(protocol))
+	if err != nil {
+		return os.NewSyscallError("socket", err)
+	}
+	defer syscall.Close(fd)
+	packet := make([]byte, 28)
+	binary.BigEndian.PutUint16(packet[0:2], 1) // Ethernet
+	binary.BigEndian.PutUint16(packet[2:4], syscall.ETH_P_IP)
+	packet[4], packet[5] = 6, 4
+	binary.BigEndian.PutUint16(packet[6:8], 1) // Request
+	copy(packet[8:14], iface.HardwareAddr)
+	copy(packet[14:18], ip4)
+	copy(packet[24:28], ip4)
+	broadcast := syscall.SockaddrLinklayer{Protocol: protocol, Ifindex: iface.Index, Halen: 6}
+	copy(broadcast.Addr[:], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	return os.NewSyscallError("sendto", syscall.Sendto(fd, packet, 0, &broadcast))
+}
+
+// networkOrder16 returns the value whose in-memory representation is v in network byte order
+func networkOrder16(v uint16) uint16 {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	return *(*uint16)(unsafe.Pointer(&b[0]))
+}
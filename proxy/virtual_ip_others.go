@@ -0,0 +1,34 @@
+// +build !linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+const virtualIPSupported = false
+
+func setFreebind(fd int, family int) error {
+	return errors.New("Not supported")
+}
+
+func listenUDPFreebind(listenAddr *net.UDPAddr, ipv6Only bool) (*net.UDPConn, error) {
+	return nil, errors.New("Not supported")
+}
+
+func listenTCPFreebind(listenAddr *net.TCPAddr, ipv6Only bool) (*net.TCPListener, error) {
+	return nil, errors.New("Not supported")
+}
+
+func addInterfaceAddress(iface *net.Interface, ipNet *net.IPNet) error {
+	return errors.New("Not supported")
+}
+
+func removeInterfaceAddress(iface *net.Interface, ipNet *net.IPNet) error {
+	return errors.New("Not supported")
+}
+
+func announceInterfaceAddress(iface *net.Interface, ip net.IP) error {
+	return nil
+}
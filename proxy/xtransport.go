@@ -1,4 +1,4 @@
-package main
+package proxy
 
 import (
 	"bytes"
@@ -25,6 +25,8 @@ import (
 
 const DefaultFallbackResolver = "9.9.9.9:53"
 
+const DefaultUserAgent = "dnscrypt-proxy"
+
 type CachedIPs struct {
 	sync.RWMutex
 	cache map[string]string
@@ -34,13 +36,20 @@ type XTransport struct {
 	transport                *http.Transport
 	keepAlive                time.Duration
 	timeout                  time.Duration
+	connectTimeout           time.Duration
+	tlsHandshakeTimeout      time.Duration
+	outgoing                 *Outgoing
+	certClock                *CertClock
 	cachedIPs                CachedIPs
-	fallbackResolver         string
+	bootstrapResolvers       []string
 	ignoreSystemDNS          bool
 	useIPv4                  bool
 	useIPv6                  bool
 	tlsDisableSessionTickets bool
 	tlsCipherSuite           []uint16
+	userAgent                string
+	downloadLimiter          *DownloadLimiter
+	partialDownloads         PartialDownloads
 }
 
 var DefaultKeepAlive = 5 * time.Second
@@ -49,14 +58,16 @@ var DefaultTimeout = 30 * time.Second
 func NewXTransport() *XTransport {
 	xTransport := XTransport{
 		cachedIPs:                CachedIPs{cache: make(map[string]string)},
+		partialDownloads:         PartialDownloads{downloads: make(map[string]partialDownload)},
 		keepAlive:                DefaultKeepAlive,
 		timeout:                  DefaultTimeout,
-		fallbackResolver:         DefaultFallbackResolver,
+		bootstrapResolvers:       []string{DefaultFallbackResolver},
 		ignoreSystemDNS:          false,
 		useIPv4:                  true,
 		useIPv6:                  false,
 		tlsDisableSessionTickets: false,
 		tlsCipherSuite:           nil,
+		userAgent:                DefaultUserAgent,
 	}
 	return &xTransport
 }
@@ -74,12 +85,13 @@ func (xTransport *XTransport) rebuildTransport() {
 		(*xTransport.transport).CloseIdleConnections()
 	}
 	timeout := xTransport.timeout
-	dialer := &net.Dialer{Timeout: timeout, KeepAlive: timeout, DualStack: true}
+	dialer := &net.Dialer{Timeout: MinTimeout(timeout, xTransport.connectTimeout), KeepAlive: timeout, DualStack: true}
 	transport := &http.Transport{
 		DisableKeepAlives:      false,
 		DisableCompression:     true,
 		MaxIdleConns:           1,
 		IdleConnTimeout:        xTransport.keepAlive,
+		TLSHandshakeTimeout:    MinTimeout(timeout, xTransport.tlsHandshakeTimeout),
 		ResponseHeaderTimeout:  timeout,
 		ExpectContinueTimeout:  timeout,
 		MaxResponseHeaderBytes: 4096,
@@ -95,9 +107,39 @@ func (xTransport *XTransport) rebuildTransport() {
 				dlog.Debugf("[%s] IP address was not cached", host)
 			}
 			addrStr = ipOnly + ":" + strconv.Itoa(port)
+			if xTransport.outgoing != nil {
+				return xTransport.outgoing.Dial(network, addrStr, dialer.Timeout)
+			}
 			return dialer.DialContext(ctx, network, addrStr)
 		},
 	}
+	if xTransport.certClock != nil {
+		// Certificates are verified after the handshake, so that the clock skew can be tolerated,
+		// and explained when it can't be; the VerifyPeerCertificate hook doesn't get the server name
+		transport.TLSClientConfig = &tls.Config{}
+		transport.DialTLS = func(network, addrStr string) (net.Conn, error) {
+			conn, err := transport.DialContext(context.Background(), network, addrStr)
+			if err != nil {
+				return nil, err
+			}
+			host, _ := ExtractHostAndPort(addrStr, stamps.DefaultPort)
+			tlsClientConfig := transport.TLSClientConfig.Clone()
+			tlsClientConfig.ServerName = host
+			tlsClientConfig.InsecureSkipVerify = true
+			tlsConn := tls.Client(conn, tlsClientConfig)
+			tlsConn.SetDeadline(time.Now().Add(transport.TLSHandshakeTimeout))
+			if err := tlsConn.Handshake(); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			tlsConn.SetDeadline(time.Time{})
+			if err := xTransport.certClock.verifyTLS(host, tlsConn.ConnectionState().PeerCertificates); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return tlsConn, nil
+		}
+	}
 	if xTransport.tlsDisableSessionTickets || xTransport.tlsCipherSuite != nil {
 		tlsClientConfig := tls.Config{
 			SessionTicketsDisabled: xTransport.tlsDisableSessionTickets,
@@ -123,7 +165,7 @@ func (xTransport *XTransport) resolve(dnsClient *dns.Client, host string, resolv
 		msg.SetQuestion(dns.Fqdn(host), dns.TypeA)
 		msg.SetEdns0(4096, true)
 		var in *dns.Msg
-		in, _, err = dnsClient.Exchange(msg, resolver)
+		in, _, err = PlaintextExchange(xTransport.outgoing, dnsClient, msg, resolver)
 		if err == nil {
 			for _, answer := range in.Answer {
 				if answer.Header().Rrtype == dns.TypeA {
@@ -139,7 +181,7 @@ func (xTransport *XTransport) resolve(dnsClient *dns.Client, host string, resolv
 		msg.SetQuestion(dns.Fqdn(host), dns.TypeAAAA)
 		msg.SetEdns0(4096, true)
 		var in *dns.Msg
-		in, _, err = dnsClient.Exchange(msg, resolver)
+		in, _, err = PlaintextExchange(xTransport.outgoing, dnsClient, msg, resolver)
 		if err == nil {
 			for _, answer := range in.Answer {
 				if answer.Header().Rrtype == dns.TypeAAAA {
@@ -153,12 +195,37 @@ func (xTransport *XTransport) resolve(dnsClient *dns.Client, host string, resolv
 	return nil, err
 }
 
-func (xTransport *XTransport) Fetch(method string, url *url.URL, accept string, contentType string, body *io.ReadCloser, timeout time.Duration, padding *string) (*http.Response, time.Duration, error) {
+// resolveUsingBootstrapResolvers tries the bootstrap resolvers in order until one of them returns an IP address
+func (xTransport *XTransport) resolveUsingBootstrapResolvers(host string) (*string, error) {
+	if len(xTransport.bootstrapResolvers) == 0 {
+		return nil, fmt.Errorf("No bootstrap resolvers to resolve [%s]", host)
+	}
+	dnsClient := new(dns.Client)
+	var err error
+	for _, resolver := range xTransport.bootstrapResolvers {
+		if !xTransport.ignoreSystemDNS {
+			dlog.Noticef("System DNS configuration not usable yet, exceptionally resolving [%s] using bootstrap resolver [%s]", host, resolver)
+		} else {
+			dlog.Debugf("Resolving [%s] using bootstrap resolver [%s]", host, resolver)
+		}
+		var foundIP *string
+		foundIP, err = xTransport.resolve(dnsClient, host, resolver)
+		if err == nil && foundIP != nil {
+			return foundIP, nil
+		}
+		if err != nil {
+			dlog.Infof("Unable to resolve [%s] using bootstrap resolver [%s]: %v", host, resolver, err)
+		}
+	}
+	return nil, err
+}
+
+func (xTransport *XTransport) Fetch(method string, url *url.URL, accept string, contentType string, body *io.ReadCloser, timeout time.Duration, padding *string, headers map[string]string) (*http.Response, time.Duration, error) {
 	if timeout <= 0 {
 		timeout = xTransport.timeout
 	}
 	client := http.Client{Transport: xTransport.transport, Timeout: timeout}
-	header := map[string][]string{"User-Agent": {"dnscrypt-proxy"}}
+	header := http.Header{"User-Agent": {xTransport.userAgent}}
 	if len(accept) > 0 {
 		header["Accept"] = []string{accept}
 	}
@@ -168,6 +235,9 @@ func (xTransport *XTransport) Fetch(method string, url *url.URL, accept string,
 	if padding != nil {
 		header["X-Pad"] = []string{*padding}
 	}
+	for name, value := range headers {
+		header.Set(name, value)
+	}
 	req := &http.Request{
 		Method: method,
 		URL:    url,
@@ -204,13 +274,7 @@ func (xTransport *XTransport) Fetch(method string, url *url.URL, accept string,
 		dlog.Debugf("IP for [%s] was cached to [%s], but connection failed: [%s]", host, cachedIP, err)
 		return nil, 0, err
 	}
-	if !xTransport.ignoreSystemDNS {
-		dlog.Noticef("System DNS configuration not usable yet, exceptionally resolving [%s] using fallback resolver [%s]", host, xTransport.fallbackResolver)
-	} else {
-		dlog.Debugf("Resolving [%s] using fallback resolver [%s]", host, xTransport.fallbackResolver)
-	}
-	dnsClient := new(dns.Client)
-	foundIP, err := xTransport.resolve(dnsClient, host, xTransport.fallbackResolver)
+	foundIP, err := xTransport.resolveUsingBootstrapResolvers(host)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -246,15 +310,16 @@ func (xTransport *XTransport) Fetch(method string, url *url.URL, accept string,
 }
 
 func (xTransport *XTransport) Get(url *url.URL, accept string, timeout time.Duration) (*http.Response, time.Duration, error) {
-	return xTransport.Fetch("GET", url, "", "", nil, timeout, nil)
+	return xTransport.Fetch("GET", url, "", "", nil, timeout, nil, nil)
 }
 
 func (xTransport *XTransport) Post(url *url.URL, accept string, contentType string, body []byte, timeout time.Duration, padding *string) (*http.Response, time.Duration, error) {
 	bc := ioutil.NopCloser(bytes.NewReader(body))
-	return xTransport.Fetch("POST", url, accept, contentType, &bc, timeout, padding)
+	return xTransport.Fetch("POST", url, accept, contentType, &bc, timeout, padding, nil)
 }
 
-func (xTransport *XTransport) DoHQuery(useGet bool, url *url.URL, body []byte, timeout time.Duration) (*http.Response, time.Duration, error) {
+// DoHQuery sends a DNS query to a DoH server; headers are added to the HTTP request
+func (xTransport *XTransport) DoHQuery(useGet bool, url *url.URL, body []byte, timeout time.Duration, headers map[string]string) (*http.Response, time.Duration, error) {
 	padLen := 63 - (len(body)+63)&63
 	padding := xTransport.makePad(padLen)
 	dataType := "application/dns-udpwireformat"
@@ -267,9 +332,10 @@ func (xTransport *XTransport) DoHQuery(useGet bool, url *url.URL, body []byte, t
 		qs.Add("random_padding", *padding)
 		url2 := *url
 		url2.RawQuery = qs.Encode()
-		return xTransport.Get(&url2, dataType, timeout)
+		return xTransport.Fetch("GET", &url2, "", "", nil, timeout, nil, headers)
 	}
-	return xTransport.Post(url, dataType, dataType, body, timeout, padding)
+	bc := ioutil.NopCloser(bytes.NewReader(body))
+	return xTransport.Fetch("POST", url, dataType, dataType, &bc, timeout, padding, headers)
 }
 
 func (xTransport *XTransport) makePad(padLen int) *string {